@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
+	"io"
+	"os"
+	"sort"
+)
+
+const HELP = `
+Usage: rdbtool <command> [options] <file>
+verify <file>				Check structure and checksum of the rdb file
+dump [--format json|resp] <file>	Print content of the rdb file as json or as commands restoring it
+stats [--top <n>] <file>		Print number of keys and sizes per db and type, and the biggest keys
+check-aof [--fix] <file>		Check the append only file, with --fix truncate it to the last valid command
+
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "rdbtool: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, w io.Writer) error {
+	if len(args) == 0 || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(w, HELP)
+		return nil
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	var (
+		format = fs.String("format", "json", "output format of dump, json or resp")
+		top    = fs.Int("top", 10, "number of the biggest keys printed by stats")
+		fix    = fs.Bool("fix", false, "truncate the append only file to the last valid command")
+	)
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one file, see --help")
+	}
+
+	p := fs.Arg(0)
+	switch args[0] {
+	case "verify":
+		return verify(p, w)
+	case "dump":
+		return dump(p, *format, w)
+	case "stats":
+		return stats(p, *top, w)
+	case "check-aof":
+		return checkAof(p, *fix, w)
+	default:
+		return fmt.Errorf("unknown command %q, see --help", args[0])
+	}
+}
+
+// walk parses rdb at p without loading it, logs of the parser are discarded
+func walk(p string, visit func(entry *resp.RdbEntry) error) (*resp.Rdb, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	rdb := resp.NewRdb(nil)
+	rdb.SetLogOutput(io.Discard)
+	if err = rdb.Walk(bufio.NewReader(f), visit); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return rdb, fmt.Errorf("invalid rdb %s: %w", p, err)
+	}
+
+	return rdb, nil
+}
+
+func verify(p string, w io.Writer) error {
+	keys := 0
+	rdb, err := walk(p, func(entry *resp.RdbEntry) error {
+		keys++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "version: %s\n", rdb.Version())
+	metadata := rdb.Metadata()
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "aux %s: %s\n", name, metadata[name])
+	}
+
+	fmt.Fprintf(w, "keys: %d\n", keys)
+	if rdb.Checksum() == 0 {
+		fmt.Fprintln(w, "checksum: disabled")
+	} else {
+		fmt.Fprintf(w, "checksum: %#x OK\n", rdb.Checksum())
+	}
+
+	return nil
+}
+
+func dump(p string, format string, w io.Writer) error {
+	exporter, err := resp.NewExporter(w, format)
+	if err != nil {
+		return fmt.Errorf("unknown dump format %q", format)
+	}
+
+	_, err = walk(p, exporter.Write)
+	if closeErr := exporter.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+type typeStats struct {
+	keys    int
+	expires int
+	bytes   int64
+}
+
+type key struct {
+	db   int
+	name string
+	t    byte
+	size int64
+}
+
+func stats(p string, top int, w io.Writer) error {
+	var (
+		perDb   = make(map[int]map[byte]*typeStats)
+		biggest []key
+	)
+
+	_, err := walk(p, func(entry *resp.RdbEntry) error {
+		if _, ok := perDb[entry.Db]; !ok {
+			perDb[entry.Db] = make(map[byte]*typeStats)
+		}
+
+		s, ok := perDb[entry.Db][entry.Type]
+		if !ok {
+			s = &typeStats{}
+			perDb[entry.Db][entry.Type] = s
+		}
+
+		s.keys++
+		s.bytes += entry.Size
+		if !entry.Expire.IsZero() {
+			s.expires++
+		}
+
+		// keep top keys sorted by size in descending order
+		i := sort.Search(len(biggest), func(i int) bool {
+			return biggest[i].size < entry.Size
+		})
+		if i < top {
+			biggest = append(biggest, key{})
+			copy(biggest[i+1:], biggest[i:])
+			biggest[i] = key{db: entry.Db, name: entry.Key, t: entry.Type, size: entry.Size}
+			if len(biggest) > top {
+				biggest = biggest[:top]
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dbs := make([]int, 0, len(perDb))
+	for db := range perDb {
+		dbs = append(dbs, db)
+	}
+
+	sort.Ints(dbs)
+	for _, db := range dbs {
+		fmt.Fprintf(w, "db%d\n", db)
+		types := make([]int, 0, len(perDb[db]))
+		for t := range perDb[db] {
+			types = append(types, int(t))
+		}
+
+		sort.Ints(types)
+		for _, t := range types {
+			s := perDb[db][byte(t)]
+			fmt.Fprintf(w, "  %s: keys=%d expires=%d bytes=%d\n", resp.TypeName(byte(t)), s.keys, s.expires, s.bytes)
+		}
+	}
+
+	if len(biggest) > 0 {
+		fmt.Fprintf(w, "biggest keys\n")
+	}
+
+	for _, k := range biggest {
+		fmt.Fprintf(w, "  db%d %s %q %d bytes\n", k.db, resp.TypeName(k.t), k.name, k.size)
+	}
+
+	return nil
+}
+
+func checkAof(p string, fix bool, w io.Writer) error {
+	offset, cmds, err := persistence.CheckAofFile(p, func(r *bufio.Reader) error {
+		rdb := resp.NewRdb(nil)
+		rdb.SetLogOutput(io.Discard)
+		return rdb.Walk(r, nil)
+	}, nil)
+	if err == nil {
+		fmt.Fprintf(w, "AOF %s is valid: %d commands\n", p, cmds)
+		return nil
+	}
+
+	fmt.Fprintf(w, "AOF %s is invalid after %d commands at offset %d: %s\n", p, cmds, offset, err)
+	if !fix {
+		return fmt.Errorf("use --fix to truncate the file to the last valid command")
+	}
+
+	stat, statErr := os.Stat(p)
+	if statErr != nil {
+		return statErr
+	}
+
+	if err = os.Truncate(p, offset); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Truncated %s from %d to %d bytes\n", p, stat.Size(), offset)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestRdb(t *testing.T) string {
+	t.Helper()
+	dbs := []*storage.DbSnapshot{
+		{Index: 0, Strings: map[string]storage.StringsElement{
+			"foo":  {Value: "bar"},
+			"long": {Value: strings.Repeat("a", 100)},
+		}},
+		{Index: 2, Strings: map[string]storage.StringsElement{
+			"baz": {Value: "qux", Expire: time.UnixMilli(4102444800000)},
+		}, Streams: map[string]storage.StreamSnapshot{
+			"stream": {Entries: []storage.StreamKV{{Key: "1-1", Data: []string{"a", "1"}}}},
+		}},
+	}
+
+	buff := bytes.NewBuffer(nil)
+	if _, err := resp.WriteRdb(buff, dbs, map[string]string{"redis-ver": "7.2.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := path.Join(t.TempDir(), "dump.rdb")
+	if err := os.WriteFile(p, buff.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestDump(t *testing.T) {
+	p := writeTestRdb(t)
+	type tt struct {
+		args []string
+		e    string
+	}
+
+	tests := []tt{
+		{
+			args: []string{"dump", p},
+			e: `[{"db":0,"key":"foo","type":"string","value":"bar"}` + "\n" +
+				`,{"db":0,"key":"long","type":"string","value":"` + strings.Repeat("a", 100) + `"}` + "\n" +
+				`,{"db":2,"key":"baz","type":"string","value":"qux","expire_at_ms":4102444800000}` + "\n" +
+				`,{"db":2,"key":"stream","type":"stream","entries":[{"id":"1-1","fields":["a","1"]}]}` + "\n]\n",
+		},
+		{
+			args: []string{"dump", "--format", "resp", p},
+			e: "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n" +
+				"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+				"*3\r\n$3\r\nSET\r\n$4\r\nlong\r\n$100\r\n" + strings.Repeat("a", 100) + "\r\n" +
+				"*2\r\n$6\r\nSELECT\r\n$1\r\n2\r\n" +
+				"*5\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n$4\r\nPXAT\r\n$13\r\n4102444800000\r\n" +
+				"*5\r\n$4\r\nXADD\r\n$6\r\nstream\r\n$3\r\n1-1\r\n$1\r\na\r\n$1\r\n1\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		out := strings.Builder{}
+		if err := run(test.args, &out); err != nil {
+			t.Fatal(err)
+		}
+
+		if out.String() != test.e {
+			t.Errorf("%v: expected %q, got %q", test.args, test.e, out.String())
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	out := strings.Builder{}
+	if err := run([]string{"stats", "--top", "1", writeTestRdb(t)}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"db0\n  string: keys=2 expires=0", "db2\n  string: keys=1 expires=1", "  stream: keys=1 expires=0", "biggest keys\n  db0 string \"long\""} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in %q", line, out.String())
+		}
+	}
+
+	if strings.Contains(out.String(), `"foo"`) {
+		t.Errorf("expected only the biggest key, got %q", out.String())
+	}
+}
+
+func TestVerifyShouldDetectCorruption(t *testing.T) {
+	p := writeTestRdb(t)
+	b, _ := os.ReadFile(p)
+	b[len(b)-12] ^= 0xff
+	if err := os.WriteFile(p, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run([]string{"verify", p}, &strings.Builder{}); err == nil {
+		t.Errorf("expected verification error")
+	}
+}
+
+func TestCheckAofShouldTruncate(t *testing.T) {
+	const valid = "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	p := path.Join(t.TempDir(), "appendonly.aof")
+	if err := os.WriteFile(p, []byte(valid+"*3\r\n$3\r\nset\r\n$2\r\nfoo\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run([]string{"check-aof", p}, &strings.Builder{}); err == nil {
+		t.Errorf("expected error checking corrupted aof")
+	}
+
+	if err := run([]string{"check-aof", "--fix", p}, &strings.Builder{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := os.ReadFile(p); string(b) != valid {
+		t.Errorf("expected %q, got %q", valid, b)
+	}
+
+	if err := run([]string{"check-aof", p}, &strings.Builder{}); err != nil {
+		t.Errorf("expected fixed aof to be valid, got %s", err)
+	}
+}
@@ -0,0 +1,408 @@
+package e2e
+
+import (
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/cluster"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// SetupClusterNode starts node persisting the cluster state to the config file, the same file restarts the node
+func SetupClusterNode(t *testing.T, port int, configFile string) (*lib.RedisServer, *lib.Router) {
+	t.Helper()
+	config := lib.GetDefaultConfig()
+	config.Port = port
+	config.PersistenceConfig.Save = false
+	config.ClusterConfig.Enabled = true
+	config.ClusterConfig.NodeTimeout = time.Second
+	config.ClusterConfig.ConfigFile = configFile
+	router := lib.NewRouter()
+	router.RegisterHandlerFunc("ping", handlers.HandlePing)
+	router.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+	router.RegisterHandlerFunc("psync", lib.HandlePsync)
+	router.RegisterHandlerFunc("role", lib.HandleRole)
+	router.RegisterHandlerFunc("wait", lib.HandleWait)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterCommand("xread", lib.HandleFunc(handlers.HandleXRead), lib.CMD_READONLY)
+	router.RegisterHandlerFunc("select", lib.HandleSelect)
+	router.RegisterCommand("del", lib.HandleFunc(handlers.HandleDel), lib.CMD_WRITE)
+	router.RegisterCommand("migrate", lib.HandleFunc(handlers.HandleMigrate), lib.CMD_WRITE)
+	router.RegisterCommand("restore-asking", lib.HandleFunc(handlers.HandleRestore), lib.CMD_WRITE|lib.CMD_ASKING)
+	router.RegisterHandlerFunc("cluster", lib.HandleCluster)
+	router.RegisterHandlerFunc("asking", lib.HandleAsking)
+	router.RegisterKeys("set", lib.FirstKey)
+	router.RegisterKeys("get", lib.FirstKey)
+	router.RegisterKeys("restore-asking", lib.FirstKey)
+	router.RegisterKeys("del", lib.AllKeys)
+	router.RegisterKeys("xread", handlers.XReadKeys)
+	return setUpMaster(t, config, router)
+}
+
+func addSlots(t *testing.T, port, start, end int) {
+	t.Helper()
+	args := []string{"CLUSTER", "ADDSLOTS"}
+	for slot := start; slot <= end; slot++ {
+		args = append(args, fmt.Sprint(slot))
+	}
+
+	if s, _ := TryString(ptr(do(t, port, args...))); string(s) != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+}
+
+// pipeline sends the commands over a single connection and returns the last reply as string
+func pipeline(t *testing.T, port int, cmds ...[]string) string {
+	t.Helper()
+	c, res := dial(t, port), ""
+	for _, cmd := range cmds {
+		res = c.str(cmd...)
+	}
+
+	return res
+}
+
+func TestCluster(t *testing.T) {
+	const OTHER_PORT = 6800
+	SetupClusterNode(t, MASTER_PORT, filepath.Join(t.TempDir(), "nodes.conf"))
+	SetupClusterNode(t, OTHER_PORT, filepath.Join(t.TempDir(), "nodes.conf"))
+	str := func(port int, args ...string) string {
+		s, _ := TryString(ptr(do(t, port, args...)))
+		return string(s)
+	}
+
+	addSlots(t, MASTER_PORT, 0, 8191)
+	addSlots(t, OTHER_PORT, 8192, 16383)
+	if info := str(MASTER_PORT, "CLUSTER", "INFO"); !strings.Contains(info, "cluster_state:fail") {
+		t.Errorf("expected cluster to fail without all slots, got %s", info)
+	}
+
+	if s := str(MASTER_PORT, "CLUSTER", "MEET", "127.0.0.1", fmt.Sprint(OTHER_PORT)); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	for _, port := range []int{MASTER_PORT, OTHER_PORT} {
+		if info := str(port, "CLUSTER", "INFO"); !strings.Contains(info, "cluster_state:ok") || !strings.Contains(info, "cluster_known_nodes:2") {
+			t.Errorf("expected cluster of 2 nodes to be ok, got %s", info)
+		}
+
+		if nodes := str(port, "CLUSTER", "NODES"); strings.Count(nodes, "\n") != 2 || !strings.Contains(nodes, "myself,master") {
+			t.Errorf("unexpected nodes %s", nodes)
+		}
+	}
+
+	slots, _ := do(t, OTHER_PORT, "CLUSTER", "SLOTS").I.(resp.Array)
+	if len(slots.A) != 2 {
+		t.Fatalf("expected 2 slot ranges, got %v", slots.A)
+	}
+
+	if r, _ := slots.A[0].(resp.Array); r.A[1] != (resp.SimpleInt{I: 8191}) || r.A[2].(resp.Array).A[1] != (resp.SimpleInt{I: int64(MASTER_PORT)}) {
+		t.Errorf("unexpected first range %v", r)
+	}
+
+	if res := do(t, MASTER_PORT, "CLUSTER", "KEYSLOT", "foo"); res.I != (resp.SimpleInt{I: 12182}) {
+		t.Errorf("expected slot 12182, got %v", res.I)
+	}
+
+	for _, c := range []struct {
+		port     int
+		cmd      []string
+		expected string
+	}{
+		{MASTER_PORT, []string{"SET", "foo", "bar"}, "MOVED 12182 127.0.0.1:6800"},
+		{OTHER_PORT, []string{"SET", "foo", "bar"}, "OK"},
+		{OTHER_PORT, []string{"GET", "foo"}, "bar"},
+		{OTHER_PORT, []string{"SET", "{foo}.other", "baz"}, "OK"},
+		{MASTER_PORT, []string{"SET", "bar", "foo"}, "OK"},
+		{MASTER_PORT, []string{"XREAD", "STREAMS", "foo", "bar", "0-0", "0-0"}, "CROSSSLOT Keys in request don't hash to the same slot"},
+		{OTHER_PORT, []string{"XREAD", "STREAMS", "{foo}a", "{foo}b", "0-0", "0-0"}, ""},
+		{MASTER_PORT, []string{"CLUSTER", "ADDSLOTS", "0"}, "ERR Slot 0 is already busy"},
+		{MASTER_PORT, []string{"CLUSTER", "ADDSLOTS", "16384"}, "ERR Invalid or out of range slot"},
+		{MASTER_PORT, []string{"SELECT", "1"}, "ERR SELECT is not allowed in cluster mode"},
+	} {
+		if s := str(c.port, c.cmd...); s != c.expected {
+			t.Errorf("expected %q to %v, got %q", c.expected, c.cmd, s)
+		}
+	}
+
+	if res := do(t, OTHER_PORT, "CLUSTER", "COUNTKEYSINSLOT", "12182"); res.I != (resp.SimpleInt{I: 2}) {
+		t.Errorf("expected 2 keys in slot, got %v", res.I)
+	}
+
+	keys, _ := do(t, OTHER_PORT, "CLUSTER", "GETKEYSINSLOT", "12182", "1").I.(resp.Array)
+	if len(keys.A) != 1 || string(keys.A[0].(resp.BulkString).S) != "foo" {
+		t.Errorf("expected foo, got %v", keys.A)
+	}
+
+	shards, _ := do(t, MASTER_PORT, "CLUSTER", "SHARDS").I.(resp.Array)
+	if len(shards.A) != 2 {
+		t.Errorf("expected 2 shards, got %v", shards.A)
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	ports := []int{7000, 7001, 7002, 7003}
+	files := make([]string, len(ports))
+	servers := make([]*lib.RedisServer, len(ports))
+	for i, port := range ports {
+		files[i] = filepath.Join(t.TempDir(), "nodes.conf")
+		servers[i], _ = SetupClusterNode(t, port, files[i])
+	}
+
+	str := func(port int, args ...string) string {
+		s, _ := TryString(ptr(do(t, port, args...)))
+		return string(s)
+	}
+
+	addSlots(t, ports[0], 0, 5460)
+	addSlots(t, ports[1], 5461, 10922)
+	addSlots(t, ports[2], 10923, 16383)
+	for _, port := range ports[1:] {
+		if s := str(ports[0], "CLUSTER", "MEET", "127.0.0.1", fmt.Sprint(port)); s != "OK" {
+			t.Fatalf("expected OK, got %s", s)
+		}
+	}
+
+	// the rest of the nodes is learned from gossip
+	eventually(t, func() bool {
+		for _, port := range ports {
+			if info := str(port, "CLUSTER", "INFO"); !strings.Contains(info, "cluster_state:ok") || !strings.Contains(info, "cluster_known_nodes:4") {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	masterID := str(ports[0], "CLUSTER", "MYID")
+	replicaID := str(ports[3], "CLUSTER", "MYID")
+	if s := str(ports[3], "CLUSTER", "REPLICATE", masterID); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	eventually(t, func() bool {
+		replicas, _ := do(t, ports[1], "CLUSTER", "REPLICAS", masterID).I.(resp.Array)
+		return len(replicas.A) == 1
+	})
+
+	// bar hashes to slot 5061 of the first master
+	if s := str(ports[0], "SET", "bar", "baz"); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	if res := do(t, ports[0], "WAIT", "1", "1000"); res.I != (resp.SimpleInt{I: 1}) {
+		t.Fatalf("expected write to reach the replica, got %v", res.I)
+	}
+
+	if s := str(ports[3], "GET", "bar"); s != "MOVED 5061 127.0.0.1:7000" {
+		t.Errorf("expected replica to redirect to its master, got %s", s)
+	}
+
+	servers[0].Close()
+	failedOver := func() bool {
+		nodes := str(ports[1], "CLUSTER", "NODES")
+		for _, line := range strings.Split(nodes, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 8 && fields[0] == replicaID {
+				return fields[2] == "master" && fields[8] == "0-5460" &&
+					strings.Contains(str(ports[1], "CLUSTER", "INFO"), "cluster_state:ok")
+			}
+		}
+
+		return false
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); !failedOver(); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica is not promoted in time, nodes:\n%s", str(ports[1], "CLUSTER", "NODES"))
+		}
+	}
+
+	if s := str(ports[3], "GET", "bar"); s != "baz" {
+		t.Errorf("expected promoted replica to serve the data, got %s", s)
+	}
+
+	if s := str(ports[2], "SET", "bar", "qux"); s != "MOVED 5061 127.0.0.1:7003" {
+		t.Errorf("expected redirect to promoted replica, got %s", s)
+	}
+
+	if res := do(t, ports[1], "CLUSTER", "COUNT-FAILURE-REPORTS", masterID); res.I == (resp.SimpleInt{I: 0}) {
+		t.Errorf("expected failure reports of the failed master")
+	}
+
+	// old master restores its id from nodes.conf and rejoins as replica of the node that took over its slots
+	SetupClusterNode(t, ports[0], files[0])
+	if s := str(ports[0], "CLUSTER", "MYID"); s != masterID {
+		t.Fatalf("expected node id %s to be restored, got %s", masterID, s)
+	}
+
+	eventually(t, func() bool {
+		role, _ := do(t, ports[0], "ROLE").I.(resp.Array)
+		return len(role.A) == 5 && role.A[2] == (resp.SimpleInt{I: int64(ports[3])}) &&
+			strings.Contains(str(ports[2], "CLUSTER", "NODES"), masterID+" 127.0.0.1:7000@17000 slave "+replicaID)
+	})
+}
+
+func TestClusterMigration(t *testing.T) {
+	ports := []int{7100, 7101}
+	for _, port := range ports {
+		SetupClusterNode(t, port, filepath.Join(t.TempDir(), "nodes.conf"))
+	}
+
+	str := func(port int, args ...string) string {
+		s, _ := TryString(ptr(do(t, port, args...)))
+		return string(s)
+	}
+
+	addSlots(t, ports[0], 0, 8191)
+	addSlots(t, ports[1], 8192, 16383)
+	if s := str(ports[0], "CLUSTER", "MEET", "127.0.0.1", fmt.Sprint(ports[1])); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	eventually(t, func() bool {
+		return strings.Contains(str(ports[1], "CLUSTER", "INFO"), "cluster_state:ok")
+	})
+
+	source, target := str(ports[0], "CLUSTER", "MYID"), str(ports[1], "CLUSTER", "MYID")
+	// all the keys hash to slot 5061 of the source
+	for _, key := range []string{"bar", "{bar}2", "{bar}3"} {
+		if s := str(ports[0], "SET", key, "v"+key); s != "OK" {
+			t.Fatalf("expected OK, got %s", s)
+		}
+	}
+
+	asking := func(port int, args ...string) string {
+		return pipeline(t, port, []string{"ASKING"}, args)
+	}
+
+	for _, c := range []struct {
+		port     int
+		cmd      []string
+		expected string
+	}{
+		{ports[1], []string{"CLUSTER", "SETSLOT", "5061", "IMPORTING", source}, "OK"},
+		{ports[0], []string{"CLUSTER", "SETSLOT", "5061", "MIGRATING", target}, "OK"},
+		{ports[0], []string{"CLUSTER", "SETSLOT", "5061", "NODE", target}, "ERR Can't assign hashslot 5061 to a different node while I still hold keys for this hash slot."},
+		{ports[0], []string{"CLUSTER", "SETSLOT", "12182", "MIGRATING", target}, "ERR I'm not the owner of hash slot 12182"},
+		{ports[0], []string{"GET", "bar"}, "vbar"},
+		{ports[0], []string{"GET", "{bar}missing"}, "ASK 5061 127.0.0.1:7101"},
+		{ports[1], []string{"GET", "bar"}, "MOVED 5061 127.0.0.1:7100"},
+		{ports[0], []string{"MIGRATE", "127.0.0.1", "7101", "", "0", "1000", "KEYS", "bar", "{bar}2", "{bar}missing"}, "OK"},
+		{ports[0], []string{"MIGRATE", "127.0.0.1", "7101", "bar", "0", "1000"}, "NOKEY"},
+		{ports[0], []string{"GET", "bar"}, "ASK 5061 127.0.0.1:7101"},
+		{ports[0], []string{"DEL", "{bar}3", "bar"}, "TRYAGAIN Multiple keys request during rehashing of slot"},
+		{ports[0], []string{"MIGRATE", "127.0.0.1", "7101", "{bar}3", "0", "1000", "COPY"}, "OK"},
+		{ports[0], []string{"GET", "{bar}3"}, "v{bar}3"},
+		{ports[0], []string{"MIGRATE", "127.0.0.1", "7101", "{bar}3", "0", "1000"}, "ERR Target instance replied with error: BUSYKEY Target key name already exists."},
+		{ports[0], []string{"MIGRATE", "127.0.0.1", "7101", "{bar}3", "0", "1000", "REPLACE"}, "OK"},
+	} {
+		if s := str(c.port, c.cmd...); s != c.expected {
+			t.Errorf("expected %q to %v, got %q", c.expected, c.cmd, s)
+		}
+	}
+
+	if s := asking(ports[1], "GET", "bar"); s != "vbar" {
+		t.Errorf("expected migrated key to be served after ASKING, got %s", s)
+	}
+
+	if s := asking(ports[1], "DEL", "{bar}2", "{bar}missing"); s != "TRYAGAIN Multiple keys request during rehashing of slot" {
+		t.Errorf("expected TRYAGAIN, got %s", s)
+	}
+
+	if res := do(t, ports[0], "CLUSTER", "COUNTKEYSINSLOT", "5061"); res.I != (resp.SimpleInt{I: 0}) {
+		t.Fatalf("expected all keys to be migrated, got %v", res.I)
+	}
+
+	for _, port := range ports {
+		if s := str(port, "CLUSTER", "SETSLOT", "5061", "NODE", target); s != "OK" {
+			t.Fatalf("expected OK, got %s", s)
+		}
+	}
+
+	if s := str(ports[0], "GET", "bar"); s != "MOVED 5061 127.0.0.1:7101" {
+		t.Errorf("expected redirect to the new owner, got %s", s)
+	}
+
+	if s := str(ports[1], "GET", "{bar}3"); s != "v{bar}3" {
+		t.Errorf("expected new owner to serve the slot, got %s", s)
+	}
+
+	// the new owner of the slot took greater config epoch, so gossip keeps the slot assigned to it
+	time.Sleep(5 * cluster.CLUSTER_TICK)
+	if nodes := str(ports[0], "CLUSTER", "NODES"); strings.Contains(nodes, "[") || !strings.Contains(nodes, " connected 0-5060 5062-8191\n") {
+		t.Errorf("unexpected nodes %s", nodes)
+	}
+
+	if s := str(ports[0], "GET", "bar"); s != "MOVED 5061 127.0.0.1:7101" {
+		t.Errorf("expected the slot to stay with the new owner, got %s", s)
+	}
+}
+
+func TestMigratePartialFailure(t *testing.T) {
+	const TARGET_PORT = 6800
+	_, router := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterCommand("migrate", lib.HandleFunc(handlers.HandleMigrate), lib.CMD_WRITE)
+	_, router = SetupMaster(t, TARGET_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterCommand("restore", lib.HandleFunc(handlers.HandleRestore), lib.CMD_WRITE)
+	_, stream, _, err := ConnectReplica(fmt.Sprintf(":%d", MASTER_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect replica: %s", err)
+	}
+
+	source, target := dial(t, MASTER_PORT), dial(t, TARGET_PORT)
+	for _, key := range []string{"a", "b", "c"} {
+		if s := source.str("SET", key, "v"+key); s != "OK" {
+			t.Fatalf("expected OK, got %s", s)
+		}
+	}
+
+	if s := target.str("SET", "b", "old"); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	expected := "ERR Target instance replied with error: BUSYKEY Target key name already exists."
+	if s := source.str("MIGRATE", "localhost", fmt.Sprint(TARGET_PORT), "", "0", "1000", "KEYS", "a", "b", "c"); s != expected {
+		t.Fatalf("expected %q, got %q", expected, s)
+	}
+
+	for key, expected := range map[string]string{"a": "", "b": "vb", "c": ""} {
+		if s := source.str("GET", key); s != expected {
+			t.Errorf("expected %q in %s of the source, got %q", expected, key, s)
+		}
+	}
+
+	for key, expected := range map[string]string{"a": "va", "b": "old", "c": "vc"} {
+		if s := target.str("GET", key); s != expected {
+			t.Errorf("expected %q in %s of the target, got %q", expected, key, s)
+		}
+	}
+
+	// only the migrated keys are deleted on replicas
+	for {
+		cmd := resp.Array{}
+		if _, err := cmd.UnmarshalRESP(stream); err != nil {
+			t.Fatal(err)
+		}
+
+		if name, _ := TryString(&resp.Any{I: cmd.A[0]}); strings.ToUpper(string(name)) != "DEL" {
+			continue
+		}
+
+		if !reflect.DeepEqual(cmd, command("DEL", "a", "c")) {
+			t.Errorf("expected the migrated keys to be deleted, got %v", cmd)
+		}
+
+		break
+	}
+}
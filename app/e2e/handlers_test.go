@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
 	"net"
 	"reflect"
 	"regexp"
+	"sync"
 	"testing"
 	"time"
 )
@@ -41,6 +43,35 @@ func TestServerShouldReturnPong(t *testing.T) {
 	}
 }
 
+func TestInlineCommands(t *testing.T) {
+	_, router := SetupMaster(t, MASTER_PORT)
+	router.RegisterHandlerFunc("ping", handlers.HandlePing)
+	router.RegisterHandlerFunc("set", handlers.HandleSet)
+	router.RegisterHandlerFunc("get", handlers.HandleGet)
+	c := dial(t, MASTER_PORT)
+	c.conn.Write([]byte("PING\r\n\r\n  \nset foo \"hello\\tworld\" \r\nget foo\n*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"))
+	for _, expected := range []string{"PONG", "OK", "hello\tworld", "hello\tworld"} {
+		if s, _ := TryString(ptr(c.read())); string(s) != expected {
+			t.Errorf("expected %q, got %q", expected, s)
+		}
+	}
+
+	c.conn.Write([]byte("set foo \"bar\n"))
+	if e, ok := c.read().I.(resp.SimpleError); !ok || e.E != "ERR Protocol error: unbalanced quotes in request" {
+		t.Errorf("expected protocol error, got %v", e)
+	}
+
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("expected connection to be closed after protocol error")
+	}
+
+	c = dial(t, MASTER_PORT)
+	c.conn.Write(bytes.Repeat([]byte("a"), 2*lib.PROTO_INLINE_MAX_SIZE))
+	if e, ok := c.read().I.(resp.SimpleError); !ok || e.E != "ERR Protocol error: too big inline request" {
+		t.Errorf("expected protocol error, got %v", e)
+	}
+}
+
 func TestServerShouldReturnEcho(t *testing.T) {
 	type testCase struct {
 		args   resp.Marshaller
@@ -917,35 +948,40 @@ func TestXAddWithBlocking(t *testing.T) {
 			_, router := SetupMaster(t, MASTER_PORT)
 			router.RegisterHandlerFunc("xadd", handlers.HandleXAdd)
 			router.RegisterHandlerFunc("xread", handlers.HandleXRead)
+			// commands run at once rather than as parallel subtests, which are serialized when -parallel is 1
+			wg := sync.WaitGroup{}
 			for j, c := range test {
-				c := c
-				t.Run(fmt.Sprintf("command %d", j), func(t *testing.T) {
-					t.Parallel()
+				wg.Add(1)
+				go func(j int, c tt) {
+					defer wg.Done()
 					if c.s != 0 {
 						time.Sleep(c.s)
 					}
 
 					client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
 					if err != nil {
-						t.Error(err)
+						t.Errorf("command %d: %s", j, err)
+						return
 					}
 
+					defer client.Close()
 					r := bufio.NewReader(client)
 					if _, err := c.c.MarshalRESP(client); err != nil {
-						t.Error(err)
+						t.Errorf("command %d: %s", j, err)
 					}
 
 					res := resp.Any{}
 					if _, err := res.UnmarshalRESP(r); err != nil {
-						t.Error(err)
+						t.Errorf("command %d: %s", j, err)
 					}
 
 					if !reflect.DeepEqual(res, c.e) {
-						t.Errorf("exptected %q, got %q", c.e.I, res.I)
+						t.Errorf("command %d: exptected %q, got %q", j, c.e.I, res.I)
 					}
-				})
-
+				}(j, c)
 			}
+
+			wg.Wait()
 		})
 	}
 
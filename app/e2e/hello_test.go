@@ -0,0 +1,126 @@
+package e2e
+
+import (
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fields returns the map reply as the strings of its keys and values
+func fields(t *testing.T, res resp.Any) map[string]interface{} {
+	t.Helper()
+	m, ok := res.I.(resp.Map)
+	if !ok {
+		t.Fatalf("expected map reply, got %#v", res.I)
+	}
+
+	f := make(map[string]interface{}, len(m.Entries))
+	for _, e := range m.Entries {
+		key, _ := TryString(&resp.Any{I: e.Key})
+		switch v := e.Value.(type) {
+		case resp.SimpleInt:
+			f[string(key)] = v.I
+		case resp.BulkString:
+			f[string(key)] = string(v.S)
+		default:
+			f[string(key)] = v
+		}
+	}
+
+	return f
+}
+
+func TestHello(t *testing.T) {
+	_, router := SetupMaster(t, MASTER_PORT)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterHandlerFunc("config", lib.HandleConfig)
+	router.RegisterHandlerFunc("hello", lib.HandleHello)
+	registerPubsub(router)
+	c, pub := dial(t, MASTER_PORT), dial(t, MASTER_PORT)
+	for _, step := range []struct {
+		cmd      []string
+		expected string
+	}{
+		{[]string{"HELLO", "4"}, "NOPROTO unsupported protocol version"},
+		{[]string{"HELLO", "three"}, "ERR Protocol version is not an integer or out of range"},
+		{[]string{"HELLO", "3", "AUTH", "admin", "secret"}, "WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"HELLO", "3", "AUTH", "default"}, "ERR Syntax error in HELLO option 'AUTH'"},
+		{[]string{"HELLO", "3", "SETNAME", "my app"}, "ERR Client names cannot contain spaces, newlines or special characters."},
+	} {
+		if e, ok := c.do(step.cmd...).I.(resp.SimpleError); !ok || e.E != step.expected {
+			t.Errorf("expected %q to %v, got %v", step.expected, step.cmd, e)
+		}
+	}
+
+	// failed negotiation keeps RESP2
+	if arr, ok := c.do("HELLO").I.(resp.Array); !ok || len(arr.A) != 14 {
+		t.Fatalf("expected flat array of RESP2 HELLO reply, got %#v", arr)
+	}
+
+	f := fields(t, c.do("HELLO", "3", "AUTH", "default", "secret", "SETNAME", "app"))
+	for key, expected := range map[string]interface{}{
+		"server": "redis", "proto": int64(3), "mode": "standalone", "role": "master", "modules": resp.Array{A: []resp.Marshaller{}},
+	} {
+		if !reflect.DeepEqual(f[key], expected) {
+			t.Errorf("expected %s of HELLO to be %v, got %#v", key, expected, f[key])
+		}
+	}
+
+	if id, ok := f["id"].(int64); !ok || id <= 0 {
+		t.Errorf("expected client id, got %v", f["id"])
+	}
+
+	if res := c.do("GET", "missing"); res.I != (resp.Null{}) {
+		t.Errorf("expected RESP3 null, got %#v", res.I)
+	}
+
+	if f := fields(t, c.do("CONFIG", "GET", "appendonly")); f["appendonly"] != "no" {
+		t.Errorf("expected config map, got %v", f)
+	}
+
+	// RESP3 subscriber receives pushes and keeps executing commands
+	if p, ok := c.do("SUBSCRIBE", "news").I.(resp.Push); !ok || len(p.A) != 3 {
+		t.Fatalf("expected subscription push, got %#v", p)
+	}
+
+	if s, _ := TryString(ptr(c.do("PING"))); string(s) != "PONG" {
+		t.Errorf("expected PONG, got %s", s)
+	}
+
+	if res := c.do("GET", "missing"); res.I != (resp.Null{}) {
+		t.Errorf("expected subscriber to execute GET, got %#v", res.I)
+	}
+
+	pub.do("PUBLISH", "news", "hello")
+	p, ok := c.read().I.(resp.Push)
+	if !ok {
+		t.Fatalf("expected message push, got %#v", p)
+	}
+
+	var msg []string
+	for _, m := range p.A {
+		b, _ := TryString(&resp.Any{I: m})
+		msg = append(msg, string(b))
+	}
+
+	if strings.Join(msg, " ") != "message news hello" {
+		t.Errorf("unexpected message %v", msg)
+	}
+
+	// switching back to RESP2 changes the replies and the messages
+	if arr, ok := c.do("HELLO", "2").I.(resp.Array); !ok || len(arr.A) != 14 {
+		t.Fatalf("expected RESP2 HELLO reply, got %#v", arr)
+	}
+
+	pub.do("PUBLISH", "news", "again")
+	if s := strs(t, c); s != "message news again" {
+		t.Errorf("expected RESP2 message, got %q", s)
+	}
+
+	if e, ok := c.do("GET", "missing").I.(resp.SimpleError); !ok || !strings.HasPrefix(e.E, "ERR Can't execute 'get'") {
+		t.Errorf("expected RESP2 subscriber to be restricted, got %#v", e)
+	}
+}
@@ -122,7 +122,7 @@ func setUpMaster(t testing.TB, config *lib.ServerConfig, router *lib.Router) (*l
 func SetupReplicaOf(t testing.TB, port int, masterAddr string) (*lib.RedisServer, *lib.Router) {
 	t.Helper()
 	conf := lib.GetDefaultConfig()
-	conf.ReplicaOf = masterAddr
+	conf.SetReplicaOf(masterAddr)
 	conf.Port = port
 	router := lib.NewRouter()
 	replica, err := lib.New(conf, router)
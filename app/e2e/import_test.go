@@ -0,0 +1,316 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func command(args ...string) resp.Array {
+	cmd := resp.Array{}
+	for _, arg := range args {
+		cmd.Append(resp.BulkString{S: []byte(arg)})
+	}
+
+	return cmd
+}
+
+func TestDumpAndRestore(t *testing.T) {
+	_, router := SetupMaster(t, MASTER_PORT)
+	router.RegisterHandlerFunc("set", handlers.HandleSet)
+	router.RegisterHandlerFunc("get", handlers.HandleGet)
+	router.RegisterHandlerFunc("dump", handlers.HandleDump)
+	router.RegisterHandlerFunc("restore", handlers.HandleRestore)
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	do := func(args ...string) []byte {
+		t.Helper()
+		cmd := command(args...)
+		if _, err := cmd.MarshalRESP(client); err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Any{}
+		if _, err := res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := TryString(&res)
+		return s
+	}
+
+	do("SET", "foo", "bar")
+	payload := do("DUMP", "foo")
+	if !bytes.Equal(payload[:5], []byte("\x00\x03bar")) {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+
+	type tt struct {
+		args []string
+		e    string
+	}
+
+	tests := []tt{
+		{args: []string{"RESTORE", "baz", "0", string(payload)}, e: "OK"},
+		{args: []string{"GET", "baz"}, e: "bar"},
+		{args: []string{"RESTORE", "baz", "0", string(payload)}, e: "BUSYKEY Target key name already exists."},
+		{args: []string{"RESTORE", "baz", "0", string(payload[:len(payload)-1]) + "x", "REPLACE"}, e: "ERR DUMP payload version or checksum are wrong"},
+		{args: []string{"RESTORE", "baz", "100", string(payload), "REPLACE"}, e: "OK"},
+		{args: []string{"RESTORE", "qux", "1", string(payload), "ABSTTL"}, e: "OK"},
+		{args: []string{"GET", "qux"}, e: ""},
+	}
+
+	for _, test := range tests {
+		if got := do(test.args...); string(got) != test.e {
+			t.Errorf("%s: expected %q, got %q", test.args[0], test.e, got)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if got := do("GET", "baz"); got != nil {
+		t.Errorf("expected restored key to expire, got %q", got)
+	}
+}
+
+// setupImportMaster starts master with dir, the only directory IMPORT reads files from
+func setupImportMaster(t *testing.T, dir string) *lib.Router {
+	t.Helper()
+	config := lib.GetDefaultConfig()
+	config.Port = MASTER_PORT
+	config.PersistenceConfig.Dir = dir
+	config.PersistenceConfig.File = "dump.rdb"
+	_, router := setUpMaster(t, config, lib.NewRouter())
+	router.RegisterCommand("import", lib.HandleFunc(lib.HandleImport), lib.CMD_WRITE|lib.CMD_NOMULTI|lib.CMD_BULK)
+	router.RegisterArity("import", 2)
+	router.RegisterCommand("export", lib.HandleFunc(lib.HandleExport), lib.CMD_READONLY)
+	return router
+}
+
+func TestImportShouldSummarizeErrors(t *testing.T) {
+	dir := t.TempDir()
+	router := setupImportMaster(t, dir)
+	router.RegisterHandlerFunc("set", handlers.HandleSet)
+	router.RegisterHandlerFunc("get", handlers.HandleGet)
+	router.RegisterHandlerFunc("select", lib.HandleSelect)
+	fixture := bytes.NewBuffer(nil)
+	for _, args := range [][]string{
+		{"SET", "foo", "bar"},
+		{"SET", "foo"},
+		{"SET", "bar"},
+		{"NOSUCHCOMMAND"},
+		{"SELECT", "1"},
+		{"SET", "foo", "baz"},
+	} {
+		cmd := command(args...)
+		cmd.MarshalRESP(fixture)
+	}
+
+	if err := os.WriteFile(path.Join(dir, "fixture.resp"), fixture.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	cmd := command("IMPORT", "fixture.resp")
+	cmd.MarshalRESP(client)
+	summary := resp.BulkString{}
+	if _, err = summary.UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"commands:6\r\n",
+		"errors:3\r\n",
+		"errorstat_nosuchcommand:count=1,first=unknown command: nosuchcommand\r\n",
+		"errorstat_set:count=2,first=ERR wrong number of arguments\r\n",
+	} {
+		if !strings.Contains(string(summary.S), line) {
+			t.Errorf("expected %q in summary %q", line, summary.S)
+		}
+	}
+
+	for _, c := range []struct {
+		args []string
+		e    string
+	}{
+		{args: []string{"GET", "foo"}, e: "bar"},
+		{args: []string{"SELECT", "1"}, e: "OK"},
+		{args: []string{"GET", "foo"}, e: "baz"},
+	} {
+		cmd := command(c.args...)
+		cmd.MarshalRESP(client)
+		res := resp.Any{}
+		if _, err = res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		if s, _ := TryString(&res); string(s) != c.e {
+			t.Errorf("%v: expected %q, got %q", c.args, c.e, s)
+		}
+	}
+}
+
+func TestImportShouldOnlyReadWorkingDirectory(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	setupImportMaster(t, dir)
+	secret := path.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("*1\r\n$6\r\nsecret\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(secret, path.Join(dir, "link.resp")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path.Join(dir, "broken.resp"), []byte("*1\r\n?password\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(t, MASTER_PORT)
+	for _, p := range []string{secret, "../" + path.Base(outside) + "/secret", "link.resp", ".", "missing.resp"} {
+		if _, ok := c.do("IMPORT", p).I.(resp.SimpleError); !ok {
+			t.Errorf("expected import of %q to be refused", p)
+		}
+	}
+
+	res, ok := c.do("IMPORT", "broken.resp").I.(resp.SimpleError)
+	if !ok || !strings.HasPrefix(res.E, "ERR Protocol error") || strings.Contains(res.E, "password") {
+		t.Errorf("expected protocol error without content of the file, got %#v", res)
+	}
+}
+
+func TestImportShouldNotRunInTransactions(t *testing.T) {
+	dir := t.TempDir()
+	router := setupImportMaster(t, dir)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	registerTransactions(router)
+	fixture := batch(
+		command("SET", "foo", "bar"),
+		command("IMPORT", "fixture.resp"),
+		command("MULTI"),
+		command("SET", "baz", "qux"),
+		command("EXEC"),
+	)
+
+	if err := os.WriteFile(path.Join(dir, "fixture.resp"), fixture, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(t, MASTER_PORT)
+	for _, step := range []struct {
+		cmd      []string
+		expected string
+	}{
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"IMPORT", "fixture.resp"}, "ERR Command not allowed inside a transaction"},
+		{[]string{"EXEC"}, "EXECABORT Transaction discarded because of previous errors."},
+	} {
+		if s := c.str(step.cmd...); s != step.expected {
+			t.Errorf("expected %q to %v, got %q", step.expected, step.cmd, s)
+		}
+	}
+
+	summary := c.str("IMPORT", "fixture.resp")
+	for _, line := range []string{
+		"commands:5\r\n",
+		"errors:1\r\n",
+		"errorstat_import:count=1,first=ERR Command not allowed inside IMPORT\r\n",
+	} {
+		if !strings.Contains(summary, line) {
+			t.Errorf("expected %q in summary %q", line, summary)
+		}
+	}
+
+	other := dial(t, MASTER_PORT)
+	for key, expected := range map[string]string{"foo": "bar", "baz": "qux"} {
+		if s := other.str("GET", key); s != expected {
+			t.Errorf("expected %q in %s, got %q", expected, key, s)
+		}
+	}
+}
+
+func TestExportShouldBeImported(t *testing.T) {
+	dir := t.TempDir()
+	router := setupImportMaster(t, dir)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterCommand("del", lib.HandleFunc(handlers.HandleDel), lib.CMD_WRITE)
+	router.RegisterCommand("xadd", lib.HandleFunc(handlers.HandleXAdd), lib.CMD_WRITE)
+	router.RegisterCommand("type", lib.HandleFunc(handlers.HandleType), lib.CMD_READONLY)
+	router.RegisterHandlerFunc("select", lib.HandleSelect)
+	if err := os.Symlink(t.TempDir(), path.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dial(t, MASTER_PORT)
+	for _, cmd := range [][]string{
+		{"SET", "foo", "bar"},
+		{"SET", "baz", "qux", "PX", "100000"},
+		{"XADD", "stream", "1-1", "a", "b"},
+		{"SELECT", "1"},
+		{"SET", "foo", "one"},
+		{"EXPORT", "keys.json", "JSON"},
+		{"EXPORT", "keys.resp"},
+	} {
+		if res, ok := c.do(cmd...).I.(resp.SimpleError); ok {
+			t.Fatalf("unexpected error %s to %v", res.E, cmd)
+		}
+	}
+
+	for _, p := range []string{"../keys.json", "link/keys.json", "link", "."} {
+		if _, ok := c.do("EXPORT", p).I.(resp.SimpleError); !ok {
+			t.Errorf("expected export to %q to be refused", p)
+		}
+	}
+
+	for _, export := range []struct {
+		file     string
+		commands string
+	}{
+		{"keys.json", "commands:4\r\n"},
+		{"keys.resp", "commands:6\r\n"},
+	} {
+		c.do("SELECT", "0")
+		c.do("DEL", "foo", "baz", "stream")
+		c.do("SELECT", "1")
+		c.do("DEL", "foo")
+		summary := c.str("IMPORT", export.file)
+		if !strings.Contains(summary, export.commands) || !strings.Contains(summary, "errors:0\r\n") {
+			t.Errorf("unexpected summary of %s %q", export.file, summary)
+		}
+
+		for _, step := range []struct {
+			cmd      []string
+			expected string
+		}{
+			{[]string{"SELECT", "0"}, "OK"},
+			{[]string{"GET", "foo"}, "bar"},
+			{[]string{"GET", "baz"}, "qux"},
+			{[]string{"TYPE", "stream"}, "stream"},
+			{[]string{"SELECT", "1"}, "OK"},
+			{[]string{"GET", "foo"}, "one"},
+		} {
+			if s := c.str(step.cmd...); s != step.expected {
+				t.Errorf("%s: expected %q to %v, got %q", export.file, step.expected, step.cmd, s)
+			}
+		}
+	}
+}
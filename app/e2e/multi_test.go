@@ -0,0 +1,257 @@
+package e2e
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client sends commands over a single connection, so the connection state like MULTI is kept between them
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, port int) *client {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", port), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) do(args ...string) resp.Any {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := command(args...).MarshalRESP(c.conn); err != nil {
+		c.t.Fatalf("unexpected error: %s", err)
+	}
+
+	return c.read()
+}
+
+// read reads the next reply, e.g. message pushed to the subscriber
+func (c *client) read() resp.Any {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	res := resp.Any{}
+	if _, err := res.UnmarshalRESP(c.r); err != nil {
+		c.t.Fatalf("unexpected error: %s", err)
+	}
+
+	return res
+}
+
+func (c *client) str(args ...string) string {
+	c.t.Helper()
+	s, _ := TryString(ptr(c.do(args...)))
+	return string(s)
+}
+
+func registerTransactions(router *lib.Router) {
+	router.RegisterHandlerFunc("multi", lib.HandleMulti)
+	router.RegisterHandlerFunc("exec", lib.HandleExec)
+	router.RegisterHandlerFunc("discard", lib.HandleDiscard)
+	router.RegisterHandlerFunc("watch", lib.HandleWatch)
+	router.RegisterHandlerFunc("unwatch", lib.HandleUnwatch)
+	router.RegisterArity("set", -3)
+	router.RegisterArity("get", 2)
+}
+
+// replies returns replies of EXEC as strings
+func replies(t *testing.T, res resp.Any) []string {
+	t.Helper()
+	arr, ok := res.I.(resp.Array)
+	if !ok {
+		t.Fatalf("expected array, got %v", res.I)
+	}
+
+	s := make([]string, 0, len(arr.A))
+	for _, m := range arr.A {
+		b, _ := TryString(&resp.Any{I: m})
+		s = append(s, string(b))
+	}
+
+	return s
+}
+
+func TestTransaction(t *testing.T) {
+	_, router := SetupMaster(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterCommand("xadd", lib.HandleFunc(handlers.HandleXAdd), lib.CMD_WRITE)
+	registerTransactions(router)
+	c, other := dial(t, MASTER_PORT), dial(t, MASTER_PORT)
+	for _, step := range []struct {
+		c        *client
+		cmd      []string
+		expected string
+	}{
+		{c, []string{"EXEC"}, "ERR EXEC without MULTI"},
+		{c, []string{"DISCARD"}, "ERR DISCARD without MULTI"},
+		{c, []string{"MULTI"}, "OK"},
+		{c, []string{"MULTI"}, "ERR MULTI calls can not be nested"},
+		{c, []string{"WATCH", "foo"}, "ERR WATCH inside MULTI is not allowed"},
+		{c, []string{"SET", "foo", "bar"}, "QUEUED"},
+		{other, []string{"GET", "foo"}, ""},
+		{c, []string{"DISCARD"}, "OK"},
+		{c, []string{"GET", "foo"}, ""},
+		{c, []string{"MULTI"}, "OK"},
+		{c, []string{"SET", "foo"}, "ERR wrong number of arguments for 'set' command"},
+		{c, []string{"UNKNOWN"}, "unknown command: unknown"},
+		{c, []string{"SET", "foo", "bar"}, "QUEUED"},
+		{c, []string{"EXEC"}, "EXECABORT Transaction discarded because of previous errors."},
+		{c, []string{"GET", "foo"}, ""},
+	} {
+		if s := step.c.str(step.cmd...); s != step.expected {
+			t.Errorf("expected %q to %v, got %q", step.expected, step.cmd, s)
+		}
+	}
+
+	c.do("MULTI")
+	c.do("SET", "foo", "bar")
+	c.do("XADD", "foo", "*", "a", "b")
+	c.do("GET", "foo")
+	if r := replies(t, c.do("EXEC")); strings.Join(r, ",") != "OK,operation againsts wrong type of the Key,bar" {
+		t.Errorf("expected errors not to stop the transaction, got %v", r)
+	}
+
+	// modification of the watched key by other client aborts the transaction
+	c.do("WATCH", "foo", "baz")
+	other.do("SET", "foo", "other")
+	c.do("MULTI")
+	c.do("SET", "foo", "mine")
+	if arr, ok := c.do("EXEC").I.(resp.Array); !ok || arr.A != nil {
+		t.Errorf("expected null reply, got %v", arr)
+	}
+
+	if s := c.str("GET", "foo"); s != "other" {
+		t.Errorf("expected write of the other client to be kept, got %s", s)
+	}
+
+	// EXEC unwatches the keys
+	other.do("SET", "foo", "other")
+	c.do("MULTI")
+	c.do("SET", "foo", "mine")
+	if r := replies(t, c.do("EXEC")); len(r) != 1 || r[0] != "OK" {
+		t.Errorf("expected transaction to be executed, got %v", r)
+	}
+
+	c.do("WATCH", "foo")
+	c.do("UNWATCH")
+	other.do("SET", "foo", "other")
+	c.do("MULTI")
+	c.do("GET", "foo")
+	if r := replies(t, c.do("EXEC")); len(r) != 1 || r[0] != "other" {
+		t.Errorf("expected unwatched transaction to be executed, got %v", r)
+	}
+}
+
+func TestTransactionPropagation(t *testing.T) {
+	_, router := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	registerTransactions(router)
+	_, replicaReader, _, err := ConnectReplica(fmt.Sprintf(":%d", MASTER_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect replica: %s", err)
+	}
+
+	c := dial(t, MASTER_PORT)
+	c.do("MULTI")
+	c.do("GET", "foo")
+	c.do("SET", "foo", "1")
+	c.do("SET", "bar", "2")
+	if r := replies(t, c.do("EXEC")); strings.Join(r, ",") != ",OK,OK" {
+		t.Fatalf("unexpected replies %v", r)
+	}
+
+	// read only transaction is not propagated
+	c.do("MULTI")
+	c.do("GET", "foo")
+	c.do("EXEC")
+	c.do("SET", "baz", "3")
+	expected := []string{"MULTI", "SET foo 1", "SET bar 2", "EXEC", "SET baz 3"}
+	for _, e := range expected {
+		cmd := resp.Array{}
+		if _, err = cmd.UnmarshalRESP(replicaReader); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		args := make([]string, 0, len(cmd.A))
+		for _, arg := range cmd.A {
+			args = append(args, string(arg.(resp.BulkString).S))
+		}
+
+		if s := strings.Join(args, " "); s != e {
+			t.Errorf("expected %q to be propagated, got %q", e, s)
+		}
+	}
+}
+
+func TestTransactionAof(t *testing.T) {
+	const RESTARTED_PORT = 6381
+	dir := t.TempDir()
+	setup := func(port int) {
+		config := lib.GetDefaultConfig()
+		config.Port = port
+		config.PersistenceConfig.Dir = dir
+		config.PersistenceConfig.AppendOnly = true
+		config.PersistenceConfig.AppendFsync = persistence.FSYNC_ALWAYS
+		router := lib.NewRouter()
+		router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+		router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+		router.RegisterHandlerFunc("select", lib.HandleSelect)
+		registerTransactions(router)
+		setUpMaster(t, config, router)
+	}
+
+	setup(MASTER_PORT)
+	c := dial(t, MASTER_PORT)
+	c.do("MULTI")
+	c.do("SET", "foo", "1")
+	c.do("SET", "bar", "2")
+	c.do("EXEC")
+
+	var log strings.Builder
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.Contains(path, ".incr.") {
+			b, _ := os.ReadFile(path)
+			log.Write(b)
+		}
+
+		return nil
+	})
+
+	if !strings.Contains(log.String(), "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$1\r\n1\r\n") ||
+		!strings.HasSuffix(log.String(), "*1\r\n$4\r\nEXEC\r\n") {
+		t.Errorf("expected transaction to be logged as MULTI/EXEC block, got %q", log.String())
+	}
+
+	// transaction is logged once executed
+	c.do("MULTI")
+	c.do("SET", "foo", "3")
+	setup(RESTARTED_PORT)
+	for key, expected := range map[string]string{"foo": "1", "bar": "2"} {
+		if s, _ := TryString(ptr(do(t, RESTARTED_PORT, "GET", key))); string(s) != expected {
+			t.Errorf("expected %s of %s, got %s", expected, key, s)
+		}
+	}
+}
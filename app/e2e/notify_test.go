@@ -0,0 +1,185 @@
+package e2e
+
+import (
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyspaceNotifications(t *testing.T) {
+	_, router := SetupMaster(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterKeys("get", lib.FirstKey)
+	router.RegisterCommand("del", lib.HandleFunc(handlers.HandleDel), lib.CMD_WRITE)
+	router.RegisterCommand("xadd", lib.HandleFunc(handlers.HandleXAdd), lib.CMD_WRITE)
+	router.RegisterHandlerFunc("config", lib.HandleConfig)
+	registerPubsub(router)
+	c, sub := dial(t, MASTER_PORT), dial(t, MASTER_PORT)
+	sub.do("PSUBSCRIBE", "__key*@0__:*")
+
+	// notifications are disabled by default
+	c.do("SET", "foo", "bar")
+	for _, step := range []struct {
+		cmd      []string
+		expected string
+	}{
+		{[]string{"CONFIG", "SET", "notify-keyspace-events", "KEy"}, "ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - invalid keyspace notification class 'y'"},
+		{[]string{"CONFIG", "SET", "notify-keyspace-events", "gKEt$xn"}, "OK"},
+	} {
+		if s := c.str(step.cmd...); s != step.expected {
+			t.Errorf("expected %q to %v, got %q", step.expected, step.cmd, s)
+		}
+	}
+
+	if s := strs(t, c, "CONFIG", "GET", "notify-keyspace-events"); s != "notify-keyspace-events g$xtKEn" {
+		t.Errorf("unexpected flags %q", s)
+	}
+
+	c.do("SET", "baz", "1", "PX", "50")
+	c.do("DEL", "foo", "missing")
+	c.do("XADD", "stream", "1-1", "a", "b")
+	time.Sleep(100 * time.Millisecond)
+	c.do("GET", "baz")
+	for _, expected := range []string{
+		"pmessage __key*@0__:* __keyspace@0__:baz new",
+		"pmessage __key*@0__:* __keyevent@0__:new baz",
+		"pmessage __key*@0__:* __keyspace@0__:baz set",
+		"pmessage __key*@0__:* __keyevent@0__:set baz",
+		"pmessage __key*@0__:* __keyspace@0__:baz expire",
+		"pmessage __key*@0__:* __keyevent@0__:expire baz",
+		"pmessage __key*@0__:* __keyspace@0__:foo del",
+		"pmessage __key*@0__:* __keyevent@0__:del foo",
+		"pmessage __key*@0__:* __keyspace@0__:stream new",
+		"pmessage __key*@0__:* __keyevent@0__:new stream",
+		"pmessage __key*@0__:* __keyspace@0__:stream xadd",
+		"pmessage __key*@0__:* __keyevent@0__:xadd stream",
+		"pmessage __key*@0__:* __keyspace@0__:baz expired",
+		"pmessage __key*@0__:* __keyevent@0__:expired baz",
+	} {
+		if s := strs(t, sub); s != expected {
+			t.Errorf("expected %q, got %q", expected, s)
+		}
+	}
+}
+
+func TestActiveExpiry(t *testing.T) {
+	_, router := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterHandlerFunc("config", lib.HandleConfig)
+	registerPubsub(router)
+	_, stream, _, err := ConnectReplica(fmt.Sprintf(":%d", MASTER_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect replica: %s", err)
+	}
+
+	c, sub := dial(t, MASTER_PORT), dial(t, MASTER_PORT)
+	if s := c.str("CONFIG", "SET", "notify-keyspace-events", "Ex"); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	sub.do("SUBSCRIBE", "__keyevent@0__:expired")
+	c.do("SET", "foo", "bar", "PX", "50")
+	c.do("SET", "bar", "baz")
+
+	// the key is never accessed after it is set
+	if s := strs(t, sub); s != "message __keyevent@0__:expired foo" {
+		t.Errorf("expected expired event, got %q", s)
+	}
+
+	for {
+		cmd := resp.Array{}
+		if _, err := cmd.UnmarshalRESP(stream); err != nil {
+			t.Fatal(err)
+		}
+
+		if name, _ := TryString(&resp.Any{I: cmd.A[0]}); strings.ToUpper(string(name)) != "DEL" {
+			continue
+		}
+
+		if !reflect.DeepEqual(cmd, command("DEL", "foo")) {
+			t.Errorf("expected the expired key to be deleted on replicas, got %v", cmd)
+		}
+
+		break
+	}
+}
+
+func TestLazyExpiryShouldPropagateDel(t *testing.T) {
+	_, router := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterKeys("get", lib.FirstKey)
+	_, stream, _, err := ConnectReplica(fmt.Sprintf(":%d", MASTER_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect replica: %s", err)
+	}
+
+	c := dial(t, MASTER_PORT)
+	c.do("SET", "foo", "bar", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	// the key is deleted on access rather than by the active expiry
+	if b, ok := c.do("GET", "foo").I.(resp.BulkString); !ok || !b.EncodeNil {
+		t.Errorf("expected expired key to be missing, got %v", b)
+	}
+
+	cmd := resp.Array{}
+	for _, name := range []string{"SET", "DEL"} {
+		cmd = resp.Array{}
+		if _, err := cmd.UnmarshalRESP(stream); err != nil {
+			t.Fatal(err)
+		}
+
+		if s, _ := TryString(&resp.Any{I: cmd.A[0]}); string(s) != name {
+			t.Fatalf("expected %s to be propagated, got %v", name, cmd)
+		}
+	}
+
+	if !reflect.DeepEqual(cmd, command("DEL", "foo")) {
+		t.Errorf("expected the expired key to be deleted on replicas, got %v", cmd)
+	}
+}
+
+func TestReplicaShouldNotDeleteExpiredKeysOnAccess(t *testing.T) {
+	const REPLICA_PORT = 6800
+	_, router := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	_, replicaRouter := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	replicaRouter.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	replicaRouter.RegisterCommand("del", lib.HandleFunc(handlers.HandleDel), lib.CMD_WRITE)
+	replicaRouter.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	replicaRouter.RegisterKeys("get", lib.FirstKey)
+	replicaRouter.RegisterHandlerFunc("config", lib.HandleConfig)
+	registerPubsub(replicaRouter)
+
+	replica, sub := dial(t, REPLICA_PORT), dial(t, REPLICA_PORT)
+	if s := replica.str("CONFIG", "SET", "notify-keyspace-events", "Egx"); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	sub.do("PSUBSCRIBE", "__keyevent@0__:*")
+	dial(t, MASTER_PORT).do("SET", "foo", "bar", "PX", "200")
+	eventually(t, func() bool {
+		return replica.str("GET", "foo") == "bar"
+	})
+
+	// the replica reads the key as missing, yet it is deleted once the master says so
+	eventually(t, func() bool {
+		b, ok := replica.do("GET", "foo").I.(resp.BulkString)
+		return ok && b.EncodeNil
+	})
+
+	for _, expected := range []string{
+		"pmessage __keyevent@0__:* __keyevent@0__:expire foo",
+		"pmessage __keyevent@0__:* __keyevent@0__:del foo",
+	} {
+		if s := strs(t, sub); s != expected {
+			t.Errorf("expected %q, got %q", expected, s)
+		}
+	}
+}
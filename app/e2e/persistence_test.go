@@ -0,0 +1,316 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func SetupAofMaster(t testing.TB, port int, dir string) (*lib.RedisServer, *lib.Router) {
+	t.Helper()
+	config := lib.GetDefaultConfig()
+	config.Port = port
+	config.PersistenceConfig.Dir = dir
+	config.PersistenceConfig.AppendOnly = true
+	config.PersistenceConfig.AppendFsync = persistence.FSYNC_ALWAYS
+	router := lib.NewRouter()
+	router.RegisterHandler("set", lib.AofWrapper{Next: lib.HandleFunc(handlers.HandleSet)})
+	router.RegisterHandler("xadd", lib.AofWrapper{Next: lib.HandleFunc(handlers.HandleXAdd)})
+	router.RegisterHandler("xdel", lib.AofWrapper{Next: lib.HandleFunc(handlers.HandleXDel)})
+	router.RegisterHandlerFunc("get", handlers.HandleGet)
+	router.RegisterHandlerFunc("type", handlers.HandleType)
+	router.RegisterHandlerFunc("xrange", handlers.HandleXRange)
+	router.RegisterHandlerFunc("xsetid", handlers.HandleXSetId)
+	router.RegisterHandlerFunc("select", lib.HandleSelect)
+	router.RegisterHandlerFunc("info", handlers.HandleInfo)
+	router.RegisterHandlerFunc("bgrewriteaof", lib.HandleBgRewriteAof)
+	return setUpMaster(t, config, router)
+}
+
+func TestAofShouldRestoreDataset(t *testing.T) {
+	const RESTARTED_PORT = 6381
+	dir := t.TempDir()
+	SetupAofMaster(t, MASTER_PORT, dir)
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	commands := []string{
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n",
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n",
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n",
+		"*5\r\n$4\r\nXADD\r\n$6\r\nstream\r\n$1\r\n*\r\n$1\r\na\r\n$1\r\nb\r\n",
+	}
+	var id []byte
+	for _, c := range commands {
+		if _, err = client.Write([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Any{}
+		if _, err = res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		id, _ = TryString(&res)
+	}
+
+	// rewrite compacts commands above into the new base file, next commands go to the new incr file
+	if _, err = client.Write([]byte("*1\r\n$12\r\nBGREWRITEAOF\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	res := resp.Any{}
+	if _, err = res.UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, _ := TryString(&res); string(s) != "Background append only file rewriting started" {
+		t.Fatalf("unexpected response to BGREWRITEAOF: %s", s)
+	}
+
+	for rewritten := false; !rewritten; {
+		if _, err = client.Write([]byte("*2\r\n$4\r\nINFO\r\n$11\r\npersistence\r\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		info := resp.BulkString{}
+		if _, err = info.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		rewritten = strings.Contains(string(info.S), "aof_rewrites:1\r\n")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err = client.Write([]byte("*3\r\n$3\r\nSET\r\n$3\r\nbar\r\n$3\r\nqux\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = (&resp.Any{}).UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	SetupAofMaster(t, RESTARTED_PORT, dir)
+	restarted, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", RESTARTED_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r = bufio.NewReader(restarted)
+	type tt struct {
+		c string
+		e []byte
+	}
+
+	tests := []tt{
+		{c: "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", e: []byte("bar")},
+		{c: "*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n", e: []byte("OK")},
+		{c: "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", e: []byte("baz")},
+		{c: "*2\r\n$3\r\nGET\r\n$3\r\nbar\r\n", e: []byte("qux")},
+	}
+	for _, test := range tests {
+		if _, err = restarted.Write([]byte(test.c)); err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Any{}
+		if _, err = res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		if s, _ := TryString(&res); !bytes.Equal(s, test.e) {
+			t.Errorf("expected %s, got %s", test.e, s)
+		}
+	}
+
+	if _, err = restarted.Write([]byte("*4\r\n$6\r\nXRANGE\r\n$6\r\nstream\r\n$1\r\n-\r\n$1\r\n+\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := resp.Array{}
+	if _, err = entries.UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries.A) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries.A))
+	}
+
+	entry := entries.A[0].(resp.Array)
+	if got := entry.A[0].(resp.BulkString).S; !bytes.Equal(got, id) {
+		t.Errorf("expected entry id %s, got %s", id, got)
+	}
+}
+
+func SetupRdbMaster(t testing.TB, port int, dir string) (*lib.ServerConfig, *lib.Router) {
+	t.Helper()
+	config := lib.GetDefaultConfig()
+	config.Port = port
+	config.PersistenceConfig.Dir = dir
+	config.PersistenceConfig.File = "dump.rdb"
+	router := lib.NewRouter()
+	router.RegisterHandlerFunc("set", handlers.HandleSet)
+	router.RegisterHandlerFunc("xadd", handlers.HandleXAdd)
+	router.RegisterHandlerFunc("xdel", handlers.HandleXDel)
+	router.RegisterHandlerFunc("get", handlers.HandleGet)
+	router.RegisterHandlerFunc("type", handlers.HandleType)
+	router.RegisterHandlerFunc("xrange", handlers.HandleXRange)
+	router.RegisterHandlerFunc("save", lib.HandleSave)
+	setUpMaster(t, config, router)
+	return config, router
+}
+
+func TestSaveShouldRestoreDatasetAndReplicationState(t *testing.T) {
+	const RESTARTED_PORT = 6381
+	dir := t.TempDir()
+	config, _ := SetupRdbMaster(t, MASTER_PORT, dir)
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	config.ReplicationConfig.MasterReplOffset.Store(100)
+	r := bufio.NewReader(client)
+	for _, c := range []string{
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n",
+		"*5\r\n$4\r\nXADD\r\n$6\r\nstream\r\n$3\r\n1-1\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"*1\r\n$4\r\nSAVE\r\n",
+	} {
+		if _, err = client.Write([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Any{}
+		if _, err = res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := res.I.(resp.SimpleError); ok {
+			t.Fatalf("unexpected error %v", res.I)
+		}
+	}
+
+	restartedConfig, _ := SetupRdbMaster(t, RESTARTED_PORT, dir)
+	if restartedConfig.ReplicationConfig.MasterReplid != config.ReplicationConfig.MasterReplid {
+		t.Errorf("expected replication id %s, got %s", config.ReplicationConfig.MasterReplid, restartedConfig.ReplicationConfig.MasterReplid)
+	}
+
+	if offset := restartedConfig.ReplicationConfig.MasterReplOffset.Load(); offset != 100 {
+		t.Errorf("expected replication offset 100, got %d", offset)
+	}
+
+	restarted, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", RESTARTED_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r = bufio.NewReader(restarted)
+	if _, err = restarted.Write([]byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	res := resp.Any{}
+	if _, err = res.UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, _ := TryString(&res); string(s) != "bar" {
+		t.Errorf("expected bar, got %s", s)
+	}
+
+	if _, err = restarted.Write([]byte("*4\r\n$6\r\nXRANGE\r\n$6\r\nstream\r\n$1\r\n-\r\n$1\r\n+\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := resp.Array{}
+	if _, err = entries.UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries.A) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries.A))
+	}
+}
+
+// deleteStreamEntries deletes the last entry of one stream and the only entry of another one
+func deleteStreamEntries(t *testing.T, c *client) {
+	t.Helper()
+	for _, cmd := range [][]string{
+		{"XADD", "stream", "1-1", "a", "1"},
+		{"XADD", "stream", "5-0", "a", "2"},
+		{"XDEL", "stream", "5-0"},
+		{"XADD", "empty", "7-0", "a", "1"},
+		{"XDEL", "empty", "7-0"},
+	} {
+		if res := c.do(cmd...); res.I == nil {
+			t.Fatalf("unexpected reply to %v", cmd)
+		} else if err, ok := res.I.(resp.SimpleError); ok {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+}
+
+// assertDeletedIdsNotReissued checks that ids of the deleted entries are not reissued after restart
+func assertDeletedIdsNotReissued(t *testing.T, c *client) {
+	t.Helper()
+	if typ := c.str("TYPE", "empty"); typ != "stream" {
+		t.Errorf("expected emptied stream to be kept, got type %s", typ)
+	}
+
+	if id := c.str("XADD", "stream", "5-*", "a", "3"); id != "5-1" {
+		t.Errorf("expected 5-1, got %s", id)
+	}
+
+	if id := c.str("XADD", "empty", "7-*", "a", "2"); id != "7-1" {
+		t.Errorf("expected 7-1, got %s", id)
+	}
+
+	if res := c.do("XADD", "stream", "4-0", "a", "4"); res.I == nil {
+		t.Error("expected error adding id smaller than the deleted one")
+	} else if _, ok := res.I.(resp.SimpleError); !ok {
+		t.Errorf("expected error adding id smaller than the deleted one, got %v", res.I)
+	}
+}
+
+func TestSaveShouldRestoreDeletedStreamIds(t *testing.T) {
+	const RESTARTED_PORT = 6381
+	dir := t.TempDir()
+	SetupRdbMaster(t, MASTER_PORT, dir)
+	c := dial(t, MASTER_PORT)
+	deleteStreamEntries(t, c)
+	if s := c.str("SAVE"); s != "OK" {
+		t.Fatalf("unexpected response to SAVE: %s", s)
+	}
+
+	SetupRdbMaster(t, RESTARTED_PORT, dir)
+	assertDeletedIdsNotReissued(t, dial(t, RESTARTED_PORT))
+}
+
+func TestAofRewriteShouldRestoreDeletedStreamIds(t *testing.T) {
+	const RESTARTED_PORT = 6381
+	dir := t.TempDir()
+	SetupAofMaster(t, MASTER_PORT, dir)
+	c := dial(t, MASTER_PORT)
+	deleteStreamEntries(t, c)
+	if s := c.str("BGREWRITEAOF"); s != "Background append only file rewriting started" {
+		t.Fatalf("unexpected response to BGREWRITEAOF: %s", s)
+	}
+
+	for !strings.Contains(c.str("INFO", "persistence"), "aof_rewrites:1\r\n") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	SetupAofMaster(t, RESTARTED_PORT, dir)
+	assertDeletedIdsNotReissued(t, dial(t, RESTARTED_PORT))
+}
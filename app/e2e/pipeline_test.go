@@ -0,0 +1,151 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func registerPipeline(router *lib.Router) {
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterCommand("xadd", lib.HandleFunc(handlers.HandleXAdd), lib.CMD_WRITE)
+	router.RegisterCommand("xread", lib.HandleFunc(handlers.HandleXRead), lib.CMD_READONLY)
+}
+
+// batch marshals the commands to be sent by a single write
+func batch(cmds ...resp.Array) []byte {
+	var b bytes.Buffer
+	for _, cmd := range cmds {
+		cmd.MarshalRESP(&b)
+	}
+
+	return b.Bytes()
+}
+
+func TestPipeline(t *testing.T) {
+	_, router := SetupMaster(t, MASTER_PORT)
+	registerPipeline(router)
+	c := dial(t, MASTER_PORT)
+
+	cmds := []resp.Array{}
+	expected := []interface{}{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		cmds = append(cmds, command("set", key, strconv.Itoa(i)), command("get", key))
+		expected = append(expected, resp.SimpleString{S: "OK"}, resp.BulkString{S: []byte(strconv.Itoa(i))})
+	}
+
+	cmds = append(cmds, command("unknown"), command("get", "key:0"))
+	if _, err := c.conn.Write(batch(cmds...)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for i, e := range expected {
+		if res := c.read(); !reflect.DeepEqual(res.I, e) {
+			t.Fatalf("expected reply %d to be %#v, got %#v", i, e, res.I)
+		}
+	}
+
+	if _, ok := c.read().I.(resp.SimpleError); !ok {
+		t.Errorf("expected error reply to the unknown command")
+	}
+
+	if s, _ := TryString(ptr(c.read())); string(s) != "0" {
+		t.Errorf("expected %q, got %q", "0", s)
+	}
+}
+
+func TestPipelineFlushedBeforeBlocking(t *testing.T) {
+	_, router := SetupMaster(t, MASTER_PORT)
+	registerPipeline(router)
+	c := dial(t, MASTER_PORT)
+	if s := c.str("xadd", "stream", "1-1", "field", "value"); s != "1-1" {
+		t.Fatalf("expected %q, got %q", "1-1", s)
+	}
+
+	cmds := batch(command("set", "foo", "bar"), command("xread", "block", "1000", "streams", "stream", "$"))
+	if _, err := c.conn.Write(cmds); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// reply to SET is sent before the server waits for the stream
+	c.conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	res := resp.Any{}
+	if _, err := res.UnmarshalRESP(c.r); err != nil {
+		t.Fatalf("expected reply to SET before XREAD is unblocked, got %s", err)
+	}
+
+	if !reflect.DeepEqual(res.I, resp.SimpleString{S: "OK"}) {
+		t.Errorf("expected OK, got %#v", res.I)
+	}
+
+	if s := dial(t, MASTER_PORT).str("xadd", "stream", "1-2", "field", "value"); s != "1-2" {
+		t.Fatalf("expected %q, got %q", "1-2", s)
+	}
+
+	if res := c.read(); !reflect.DeepEqual(res.I, resp.Array{A: []resp.Marshaller{resp.Array{A: []resp.Marshaller{
+		resp.BulkString{S: []byte("stream")},
+		resp.Array{A: []resp.Marshaller{resp.Array{A: []resp.Marshaller{
+			resp.BulkString{S: []byte("1-2")},
+			resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("field")}, resp.BulkString{S: []byte("value")}}},
+		}}}},
+	}}}}) {
+		t.Errorf("expected XREAD to be unblocked by XADD, got %#v", res.I)
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	_, router := SetupMaster(b, MASTER_PORT)
+	registerPipeline(router)
+
+	for _, size := range []int{1, 16, 128} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			conn, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+			if err != nil {
+				b.Fatalf("unexpected error: %s", err)
+			}
+
+			defer conn.Close()
+			cmds := make([]resp.Array, 0, size)
+			for i := 0; i < size; i++ {
+				if i%2 == 0 {
+					cmds = append(cmds, command("set", fmt.Sprintf("key:%d", i), "value"))
+				} else {
+					cmds = append(cmds, command("get", fmt.Sprintf("key:%d", i-1)))
+				}
+			}
+
+			pipeline := batch(cmds...)
+			r := bufio.NewReaderSize(conn, 64*1024)
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(pipeline); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+
+				// SET replies with a single line, GET with the length and the value
+				for j := 0; j < size; j++ {
+					lines := 1 + j%2
+					for ; lines > 0; lines-- {
+						if _, err := r.ReadSlice('\n'); err != nil {
+							b.Fatalf("unexpected error: %s", err)
+						}
+					}
+				}
+			}
+
+			b.ReportMetric(float64(b.N*size)/time.Since(start).Seconds(), "ops/s")
+		})
+	}
+}
@@ -9,7 +9,10 @@ import (
 	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
 	"io"
 	"net"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -201,3 +204,260 @@ func TestPropagation(t *testing.T) {
 		}
 	}
 }
+
+func TestPartialResync(t *testing.T) {
+	config := lib.GetDefaultConfig()
+	config.Port = MASTER_PORT
+	config.PersistenceConfig.File = ""
+	config.PersistenceConfig.Dir = ""
+	router := lib.NewRouter()
+	router.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+	router.RegisterHandlerFunc("psync", lib.HandlePsync)
+	router.RegisterHandler("set", lib.ReplWrapper{Next: lib.HandleFunc(handlers.HandleSet)})
+	setUpMaster(t, config, router)
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	set := func(cmd string) {
+		if _, err := client.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.SimpleString{}
+		if _, err := res.UnmarshalRESP(r); err != nil || res.S != "OK" {
+			t.Fatalf("expected OK, got %q, %v", res.S, err)
+		}
+	}
+
+	set("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$1\r\n1\r\n")
+	replid, offset := config.ReplicationConfig.MasterReplid, config.ReplicationConfig.MasterReplOffset.Load()
+	missed := "*3\r\n$3\r\nSET\r\n$3\r\nbar\r\n$1\r\n2\r\n"
+	set(missed)
+	if got := config.ReplicationConfig.MasterReplOffset.Load(); got != offset+uint64(len(missed)) {
+		t.Fatalf("expected offset %d, got %d", offset+uint64(len(missed)), got)
+	}
+
+	psync := func(replid string, offset uint64) (string, *bufio.Reader) {
+		replica, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		t.Cleanup(func() { replica.Close() })
+		replica.Write([]byte(fmt.Sprintf("*3\r\n$5\r\nPSYNC\r\n$%d\r\n%s\r\n$%d\r\n%d\r\n", len(replid), replid, len(fmt.Sprint(offset)), offset)))
+		rr := bufio.NewReader(replica)
+		res := resp.SimpleString{}
+		if _, err := res.UnmarshalRESP(rr); err != nil {
+			t.Fatal(err)
+		}
+
+		return res.S, rr
+	}
+
+	t.Run("continue from backlog", func(t *testing.T) {
+		res, rr := psync(replid, offset+1)
+		if res != "CONTINUE "+replid {
+			t.Fatalf("expected CONTINUE %s, got %s", replid, res)
+		}
+
+		buf := make([]byte, len(missed))
+		if _, err := io.ReadFull(rr, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != missed {
+			t.Errorf("expected %q, got %q", missed, buf)
+		}
+	})
+
+	t.Run("full resync of unknown history", func(t *testing.T) {
+		if res, _ := psync(strings.Repeat("a", 40), offset+1); !strings.HasPrefix(res, "FULLRESYNC "+replid) {
+			t.Errorf("expected FULLRESYNC, got %s", res)
+		}
+
+		if res, _ := psync(replid, offset+uint64(len(missed))+2); !strings.HasPrefix(res, "FULLRESYNC") {
+			t.Errorf("expected FULLRESYNC, got %s", res)
+		}
+	})
+
+	t.Run("continue with secondary id", func(t *testing.T) {
+		promoted := strings.Repeat("b", 40)
+		config.ReplicationConfig.ShiftReplid(promoted)
+		if res, _ := psync(replid, offset+1); res != "CONTINUE "+promoted {
+			t.Errorf("expected CONTINUE %s, got %s", promoted, res)
+		}
+	})
+}
+
+func TestWriteCommandsPropagation(t *testing.T) {
+	_, router := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("xadd", lib.HandleFunc(handlers.HandleXAdd), lib.CMD_WRITE)
+	router.RegisterHandlerFunc("select", lib.HandleSelect)
+	_, replicaReader, _, err := ConnectReplica(fmt.Sprintf(":%d", MASTER_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect replica: %s", err)
+	}
+
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	var xaddId string
+	for _, c := range [][]string{
+		{"SET", "foo", "bar", "EX", "100"},
+		{"XADD", "stream", "*", "a", "b"},
+		{"SET", "foo", "baz", "NX"},
+		{"SELECT", "1"},
+		{"SET", "qux", "1"},
+	} {
+		if _, err = command(c...).MarshalRESP(client); err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Any{}
+		if _, err = res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		if c[0] == "XADD" {
+			id, _ := TryString(&res)
+			xaddId = string(id)
+		}
+	}
+
+	expected := [][]string{
+		{"SET", "foo", "bar", "PXAT", ""},
+		{"XADD", "stream", xaddId, "a", "b"},
+		{"SELECT", "1"},
+		{"SET", "qux", "1"},
+	}
+	for _, e := range expected {
+		cmd := resp.Array{}
+		if _, err = cmd.UnmarshalRESP(replicaReader); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(cmd.A) != len(e) {
+			t.Fatalf("expected %v, got %s", e, cmd)
+		}
+
+		for i, arg := range e {
+			got := string(cmd.A[i].(resp.BulkString).S)
+			if arg == "" {
+				expire, err := strconv.ParseInt(got, 10, 64)
+				if err != nil || time.UnixMilli(expire).Before(time.Now().Add(99*time.Second)) {
+					t.Errorf("expected absolute expire in 100 seconds, got %s", got)
+				}
+
+				continue
+			}
+
+			if got != arg {
+				t.Errorf("expected %v, got %s", e, cmd)
+			}
+		}
+	}
+}
+
+func TestConcurrentWritesShouldReplicateInOrder(t *testing.T) {
+	const (
+		REPLICA_PORT = 6800
+		CLIENTS      = 16
+		KEYS         = 2000
+	)
+
+	_, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	routerMaster.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerMaster.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	routerMaster.RegisterHandlerFunc("wait", lib.HandleWait)
+	_, routerReplica := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	routerReplica.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerReplica.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	routerReplica.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+
+	// writes have to run in parallel to be reordered, even on a single CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	// every client writes the same keys in the same order at once, so the last write of every key is contended,
+	// NX and XX writes are applied depending on the order of the others
+	cmds := make([][]byte, CLIENTS)
+	for i := range cmds {
+		pipeline := make([]resp.Array, 0, 2*KEYS)
+		for j := 0; j < KEYS; j++ {
+			key := fmt.Sprintf("key:%d", j)
+			pipeline = append(pipeline, command("SET", key, strconv.Itoa(i), "NX"), command("SET", key, strconv.Itoa(i), "XX"))
+		}
+
+		cmds[i] = batch(pipeline...)
+	}
+
+	conns := make([]net.Conn, CLIENTS)
+	for i := range conns {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	errs := make(chan error, CLIENTS)
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn, cmds []byte) {
+			defer wg.Done()
+			<-start
+			go conn.Write(cmds)
+			r := bufio.NewReader(conn)
+			for j := 0; j < 2*KEYS; j++ {
+				if _, err := (&resp.Any{}).UnmarshalRESP(r); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(conn, cmds[i])
+	}
+
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	master, replica := dial(t, MASTER_PORT), dial(t, REPLICA_PORT)
+	// the reply is read within the timeout of WAIT rather than the deadline of the client
+	if _, err := command("WAIT", "1", "5000").MarshalRESP(master.conn); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	master.conn.SetReadDeadline(time.Now().Add(6 * time.Second))
+	res := resp.Any{}
+	if _, err := res.UnmarshalRESP(master.r); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if res.I != (resp.SimpleInt{I: 1}) {
+		t.Fatalf("expected replica to acknowledge the writes, got %#v", res.I)
+	}
+
+	diverged := 0
+	for j := 0; j < KEYS; j++ {
+		key := fmt.Sprintf("key:%d", j)
+		if m, r := master.str("GET", key), replica.str("GET", key); m != r {
+			diverged++
+		}
+	}
+
+	if diverged > 0 {
+		t.Errorf("expected replica to have the same values as master, %d of %d keys differ", diverged, KEYS)
+	}
+}
@@ -0,0 +1,226 @@
+package e2e
+
+import (
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func registerPubsub(router *lib.Router) {
+	router.RegisterHandlerFunc("ping", handlers.HandlePing)
+	router.RegisterHandlerFunc("subscribe", lib.HandleSubscribe)
+	router.RegisterHandlerFunc("psubscribe", lib.HandlePSubscribe)
+	router.RegisterHandlerFunc("ssubscribe", lib.HandleSSubscribe)
+	router.RegisterHandlerFunc("unsubscribe", lib.HandleUnsubscribe)
+	router.RegisterHandlerFunc("punsubscribe", lib.HandlePUnsubscribe)
+	router.RegisterHandlerFunc("sunsubscribe", lib.HandleSUnsubscribe)
+	router.RegisterHandlerFunc("publish", lib.HandlePublish)
+	router.RegisterHandlerFunc("spublish", lib.HandleSPublish)
+	router.RegisterHandlerFunc("pubsub", lib.HandlePubsub)
+	router.RegisterKeys("ssubscribe", lib.AllKeys)
+	router.RegisterKeys("sunsubscribe", lib.AllKeys)
+	router.RegisterKeys("spublish", lib.FirstKey)
+}
+
+// strs returns the elements of the array reply joined by spaces, the next pushed reply is read without args
+func strs(t *testing.T, c *client, args ...string) string {
+	t.Helper()
+	res := c.read
+	if len(args) > 0 {
+		res = func() resp.Any {
+			return c.do(args...)
+		}
+	}
+
+	arr, ok := res().I.(resp.Array)
+	if !ok {
+		t.Fatalf("expected array reply to %v", args)
+	}
+
+	s := make([]string, 0, len(arr.A))
+	for _, m := range arr.A {
+		if n, ok := m.(resp.SimpleInt); ok {
+			s = append(s, fmt.Sprint(n.I))
+			continue
+		}
+
+		b, _ := TryString(&resp.Any{I: m})
+		s = append(s, string(b))
+	}
+
+	return strings.Join(s, " ")
+}
+
+func TestPubsub(t *testing.T) {
+	_, router := SetupMaster(t, MASTER_PORT)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	registerPubsub(router)
+	sub, psub, pub := dial(t, MASTER_PORT), dial(t, MASTER_PORT), dial(t, MASTER_PORT)
+	for _, step := range []struct {
+		c        *client
+		cmd      []string
+		expected string
+	}{
+		{sub, []string{"SUBSCRIBE", "news.tech", "sports"}, "subscribe news.tech 1"},
+		{sub, nil, "subscribe sports 2"},
+		{sub, []string{"SUBSCRIBE", "sports"}, "subscribe sports 2"},
+		{sub, []string{"PING"}, "pong "},
+		{psub, []string{"PSUBSCRIBE", "news.*"}, "psubscribe news.* 1"},
+		{psub, []string{"SSUBSCRIBE", "orders"}, "ssubscribe orders 1"},
+		{pub, []string{"PUBSUB", "CHANNELS"}, "news.tech sports"},
+		{pub, []string{"PUBSUB", "CHANNELS", "news.*"}, "news.tech"},
+		{pub, []string{"PUBSUB", "NUMSUB", "sports", "missing"}, "sports 1 missing 0"},
+		{pub, []string{"PUBSUB", "SHARDCHANNELS"}, "orders"},
+	} {
+		if s := strs(t, step.c, step.cmd...); s != step.expected {
+			t.Errorf("expected %q to %v, got %q", step.expected, step.cmd, s)
+		}
+	}
+
+	if s := sub.str("GET", "foo"); s != "ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context" {
+		t.Errorf("expected subscriber to reject GET, got %q", s)
+	}
+
+	if n := pub.do("PUBSUB", "NUMPAT").I; n != (resp.SimpleInt{I: 1}) {
+		t.Errorf("expected 1 pattern, got %v", n)
+	}
+
+	if n := pub.do("PUBLISH", "news.tech", "hello").I; n != (resp.SimpleInt{I: 2}) {
+		t.Errorf("expected message to be received by 2 subscribers, got %v", n)
+	}
+
+	if s := strs(t, sub); s != "message news.tech hello" {
+		t.Errorf("unexpected message %q", s)
+	}
+
+	if s := strs(t, psub); s != "pmessage news.* news.tech hello" {
+		t.Errorf("unexpected message %q", s)
+	}
+
+	// shard channels are apart from the channels and patterns
+	if n := pub.do("PUBLISH", "orders", "1").I; n != (resp.SimpleInt{I: 0}) {
+		t.Errorf("expected no subscriber of the channel, got %v", n)
+	}
+
+	if n := pub.do("SPUBLISH", "orders", "1").I; n != (resp.SimpleInt{I: 1}) {
+		t.Errorf("expected message to be received by the shard subscriber, got %v", n)
+	}
+
+	if s := strs(t, psub); s != "smessage orders 1" {
+		t.Errorf("unexpected message %q", s)
+	}
+
+	for _, step := range []struct {
+		cmd      []string
+		expected string
+	}{
+		{[]string{"UNSUBSCRIBE", "sports"}, "unsubscribe sports 1"},
+		{[]string{"UNSUBSCRIBE"}, "unsubscribe news.tech 0"},
+		{[]string{"UNSUBSCRIBE"}, "unsubscribe  0"},
+	} {
+		if s := strs(t, sub, step.cmd...); s != step.expected {
+			t.Errorf("expected %q to %v, got %q", step.expected, step.cmd, s)
+		}
+	}
+
+	if s := sub.str("GET", "foo"); s != "" {
+		t.Errorf("expected connection to leave subscribed state, got %q", s)
+	}
+}
+
+func TestPubsubSlowSubscriber(t *testing.T) {
+	buffer := lib.PUBSUB_BUFFER
+	lib.PUBSUB_BUFFER = 4
+	t.Cleanup(func() {
+		lib.PUBSUB_BUFFER = buffer
+	})
+
+	_, router := SetupMaster(t, MASTER_PORT)
+	registerPubsub(router)
+	slow, pub := dial(t, MASTER_PORT), dial(t, MASTER_PORT)
+	slow.do("SUBSCRIBE", "news")
+	// the subscriber never reads, publisher fills its buffers without waiting for it
+	message := strings.Repeat("x", 1<<20)
+	start := time.Now()
+	for i := 0; i < 64; i++ {
+		pub.do("PUBLISH", "news", message)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected publisher not to wait for the subscriber, took %s", d)
+	}
+
+	eventually(t, func() bool {
+		return strs(t, pub, "PUBSUB", "NUMSUB", "news") == "news 0"
+	})
+}
+
+func TestPubsubPropagation(t *testing.T) {
+	const REPLICA_PORT = 6380
+	_, router := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	registerPubsub(router)
+	_, replicaRouter := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	registerPubsub(replicaRouter)
+	sub := dial(t, REPLICA_PORT)
+	sub.do("SUBSCRIBE", "news")
+	pub := dial(t, MASTER_PORT)
+	if n := pub.do("PUBLISH", "news", "hello").I; n != (resp.SimpleInt{I: 0}) {
+		t.Errorf("expected no subscriber of the master, got %v", n)
+	}
+
+	if s := strs(t, sub); s != "message news hello" {
+		t.Errorf("expected message published on the master, got %q", s)
+	}
+}
+
+func TestClusterPubsub(t *testing.T) {
+	ports := []int{7200, 7201}
+	for _, port := range ports {
+		_, router := SetupClusterNode(t, port, filepath.Join(t.TempDir(), "nodes.conf"))
+		registerPubsub(router)
+	}
+
+	addSlots(t, ports[0], 0, 8191)
+	addSlots(t, ports[1], 8192, 16383)
+	if s, _ := TryString(ptr(do(t, ports[0], "CLUSTER", "MEET", "127.0.0.1", fmt.Sprint(ports[1])))); string(s) != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	eventually(t, func() bool {
+		s, _ := TryString(ptr(do(t, ports[1], "CLUSTER", "INFO")))
+		return strings.Contains(string(s), "cluster_state:ok")
+	})
+
+	sub := dial(t, ports[1])
+	sub.do("SUBSCRIBE", "news")
+	// shard channels are served by the owner of their slot, bar hashes to slot 5061 and foo to 12182
+	if s := sub.str("SSUBSCRIBE", "bar"); s != "MOVED 5061 127.0.0.1:7200" {
+		t.Errorf("expected shard channel to be redirected, got %q", s)
+	}
+
+	if s := strs(t, sub, "SSUBSCRIBE", "foo"); s != "ssubscribe foo 1" {
+		t.Errorf("unexpected reply %q", s)
+	}
+
+	pub := dial(t, ports[0])
+	eventually(t, func() bool {
+		pub.do("PUBLISH", "news", "hello")
+		sub.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		res := resp.Any{}
+		if _, err := res.UnmarshalRESP(sub.r); err != nil {
+			return false
+		}
+
+		arr, ok := res.I.(resp.Array)
+		return ok && strings.Join(replies(t, resp.Any{I: arr}), " ") == "message news hello"
+	})
+
+	if s := pub.str("SPUBLISH", "foo", "1"); s != "MOVED 12182 127.0.0.1:7201" {
+		t.Errorf("expected sharded publish to be redirected, got %q", s)
+	}
+}
@@ -2,10 +2,16 @@ package e2e
 
 import (
 	"bufio"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestHandshakeWithMaster(t *testing.T) {
@@ -21,3 +27,710 @@ func TestHandshakeWithMaster(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestFullResyncShouldSendDataset(t *testing.T) {
+	const REPLICA_PORT = 6800
+	for _, diskless := range []bool{false, true} {
+		t.Run(fmt.Sprintf("diskless %t", diskless), func(t *testing.T) {
+			config := lib.GetDefaultConfig()
+			config.Port = MASTER_PORT
+			config.PersistenceConfig.Dir = ""
+			config.PersistenceConfig.File = ""
+			config.ReplicationConfig.ReplDisklessSync = diskless
+			router := lib.NewRouter()
+			router.RegisterHandlerFunc("ping", handlers.HandlePing)
+			router.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+			router.RegisterHandlerFunc("psync", lib.HandlePsync)
+			router.RegisterHandler("set", lib.ReplWrapper{Next: lib.HandleFunc(handlers.HandleSet)})
+			router.RegisterHandlerFunc("xadd", handlers.HandleXAdd)
+			setUpMaster(t, config, router)
+			master, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			r := bufio.NewReader(master)
+			for _, c := range []string{
+				"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n",
+				"*5\r\n$4\r\nXADD\r\n$6\r\nstream\r\n$3\r\n1-1\r\n$1\r\na\r\n$1\r\nb\r\n",
+			} {
+				master.Write([]byte(c))
+				res := resp.Any{}
+				if _, err = res.UnmarshalRESP(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, replicaRouter := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+			replicaRouter.RegisterHandlerFunc("set", handlers.HandleSet)
+			replicaRouter.RegisterHandlerFunc("get", handlers.HandleGet)
+			replicaRouter.RegisterHandlerFunc("type", handlers.HandleType)
+			// written after the snapshot, has to be streamed after the rdb
+			master.Write([]byte("*3\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n"))
+			if _, err = (&resp.Any{}).UnmarshalRESP(r); err != nil {
+				t.Fatal(err)
+			}
+
+			replica, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", REPLICA_PORT), time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			rr := bufio.NewReader(replica)
+			for _, c := range []struct{ cmd, expected string }{
+				{"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", "bar"},
+				{"*2\r\n$3\r\nGET\r\n$3\r\nbaz\r\n", "qux"},
+				{"*2\r\n$4\r\nTYPE\r\n$6\r\nstream\r\n", "stream"},
+			} {
+				replica.Write([]byte(c.cmd))
+				res := resp.Any{}
+				if _, err = res.UnmarshalRESP(rr); err != nil {
+					t.Fatal(err)
+				}
+
+				if s, _ := TryString(&res); string(s) != c.expected {
+					t.Errorf("%q: expected %s, got %s", c.cmd, c.expected, s)
+				}
+			}
+		})
+	}
+}
+
+func info(t *testing.T, conn net.Conn, r *bufio.Reader) string {
+	t.Helper()
+	if _, err := command("INFO", "replication").MarshalRESP(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	res := resp.Any{}
+	if _, err := res.UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := TryString(&res)
+	return string(s)
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+
+	t.Fatal("condition is not met in time")
+}
+
+func TestReplicaShouldReconnect(t *testing.T) {
+	const REPLICA_PORT = 6800
+	master, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	routerMaster.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	_, routerReplica := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	routerReplica.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerReplica.RegisterHandlerFunc("get", handlers.HandleGet)
+	routerReplica.RegisterHandlerFunc("info", handlers.HandleInfo)
+	replica, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", REPLICA_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rr := bufio.NewReader(replica)
+	if s := info(t, replica, rr); !strings.Contains(s, "master_link_status:up") {
+		t.Fatalf("expected link to be up, got %s", s)
+	}
+
+	master.Close()
+	eventually(t, func() bool {
+		return strings.Contains(info(t, replica, rr), "master_link_status:down")
+	})
+
+	_, routerMaster = SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	routerMaster.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	eventually(t, func() bool {
+		return strings.Contains(info(t, replica, rr), "master_link_status:up")
+	})
+
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err = command("SET", "foo", "bar").MarshalRESP(client); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, func() bool {
+		command("GET", "foo").MarshalRESP(replica)
+		res := resp.Any{}
+		if _, err := res.UnmarshalRESP(rr); err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := TryString(&res)
+		return string(s) == "bar"
+	})
+}
+
+func TestReplicaOfAtRuntime(t *testing.T) {
+	const REPLICA_PORT = 6800
+	_, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	routerMaster.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerMaster.RegisterHandlerFunc("info", handlers.HandleInfo)
+	_, routerReplica := SetupMaster(t, REPLICA_PORT)
+	routerReplica.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerReplica.RegisterHandlerFunc("get", handlers.HandleGet)
+	routerReplica.RegisterHandlerFunc("info", handlers.HandleInfo)
+	routerReplica.RegisterHandlerFunc("replicaof", lib.HandleReplicaOf)
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	command("SET", "foo", "bar").MarshalRESP(client)
+	if _, err = (&resp.Any{}).UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	replica, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", REPLICA_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rr := bufio.NewReader(replica)
+	for _, c := range []struct {
+		cmd      resp.Array
+		expected string
+	}{
+		{command("REPLICAOF", "localhost", "abc"), "ERR Invalid master port"},
+		{command("REPLICAOF", "localhost", fmt.Sprint(MASTER_PORT)), "OK"},
+		{command("REPLICAOF", "localhost", fmt.Sprint(MASTER_PORT)), "OK Already connected to specified master"},
+	} {
+		c.cmd.MarshalRESP(replica)
+		res := resp.Any{}
+		if _, err = res.UnmarshalRESP(rr); err != nil {
+			t.Fatal(err)
+		}
+
+		if s, _ := TryString(&res); string(s) != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, s)
+		}
+	}
+
+	eventually(t, func() bool {
+		command("GET", "foo").MarshalRESP(replica)
+		res := resp.Any{}
+		if _, err := res.UnmarshalRESP(rr); err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := TryString(&res)
+		return string(s) == "bar"
+	})
+
+	masterInfo := info(t, client, r)
+	replid := masterInfo[strings.Index(masterInfo, "master_replid:")+len("master_replid:"):][:40]
+	command("REPLICAOF", "NO", "ONE").MarshalRESP(replica)
+	if _, err = (&resp.Any{}).UnmarshalRESP(rr); err != nil {
+		t.Fatal(err)
+	}
+
+	s := info(t, replica, rr)
+	if !strings.Contains(s, "role:master") || strings.Contains(s, "master_link_status") {
+		t.Errorf("expected replica to be promoted, got %s", s)
+	}
+
+	if !strings.Contains(s, "master_replid2:"+replid) {
+		t.Errorf("expected old master id %s to be secondary, got %s", replid, s)
+	}
+}
+
+func TestConcurrentReplicaOf(t *testing.T) {
+	const REPLICA_PORT = 6800
+	_, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	routerMaster.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerMaster.RegisterHandlerFunc("info", handlers.HandleInfo)
+	_, routerReplica := SetupMaster(t, REPLICA_PORT)
+	routerReplica.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerReplica.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	routerReplica.RegisterHandlerFunc("replicaof", lib.HandleReplicaOf)
+
+	// clients switch the master back and forth while others write
+	errs := make(chan error, 8)
+	wg := sync.WaitGroup{}
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", REPLICA_PORT), time.Second)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for j := 0; j < 20; j++ {
+				cmd := command("SET", "foo", fmt.Sprint(j))
+				switch {
+				case i%2 == 0:
+				case j%2 == 0:
+					cmd = command("REPLICAOF", "localhost", fmt.Sprint(MASTER_PORT))
+				default:
+					cmd = command("REPLICAOF", "NO", "ONE")
+				}
+
+				cmd.MarshalRESP(conn)
+				if _, err = (&resp.Any{}).UnmarshalRESP(r); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	master, replica := dial(t, MASTER_PORT), dial(t, REPLICA_PORT)
+	replica.do("REPLICAOF", "localhost", fmt.Sprint(MASTER_PORT))
+	master.do("SET", "foo", "bar")
+	eventually(t, func() bool {
+		return replica.str("GET", "foo") == "bar"
+	})
+
+	// replaced links are closed, so the master ends up with a single replica
+	eventually(t, func() bool {
+		return strings.Contains(master.str("INFO", "replication"), "connected_slaves:1")
+	})
+}
+
+func TestReplicaShouldRejectWrites(t *testing.T) {
+	const REPLICA_PORT = 6800
+	_, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	routerMaster.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	_, routerReplica := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	routerReplica.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerReplica.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	replica, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", REPLICA_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rr := bufio.NewReader(replica)
+	command("SET", "foo", "replica").MarshalRESP(replica)
+	res := resp.Any{}
+	if _, err = res.UnmarshalRESP(rr); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, _ := TryString(&res); !strings.HasPrefix(string(s), "READONLY") {
+		t.Errorf("expected READONLY error, got %s", s)
+	}
+
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	command("SET", "foo", "master").MarshalRESP(client)
+	eventually(t, func() bool {
+		command("GET", "foo").MarshalRESP(replica)
+		res := resp.Any{}
+		if _, err := res.UnmarshalRESP(rr); err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := TryString(&res)
+		return string(s) == "master"
+	})
+}
+
+func TestMasterShouldTrackReplicaAcks(t *testing.T) {
+	const REPLICA_PORT = 6800
+	config := lib.GetDefaultConfig()
+	config.Port = MASTER_PORT
+	config.PersistenceConfig.Dir = ""
+	config.PersistenceConfig.File = ""
+	config.ReplicationConfig.ReplPingReplicaPeriod = 100 * time.Millisecond
+	router := lib.NewRouter()
+	router.RegisterHandlerFunc("ping", handlers.HandlePing)
+	router.RegisterHandlerFunc("info", handlers.HandleInfo)
+	router.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+	router.RegisterHandlerFunc("psync", lib.HandlePsync)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	setUpMaster(t, config, router)
+	_, routerReplica := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	routerReplica.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerReplica.RegisterHandlerFunc("ping", handlers.HandlePing)
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	command("SET", "foo", "bar").MarshalRESP(client)
+	if _, err = (&resp.Any{}).UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// replica acknowledges the write and the pings sent after it
+	prefix := fmt.Sprintf("slave0:ip=127.0.0.1,port=%d,state=online,offset=", REPLICA_PORT)
+	eventually(t, func() bool {
+		s := info(t, client, r)
+		i := strings.Index(s, prefix)
+		if i < 0 {
+			return false
+		}
+
+		var offset, lag int
+		fmt.Sscanf(s[i+len(prefix):], "%d,lag=%d", &offset, &lag)
+		return offset > len("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n") && lag <= 1
+	})
+}
+
+func TestWaitForReplicaAcks(t *testing.T) {
+	const REPLICA_PORT = 6800
+	_, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	routerMaster.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerMaster.RegisterHandlerFunc("wait", lib.HandleWait)
+	_, routerReplica := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	routerReplica.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerReplica.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+	// replica that never acknowledges anything
+	fake, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err = EstablishReplicaMaster(resp.NewRdb(&sync.Map{}), fake, bufio.NewReader(fake)); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	command("SET", "foo", "bar").MarshalRESP(client)
+	if _, err = (&resp.Any{}).UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		replicas, timeout string
+		expected          int64
+		min, max          time.Duration
+	}{
+		{"1", "5000", 1, 0, time.Second},
+		{"2", "300", 1, 300 * time.Millisecond, time.Second},
+	} {
+		start := time.Now()
+		command("WAIT", c.replicas, c.timeout).MarshalRESP(client)
+		res := resp.SimpleInt{}
+		if _, err = res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		if elapsed := time.Since(start); elapsed < c.min || elapsed > c.max {
+			t.Errorf("WAIT %s %s: expected to return in [%s, %s], took %s", c.replicas, c.timeout, c.min, c.max, elapsed)
+		}
+
+		if res.I != c.expected {
+			t.Errorf("WAIT %s %s: expected %d, got %d", c.replicas, c.timeout, c.expected, res.I)
+		}
+	}
+}
+
+func TestGetAckShouldNotSplitTransactions(t *testing.T) {
+	const TRANSACTIONS = 20
+	// GETACK has to be attempted while the transaction is propagated
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	_, router := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterHandlerFunc("wait", lib.HandleWait)
+	registerTransactions(router)
+	_, stream, _, err := ConnectReplica(fmt.Sprintf(":%d", MASTER_PORT))
+	if err != nil {
+		t.Fatalf("Failed to connect replica: %s", err)
+	}
+
+	// the replica never acknowledges anything, so every WAIT asks for GETACK
+	done := make(chan struct{})
+	waits := sync.WaitGroup{}
+	waits.Add(1)
+	go func() {
+		defer waits.Done()
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			command("WAIT", "1", "1").MarshalRESP(conn)
+			if _, err := (&resp.Any{}).UnmarshalRESP(r); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := dial(t, MASTER_PORT)
+	for i := 0; i < TRANSACTIONS; i++ {
+		cmds := []resp.Array{command("MULTI")}
+		for j := 0; j < 50; j++ {
+			cmds = append(cmds, command("SET", fmt.Sprintf("key:%d", j), fmt.Sprint(i)))
+		}
+
+		cmds = append(cmds, command("EXEC"))
+		if _, err := c.conn.Write(batch(cmds...)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		for range cmds {
+			c.read()
+		}
+	}
+
+	close(done)
+	waits.Wait()
+	inTransaction := false
+	for n := 0; n < TRANSACTIONS; {
+		cmd := resp.Array{}
+		if _, err := cmd.UnmarshalRESP(stream); err != nil {
+			t.Fatal(err)
+		}
+
+		switch name, _ := TryString(&resp.Any{I: cmd.A[0]}); strings.ToUpper(string(name)) {
+		case "MULTI":
+			inTransaction = true
+		case "EXEC":
+			inTransaction = false
+			n++
+		case "REPLCONF", "PING":
+			if inTransaction {
+				t.Fatalf("expected %s to be propagated between the commands, got it in transaction %d", name, n)
+			}
+		}
+	}
+}
+
+func TestMinReplicasToWrite(t *testing.T) {
+	const REPLICA_PORT = 6800
+	config := lib.GetDefaultConfig()
+	config.Port = MASTER_PORT
+	config.PersistenceConfig.Dir = ""
+	config.PersistenceConfig.File = ""
+	config.ReplicationConfig.MinReplicasToWrite = 1
+	router := lib.NewRouter()
+	router.RegisterHandlerFunc("ping", handlers.HandlePing)
+	router.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+	router.RegisterHandlerFunc("psync", lib.HandlePsync)
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	setUpMaster(t, config, router)
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	send := func(cmd resp.Array) string {
+		cmd.MarshalRESP(client)
+		res := resp.Any{}
+		if _, err := res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := TryString(&res)
+		return string(s)
+	}
+
+	if s := send(command("SET", "foo", "bar")); !strings.HasPrefix(s, "NOREPLICAS") {
+		t.Errorf("expected NOREPLICAS error, got %s", s)
+	}
+
+	if s := send(command("GET", "foo")); s != "" {
+		t.Errorf("expected read to be served, got %s", s)
+	}
+
+	SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	eventually(t, func() bool {
+		return send(command("SET", "foo", "bar")) == "OK"
+	})
+}
+
+func TestChainedReplication(t *testing.T) {
+	const (
+		REPLICA_PORT     = 6800
+		SUB_REPLICA_PORT = 6381
+	)
+
+	_, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	routerMaster.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	_, routerReplica := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	routerReplica.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerReplica.RegisterHandlerFunc("ping", handlers.HandlePing)
+	routerReplica.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+	routerReplica.RegisterHandlerFunc("psync", lib.HandlePsync)
+	_, routerSub := SetupReplicaOf(t, SUB_REPLICA_PORT, fmt.Sprintf(":%d", REPLICA_PORT))
+	routerSub.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	routerSub.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	routerSub.RegisterHandlerFunc("info", handlers.HandleInfo)
+	routerSub.RegisterHandlerFunc("select", lib.HandleSelect)
+	client, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r := bufio.NewReader(client)
+	for _, c := range []resp.Array{command("SET", "foo", "bar"), command("INFO", "replication")} {
+		c.MarshalRESP(client)
+		if _, err = (&resp.Any{}).UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", SUB_REPLICA_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rs := bufio.NewReader(sub)
+	eventually(t, func() bool {
+		command("GET", "foo").MarshalRESP(sub)
+		res := resp.Any{}
+		if _, err := res.UnmarshalRESP(rs); err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := TryString(&res)
+		return string(s) == "bar"
+	})
+
+	// sub-replica continues the history of the master
+	field := func(info, name string) string {
+		s := info[strings.Index(info, name+":")+len(name)+1:]
+		return strings.TrimSpace(s[:strings.IndexByte(s, '\n')])
+	}
+
+	masterInfo, subInfo := info(t, client, r), info(t, sub, rs)
+	if field(masterInfo, "master_replid") != field(subInfo, "master_replid") {
+		t.Errorf("expected replication id %s, got %s", field(masterInfo, "master_replid"), field(subInfo, "master_replid"))
+	}
+
+	eventually(t, func() bool {
+		return field(info(t, client, r), "master_repl_offset") == field(info(t, sub, rs), "master_repl_offset")
+	})
+}
+
+func TestFailover(t *testing.T) {
+	const REPLICA_PORT = 6800
+	_, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	_, routerReplica := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	for _, router := range []*lib.Router{routerMaster, routerReplica} {
+		router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+		router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+		router.RegisterHandlerFunc("ping", handlers.HandlePing)
+		router.RegisterHandlerFunc("info", handlers.HandleInfo)
+		router.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+		router.RegisterHandlerFunc("psync", lib.HandlePsync)
+		router.RegisterHandlerFunc("select", lib.HandleSelect)
+		router.RegisterHandlerFunc("role", lib.HandleRole)
+		router.RegisterHandlerFunc("failover", lib.HandleFailover)
+	}
+
+	master, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", MASTER_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	replica, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", REPLICA_PORT), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r, rr := bufio.NewReader(master), bufio.NewReader(replica)
+	send := func(conn net.Conn, r *bufio.Reader, cmd resp.Array) string {
+		cmd.MarshalRESP(conn)
+		res := resp.Any{}
+		if _, err := res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := TryString(&res)
+		return string(s)
+	}
+
+	role := func(conn net.Conn, r *bufio.Reader) string {
+		command("ROLE").MarshalRESP(conn)
+		res := resp.Array{}
+		if _, err := res.UnmarshalRESP(r); err != nil {
+			t.Fatal(err)
+		}
+
+		role, _ := res.A[0].(resp.BulkString)
+		return string(role.S)
+	}
+
+	if s := send(master, r, command("SET", "foo", "bar")); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	for _, c := range []struct {
+		cmd      resp.Array
+		expected string
+	}{
+		{command("FAILOVER", "TO", "127.0.0.1", "1"), "ERR FAILOVER target HOST and PORT is not a replica."},
+		{command("FAILOVER", "FORCE"), "ERR FAILOVER with force option requires both a timeout and target HOST and IP."},
+		{command("FAILOVER", "ABORT"), "ERR No failover in progress."},
+	} {
+		if s := send(master, r, c.cmd); s != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, s)
+		}
+	}
+
+	masterInfo := info(t, master, r)
+	replid := masterInfo[strings.Index(masterInfo, "master_replid:")+len("master_replid:"):][:40]
+	if s := send(master, r, command("FAILOVER", "TO", "127.0.0.1", fmt.Sprint(REPLICA_PORT), "TIMEOUT", "5000")); s != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	eventually(t, func() bool {
+		return role(replica, rr) == "master" && role(master, r) == "slave" &&
+			strings.Contains(info(t, master, r), "master_link_status:up")
+	})
+
+	// old master continues the history of the promoted replica instead of loading its dataset
+	replicaInfo := info(t, replica, rr)
+	if !strings.Contains(replicaInfo, "master_replid2:"+replid) {
+		t.Errorf("expected old replication id %s to be secondary, got %s", replid, replicaInfo)
+	}
+
+	newReplid := replicaInfo[strings.Index(replicaInfo, "master_replid:")+len("master_replid:"):][:40]
+	if s := info(t, master, r); !strings.Contains(s, "master_replid:"+newReplid) || !strings.Contains(s, "master_replid2:"+replid) {
+		t.Errorf("expected old master to continue replication %s, got %s", newReplid, s)
+	}
+
+	if s := send(master, r, command("SET", "foo", "old")); !strings.HasPrefix(s, "READONLY") {
+		t.Errorf("expected READONLY error, got %s", s)
+	}
+
+	send(replica, rr, command("SET", "foo", "new"))
+	eventually(t, func() bool {
+		return send(master, r, command("GET", "foo")) == "new"
+	})
+}
@@ -0,0 +1,198 @@
+package e2e
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/sentinel"
+	"net"
+	"testing"
+	"time"
+)
+
+func setupSentinel(t *testing.T, port int, known ...int) {
+	t.Helper()
+	mc := sentinel.NewMasterConfig("mymaster", "127.0.0.1", fmt.Sprint(MASTER_PORT), 2)
+	mc.DownAfter = time.Second
+	mc.FailoverTimeout = 3 * time.Second
+	for _, p := range known {
+		mc.KnownSentinels = append(mc.KnownSentinels, fmt.Sprintf("127.0.0.1:%d", p))
+	}
+
+	config := sentinel.GetDefaultConfig()
+	config.Port = port
+	config.Masters = []*sentinel.MasterConfig{mc}
+	config.PingPeriod = 50 * time.Millisecond
+	config.InfoPeriod = 200 * time.Millisecond
+	config.HelloPeriod = 100 * time.Millisecond
+	sen := sentinel.New(config)
+	t.Cleanup(sen.Close)
+
+	serverConfig := lib.GetDefaultConfig()
+	serverConfig.Port = port
+	serverConfig.PersistenceConfig.Save = false
+	router := lib.NewRouter()
+	router.RegisterHandlerFunc("ping", handlers.HandlePing)
+	sen.RegisterHandlers(router)
+	setUpMaster(t, serverConfig, router)
+	go sen.Run()
+}
+
+// do sends command over a new connection
+func do(t *testing.T, port int, args ...string) resp.Any {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf(":%d", port), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	command(args...).MarshalRESP(conn)
+	res := resp.Any{}
+	if _, err := res.UnmarshalRESP(bufio.NewReader(conn)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	return res
+}
+
+func TestSentinelFailover(t *testing.T) {
+	const (
+		REPLICA_PORT       = 6800
+		OTHER_REPLICA_PORT = 6381
+	)
+
+	desync := sentinel.SENTINEL_MAX_DESYNC
+	sentinel.SENTINEL_MAX_DESYNC = 200 * time.Millisecond
+	t.Cleanup(func() {
+		sentinel.SENTINEL_MAX_DESYNC = desync
+	})
+
+	master, routerMaster := SetupMasterWithReplicationHandlers(t, MASTER_PORT)
+	_, routerReplica := SetupReplicaOf(t, REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	_, routerOther := SetupReplicaOf(t, OTHER_REPLICA_PORT, fmt.Sprintf(":%d", MASTER_PORT))
+	for _, router := range []*lib.Router{routerMaster, routerReplica, routerOther} {
+		router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+		router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+		router.RegisterHandlerFunc("ping", handlers.HandlePing)
+		router.RegisterHandlerFunc("info", handlers.HandleInfo)
+		router.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
+		router.RegisterHandlerFunc("psync", lib.HandlePsync)
+		router.RegisterHandlerFunc("select", lib.HandleSelect)
+		router.RegisterHandlerFunc("role", lib.HandleRole)
+		router.RegisterHandlerFunc("replicaof", lib.HandleReplicaOf)
+	}
+
+	if s, _ := TryString(ptr(do(t, MASTER_PORT, "SET", "foo", "bar"))); string(s) != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	sentinels := []int{26379, 26380, 26381}
+	for i, port := range sentinels {
+		known := append(append([]int{}, sentinels[:i]...), sentinels[i+1:]...)
+		setupSentinel(t, port, known...)
+	}
+
+	field := func(res resp.Any, name string) string {
+		arr, _ := res.I.(resp.Array)
+		for i := 0; i+1 < len(arr.A); i += 2 {
+			k, _ := arr.A[i].(resp.BulkString)
+			v, _ := arr.A[i+1].(resp.BulkString)
+			if string(k.S) == name {
+				return string(v.S)
+			}
+		}
+
+		return ""
+	}
+
+	// sentinels discover the replicas and each other
+	eventually(t, func() bool {
+		for _, port := range sentinels {
+			res := do(t, port, "SENTINEL", "MASTER", "mymaster")
+			if field(res, "num-slaves") != "2" || field(res, "num-other-sentinels") != "2" {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	masterAddr := func(port int) string {
+		arr, ok := do(t, port, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster").I.(resp.Array)
+		if !ok || len(arr.A) != 2 {
+			t.Fatalf("unexpected reply %v", arr)
+		}
+
+		host, _ := arr.A[0].(resp.BulkString)
+		p, _ := arr.A[1].(resp.BulkString)
+		return string(host.S) + ":" + string(p.S)
+	}
+
+	if addr := masterAddr(sentinels[0]); addr != fmt.Sprintf("127.0.0.1:%d", MASTER_PORT) {
+		t.Fatalf("expected master %d, got %s", MASTER_PORT, addr)
+	}
+
+	if b, ok := do(t, sentinels[0], "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "unknown").I.(resp.BulkString); !ok || b.S != nil {
+		t.Fatalf("expected nil, got %v", b)
+	}
+
+	master.Close()
+	var promoted string
+	for deadline := time.Now().Add(15 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("master is not failed over in time")
+		}
+
+		promoted = masterAddr(sentinels[0])
+		agreed := promoted != fmt.Sprintf("127.0.0.1:%d", MASTER_PORT)
+		for _, port := range sentinels[1:] {
+			agreed = agreed && masterAddr(port) == promoted
+		}
+
+		if agreed {
+			break
+		}
+	}
+
+	newMaster, follower := REPLICA_PORT, OTHER_REPLICA_PORT
+	if promoted == fmt.Sprintf("127.0.0.1:%d", OTHER_REPLICA_PORT) {
+		newMaster, follower = OTHER_REPLICA_PORT, REPLICA_PORT
+	}
+
+	role := func(port int) (string, int64) {
+		arr, _ := do(t, port, "ROLE").I.(resp.Array)
+		name, _ := arr.A[0].(resp.BulkString)
+		if string(name.S) != "slave" {
+			return string(name.S), 0
+		}
+
+		masterPort, _ := arr.A[2].(resp.SimpleInt)
+		return string(name.S), masterPort.I
+	}
+
+	if r, _ := role(newMaster); r != "master" {
+		t.Fatalf("expected promoted replica to be master, got %s", r)
+	}
+
+	eventually(t, func() bool {
+		r, port := role(follower)
+		return r == "slave" && port == int64(newMaster)
+	})
+
+	if s, _ := TryString(ptr(do(t, newMaster, "SET", "foo", "baz"))); string(s) != "OK" {
+		t.Fatalf("expected OK, got %s", s)
+	}
+
+	eventually(t, func() bool {
+		s, _ := TryString(ptr(do(t, follower, "GET", "foo")))
+		return string(s) == "baz"
+	})
+}
+
+func ptr(a resp.Any) *resp.Any {
+	return &a
+}
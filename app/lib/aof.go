@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"io"
+	"sort"
+	"time"
+)
+
+// AofWrapper feeds successfully executed write commands to the append only file, ReplWrapper around it keeps
+// the writes in the order of the execution
+type AofWrapper struct {
+	Next Handler
+}
+
+func (h AofWrapper) HandleResp(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if req.s.aof == nil {
+		return h.Next.HandleResp(ctx, req)
+	}
+
+	// EXEC holds the AOF for the whole transaction
+	if req.multi == nil || !req.multi.locked {
+		release := req.s.aof.Hold()
+		defer release()
+	}
+
+	res, err := h.Next.HandleResp(ctx, req)
+	if err != nil || req.skipPropagation {
+		return res, err
+	}
+
+	if t := req.multi; t != nil && !t.logged {
+		if err = req.s.aof.Feed(req.Db.Index(), &multiCommand); err != nil {
+			req.Logger.Printf("Failed to feed AOF: %s", err)
+			return nil, fmt.Errorf("MISCONF Errors writing to the AOF file: %s", err)
+		}
+
+		t.logged = true
+	}
+
+	// handlers may rewrite their arguments to make the logged command deterministic (e.g. XADD with generated id),
+	// so arguments are copied after the execution
+	cmd := resp.Array{A: make([]resp.Marshaller, 0, len(req.Args.A)+1)}
+	cmd.Append(resp.BulkString{S: []byte(req.Command)})
+	cmd.A = append(cmd.A, req.Args.A...)
+	if err = req.s.aof.Feed(req.Db.Index(), &cmd); err != nil {
+		req.Logger.Printf("Failed to feed AOF: %s", err)
+		return nil, fmt.Errorf("MISCONF Errors writing to the AOF file: %s", err)
+	}
+
+	return res, nil
+}
+
+func HandleBgRewriteAof(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if req.s.aof == nil {
+		return nil, fmt.Errorf("ERR Append only file is disabled")
+	}
+
+	if err := req.s.aof.Rewrite(); err != nil {
+		return nil, err
+	}
+
+	return "Background append only file rewriting started", nil
+}
+
+// loadAof replays the append only file through the router and opens it for appending
+func (s *RedisServer) loadAof() error {
+	var (
+		start  = time.Now()
+		config = s.config.PersistenceConfig
+		client = s.newInternalRequest(io.Discard)
+	)
+
+	config.Loading.Store(true)
+	manifest, n, err := persistence.LoadAof(config, func(r *bufio.Reader) error {
+		return resp.NewRdb(s.db).Load(r)
+	}, func(args *resp.Array) error {
+		return s.replay(client, args)
+	})
+	config.Loading.Store(false)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Printf("DB loaded from append only file: %d commands in %s", n, time.Since(start))
+	aof, err := persistence.OpenAof(config, manifest, s.snapshot)
+	if err != nil {
+		return err
+	}
+
+	s.aof = aof
+	return nil
+}
+
+// snapshot copies content of every db ordered by index
+func (s *RedisServer) snapshot() []*storage.DbSnapshot {
+	dbs := make([]*storage.DbSnapshot, 0, 16)
+	s.db.Range(func(_, v any) bool {
+		dbs = append(dbs, v.(*storage.RedisDataTypes).Snapshot())
+		return true
+	})
+
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].Index < dbs[j].Index
+	})
+
+	return dbs
+}
+
+// replay executes command on behalf of the internal client, errors returned by handlers are only logged
+// as they are part of the normal command flow, e.g. SET against a key holding a stream
+func (s *RedisServer) replay(client *RESPRequest, args *resp.Array) error {
+	handler, err := s.router.ResolveRequest(args)
+	if err != nil {
+		return err
+	}
+
+	if err = s.execute(client, handler, args); err != nil {
+		s.logger.Printf("Error replaying %s: %s", client.Command, err)
+	}
+
+	return nil
+}
+
+func (s *RedisServer) execute(client *RESPRequest, handler Handler, args *resp.Array) (err error) {
+	if client.Command, err = s.router.getCommand(&args.A); err != nil {
+		return err
+	}
+
+	args.A = args.A[1:]
+	client.Args = args
+	client.skipPropagation = false
+	if client.multi != nil && !isTransactionCommand(client.Command) {
+		return client.queue(s.router, handler)
+	}
+
+	_, err = handler.HandleResp(context.Background(), client)
+	return err
+}
@@ -0,0 +1,430 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/cluster"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HandleCluster handles CLUSTER subcommands of the node in cluster mode
+func HandleCluster(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	c := req.s.cluster
+	if c == nil {
+		return nil, fmt.Errorf("ERR This instance has cluster support disabled")
+	}
+
+	args := make([]string, 0, len(req.Args.A))
+	for _, arg := range req.Args.A {
+		b, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+
+		args = append(args, string(b.S))
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'cluster' command")
+	}
+
+	sub := strings.ToUpper(args[0])
+	wrongArgs := fmt.Errorf("ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(args[0]))
+	switch sub {
+	case "MYID":
+		return resp.BulkString{S: []byte(c.Myself().ID)}, nil
+	case "INFO":
+		return resp.BulkString{S: []byte(c.Info())}, nil
+	case "KEYSLOT":
+		if len(args) != 2 {
+			return nil, wrongArgs
+		}
+
+		return cluster.KeySlot(args[1]), nil
+	case "COUNTKEYSINSLOT":
+		if len(args) != 2 {
+			return nil, wrongArgs
+		}
+
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return len(keysInSlot(req, slot, -1)), nil
+	case "GETKEYSINSLOT":
+		if len(args) != 3 {
+			return nil, wrongArgs
+		}
+
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := strconv.Atoi(args[2])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("ERR Invalid number of keys")
+		}
+
+		keys := resp.Array{A: make([]resp.Marshaller, 0)}
+		for _, key := range keysInSlot(req, slot, count) {
+			keys.Append(resp.BulkString{S: []byte(key)})
+		}
+
+		return keys, nil
+	case "ADDSLOTS":
+		if len(args) < 2 {
+			return nil, wrongArgs
+		}
+
+		slots := make([]int, 0, len(args)-1)
+		seen := make(map[int]bool, len(args)-1)
+		for _, arg := range args[1:] {
+			slot, err := parseSlot(arg)
+			if err != nil {
+				return nil, err
+			}
+
+			if seen[slot] {
+				return nil, fmt.Errorf("ERR Slot %d specified multiple times", slot)
+			}
+
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+
+		if err := c.AddSlots(slots); err != nil {
+			return nil, err
+		}
+
+		return "OK", nil
+	case "MEET":
+		if len(args) != 3 && len(args) != 4 {
+			return nil, wrongArgs
+		}
+
+		port, err := strconv.ParseUint(args[2], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("ERR Invalid base port specified: %s", args[2])
+		}
+
+		cport := port + cluster.BUS_PORT_OFFSET
+		if len(args) == 4 {
+			if cport, err = strconv.ParseUint(args[3], 10, 16); err != nil {
+				return nil, fmt.Errorf("ERR Invalid bus port specified: %s", args[3])
+			}
+		}
+
+		if err := c.Meet(args[1], int(port), int(cport)); err != nil {
+			return nil, fmt.Errorf("ERR Invalid node address specified: %s:%s", args[1], args[2])
+		}
+
+		return "OK", nil
+	case "SETSLOT":
+		if len(args) < 3 {
+			return nil, wrongArgs
+		}
+
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		state := strings.ToUpper(args[2])
+		if state == "STABLE" {
+			if len(args) != 3 {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+
+			c.SetSlotStable(slot)
+			return "OK", nil
+		}
+
+		if len(args) != 4 {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+
+		switch state {
+		case "MIGRATING":
+			err = c.SetSlotMigrating(slot, args[3])
+		case "IMPORTING":
+			err = c.SetSlotImporting(slot, args[3])
+		case "NODE":
+			err = c.SetSlotNode(slot, args[3], len(keysInSlot(req, slot, 1)) == 0)
+		default:
+			return nil, fmt.Errorf("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return "OK", nil
+	case "REPLICATE":
+		if len(args) != 2 {
+			return nil, wrongArgs
+		}
+
+		if err := c.Replicate(args[1]); err != nil {
+			return nil, err
+		}
+
+		return "OK", nil
+	case "REPLICAS", "SLAVES":
+		if len(args) != 2 {
+			return nil, wrongArgs
+		}
+
+		node := c.NodeByID(args[1])
+		if node == nil {
+			return nil, fmt.Errorf("ERR Unknown node %s", args[1])
+		}
+
+		if !c.Describe(node).Master {
+			return nil, fmt.Errorf("ERR The specified node is not a master")
+		}
+
+		replicas := resp.Array{A: make([]resp.Marshaller, 0)}
+		for _, replica := range c.Replicas(node) {
+			replicas.Append(resp.BulkString{S: []byte(c.NodesLine(replica))})
+		}
+
+		return replicas, nil
+	case "COUNT-FAILURE-REPORTS":
+		if len(args) != 2 {
+			return nil, wrongArgs
+		}
+
+		node := c.NodeByID(args[1])
+		if node == nil {
+			return nil, fmt.Errorf("ERR Unknown node %s", args[1])
+		}
+
+		return c.FailureReports(node), nil
+	case "SLOTS":
+		slots := resp.Array{A: make([]resp.Marshaller, 0)}
+		for _, r := range c.Ranges() {
+			entry := resp.Array{A: []resp.Marshaller{
+				resp.SimpleInt{I: int64(r.Start)},
+				resp.SimpleInt{I: int64(r.End)},
+			}}
+
+			for _, node := range append([]*cluster.Node{r.Node}, c.Replicas(r.Node)...) {
+				entry.Append(resp.Array{A: []resp.Marshaller{
+					resp.BulkString{S: []byte(node.IP)},
+					resp.SimpleInt{I: int64(node.Port)},
+					resp.BulkString{S: []byte(node.ID)},
+				}})
+			}
+
+			slots.Append(entry)
+		}
+
+		return slots, nil
+	case "SHARDS":
+		shards := resp.Array{A: make([]resp.Marshaller, 0)}
+		for _, master := range c.Nodes() {
+			if !c.Describe(master).Master {
+				continue
+			}
+
+			slots := resp.Array{A: make([]resp.Marshaller, 0)}
+			for _, r := range c.NodeRanges(master) {
+				slots.Append(resp.SimpleInt{I: int64(r.Start)})
+				slots.Append(resp.SimpleInt{I: int64(r.End)})
+			}
+
+			nodes := resp.Array{A: make([]resp.Marshaller, 0)}
+			for _, node := range append([]*cluster.Node{master}, c.Replicas(master)...) {
+				info := c.Describe(node)
+				role, health := "master", "online"
+				if !info.Master {
+					role = "replica"
+				}
+
+				if info.Failing {
+					health = "fail"
+				}
+
+				nodes.Append(resp.Array{A: []resp.Marshaller{
+					resp.BulkString{S: []byte("id")}, resp.BulkString{S: []byte(node.ID)},
+					resp.BulkString{S: []byte("port")}, resp.SimpleInt{I: int64(node.Port)},
+					resp.BulkString{S: []byte("ip")}, resp.BulkString{S: []byte(node.IP)},
+					resp.BulkString{S: []byte("endpoint")}, resp.BulkString{S: []byte(node.IP)},
+					resp.BulkString{S: []byte("role")}, resp.BulkString{S: []byte(role)},
+					resp.BulkString{S: []byte("replication-offset")}, resp.SimpleInt{I: int64(info.Offset)},
+					resp.BulkString{S: []byte("health")}, resp.BulkString{S: []byte(health)},
+				}})
+			}
+
+			shards.Append(resp.Array{A: []resp.Marshaller{
+				resp.BulkString{S: []byte("slots")},
+				slots,
+				resp.BulkString{S: []byte("nodes")},
+				nodes,
+			}})
+		}
+
+		return shards, nil
+	case "NODES":
+		var b strings.Builder
+		for _, node := range c.Nodes() {
+			b.WriteString(c.NodesLine(node))
+			b.WriteByte('\n')
+		}
+
+		return resp.BulkString{S: []byte(b.String())}, nil
+	}
+
+	return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", args[0])
+}
+
+func parseSlot(arg string) (int, error) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= cluster.SLOTS {
+		return 0, fmt.Errorf("ERR Invalid or out of range slot")
+	}
+
+	return slot, nil
+}
+
+// keysInSlot returns up to count keys of the slot, all of them when count is negative
+func keysInSlot(req *RESPRequest, slot, count int) []string {
+	keys := make([]string, 0)
+	for _, key := range req.Db.Keys() {
+		if cluster.KeySlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	if count >= 0 && len(keys) > count {
+		keys = keys[:count]
+	}
+
+	return keys
+}
+
+// clusterRedirect returns error when keys of the command can not be served by this node, i.e. they belong
+// to different slots or the slot is served by another node. Keys missing in the slot being migrated are
+// redirected with ASK, the node importing the slot serves them only to asking clients
+func (s *RedisServer) clusterRedirect(req *RESPRequest, keys []string, asking bool) error {
+	if s.cluster == nil || len(keys) == 0 {
+		return nil
+	}
+
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return fmt.Errorf("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	if !s.cluster.OK() {
+		return fmt.Errorf("CLUSTERDOWN The cluster is down")
+	}
+
+	owner, migrating, importing := s.cluster.SlotState(slot)
+	if owner == nil {
+		return fmt.Errorf("CLUSTERDOWN Hash slot not served")
+	}
+
+	myself := s.cluster.Myself()
+	if owner != myself {
+		migrating = nil
+	}
+
+	if migrating == nil && importing == nil {
+		if owner != myself {
+			return fmt.Errorf("MOVED %d %s", slot, owner.Addr())
+		}
+
+		return nil
+	}
+
+	missing := 0
+	for _, key := range keys {
+		if !keyExists(req.Db, key) {
+			missing++
+		}
+	}
+
+	switch {
+	case migrating != nil && missing > 0 && missing < len(keys):
+		return fmt.Errorf("TRYAGAIN Multiple keys request during rehashing of slot")
+	case migrating != nil && missing > 0:
+		return fmt.Errorf("ASK %d %s", slot, migrating.Addr())
+	case importing != nil && asking && len(keys) > 1 && missing > 0:
+		return fmt.Errorf("TRYAGAIN Multiple keys request during rehashing of slot")
+	case importing != nil && asking:
+		return nil
+	case owner != myself:
+		return fmt.Errorf("MOVED %d %s", slot, owner.Addr())
+	}
+
+	return nil
+}
+
+func keyExists(db *storage.RedisDataTypes, key string) bool {
+	switch db.GetType(key) {
+	case storage.NONE:
+		return false
+	case storage.STRINGS:
+		_, ok, _ := db.GetStorage(storage.STRINGS).(storage.StringsStorage).Get(key)
+		return ok
+	}
+
+	return true
+}
+
+// HandleAsking lets the next command access the slot being imported by this node
+func HandleAsking(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if req.s.cluster == nil {
+		return nil, fmt.Errorf("ERR This instance has cluster support disabled")
+	}
+
+	if len(req.Args.A) != 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'asking' command")
+	}
+
+	req.asking = true
+	return "OK", nil
+}
+
+// clusterReplication lets the cluster drive replication of the server
+type clusterReplication struct {
+	s *RedisServer
+}
+
+func (r clusterReplication) Offset() uint64 {
+	return r.s.config.ReplicationConfig.MasterReplOffset.Load()
+}
+
+func (r clusterReplication) ReplicateTo(addr string) {
+	r.s.role.Lock()
+	defer r.s.role.Unlock()
+	if addr == r.s.config.ReplicaOf() {
+		return
+	}
+
+	r.s.stopReplication()
+	r.s.config.SetReplicaOf(addr)
+	go r.s.startReplication(addr, false)
+}
+
+func (r clusterReplication) Promote() {
+	r.s.role.Lock()
+	defer r.s.role.Unlock()
+	if r.s.config.ReplicaOf() != "" {
+		r.s.promote()
+	}
+}
+
+func (r clusterReplication) Deliver(channel, message string, shard bool) {
+	r.s.pubsub.publish(channel, message, shard)
+}
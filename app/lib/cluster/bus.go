@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// message types of the cluster bus
+const (
+	MSG_PING uint16 = iota
+	MSG_PONG
+	MSG_MEET
+	MSG_FAIL
+	MSG_UPDATE
+	MSG_FAILOVER_AUTH_REQUEST
+	MSG_FAILOVER_AUTH_ACK
+	MSG_PUBLISH
+	MSG_PUBLISHSHARD
+)
+
+const (
+	BUS_VERSION = 1
+	NODE_ID_LEN = 40
+	NET_IP_LEN  = 46
+	// MAX_GOSSIP limits the number of gossip sections of a single message
+	MAX_GOSSIP = 1024
+	// MAX_PUBLISH limits the length of the channel and the message of PUBLISH together
+	MAX_PUBLISH = 512 << 20
+)
+
+var busSignature = [4]byte{'R', 'C', 'm', 'b'}
+
+type slotBitmap [SLOTS / 8]byte
+
+func (b *slotBitmap) set(slot int) {
+	b[slot/8] |= 1 << (slot % 8)
+}
+
+func (b *slotBitmap) has(slot int) bool {
+	return b[slot/8]&(1<<(slot%8)) != 0
+}
+
+// header starts every message of the bus, it describes the sender, all numbers are big endian
+type header struct {
+	Signature    [4]byte
+	TotLen       uint32
+	Version      uint16
+	Type         uint16
+	Count        uint16
+	CurrentEpoch uint64
+	// ConfigEpoch and Slots of the master, replicas send the ones of their master
+	ConfigEpoch uint64
+	Offset      uint64
+	Sender      [NODE_ID_LEN]byte
+	Slots       slotBitmap
+	// Master is the id of the master of the replica, zeroed for master
+	Master [NODE_ID_LEN]byte
+	IP     [NET_IP_LEN]byte
+	Port   uint16
+	CPort  uint16
+	Flags  uint16
+	State  uint8
+}
+
+// gossip is what the sender knows about another node, PING, PONG and MEET carry some of them
+type gossip struct {
+	Node [NODE_ID_LEN]byte
+	// PingSent and PongReceived are unix seconds
+	PingSent     uint32
+	PongReceived uint32
+	IP           [NET_IP_LEN]byte
+	Port         uint16
+	CPort        uint16
+	Flags        uint16
+}
+
+// failBody of FAIL names the failed node
+type failBody struct {
+	Node [NODE_ID_LEN]byte
+}
+
+// updateBody of UPDATE tells the node with stale config the new owner of its slots
+type updateBody struct {
+	ConfigEpoch uint64
+	Node        [NODE_ID_LEN]byte
+	Slots       slotBitmap
+}
+
+// publishBody of PUBLISH and PUBLISHSHARD is followed by the channel and the message
+type publishBody struct {
+	ChannelLen uint32
+	MessageLen uint32
+}
+
+type message struct {
+	header
+	gossip  []gossip
+	fail    failBody
+	update  updateBody
+	publish publishBody
+	channel []byte
+	payload []byte
+}
+
+var (
+	headerSize  = binary.Size(header{})
+	gossipSize  = binary.Size(gossip{})
+	publishSize = binary.Size(publishBody{})
+)
+
+func (m *message) MarshalBinary() ([]byte, error) {
+	var body interface{}
+	switch m.Type {
+	case MSG_PING, MSG_PONG, MSG_MEET:
+		m.Count = uint16(len(m.gossip))
+		body = m.gossip
+	case MSG_FAIL:
+		body = &m.fail
+	case MSG_UPDATE:
+		body = &m.update
+	case MSG_PUBLISH, MSG_PUBLISHSHARD:
+		m.publish.ChannelLen, m.publish.MessageLen = uint32(len(m.channel)), uint32(len(m.payload))
+		body = &m.publish
+	}
+
+	m.Signature = busSignature
+	m.Version = BUS_VERSION
+	m.TotLen = uint32(headerSize + len(m.channel) + len(m.payload))
+	if body != nil {
+		m.TotLen += uint32(binary.Size(body))
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, m.TotLen))
+	if err := binary.Write(b, binary.BigEndian, &m.header); err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		if err := binary.Write(b, binary.BigEndian, body); err != nil {
+			return nil, err
+		}
+	}
+
+	b.Write(m.channel)
+	b.Write(m.payload)
+	return b.Bytes(), nil
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	m := &message{}
+	if err := binary.Read(r, binary.BigEndian, &m.header); err != nil {
+		return nil, err
+	}
+
+	if m.Signature != busSignature || m.Version != BUS_VERSION {
+		return nil, fmt.Errorf("unexpected message signature %q version %d", m.Signature, m.Version)
+	}
+
+	maxLen := headerSize + MAX_GOSSIP*gossipSize
+	if m.Type == MSG_PUBLISH || m.Type == MSG_PUBLISHSHARD {
+		maxLen = headerSize + publishSize + MAX_PUBLISH
+	}
+
+	if m.Count > MAX_GOSSIP || int(m.TotLen) < headerSize || int(m.TotLen) > maxLen {
+		return nil, fmt.Errorf("invalid message length %d", m.TotLen)
+	}
+
+	body := make([]byte, int(m.TotLen)-headerSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	var (
+		br  = bytes.NewReader(body)
+		err error
+	)
+
+	switch m.Type {
+	case MSG_PING, MSG_PONG, MSG_MEET:
+		if len(body) != int(m.Count)*gossipSize {
+			return nil, fmt.Errorf("invalid length %d of %d gossip sections", len(body), m.Count)
+		}
+
+		m.gossip = make([]gossip, m.Count)
+		err = binary.Read(br, binary.BigEndian, m.gossip)
+	case MSG_FAIL:
+		err = binary.Read(br, binary.BigEndian, &m.fail)
+	case MSG_UPDATE:
+		err = binary.Read(br, binary.BigEndian, &m.update)
+	case MSG_PUBLISH, MSG_PUBLISHSHARD:
+		if err = binary.Read(br, binary.BigEndian, &m.publish); err != nil {
+			break
+		}
+
+		if br.Len() != int(m.publish.ChannelLen)+int(m.publish.MessageLen) {
+			return nil, fmt.Errorf("invalid length %d of published message", len(body))
+		}
+
+		data := body[publishSize:]
+		m.channel, m.payload = data[:m.publish.ChannelLen], data[m.publish.ChannelLen:]
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid body of message type %d: %w", m.Type, err)
+	}
+
+	return m, nil
+}
+
+// nodeID returns the id stored in fixed size field, empty if the field is zeroed
+func nodeID(b [NODE_ID_LEN]byte) string {
+	return string(bytes.TrimRight(b[:], "\x00"))
+}
+
+func ipString(b [NET_IP_LEN]byte) string {
+	return string(bytes.TrimRight(b[:], "\x00"))
+}
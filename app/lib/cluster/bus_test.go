@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	ping := &message{}
+	ping.Type = MSG_PING
+	ping.CurrentEpoch = 7
+	ping.Slots.set(16383)
+	copy(ping.Sender[:], NewNodeID())
+	g := gossip{Port: 7001, CPort: 17001, Flags: FLAG_MASTER | FLAG_PFAIL}
+	copy(g.Node[:], NewNodeID())
+	ping.gossip = []gossip{g, g}
+
+	update := &message{}
+	update.Type = MSG_UPDATE
+	update.update.ConfigEpoch = 3
+	update.update.Slots.set(1)
+
+	publish := &message{}
+	publish.Type = MSG_PUBLISHSHARD
+	publish.channel, publish.payload = []byte("news"), []byte("hello")
+
+	for _, m := range []*message{ping, update, publish} {
+		b, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+
+		if len(b) != int(m.TotLen) {
+			t.Fatalf("expected %d bytes, got %d", m.TotLen, len(b))
+		}
+
+		decoded, err := readMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+
+		if !reflect.DeepEqual(decoded, m) {
+			t.Errorf("expected %+v, got %+v", m.header, decoded.header)
+		}
+	}
+
+	b, _ := ping.MarshalBinary()
+	b[0] = 'X'
+	if _, err := readMessage(bytes.NewReader(b)); err == nil {
+		t.Errorf("expected invalid signature to fail")
+	}
+}
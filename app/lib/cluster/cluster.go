@@ -0,0 +1,533 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// CLUSTER_TICK is the period of pinging nodes, failure detection and replica failover
+	CLUSTER_TICK = 100 * time.Millisecond
+)
+
+// BUS_PORT_OFFSET is added to the client port to get the cluster bus port of the node
+const BUS_PORT_OFFSET = 10000
+
+type Config struct {
+	Enabled bool
+	// AnnounceIP is the address of the node given to clients in redirects and to other nodes
+	AnnounceIP string
+	// NodeTimeout is the time without reply to PING after which the node is considered failing
+	NodeTimeout time.Duration
+	// ConfigFile persists the cluster state across restarts, empty disables persistence
+	ConfigFile string
+}
+
+// Replication is the part of the server driven by the cluster
+type Replication interface {
+	// Offset returns the replication offset ranking replicas in failover election
+	Offset() uint64
+	// ReplicateTo makes the server replica of the master at addr
+	ReplicateTo(addr string)
+	// Promote turns the replica into master
+	Promote()
+	// Deliver passes the message published on another node to the subscribers of the channel
+	Deliver(channel, message string, shard bool)
+}
+
+// node flags, sent over the bus and saved in the config file
+const (
+	FLAG_MYSELF uint16 = 1 << iota
+	FLAG_MASTER
+	FLAG_SLAVE
+	FLAG_PFAIL
+	FLAG_FAIL
+)
+
+var flagNames = []struct {
+	flag uint16
+	name string
+}{
+	{FLAG_MYSELF, "myself"},
+	{FLAG_MASTER, "master"},
+	{FLAG_SLAVE, "slave"},
+	{FLAG_PFAIL, "fail?"},
+	{FLAG_FAIL, "fail"},
+}
+
+type Node struct {
+	ID    string
+	IP    string
+	Port  int
+	CPort int
+	// fields below are guarded by Cluster.mu
+	flags uint16
+	// master is nil for masters
+	master      *Node
+	configEpoch uint64
+	// offset is the replication offset reported by the node
+	offset       uint64
+	pingSent     time.Time
+	pongReceived time.Time
+	failTime     time.Time
+	// votedTime is the last time a replica of this master got our vote
+	votedTime time.Time
+	// failReports are the times masters reported the node failing, by their id
+	failReports map[string]time.Time
+	link        *link
+}
+
+func newNode(id, ip string, port, cport int) *Node {
+	return &Node{ID: id, IP: ip, Port: port, CPort: cport, flags: FLAG_MASTER, failReports: make(map[string]time.Time)}
+}
+
+func (n *Node) Addr() string {
+	return net.JoinHostPort(n.IP, strconv.Itoa(n.Port))
+}
+
+// NodeInfo is the state of the node at the time it was described
+type NodeInfo struct {
+	Master bool
+	// MasterID is set for replicas with known master
+	MasterID string
+	Failing  bool
+	Offset   uint64
+}
+
+// Cluster is the view of the node on the cluster, i.e. known nodes and owners of the slots, kept up to date
+// by gossip over the cluster bus
+type Cluster struct {
+	mu     sync.RWMutex
+	config *Config
+	logger *log.Logger
+	repl   Replication
+	myself *Node
+	nodes  map[string]*Node
+	slots  [SLOTS]*Node
+	// slots of this node being moved to other nodes and slots being moved to this node
+	migrating [SLOTS]*Node
+	importing [SLOTS]*Node
+	// currentEpoch is the greatest epoch seen in the cluster, elections are held in new epochs
+	currentEpoch  uint64
+	lastVoteEpoch uint64
+	// state of the election of this replica, the election starts at failoverAuthTime
+	failoverAuthTime  time.Time
+	failoverAuthSent  bool
+	failoverAuthCount int
+	failoverAuthEpoch uint64
+	ok                bool
+	// dirty is set when the state has to be saved to the config file
+	dirty bool
+	// actions call into the server, so they run once mu is unlocked
+	actions   []func(Replication)
+	listener  net.Listener
+	inbound   map[*link]bool
+	rand      *mrand.Rand
+	close     chan struct{}
+	closeOnce sync.Once
+}
+
+func New(config *Config, port int) *Cluster {
+	myself := newNode(NewNodeID(), config.AnnounceIP, port, port+BUS_PORT_OFFSET)
+	myself.flags |= FLAG_MYSELF
+	return &Cluster{
+		config:  config,
+		logger:  log.New(os.Stdout, fmt.Sprintf("cluster %d: ", port), log.Lmicroseconds|log.Lshortfile),
+		myself:  myself,
+		nodes:   map[string]*Node{myself.ID: myself},
+		inbound: make(map[*link]bool),
+		rand:    mrand.New(mrand.NewSource(time.Now().UnixNano())),
+		close:   make(chan struct{}),
+	}
+}
+
+// NewNodeID returns random 40 characters long hex id
+func NewNodeID() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// unlock saves the dirty state, releases mu and runs actions queued while it was held
+func (c *Cluster) unlock() {
+	if c.dirty {
+		c.save()
+	}
+
+	c.updateState()
+	actions, repl := c.actions, c.repl
+	c.actions = nil
+	c.mu.Unlock()
+	if repl == nil {
+		return
+	}
+
+	for _, action := range actions {
+		action(repl)
+	}
+}
+
+// updateState considers the cluster ok when all the slots are served by reachable masters
+func (c *Cluster) updateState() {
+	for _, owner := range c.slots {
+		if owner == nil || owner.flags&FLAG_FAIL != 0 {
+			c.ok = false
+			return
+		}
+	}
+
+	c.ok = true
+}
+
+func (c *Cluster) OK() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ok
+}
+
+func (c *Cluster) Myself() *Node {
+	return c.myself
+}
+
+// MasterAddr returns the address of the master of this node, empty for master
+func (c *Cluster) MasterAddr() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.myself.master == nil {
+		return ""
+	}
+
+	return c.myself.master.Addr()
+}
+
+// Owner returns node serving the slot, nil if the slot is not assigned
+func (c *Cluster) Owner(slot int) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[slot]
+}
+
+// AddSlots assigns the slots to this node, none is assigned if any of them is already busy
+func (c *Cluster) AddSlots(slots []int) error {
+	c.mu.Lock()
+	defer c.unlock()
+	if c.myself.flags&FLAG_SLAVE != 0 {
+		return fmt.Errorf("ERR Please use CLUSTER ADDSLOTS only with masters")
+	}
+
+	for _, slot := range slots {
+		if c.slots[slot] != nil {
+			return fmt.Errorf("ERR Slot %d is already busy", slot)
+		}
+	}
+
+	for _, slot := range slots {
+		c.slots[slot] = c.myself
+	}
+
+	c.dirty = true
+	return nil
+}
+
+// Replicate makes this empty master replica of the master with the id
+func (c *Cluster) Replicate(id string) error {
+	c.mu.Lock()
+	defer c.unlock()
+	node := c.nodes[id]
+	if node == nil {
+		return fmt.Errorf("ERR Unknown node %s", id)
+	}
+
+	if node == c.myself {
+		return fmt.Errorf("ERR Can't replicate myself")
+	}
+
+	if node.flags&FLAG_SLAVE != 0 {
+		return fmt.Errorf("ERR I can only replicate a master, not a replica.")
+	}
+
+	if c.myself.flags&FLAG_MASTER != 0 && c.nodeSlots(c.myself) > 0 {
+		return fmt.Errorf("ERR To set a master the node must be empty and without assigned slots.")
+	}
+
+	c.setMaster(node)
+	return nil
+}
+
+// setMaster turns this node into replica of the master, the server follows once mu is unlocked
+func (c *Cluster) setMaster(master *Node) {
+	c.myself.flags = c.myself.flags&^FLAG_MASTER | FLAG_SLAVE
+	c.myself.master = master
+	c.migrating, c.importing = [SLOTS]*Node{}, [SLOTS]*Node{}
+	c.resetElection()
+	c.dirty = true
+	addr := master.Addr()
+	c.logger.Printf("Replicating master %s at %s", master.ID, addr)
+	c.actions = append(c.actions, func(r Replication) {
+		r.ReplicateTo(addr)
+	})
+}
+
+// NodeByID returns known node with the id
+func (c *Cluster) NodeByID(id string) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodes[id]
+}
+
+// Nodes returns known nodes ordered by id
+func (c *Cluster) Nodes() []*Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sortedNodes()
+}
+
+func (c *Cluster) sortedNodes() []*Node {
+	nodes := make([]*Node, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+
+	return nodes
+}
+
+// Replicas returns known replicas of the master ordered by id
+func (c *Cluster) Replicas(master *Node) []*Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	replicas := make([]*Node, 0)
+	for _, node := range c.sortedNodes() {
+		if node.master == master && node.flags&FLAG_SLAVE != 0 {
+			replicas = append(replicas, node)
+		}
+	}
+
+	return replicas
+}
+
+// Describe returns the state of the node as seen by this one
+func (c *Cluster) Describe(node *Node) NodeInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	info := NodeInfo{
+		Master:  node.flags&FLAG_MASTER != 0,
+		Failing: node.flags&(FLAG_PFAIL|FLAG_FAIL) != 0,
+		Offset:  node.offset,
+	}
+
+	if node.master != nil {
+		info.MasterID = node.master.ID
+	}
+
+	if node == c.myself && c.repl != nil {
+		info.Offset = c.repl.Offset()
+	}
+
+	return info
+}
+
+// FailureReports returns the number of masters currently reporting the node failing
+func (c *Cluster) FailureReports(node *Node) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(node.failReports)
+}
+
+// SlotRange is inclusive range of slots served by the node
+type SlotRange struct {
+	Start int
+	End   int
+	Node  *Node
+}
+
+// Ranges returns ranges of consecutive slots with the same owner, unassigned slots are skipped
+func (c *Cluster) Ranges() []SlotRange {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ranges()
+}
+
+func (c *Cluster) ranges() []SlotRange {
+	ranges := make([]SlotRange, 0)
+	for slot := 0; slot < SLOTS; slot++ {
+		node := c.slots[slot]
+		if node == nil {
+			continue
+		}
+
+		if n := len(ranges); n > 0 && ranges[n-1].Node == node && ranges[n-1].End == slot-1 {
+			ranges[n-1].End = slot
+			continue
+		}
+
+		ranges = append(ranges, SlotRange{Start: slot, End: slot, Node: node})
+	}
+
+	return ranges
+}
+
+// NodeRanges returns ranges served by the node
+func (c *Cluster) NodeRanges(node *Node) []SlotRange {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodeRanges(node)
+}
+
+func (c *Cluster) nodeRanges(node *Node) []SlotRange {
+	ranges := make([]SlotRange, 0)
+	for _, r := range c.ranges() {
+		if r.Node == node {
+			ranges = append(ranges, r)
+		}
+	}
+
+	return ranges
+}
+
+func (c *Cluster) nodeSlots(node *Node) int {
+	n := 0
+	for _, owner := range c.slots {
+		if owner == node {
+			n++
+		}
+	}
+
+	return n
+}
+
+// size is the number of masters serving slots, majority of them decides failures and elections
+func (c *Cluster) size() int {
+	masters := make(map[*Node]bool)
+	for _, owner := range c.slots {
+		if owner != nil {
+			masters[owner] = true
+		}
+	}
+
+	return len(masters)
+}
+
+// nodeEpoch returns config epoch of the node, replicas report the epoch of their master
+func nodeEpoch(node *Node) uint64 {
+	if node.master != nil {
+		return node.master.configEpoch
+	}
+
+	return node.configEpoch
+}
+
+// Info returns the state of the cluster in CLUSTER INFO format
+func (c *Cluster) Info() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	assigned, ok, pfail, fail := 0, 0, 0, 0
+	for _, owner := range c.slots {
+		if owner == nil {
+			continue
+		}
+
+		assigned++
+		switch {
+		case owner.flags&FLAG_FAIL != 0:
+			fail++
+		case owner.flags&FLAG_PFAIL != 0:
+			pfail++
+		default:
+			ok++
+		}
+	}
+
+	state := "fail"
+	if c.ok {
+		state = "ok"
+	}
+
+	return fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:%d\r\ncluster_slots_fail:%d\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\n"+
+		"cluster_current_epoch:%d\r\ncluster_my_epoch:%d\r\n", state, assigned, ok, pfail, fail, len(c.nodes), c.size(),
+		c.currentEpoch, nodeEpoch(c.myself))
+}
+
+// NodesLine returns description of the node in CLUSTER NODES format
+func (c *Cluster) NodesLine(node *Node) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodesLine(node)
+}
+
+func (c *Cluster) nodesLine(node *Node) string {
+	master := "-"
+	if node.master != nil {
+		master = node.master.ID
+	}
+
+	link := "disconnected"
+	if node == c.myself || (node.link != nil && node.link.connected.Load()) {
+		link = "connected"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s:%d@%d %s %s %d %d %d %s", node.ID, node.IP, node.Port, node.CPort, flagsString(node.flags),
+		master, unixMilli(node.pingSent), unixMilli(node.pongReceived), nodeEpoch(node), link)
+	for _, r := range c.nodeRanges(node) {
+		if r.Start == r.End {
+			fmt.Fprintf(&b, " %d", r.Start)
+		} else {
+			fmt.Fprintf(&b, " %d-%d", r.Start, r.End)
+		}
+	}
+
+	if node != c.myself {
+		return b.String()
+	}
+
+	for slot := 0; slot < SLOTS; slot++ {
+		if to := c.migrating[slot]; to != nil {
+			fmt.Fprintf(&b, " [%d->-%s]", slot, to.ID)
+		} else if from := c.importing[slot]; from != nil {
+			fmt.Fprintf(&b, " [%d-<-%s]", slot, from.ID)
+		}
+	}
+
+	return b.String()
+}
+
+func flagsString(flags uint16) string {
+	names := make([]string, 0, 3)
+	for _, f := range flagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "noflags"
+	}
+
+	return strings.Join(names, ",")
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixMilli()
+}
@@ -0,0 +1,208 @@
+package cluster
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeySlot(t *testing.T) {
+	if crc := CRC16([]byte("123456789")); crc != 0x31c3 {
+		t.Errorf("expected crc 0x31c3, got %#x", crc)
+	}
+
+	for key, slot := range map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": KeySlot("user1000"),
+		"{user1000}.followers": KeySlot("user1000"),
+		"foo{}{bar}":           KeySlot("foo{}{bar}"),
+		"foo{{bar}}zap":        KeySlot("{bar"),
+		"foo{bar}{zap}":        KeySlot("bar"),
+		"":                     0,
+	} {
+		if got := KeySlot(key); got != slot {
+			t.Errorf("expected slot %d of %q, got %d", slot, key, got)
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	c := New(&Config{AnnounceIP: "127.0.0.1"}, 7000)
+	if err := c.AddSlots([]int{0, 1, 2, 5}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if err := c.AddSlots([]int{3, 2}); err == nil || c.Owner(3) != nil {
+		t.Errorf("expected busy slot to fail the whole command, got %v", err)
+	}
+
+	other := newNode(NewNodeID(), "127.0.0.1", 7001, 17001)
+	c.nodes[other.ID] = other
+	c.updateSlots(other, bitmap(3, 4, 5), 0)
+
+	ranges := c.Ranges()
+	if len(ranges) != 3 || ranges[0].End != 2 || ranges[1].Node != other || ranges[1].End != 4 || ranges[2].Node != c.Myself() {
+		t.Errorf("unexpected ranges %v", ranges)
+	}
+
+	if line := c.NodesLine(c.Myself()); line != c.Myself().ID+" 127.0.0.1:7000@17000 myself,master - 0 0 0 connected 0-2 5" {
+		t.Errorf("unexpected nodes line %q", line)
+	}
+}
+
+func bitmap(slots ...int) slotBitmap {
+	var b slotBitmap
+	for _, slot := range slots {
+		b.set(slot)
+	}
+
+	return b
+}
+
+func TestUpdateSlots(t *testing.T) {
+	c := New(&Config{AnnounceIP: "127.0.0.1", NodeTimeout: time.Second}, 7000)
+	if err := c.AddSlots([]int{0, 1}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	other := newNode(NewNodeID(), "127.0.0.1", 7001, 17001)
+	c.nodes[other.ID] = other
+	c.updateSlots(other, bitmap(0, 1, 2), 0)
+	if c.Owner(0) != c.Myself() || c.Owner(2) != other {
+		t.Fatalf("expected slots of the same epoch to be kept")
+	}
+
+	c.mu.Lock()
+	c.updateSlots(other, bitmap(0, 1), 1)
+	c.mu.Unlock()
+	if c.Owner(0) != other || c.myself.master != other || c.myself.flags&FLAG_SLAVE == 0 || len(c.actions) != 1 {
+		t.Errorf("expected master that lost all slots to replicate their new owner")
+	}
+}
+
+func TestMarkFailing(t *testing.T) {
+	c := New(&Config{AnnounceIP: "127.0.0.1", NodeTimeout: time.Second}, 7000)
+	nodes := []*Node{c.myself}
+	for port := 7001; port < 7003; port++ {
+		node := newNode(NewNodeID(), "127.0.0.1", port, port+BUS_PORT_OFFSET)
+		c.nodes[node.ID] = node
+		nodes = append(nodes, node)
+	}
+
+	for i := range c.slots {
+		c.slots[i] = nodes[i%len(nodes)]
+	}
+
+	failing := nodes[2]
+	failing.flags |= FLAG_PFAIL
+	c.markFailing(failing)
+	if failing.flags&FLAG_FAIL != 0 {
+		t.Fatalf("expected single report not to reach quorum")
+	}
+
+	g := gossip{Flags: FLAG_MASTER | FLAG_PFAIL}
+	copy(g.Node[:], failing.ID)
+	c.processGossip(nodes[1], g)
+	if failing.flags&FLAG_FAIL == 0 || failing.flags&FLAG_PFAIL != 0 {
+		t.Errorf("expected majority of masters to mark node failing, got flags %s", flagsString(failing.flags))
+	}
+}
+
+func TestNodesConf(t *testing.T) {
+	config := &Config{AnnounceIP: "127.0.0.1", ConfigFile: filepath.Join(t.TempDir(), "nodes.conf")}
+	c := New(config, 7000)
+	if err := c.AddSlots([]int{0, 1, 2, 10}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	replica := newNode(NewNodeID(), "127.0.0.1", 7001, 17001)
+	replica.flags = FLAG_SLAVE | FLAG_FAIL
+	replica.master = c.myself
+	c.mu.Lock()
+	c.nodes[replica.ID] = replica
+	c.myself.configEpoch, c.currentEpoch, c.lastVoteEpoch = 3, 5, 4
+	c.save()
+	c.mu.Unlock()
+
+	loaded := New(config, 7000)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if loaded.Myself().ID != c.Myself().ID || loaded.currentEpoch != 5 || loaded.lastVoteEpoch != 4 {
+		t.Fatalf("expected node id and epochs to be restored")
+	}
+
+	for _, node := range c.Nodes() {
+		if a, b := c.NodesLine(node), loaded.NodesLine(loaded.NodeByID(node.ID)); a != b {
+			t.Errorf("expected %q, got %q", a, b)
+		}
+	}
+}
+
+func TestSetSlot(t *testing.T) {
+	config := &Config{AnnounceIP: "127.0.0.1", NodeTimeout: time.Second, ConfigFile: filepath.Join(t.TempDir(), "nodes.conf")}
+	c := New(config, 7000)
+	if err := c.AddSlots([]int{0}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	other := newNode(NewNodeID(), "127.0.0.1", 7001, 17001)
+	other.configEpoch, c.currentEpoch = 2, 2
+	c.nodes[other.ID] = other
+	c.slots[1] = other
+	for _, err := range []error{
+		c.SetSlotMigrating(1, other.ID),
+		c.SetSlotImporting(0, other.ID),
+		c.SetSlotMigrating(0, "unknown"),
+	} {
+		if err == nil {
+			t.Errorf("expected error")
+		}
+	}
+
+	if err := c.SetSlotMigrating(0, other.ID); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if err := c.SetSlotImporting(1, other.ID); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	loaded := New(config, 7000)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	line := c.NodesLine(c.Myself())
+	if !strings.HasSuffix(line, " 0 [0->-"+other.ID+"] [1-<-"+other.ID+"]") || loaded.NodesLine(loaded.Myself()) != line {
+		t.Errorf("expected slot states to be saved, got %q", line)
+	}
+
+	// the slot being imported is not taken back by the gossip of its owner
+	c.mu.Lock()
+	c.updateSlots(other, bitmap(1), 3)
+	c.mu.Unlock()
+	if err := c.SetSlotNode(0, other.ID, false); err == nil {
+		t.Errorf("expected slot with keys not to be assigned")
+	}
+
+	if err := c.SetSlotNode(0, other.ID, true); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if err := c.SetSlotNode(1, c.Myself().ID, true); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	owner, migrating, importing := c.SlotState(0)
+	if owner != other || migrating != nil || importing != nil {
+		t.Errorf("expected slot 0 to be assigned to %s", other.ID)
+	}
+
+	if owner, _, importing = c.SlotState(1); owner != c.Myself() || importing != nil || c.myself.configEpoch <= other.configEpoch {
+		t.Errorf("expected slot 1 to be assigned to myself with greater config epoch")
+	}
+}
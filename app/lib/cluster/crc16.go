@@ -0,0 +1,46 @@
+package cluster
+
+import "strings"
+
+// SLOTS is the number of hash slots the keyspace is split into
+const SLOTS = 16384
+
+// crc16Table is CRC16-CCITT (XMODEM) table, polynomial 0x1021
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}()
+
+func CRC16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+
+	return crc
+}
+
+// KeySlot returns hash slot of the key, only the part between the first { and the following } is hashed
+// when it is not empty, so related keys are able to share the slot
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(CRC16([]byte(key)) & (SLOTS - 1))
+}
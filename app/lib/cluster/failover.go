@@ -0,0 +1,255 @@
+package cluster
+
+import (
+	"time"
+)
+
+var (
+	// FAILOVER_DELAY is the minimal delay of the election once the master fails, so FAIL reaches all the masters
+	FAILOVER_DELAY = 500 * time.Millisecond
+	// FAILOVER_RANK_DELAY delays the election of less up to date replicas, per every replica ahead of them
+	FAILOVER_RANK_DELAY = time.Second
+	// FAILOVER_MIN_AUTH_TIMEOUT is the minimal time given to the election
+	FAILOVER_MIN_AUTH_TIMEOUT = 2 * time.Second
+)
+
+func (c *Cluster) cron() {
+	ticker := time.NewTicker(CLUSTER_TICK)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.close:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		c.tick(time.Now())
+		c.unlock()
+	}
+}
+
+// tick pings nodes not heard of for half of the node timeout and marks nodes that did not reply in time
+// as possibly failing
+func (c *Cluster) tick(now time.Time) {
+	timeout := c.config.NodeTimeout
+	for _, node := range c.nodes {
+		if node == c.myself {
+			continue
+		}
+
+		if node.link == nil {
+			c.connect(node)
+		}
+
+		if node.pingSent.IsZero() && now.Sub(node.pongReceived) > timeout/2 {
+			node.link.send(c.newPing(MSG_PING, node))
+			node.pingSent = now
+		}
+
+		if !node.pingSent.IsZero() && now.Sub(node.pingSent) > timeout && node.flags&(FLAG_PFAIL|FLAG_FAIL) == 0 {
+			node.flags |= FLAG_PFAIL
+			c.logger.Printf("*** NODE %s possibly failing", node.ID)
+		}
+
+		c.markFailing(node)
+	}
+
+	if c.myself.flags&FLAG_SLAVE != 0 {
+		c.failoverIfNeeded(now)
+	}
+}
+
+// markFailing turns PFAIL into FAIL once the majority of masters reports the node failing, all the nodes
+// are told about the failure
+func (c *Cluster) markFailing(node *Node) {
+	if node.flags&FLAG_PFAIL == 0 || node.flags&FLAG_FAIL != 0 {
+		return
+	}
+
+	now := time.Now()
+	reports := 0
+	for id, t := range node.failReports {
+		if now.Sub(t) > 2*c.config.NodeTimeout {
+			delete(node.failReports, id)
+			continue
+		}
+
+		reports++
+	}
+
+	if c.myself.flags&FLAG_MASTER != 0 {
+		reports++
+	}
+
+	if reports < c.size()/2+1 {
+		return
+	}
+
+	node.flags = node.flags&^FLAG_PFAIL | FLAG_FAIL
+	node.failTime = now
+	c.dirty = true
+	c.logger.Printf("Marking node %s as failing (quorum reached)", node.ID)
+	m := c.newMessage(MSG_FAIL)
+	copy(m.fail.Node[:], node.ID)
+	c.broadcast(m)
+}
+
+// clearFailure undoes failure of the node that replies again, master still serving slots is cleared only
+// when no replica took over in time
+func (c *Cluster) clearFailure(node *Node) {
+	if node.flags&FLAG_PFAIL != 0 {
+		node.flags &^= FLAG_PFAIL
+		c.dirty = true
+	}
+
+	if node.flags&FLAG_FAIL == 0 {
+		return
+	}
+
+	if node.flags&FLAG_SLAVE != 0 || c.nodeSlots(node) == 0 || time.Since(node.failTime) > 2*c.config.NodeTimeout {
+		node.flags &^= FLAG_FAIL
+		c.dirty = true
+		c.logger.Printf("Clear FAIL state for node %s: it is reachable again", node.ID)
+	}
+}
+
+func (c *Cluster) resetElection() {
+	c.failoverAuthTime = time.Time{}
+	c.failoverAuthSent = false
+	c.failoverAuthCount = 0
+}
+
+// failoverIfNeeded runs the election of this replica once its master fails, the replica asks all the masters
+// for their votes in a new epoch and takes over the slots of its master with the majority of them
+func (c *Cluster) failoverIfNeeded(now time.Time) {
+	master := c.myself.master
+	if master == nil || master.flags&FLAG_FAIL == 0 || c.nodeSlots(master) == 0 {
+		c.resetElection()
+		return
+	}
+
+	authTimeout := 2 * c.config.NodeTimeout
+	if authTimeout < FAILOVER_MIN_AUTH_TIMEOUT {
+		authTimeout = FAILOVER_MIN_AUTH_TIMEOUT
+	}
+
+	if c.failoverAuthTime.IsZero() || now.Sub(c.failoverAuthTime) > 2*authTimeout {
+		rank := c.rank()
+		c.failoverAuthTime = now.Add(FAILOVER_DELAY + time.Duration(c.rand.Int63n(int64(FAILOVER_DELAY))) +
+			time.Duration(rank)*FAILOVER_RANK_DELAY)
+		c.failoverAuthSent = false
+		c.failoverAuthCount = 0
+		c.logger.Printf("Start of election delayed for %s (rank #%d)", c.failoverAuthTime.Sub(now), rank)
+		return
+	}
+
+	if now.Before(c.failoverAuthTime) || now.Sub(c.failoverAuthTime) > authTimeout {
+		return
+	}
+
+	if !c.failoverAuthSent {
+		c.currentEpoch++
+		c.failoverAuthEpoch = c.currentEpoch
+		c.failoverAuthSent = true
+		c.save()
+		c.logger.Printf("Starting a failover election for epoch %d", c.currentEpoch)
+		c.broadcast(c.newMessage(MSG_FAILOVER_AUTH_REQUEST))
+		return
+	}
+
+	if c.failoverAuthCount < c.size()/2+1 {
+		return
+	}
+
+	c.takeOver(master)
+}
+
+// rank is the number of replicas of the same master with greater replication offset
+func (c *Cluster) rank() int {
+	var offset uint64
+	if c.repl != nil {
+		offset = c.repl.Offset()
+	}
+
+	rank := 0
+	for _, node := range c.nodes {
+		if node != c.myself && node.flags&FLAG_SLAVE != 0 && node.master == c.myself.master && node.offset > offset {
+			rank++
+		}
+	}
+
+	return rank
+}
+
+// takeOver promotes this replica to master of the slots of the failed master with the epoch of the election
+func (c *Cluster) takeOver(old *Node) {
+	c.myself.flags = c.myself.flags&^FLAG_SLAVE | FLAG_MASTER
+	c.myself.master = nil
+	if c.myself.configEpoch < c.failoverAuthEpoch {
+		c.myself.configEpoch = c.failoverAuthEpoch
+	}
+
+	for slot, owner := range c.slots {
+		if owner == old {
+			c.slots[slot] = c.myself
+		}
+	}
+
+	c.resetElection()
+	c.dirty = true
+	c.logger.Printf("Failover election won, promoted to master with config epoch %d", c.myself.configEpoch)
+	c.actions = append(c.actions, func(r Replication) {
+		r.Promote()
+	})
+
+	// the rest of the cluster learns the new owner of the slots right away
+	for _, node := range c.nodes {
+		if node != c.myself && node.link != nil {
+			node.link.send(c.newPing(MSG_PONG, node))
+		}
+	}
+}
+
+// vote grants the replica of failed master our vote, once per epoch and once per two node timeouts for
+// replicas of the same master
+func (c *Cluster) vote(sender *Node, m *message, l *link) {
+	if c.myself.flags&FLAG_MASTER == 0 || c.nodeSlots(c.myself) == 0 {
+		return
+	}
+
+	if m.CurrentEpoch < c.currentEpoch || c.lastVoteEpoch == c.currentEpoch {
+		return
+	}
+
+	master := c.nodes[nodeID(m.Master)]
+	if master == nil || master.flags&FLAG_FAIL == 0 {
+		c.logger.Printf("Failover auth denied to %s: its master is not failing", sender.ID)
+		return
+	}
+
+	if time.Since(master.votedTime) < 2*c.config.NodeTimeout {
+		return
+	}
+
+	for slot := 0; slot < SLOTS; slot++ {
+		if owner := c.slots[slot]; m.Slots.has(slot) && owner != nil && owner.configEpoch > m.ConfigEpoch {
+			c.logger.Printf("Failover auth denied to %s: slot %d has greater config epoch", sender.ID, slot)
+			return
+		}
+	}
+
+	c.lastVoteEpoch = c.currentEpoch
+	master.votedTime = time.Now()
+	// vote is persisted before it is sent, so it is not given twice in the epoch after restart
+	c.save()
+	c.logger.Printf("Failover auth granted to %s for epoch %d", sender.ID, c.currentEpoch)
+	reply := sender.link
+	if l != nil {
+		reply = l
+	}
+
+	if reply != nil {
+		reply.send(c.newMessage(MSG_FAILOVER_AUTH_ACK))
+	}
+}
@@ -0,0 +1,312 @@
+package cluster
+
+import (
+	"time"
+)
+
+// newMessage returns message of the type with header describing this node
+func (c *Cluster) newMessage(typ uint16) *message {
+	m := &message{}
+	m.Type = typ
+	m.CurrentEpoch = c.currentEpoch
+	master := c.myself
+	if c.myself.master != nil {
+		master = c.myself.master
+		copy(m.Master[:], master.ID)
+	}
+
+	m.ConfigEpoch = master.configEpoch
+	for slot, owner := range c.slots {
+		if owner == master {
+			m.Slots.set(slot)
+		}
+	}
+
+	if c.repl != nil {
+		m.Offset = c.repl.Offset()
+	}
+
+	copy(m.Sender[:], c.myself.ID)
+	copy(m.IP[:], c.myself.IP)
+	m.Port, m.CPort = uint16(c.myself.Port), uint16(c.myself.CPort)
+	m.Flags = c.myself.flags
+	if !c.ok {
+		m.State = 1
+	}
+
+	return m
+}
+
+// newPing returns PING, PONG or MEET gossiping about a few random nodes other than the receiver, all failing
+// nodes are included, so their failure reports reach the majority quickly
+func (c *Cluster) newPing(typ uint16, to *Node) *message {
+	m := c.newMessage(typ)
+	candidates, failing := make([]*Node, 0, len(c.nodes)), make([]*Node, 0)
+	for _, node := range c.nodes {
+		switch {
+		case node == c.myself || node == to:
+		case node.flags&FLAG_PFAIL != 0:
+			failing = append(failing, node)
+		default:
+			candidates = append(candidates, node)
+		}
+	}
+
+	wanted := len(c.nodes) / 10
+	if wanted < 3 {
+		wanted = 3
+	}
+
+	c.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	if len(candidates) > wanted {
+		candidates = candidates[:wanted]
+	}
+
+	for _, node := range append(candidates, failing...) {
+		if len(m.gossip) == MAX_GOSSIP {
+			break
+		}
+
+		g := gossip{
+			PingSent:     uint32(unixMilli(node.pingSent) / 1000),
+			PongReceived: uint32(unixMilli(node.pongReceived) / 1000),
+			Port:         uint16(node.Port),
+			CPort:        uint16(node.CPort),
+			Flags:        node.flags &^ FLAG_MYSELF,
+		}
+
+		copy(g.Node[:], node.ID)
+		copy(g.IP[:], node.IP)
+		m.gossip = append(m.gossip, g)
+	}
+
+	return m
+}
+
+// newUpdate returns UPDATE telling the current owner of the slots of the node
+func (c *Cluster) newUpdate(node *Node) *message {
+	m := c.newMessage(MSG_UPDATE)
+	m.update.ConfigEpoch = node.configEpoch
+	copy(m.update.Node[:], node.ID)
+	for slot, owner := range c.slots {
+		if owner == node {
+			m.update.Slots.set(slot)
+		}
+	}
+
+	return m
+}
+
+// process applies the message received on the link, l is nil for the reply to MEET
+func (c *Cluster) process(m *message, l *link) {
+	id := nodeID(m.Sender)
+	if id == c.myself.ID {
+		return
+	}
+
+	sender := c.nodes[id]
+	if sender == nil && m.Type == MSG_MEET {
+		sender = newNode(id, ipString(m.IP), int(m.Port), int(m.CPort))
+		c.nodes[id] = sender
+		c.dirty = true
+		c.logger.Printf("Met node %s at %s", id, sender.Addr())
+	}
+
+	if m.CurrentEpoch > c.currentEpoch {
+		c.currentEpoch = m.CurrentEpoch
+		c.dirty = true
+	}
+
+	if (m.Type == MSG_PING || m.Type == MSG_MEET) && l != nil {
+		l.send(c.newPing(MSG_PONG, sender))
+	}
+
+	// nodes are learned only from MEET and gossip
+	if sender == nil {
+		return
+	}
+
+	sender.offset = m.Offset
+	if nodeID(m.Master) == "" && m.ConfigEpoch > sender.configEpoch {
+		sender.configEpoch = m.ConfigEpoch
+		c.dirty = true
+	}
+
+	switch m.Type {
+	case MSG_PING, MSG_PONG, MSG_MEET:
+		if m.Type == MSG_PONG {
+			sender.pingSent = time.Time{}
+			sender.pongReceived = time.Now()
+			c.clearFailure(sender)
+		}
+
+		c.updateRole(sender, m)
+		if sender.flags&FLAG_MASTER != 0 {
+			c.updateSlots(sender, m.Slots, m.ConfigEpoch)
+			c.checkClaims(sender, m, l)
+			c.handleConfigEpochCollision(sender)
+		}
+
+		for _, g := range m.gossip {
+			c.processGossip(sender, g)
+		}
+	case MSG_FAIL:
+		node := c.nodes[nodeID(m.fail.Node)]
+		if node != nil && node != c.myself && node.flags&FLAG_FAIL == 0 {
+			node.flags = node.flags&^FLAG_PFAIL | FLAG_FAIL
+			node.failTime = time.Now()
+			c.dirty = true
+			c.logger.Printf("FAIL message received from %s about %s", sender.ID, node.ID)
+		}
+	case MSG_UPDATE:
+		node := c.nodes[nodeID(m.update.Node)]
+		if node == nil || node.configEpoch >= m.update.ConfigEpoch {
+			return
+		}
+
+		node.configEpoch = m.update.ConfigEpoch
+		c.updateSlots(node, m.update.Slots, m.update.ConfigEpoch)
+		c.dirty = true
+	case MSG_FAILOVER_AUTH_REQUEST:
+		c.vote(sender, m, l)
+	case MSG_FAILOVER_AUTH_ACK:
+		if c.failoverAuthSent && sender.flags&FLAG_MASTER != 0 && c.nodeSlots(sender) > 0 &&
+			m.CurrentEpoch >= c.failoverAuthEpoch {
+			c.failoverAuthCount++
+			c.logger.Printf("Failover auth granted by %s for epoch %d", sender.ID, m.CurrentEpoch)
+		}
+	case MSG_PUBLISH, MSG_PUBLISHSHARD:
+		channel, message, shard := string(m.channel), string(m.payload), m.Type == MSG_PUBLISHSHARD
+		c.actions = append(c.actions, func(r Replication) {
+			r.Deliver(channel, message, shard)
+		})
+	}
+}
+
+// updateRole follows promotions of replicas and replicas switching masters
+func (c *Cluster) updateRole(sender *Node, m *message) {
+	masterID := nodeID(m.Master)
+	if masterID == "" {
+		if sender.flags&FLAG_SLAVE != 0 {
+			sender.flags = sender.flags&^FLAG_SLAVE | FLAG_MASTER
+			sender.master = nil
+			c.dirty = true
+		}
+
+		return
+	}
+
+	if sender.flags&FLAG_MASTER != 0 {
+		// slots of the demoted master are claimed by their new owner
+		for slot, owner := range c.slots {
+			if owner == sender {
+				c.slots[slot] = nil
+			}
+		}
+
+		sender.flags = sender.flags&^FLAG_MASTER | FLAG_SLAVE
+		c.dirty = true
+	}
+
+	if master := c.nodes[masterID]; master != nil && sender.master != master {
+		sender.master = master
+		c.dirty = true
+	}
+}
+
+// updateSlots assigns the claimed slots to the master unless they are served by a node with greater or equal
+// config epoch, once this node or its master loses all the slots, this node replicates the sender
+func (c *Cluster) updateSlots(sender *Node, claimed slotBitmap, epoch uint64) {
+	if sender == c.myself {
+		return
+	}
+
+	mine := c.myself
+	if c.myself.master != nil {
+		mine = c.myself.master
+	}
+
+	lost := false
+	for slot := 0; slot < SLOTS; slot++ {
+		owner := c.slots[slot]
+		// the slot being imported is assigned by CLUSTER SETSLOT NODE once the keys are moved
+		if !claimed.has(slot) || owner == sender || (owner != nil && owner.configEpoch >= epoch) || c.importing[slot] != nil {
+			continue
+		}
+
+		if owner == mine {
+			lost = true
+		}
+
+		c.slots[slot] = sender
+		c.dirty = true
+	}
+
+	if lost && c.nodeSlots(mine) == 0 {
+		c.logger.Printf("Slots of %s were taken over by %s", mine.ID, sender.ID)
+		c.setMaster(sender)
+	}
+}
+
+// checkClaims tells the master claiming slots of a node with greater config epoch about the new owner
+func (c *Cluster) checkClaims(sender *Node, m *message, l *link) {
+	if l == nil {
+		return
+	}
+
+	for slot := 0; slot < SLOTS; slot++ {
+		owner := c.slots[slot]
+		if m.Slots.has(slot) && owner != nil && owner != sender && owner.configEpoch > m.ConfigEpoch {
+			l.send(c.newUpdate(owner))
+			return
+		}
+	}
+}
+
+// handleConfigEpochCollision gives distinct config epochs to masters, of two masters with the same epoch
+// the one with smaller id takes a new epoch
+func (c *Cluster) handleConfigEpochCollision(sender *Node) {
+	if c.myself.flags&FLAG_MASTER == 0 || sender.configEpoch != c.myself.configEpoch || sender.ID <= c.myself.ID {
+		return
+	}
+
+	c.currentEpoch++
+	c.myself.configEpoch = c.currentEpoch
+	c.dirty = true
+	c.logger.Printf("Config epoch collision with %s, config epoch set to %d", sender.ID, c.myself.configEpoch)
+}
+
+// processGossip learns new nodes and failure reports of the masters about the known ones
+func (c *Cluster) processGossip(sender *Node, g gossip) {
+	id := nodeID(g.Node)
+	if id == c.myself.ID {
+		return
+	}
+
+	node := c.nodes[id]
+	if node == nil {
+		if g.Flags&(FLAG_PFAIL|FLAG_FAIL) == 0 && ipString(g.IP) != "" {
+			node = newNode(id, ipString(g.IP), int(g.Port), int(g.CPort))
+			node.flags = g.Flags & (FLAG_MASTER | FLAG_SLAVE)
+			c.nodes[id] = node
+			c.dirty = true
+			c.logger.Printf("Learned node %s at %s from %s", id, node.Addr(), sender.ID)
+		}
+
+		return
+	}
+
+	if sender.flags&FLAG_MASTER == 0 {
+		return
+	}
+
+	if g.Flags&(FLAG_PFAIL|FLAG_FAIL) != 0 {
+		node.failReports[sender.ID] = time.Now()
+		c.markFailing(node)
+	} else {
+		delete(node.failReports, sender.ID)
+	}
+}
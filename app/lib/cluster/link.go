@@ -0,0 +1,247 @@
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// link is a connection of the bus, outbound links are opened by this node to ping the node, inbound are
+// accepted from other nodes and only used to reply
+type link struct {
+	// node is nil for inbound link
+	node      *Node
+	out       chan []byte
+	connected atomic.Bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newLink(node *Node) *link {
+	return &link{node: node, out: make(chan []byte, 64), closed: make(chan struct{})}
+}
+
+// send queues the message, it is dropped when the link is congested, the node is pinged again later anyway
+func (l *link) send(m *message) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.out <- b:
+	default:
+	}
+}
+
+func (l *link) close() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+}
+
+// writeLoop writes queued messages until the link is closed, the connection is closed with it
+func (l *link) writeLoop(conn net.Conn) {
+	defer conn.Close()
+	for {
+		select {
+		case <-l.closed:
+			return
+		case b := <-l.out:
+			if err := conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+				l.close()
+				return
+			}
+
+			if _, err := conn.Write(b); err != nil {
+				l.close()
+				return
+			}
+		}
+	}
+}
+
+// Start listens on the bus port and starts the cron pinging other nodes, detecting failures and failing over
+// the master of this replica
+func (c *Cluster) Start(host string, repl Replication) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(c.myself.CPort)))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.listener = listener
+	c.repl = repl
+	c.mu.Unlock()
+	c.logger.Printf("Cluster bus listening on port %d, node id %s", c.myself.CPort, c.myself.ID)
+	go c.accept(listener)
+	go c.cron()
+	return nil
+}
+
+// Close stops the bus and saves the state
+func (c *Cluster) Close() {
+	c.closeOnce.Do(func() {
+		close(c.close)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.listener != nil {
+			c.listener.Close()
+		}
+
+		for l := range c.inbound {
+			l.close()
+		}
+
+		for _, node := range c.nodes {
+			if node.link != nil {
+				node.link.close()
+				node.link = nil
+			}
+		}
+
+		c.save()
+	})
+}
+
+func (c *Cluster) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		l := newLink(nil)
+		l.connected.Store(true)
+		c.mu.Lock()
+		select {
+		case <-c.close:
+			c.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+
+		c.inbound[l] = true
+		c.mu.Unlock()
+		go l.writeLoop(conn)
+		go func() {
+			c.readLoop(conn, l)
+			l.close()
+			c.mu.Lock()
+			delete(c.inbound, l)
+			c.mu.Unlock()
+		}()
+	}
+}
+
+// connect opens outbound link to the node, PING is sent right away so the node is not considered failing
+// just because the previous link dropped
+func (c *Cluster) connect(node *Node) {
+	l := newLink(node)
+	node.link = l
+	if node.pingSent.IsZero() {
+		node.pingSent = time.Now()
+	}
+
+	l.send(c.newPing(MSG_PING, node))
+	addr := net.JoinHostPort(node.IP, strconv.Itoa(node.CPort))
+	go func() {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			c.dropLink(l)
+			return
+		}
+
+		l.connected.Store(true)
+		go func() {
+			c.readLoop(conn, l)
+			c.dropLink(l)
+		}()
+		l.writeLoop(conn)
+	}()
+}
+
+// dropLink closes the link, the cron connects the node again
+func (c *Cluster) dropLink(l *link) {
+	l.close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l.node.link == l {
+		l.node.link = nil
+	}
+}
+
+func (c *Cluster) readLoop(conn net.Conn, l *link) {
+	r := bufio.NewReader(conn)
+	for {
+		m, err := readMessage(r)
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		c.process(m, l)
+		c.unlock()
+	}
+}
+
+// broadcast sends the message to all the connected nodes
+func (c *Cluster) broadcast(m *message) {
+	for _, node := range c.nodes {
+		if node != c.myself && node.link != nil {
+			node.link.send(m)
+		}
+	}
+}
+
+// Meet performs handshake with the node at the address, the node learns this one from MEET and this one
+// learns the node from its PONG, the rest of the cluster is learned from gossip
+func (c *Cluster) Meet(ip string, port, cport int) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(cport)), time.Second)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	meet := c.newPing(MSG_MEET, nil)
+	c.mu.Unlock()
+	b, err := meet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if _, err = conn.Write(b); err != nil {
+		return err
+	}
+
+	pong, err := readMessage(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+
+	if pong.Type != MSG_PONG {
+		return fmt.Errorf("unexpected reply of type %d to MEET", pong.Type)
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+	id := nodeID(pong.Sender)
+	if _, ok := c.nodes[id]; !ok {
+		c.nodes[id] = newNode(id, ip, port, cport)
+		c.dirty = true
+		c.logger.Printf("Met node %s at %s:%d", id, ip, port)
+	}
+
+	c.process(pong, nil)
+	return nil
+}
@@ -0,0 +1,141 @@
+package cluster
+
+import (
+	"fmt"
+)
+
+// SlotState returns the owner of the slot and the nodes the slot is being migrated to or imported from
+func (c *Cluster) SlotState(slot int) (owner, migrating, importing *Node) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[slot], c.migrating[slot], c.importing[slot]
+}
+
+// masterByID returns the known master with the id or the error of CLUSTER SETSLOT
+func (c *Cluster) masterByID(id string) (*Node, error) {
+	node := c.nodes[id]
+	if node == nil {
+		return nil, fmt.Errorf("ERR I don't know about node %s", id)
+	}
+
+	if node.flags&FLAG_SLAVE != 0 {
+		return nil, fmt.Errorf("ERR Target node is not a master")
+	}
+
+	return node, nil
+}
+
+// SetSlotMigrating starts migration of the slot of this node to the node with the id, requests of keys
+// missing here are redirected to the node with ASK
+func (c *Cluster) SetSlotMigrating(slot int, id string) error {
+	c.mu.Lock()
+	defer c.unlock()
+	if c.slots[slot] != c.myself {
+		return fmt.Errorf("ERR I'm not the owner of hash slot %d", slot)
+	}
+
+	node, err := c.masterByID(id)
+	if err != nil {
+		return err
+	}
+
+	if node == c.myself {
+		return fmt.Errorf("ERR I'm the owner of hash slot %d", slot)
+	}
+
+	c.migrating[slot] = node
+	c.dirty = true
+	return nil
+}
+
+// SetSlotImporting starts import of the slot from the node with the id, requests preceded by ASKING are
+// served for the slot
+func (c *Cluster) SetSlotImporting(slot int, id string) error {
+	c.mu.Lock()
+	defer c.unlock()
+	if c.slots[slot] == c.myself {
+		return fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+	}
+
+	node, err := c.masterByID(id)
+	if err != nil {
+		return err
+	}
+
+	if node == c.myself {
+		return fmt.Errorf("ERR I'm the owner of hash slot %d", slot)
+	}
+
+	c.importing[slot] = node
+	c.dirty = true
+	return nil
+}
+
+// SetSlotStable cancels migration or import of the slot
+func (c *Cluster) SetSlotStable(slot int) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.migrating[slot], c.importing[slot] = nil, nil
+	c.dirty = true
+}
+
+// SetSlotNode assigns the slot to the node with the id ending its migration, empty is true when this node
+// holds no keys of the slot. The importing node takes a new config epoch, so the rest of the cluster accepts
+// the new owner of the slot
+func (c *Cluster) SetSlotNode(slot int, id string, empty bool) error {
+	c.mu.Lock()
+	defer c.unlock()
+	node := c.nodes[id]
+	if node == nil {
+		return fmt.Errorf("ERR Unknown node %s", id)
+	}
+
+	if node.flags&FLAG_SLAVE != 0 {
+		return fmt.Errorf("ERR Target node is not a master")
+	}
+
+	if c.slots[slot] == c.myself && node != c.myself && !empty {
+		return fmt.Errorf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+	}
+
+	if empty && c.migrating[slot] != nil {
+		c.migrating[slot] = nil
+	}
+
+	if node == c.myself && c.importing[slot] != nil {
+		c.importing[slot] = nil
+		c.bumpEpoch()
+	}
+
+	c.slots[slot] = node
+	c.dirty = true
+	if node == c.myself {
+		// the rest of the cluster learns the new owner of the slot right away
+		for _, n := range c.nodes {
+			if n != c.myself && n.link != nil {
+				n.link.send(c.newPing(MSG_PONG, n))
+			}
+		}
+	}
+
+	return nil
+}
+
+// bumpEpoch takes new config epoch without agreement of the other masters, unless this node already has
+// the greatest one
+func (c *Cluster) bumpEpoch() {
+	max := c.currentEpoch
+	for _, node := range c.nodes {
+		if node.configEpoch > max {
+			max = node.configEpoch
+		}
+	}
+
+	if c.myself.configEpoch != 0 && c.myself.configEpoch == max {
+		return
+	}
+
+	c.currentEpoch++
+	c.myself.configEpoch = c.currentEpoch
+	c.logger.Printf("New config epoch set to %d", c.myself.configEpoch)
+}
@@ -0,0 +1,232 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// save writes the nodes in CLUSTER NODES format followed by the epochs to the config file, the file is
+// replaced atomically
+func (c *Cluster) save() {
+	c.dirty = false
+	if c.config.ConfigFile == "" {
+		return
+	}
+
+	var b strings.Builder
+	for _, node := range c.sortedNodes() {
+		b.WriteString(c.nodesLine(node))
+		b.WriteByte('\n')
+	}
+
+	fmt.Fprintf(&b, "vars currentEpoch %d lastVoteEpoch %d\n", c.currentEpoch, c.lastVoteEpoch)
+	tmp := c.config.ConfigFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		c.logger.Printf("Failed to save cluster config: %s", err)
+		return
+	}
+
+	if err := os.Rename(tmp, c.config.ConfigFile); err != nil {
+		c.logger.Printf("Failed to save cluster config: %s", err)
+	}
+}
+
+// Load restores the state saved to the config file, the node keeps its id, it is a new node when the file
+// does not exist
+func (c *Cluster) Load() error {
+	if c.config.ConfigFile == "" {
+		return nil
+	}
+
+	f, err := os.Open(c.config.ConfigFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	var (
+		nodes   = make(map[string]*Node)
+		masters = make(map[*Node]string)
+		owned   = make(map[*Node][]string)
+		myself  *Node
+		vars    = make(map[string]uint64)
+		scanner = bufio.NewScanner(f)
+	)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if vars[fields[i]], err = strconv.ParseUint(fields[i+1], 10, 64); err != nil {
+					return fmt.Errorf("invalid cluster config vars: %s", scanner.Text())
+				}
+			}
+
+			continue
+		}
+
+		node, err := parseNodeLine(fields)
+		if err != nil {
+			return fmt.Errorf("invalid cluster config line %q: %w", scanner.Text(), err)
+		}
+
+		nodes[node.ID] = node
+		if node.flags&FLAG_MYSELF != 0 {
+			myself = node
+		}
+
+		if fields[3] != "-" {
+			masters[node] = fields[3]
+		}
+
+		owned[node] = fields[8:]
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	if myself == nil {
+		return fmt.Errorf("invalid cluster config: myself node is missing")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for node, id := range masters {
+		node.master = nodes[id]
+	}
+
+	c.slots = [SLOTS]*Node{}
+	c.migrating, c.importing = [SLOTS]*Node{}, [SLOTS]*Node{}
+	for node, ranges := range owned {
+		for _, r := range ranges {
+			if strings.HasPrefix(r, "[") {
+				if err := c.parseSlotState(r, nodes); err != nil {
+					return fmt.Errorf("invalid cluster config slot state %q: %w", r, err)
+				}
+
+				continue
+			}
+
+			start, end, err := parseRange(r)
+			if err != nil {
+				return fmt.Errorf("invalid cluster config slots %q: %w", r, err)
+			}
+
+			for slot := start; slot <= end; slot++ {
+				c.slots[slot] = node
+			}
+		}
+	}
+
+	// the node may be started with different address
+	myself.IP, myself.Port, myself.CPort = c.myself.IP, c.myself.Port, c.myself.CPort
+	c.myself, c.nodes = myself, nodes
+	c.currentEpoch, c.lastVoteEpoch = vars["currentEpoch"], vars["lastVoteEpoch"]
+	c.updateState()
+	c.logger.Printf("Loaded cluster config %s, node id %s", c.config.ConfigFile, myself.ID)
+	return nil
+}
+
+// parseNodeLine parses CLUSTER NODES line, the link state and the ping times are not restored
+func parseNodeLine(fields []string) (*Node, error) {
+	if len(fields) < 8 {
+		return nil, fmt.Errorf("expected at least 8 fields")
+	}
+
+	addr, cport, ok := strings.Cut(fields[1], "@")
+	if !ok {
+		return nil, fmt.Errorf("missing cluster bus port")
+	}
+
+	i := strings.LastIndexByte(addr, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid address %s", addr)
+	}
+
+	port, err := strconv.Atoi(addr[i+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	cp, err := strconv.Atoi(cport)
+	if err != nil {
+		return nil, err
+	}
+
+	epoch, err := strconv.ParseUint(fields[6], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	node := newNode(fields[0], addr[:i], port, cp)
+	node.flags = 0
+	node.configEpoch = epoch
+	for _, name := range strings.Split(fields[2], ",") {
+		for _, f := range flagNames {
+			// failures are detected again
+			if f.name == name && f.flag != FLAG_PFAIL {
+				node.flags |= f.flag
+			}
+		}
+	}
+
+	return node, nil
+}
+
+func parseRange(r string) (int, int, error) {
+	first, last, isRange := strings.Cut(r, "-")
+	start, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end := start
+	if isRange {
+		if end, err = strconv.Atoi(last); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if start < 0 || end >= SLOTS || start > end {
+		return 0, 0, fmt.Errorf("slot out of range")
+	}
+
+	return start, end, nil
+}
+
+// parseSlotState restores migration of the slot saved as [slot->-id] or import saved as [slot-<-id]
+func (c *Cluster) parseSlotState(state string, nodes map[string]*Node) error {
+	state = strings.TrimSuffix(strings.TrimPrefix(state, "["), "]")
+	states := &c.migrating
+	slot, id, ok := strings.Cut(state, "->-")
+	if !ok {
+		states = &c.importing
+		if slot, id, ok = strings.Cut(state, "-<-"); !ok {
+			return fmt.Errorf("unknown slot state")
+		}
+	}
+
+	n, err := strconv.Atoi(slot)
+	if err != nil || n < 0 || n >= SLOTS {
+		return fmt.Errorf("slot out of range")
+	}
+
+	if states[n] = nodes[id]; states[n] == nil {
+		return fmt.Errorf("unknown node %s", id)
+	}
+
+	return nil
+}
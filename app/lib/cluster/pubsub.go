@@ -0,0 +1,30 @@
+package cluster
+
+// Publish sends the message of the channel over the bus, PUBLISH reaches subscribers of all the nodes while
+// sharded PUBLISH reaches only the nodes serving the slot of the channel, i.e. the master and its replicas
+func (c *Cluster) Publish(channel, message string, shard bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	typ := MSG_PUBLISH
+	if shard {
+		typ = MSG_PUBLISHSHARD
+	}
+
+	m := c.newMessage(typ)
+	m.channel, m.payload = []byte(channel), []byte(message)
+	if !shard {
+		c.broadcast(m)
+		return
+	}
+
+	master := c.myself
+	if c.myself.master != nil {
+		master = c.myself.master
+	}
+
+	for _, node := range c.nodes {
+		if node != c.myself && (node == master || node.master == master) && node.link != nil {
+			node.link.send(m)
+		}
+	}
+}
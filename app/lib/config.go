@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"github.com/codecrafters-io/redis-starter-go/app/lib/cluster"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/replication"
 	"sync/atomic"
@@ -12,9 +13,27 @@ type ServerConfig struct {
 	Port                   int
 	ConnectionReadTimeout  time.Duration
 	ConnectionWriteTimeout time.Duration
-	ReplicaOf              string
 	ReplicationConfig      *replication.ReplicationConfig
 	PersistenceConfig      *persistence.Config
+	ClusterConfig          *cluster.Config
+	// NotifyKeyspaceEvents holds NotifyFlags, it is changed at runtime by CONFIG SET
+	NotifyKeyspaceEvents atomic.Int32
+	// replicaOf is the address of the master, it is changed at runtime by REPLICAOF, FAILOVER and the cluster
+	replicaOf atomic.Pointer[string]
+}
+
+// ReplicaOf returns address of the master the server replicates, it is empty when the server is master
+func (c *ServerConfig) ReplicaOf() string {
+	if addr := c.replicaOf.Load(); addr != nil {
+		return *addr
+	}
+
+	return ""
+}
+
+// SetReplicaOf changes the master of the server, empty address makes it master
+func (c *ServerConfig) SetReplicaOf(addr string) {
+	c.replicaOf.Store(&addr)
 }
 
 func GetDefaultConfig() *ServerConfig {
@@ -24,18 +43,34 @@ func GetDefaultConfig() *ServerConfig {
 		ConnectionReadTimeout:  time.Second * 2,
 		ConnectionWriteTimeout: time.Second * 2,
 		ReplicationConfig: &replication.ReplicationConfig{
-			Role:               "master",
-			MasterReplOffset:   atomic.Uint64{},
-			SecondReplOffset:   atomic.Uint64{},
-			ConnectedSlaves:    atomic.Uint64{},
-			ReplBacklogActive:  0,
-			ReplBacklogSize:    1048576,
-			ReplBacklogFirst:   0,
-			ReplBacklogHistlen: 0,
+			Role:                  "master",
+			MasterReplOffset:      atomic.Uint64{},
+			SecondReplOffset:      atomic.Uint64{},
+			ConnectedSlaves:       atomic.Uint64{},
+			ReplBacklogSize:       1048576,
+			ReplicaReadOnly:       true,
+			ReplPingReplicaPeriod: 10 * time.Second,
+			ReplTimeout:           60 * time.Second,
+			MinReplicasMaxLag:     10 * time.Second,
+			ReplicaPriority:       100,
 		},
 		PersistenceConfig: &persistence.Config{
-			Dir:  "",
-			File: "",
+			Dir:                      "",
+			File:                     "",
+			Save:                     true,
+			AppendOnly:               false,
+			AppendDirname:            "appendonlydir",
+			AppendFilename:           "appendonly.aof",
+			AppendFsync:              persistence.FSYNC_EVERYSEC,
+			AofLoadTruncated:         true,
+			AofUseRdbPreamble:        true,
+			AutoAofRewritePercentage: 100,
+			AutoAofRewriteMinSize:    64 * 1024 * 1024,
+		},
+		ClusterConfig: &cluster.Config{
+			AnnounceIP:  "127.0.0.1",
+			NodeTimeout: 15 * time.Second,
+			ConfigFile:  "nodes.conf",
 		},
 	}
 }
@@ -46,17 +81,33 @@ var defaultConfig = &ServerConfig{
 	ConnectionReadTimeout:  time.Second * 2,
 	ConnectionWriteTimeout: time.Second * 2,
 	ReplicationConfig: &replication.ReplicationConfig{
-		Role:               "master",
-		MasterReplOffset:   atomic.Uint64{},
-		SecondReplOffset:   atomic.Uint64{},
-		ConnectedSlaves:    atomic.Uint64{},
-		ReplBacklogActive:  0,
-		ReplBacklogSize:    1048576,
-		ReplBacklogFirst:   0,
-		ReplBacklogHistlen: 0,
+		Role:                  "master",
+		MasterReplOffset:      atomic.Uint64{},
+		SecondReplOffset:      atomic.Uint64{},
+		ConnectedSlaves:       atomic.Uint64{},
+		ReplBacklogSize:       1048576,
+		ReplicaReadOnly:       true,
+		ReplPingReplicaPeriod: 10 * time.Second,
+		ReplTimeout:           60 * time.Second,
+		MinReplicasMaxLag:     10 * time.Second,
+		ReplicaPriority:       100,
 	},
 	PersistenceConfig: &persistence.Config{
-		Dir:  ".",
-		File: "dump.rdb",
+		Dir:                      ".",
+		File:                     "dump.rdb",
+		Save:                     true,
+		AppendOnly:               false,
+		AppendDirname:            "appendonlydir",
+		AppendFilename:           "appendonly.aof",
+		AppendFsync:              persistence.FSYNC_EVERYSEC,
+		AofLoadTruncated:         true,
+		AofUseRdbPreamble:        true,
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    64 * 1024 * 1024,
+	},
+	ClusterConfig: &cluster.Config{
+		AnnounceIP:  "127.0.0.1",
+		NodeTimeout: 15 * time.Second,
+		ConfigFile:  "nodes.conf",
 	},
 }
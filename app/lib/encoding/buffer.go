@@ -0,0 +1,84 @@
+package encoding
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MAX_POOLED_BUFFER is the capacity of the largest buffer kept for reuse, e.g. big bulk strings are not kept
+const MAX_POOLED_BUFFER = 64 * 1024
+
+// buffer is the scratch space of marshalling, every reply is written by a single Write, so it is not split
+// between the writes of the other goroutines, e.g. propagation to replicas
+type buffer struct {
+	b []byte
+}
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return &buffer{b: make([]byte, 0, 512)}
+	},
+}
+
+func getBuffer() *buffer {
+	buff := bufferPool.Get().(*buffer)
+	buff.b = buff.b[:0]
+	return buff
+}
+
+func (buff *buffer) Write(p []byte) (int, error) {
+	buff.b = append(buff.b, p...)
+	return len(p), nil
+}
+
+// writeTo writes the buffer and returns it to the pool
+func (buff *buffer) writeTo(w io.Writer) (int, error) {
+	n, err := w.Write(buff.b)
+	if cap(buff.b) <= MAX_POOLED_BUFFER {
+		bufferPool.Put(buff)
+	}
+
+	return n, err
+}
+
+// parseInt parses the decimal length or integer of the reply without converting it to string
+func parseInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 20 {
+		return 0, fmt.Errorf("invalid integer %q", b)
+	}
+
+	neg, digits := b[0] == '-', b
+	if neg || b[0] == '+' {
+		digits = b[1:]
+	}
+
+	if len(digits) == 0 {
+		return 0, fmt.Errorf("invalid integer %q", b)
+	}
+
+	var n uint64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid integer %q", b)
+		}
+
+		if n > 1<<63/10 {
+			return 0, fmt.Errorf("integer %q out of range", b)
+		}
+
+		if n = n*10 + uint64(c-'0'); n > 1<<63 {
+			return 0, fmt.Errorf("integer %q out of range", b)
+		}
+	}
+
+	if neg {
+		return -int64(n), nil
+	}
+
+	if n == 1<<63 {
+		return 0, fmt.Errorf("integer %q out of range", b)
+	}
+
+	return int64(n), nil
+}
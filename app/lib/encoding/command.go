@@ -0,0 +1,166 @@
+package encoding
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+const (
+	// MAX_MULTIBULK_LENGTH and MAX_BULK_LENGTH limit the number of the arguments and their size like Redis does
+	MAX_MULTIBULK_LENGTH = 1024 * 1024
+	MAX_BULK_LENGTH      = 512 * 1024 * 1024
+	// ARENA_SIZE is the size of the chunks small arguments are carved from
+	ARENA_SIZE = 16 * 1024
+	// REUSED_ARGUMENTS limits the number of bulk strings kept for the next commands
+	REUSED_ARGUMENTS = 1024
+)
+
+var (
+	// ErrProtocol is the malformed request, the rest of the stream can not be parsed, so the connection is closed
+	ErrProtocol = errors.New("ERR Protocol error")
+	// bulkStringInterface provides the type of the arguments, their values are the reused bulk strings
+	bulkStringInterface Marshaller = BulkString{}
+)
+
+// CommandReader reads the commands sent by clients, the arrays of bulk strings. Small arguments of the commands
+// are carved from the shared arena. The arena and the bulk strings the arguments point to are reused once the
+// commands read so far are released, until then they stay intact, e.g. while they are queued by MULTI
+type CommandReader struct {
+	arena []byte
+	bulks []*BulkString
+	used  int
+}
+
+// Read appends the arguments of the next command to argv, so the slice of the previous command may be reused.
+// Empty or null array is read as the command without arguments. Arguments of other types than bulk string are
+// read as they are, handlers accept e.g. integers
+func (c *CommandReader) Read(r *bufio.Reader, argv []Marshaller) ([]Marshaller, int, error) {
+	length, n, err := readHeader(r, ArrayType[0])
+	if err != nil {
+		return argv, n, err
+	}
+
+	if length > MAX_MULTIBULK_LENGTH {
+		return argv, n, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+
+	for i := int64(0); i < length; i++ {
+		if peeked, err := r.Peek(1); err == nil && peeked[0] != BulkStringType[0] {
+			var a Any
+			read, err := a.UnmarshalRESP(r)
+			n += read
+			if err != nil {
+				return argv, n, err
+			}
+
+			argv = append(argv, a.I.(Marshaller))
+			continue
+		}
+
+		size, read, err := readHeader(r, BulkStringType[0])
+		n += read
+		if err != nil {
+			return argv, n, err
+		}
+
+		if size < 0 || size > MAX_BULK_LENGTH {
+			return argv, n, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+
+		arg := c.alloc(int(size) + len(TERMINATOR))
+		read, err = io.ReadFull(r, arg)
+		n += read
+		if err != nil {
+			return argv, n, err
+		}
+
+		argv = append(argv, c.bulkString(arg[:size:size]))
+	}
+
+	return argv, n, nil
+}
+
+// Release lets the next commands reuse memory of the arguments read so far, none of them may be used since
+func (c *CommandReader) Release() {
+	for _, b := range c.bulks[:c.used] {
+		// large arguments are not kept alive by the reused bulk strings
+		b.S = nil
+	}
+
+	if len(c.bulks) > REUSED_ARGUMENTS {
+		c.bulks = c.bulks[:REUSED_ARGUMENTS]
+	}
+
+	c.arena = c.arena[:0]
+	c.used = 0
+}
+
+// bulkString returns the argument as the bulk string, converting it to the interface would allocate it on the
+// heap, so the interface is pointed to the released bulk string instead
+func (c *CommandReader) bulkString(s []byte) Marshaller {
+	if c.used == len(c.bulks) {
+		c.bulks = append(c.bulks, new(BulkString))
+	}
+
+	b := c.bulks[c.used]
+	c.used++
+	b.S = s
+	arg := bulkStringInterface
+	(*[2]unsafe.Pointer)(unsafe.Pointer(&arg))[1] = unsafe.Pointer(b)
+	return arg
+}
+
+// alloc returns the slice of the arena, large arguments are allocated on their own
+func (c *CommandReader) alloc(size int) []byte {
+	if size > ARENA_SIZE/4 {
+		return make([]byte, size)
+	}
+
+	if c.arena == nil || cap(c.arena)-len(c.arena) < size {
+		c.arena = make([]byte, 0, ARENA_SIZE)
+	}
+
+	start := len(c.arena)
+	c.arena = c.arena[:start+size]
+	return c.arena[start : start+size : start+size]
+}
+
+// readHeader reads the type and the length of the array or the bulk string
+func readHeader(r *bufio.Reader, typ byte) (int64, int, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if c != typ {
+		return 0, 1, fmt.Errorf("%w: expected '%c', got '%c'", ErrProtocol, typ, c)
+	}
+
+	line, err := r.ReadSlice(TERMINATOR[len(TERMINATOR)-1])
+	n := 1 + len(line)
+	if err == bufio.ErrBufferFull || (err == nil && (len(line) < len(TERMINATOR) || line[len(line)-2] != TERMINATOR[0])) {
+		return 0, n, fmt.Errorf("%w: invalid %s length", ErrProtocol, headerName(typ))
+	}
+
+	if err != nil {
+		return 0, n, err
+	}
+
+	length, err := parseInt(line[:len(line)-len(TERMINATOR)])
+	if err != nil {
+		return 0, n, fmt.Errorf("%w: invalid %s length", ErrProtocol, headerName(typ))
+	}
+
+	return length, n, nil
+}
+
+func headerName(typ byte) string {
+	if typ == ArrayType[0] {
+		return "multibulk"
+	}
+
+	return "bulk"
+}
@@ -0,0 +1,186 @@
+package encoding
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCommandReader(t *testing.T) {
+	var c CommandReader
+	r := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n*3\r\n$3\r\nSET\r\n$0\r\n\r\n:10\r\n*0\r\n"))
+	first, n, err := c.Read(r, make([]Marshaller, 0, 4))
+	if err != nil || n != 22 {
+		t.Fatalf("unexpected result %d %v", n, err)
+	}
+
+	expected := []Marshaller{BulkString{S: []byte("GET")}, BulkString{S: []byte("foo")}}
+	if !reflect.DeepEqual(first, expected) {
+		t.Errorf("expected %v, got %v", expected, first)
+	}
+
+	// slice of the previous command is reused, its arguments are not
+	key := first[1].(BulkString).S
+	second, _, err := c.Read(r, first[:0])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected = []Marshaller{BulkString{S: []byte("SET")}, BulkString{S: []byte{}}, SimpleInt{I: 10}}
+	if !reflect.DeepEqual(second, expected) || &second[0] != &first[0] {
+		t.Errorf("expected %v in the reused slice, got %v", expected, second)
+	}
+
+	if string(key) != "foo" {
+		t.Errorf("expected argument of the previous command to be kept, got %q", key)
+	}
+
+	if empty, _, err := c.Read(r, nil); err != nil || len(empty) != 0 {
+		t.Errorf("expected empty command, got %v %v", empty, err)
+	}
+
+	if _, _, err := c.Read(r, nil); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestCommandReaderRelease(t *testing.T) {
+	var (
+		c    CommandReader
+		argv []Marshaller
+	)
+
+	cmd := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$5\r\nvalue\r\n"
+	r := bufio.NewReader(strings.NewReader(strings.Repeat(cmd, 110)))
+	read := func() {
+		var err error
+		if argv, _, err = c.Read(r, argv[:0]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	read()
+	first := argv[1].(BulkString).S
+	c.Release()
+	if allocs := testing.AllocsPerRun(100, func() {
+		read()
+		c.Release()
+	}); allocs != 0 {
+		t.Errorf("expected released arguments to be reused, got %.1f allocations per command", allocs)
+	}
+
+	// arguments are carved from the same memory as the released ones
+	read()
+	if s := argv[1].(BulkString).S; string(s) != "foo" || &s[0] != &first[0] {
+		t.Errorf("expected argument foo in the released memory, got %q", s)
+	}
+}
+
+func TestCommandReaderLargeArgument(t *testing.T) {
+	var c CommandReader
+	value := strings.Repeat("v", ARENA_SIZE)
+	r := bufio.NewReader(strings.NewReader("*2\r\n$1\r\na\r\n$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"))
+	argv, _, err := c.Read(r, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if s := argv[1].(BulkString).S; string(s) != value || cap(s) != len(value) {
+		t.Errorf("unexpected large argument of length %d and capacity %d", len(s), cap(s))
+	}
+}
+
+func TestCommandReaderProtocolErrors(t *testing.T) {
+	for _, input := range []string{
+		"*x\r\n",
+		"*2097152\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$abc\r\n",
+		"*1\r\n$3\nGET\r\n",
+	} {
+		var c CommandReader
+		_, _, err := c.Read(bufio.NewReader(strings.NewReader(input)), nil)
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("expected protocol error reading %q, got %v", input, err)
+		}
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected int64
+		ok       bool
+	}{
+		{"0", 0, true},
+		{"42", 42, true},
+		{"+7", 7, true},
+		{"-1", -1, true},
+		{"9223372036854775807", 1<<63 - 1, true},
+		{"-9223372036854775808", -1 << 63, true},
+		{"9223372036854775808", 0, false},
+		{"99999999999999999999", 0, false},
+		{"", 0, false},
+		{"-", 0, false},
+		{"1a", 0, false},
+	} {
+		n, err := parseInt([]byte(tc.input))
+		if (err == nil) != tc.ok || n != tc.expected {
+			t.Errorf("expected %d, %v parsing %q, got %d, %v", tc.expected, tc.ok, tc.input, n, err)
+		}
+	}
+}
+
+func BenchmarkCommandReader(b *testing.B) {
+	cmd := []byte("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$5\r\nvalue\r\n")
+	stream := bytes.Repeat(cmd, 1024)
+	src := bytes.NewReader(stream)
+	r := bufio.NewReader(src)
+	var (
+		c    CommandReader
+		argv []Marshaller
+	)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(cmd)))
+	for i := 0; i < b.N; i++ {
+		if i%1024 == 0 {
+			src.Reset(stream)
+			r.Reset(src)
+		}
+
+		var err error
+		if argv, _, err = c.Read(r, argv[:0]); err != nil {
+			b.Fatalf("unexpected error: %s", err)
+		}
+
+		c.Release()
+	}
+}
+
+func BenchmarkMarshalReply(b *testing.B) {
+	w := bufio.NewWriterSize(io.Discard, 16*1024)
+	for _, bc := range []struct {
+		name  string
+		reply Marshaller
+	}{
+		{"SimpleString", SimpleString{S: "OK"}},
+		{"SimpleInt", SimpleInt{I: 12345}},
+		{"BulkString", BulkString{S: []byte("value")}},
+		{"Array", Array{A: []Marshaller{BulkString{S: []byte("a")}, BulkString{S: []byte("b")}, SimpleInt{I: 1}}}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bc.reply.MarshalRESP(w); err != nil {
+					b.Fatalf("unexpected error: %s", err)
+				}
+			}
+		})
+	}
+}
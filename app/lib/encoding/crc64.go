@@ -0,0 +1,83 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Redis uses crc-64-jones in reflected form without final xor for rdb checksums and DUMP payloads,
+// the variant differs from hash/crc64 tables that invert crc before and after the update
+const crc64JonesPoly = 0x95ac9329ac4bc9b5
+
+var crc64Table = makeCrc64Table()
+
+func makeCrc64Table() *[256]uint64 {
+	t := new([256]uint64)
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ crc64JonesPoly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+
+	return t
+}
+
+func Crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ (crc >> 8)
+	}
+
+	return crc
+}
+
+// Crc64Writer computes checksum of everything written through it
+type Crc64Writer struct {
+	W   io.Writer
+	Crc uint64
+	N   int64
+}
+
+func (c *Crc64Writer) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.Crc = Crc64(c.Crc, p[:n])
+	c.N += int64(n)
+	return n, err
+}
+
+// WriteChecksum writes checksum of the data written so far in little endian, as it is stored in rdb files
+func (c *Crc64Writer) WriteChecksum() (int, error) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, c.Crc)
+	return c.W.Write(b)
+}
+
+// Crc64Reader computes checksum of everything read through it
+type Crc64Reader struct {
+	R   ByteReader
+	Crc uint64
+	N   int64
+}
+
+func (c *Crc64Reader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.Crc = Crc64(c.Crc, p[:n])
+	c.N += int64(n)
+	return n, err
+}
+
+func (c *Crc64Reader) ReadByte() (byte, error) {
+	b, err := c.R.ReadByte()
+	if err != nil {
+		return b, err
+	}
+
+	c.Crc = Crc64(c.Crc, []byte{b})
+	c.N++
+	return b, nil
+}
@@ -0,0 +1,18 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestCrc64(t *testing.T) {
+	if got := Crc64(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("expected %x, got %x", uint64(0xe9c6d914c4b8d9ca), got)
+	}
+
+	// checksum of the empty rdb covers everything up to and including EOF opcode
+	expected := binary.LittleEndian.Uint64(EMPTYRDBRAW[len(EMPTYRDBRAW)-8:])
+	if got := Crc64(0, EMPTYRDBRAW[:len(EMPTYRDBRAW)-8]); got != expected {
+		t.Errorf("expected %x, got %x", expected, got)
+	}
+}
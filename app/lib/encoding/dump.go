@@ -0,0 +1,58 @@
+package encoding
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// DumpPayload serializes value of the entry as DUMP does: type, value in rdb encoding,
+// 2 bytes of rdb version and crc64 of everything before the checksum, both little endian
+func DumpPayload(entry *RdbEntry) ([]byte, error) {
+	buff := bytes.NewBuffer(make([]byte, 0, len(entry.Value)+16))
+	buff.WriteByte(entry.Type)
+	if err := writeValue(buff, entry); err != nil {
+		return nil, err
+	}
+
+	version, _ := strconv.Atoi(RDB_VERSION)
+	binary.Write(buff, binary.LittleEndian, uint16(version))
+	binary.Write(buff, binary.LittleEndian, Crc64(0, buff.Bytes()))
+	return buff.Bytes(), nil
+}
+
+// RestorePayload reads value serialized by DumpPayload, payloads of newer rdb versions are rejected
+func RestorePayload(payload []byte) (*RdbEntry, error) {
+	if len(payload) < 10 {
+		return nil, fmt.Errorf("ERR DUMP payload version or checksum are wrong")
+	}
+
+	body, footer := payload[:len(payload)-10], payload[len(payload)-10:]
+	version, _ := strconv.Atoi(RDB_VERSION)
+	if int(binary.LittleEndian.Uint16(footer)) > version {
+		return nil, fmt.Errorf("ERR DUMP payload version or checksum are wrong")
+	}
+
+	if binary.LittleEndian.Uint64(footer[2:]) != Crc64(0, payload[:len(payload)-8]) {
+		return nil, fmt.Errorf("ERR DUMP payload version or checksum are wrong")
+	}
+
+	r := bufio.NewReader(bytes.NewReader(body))
+	t, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("ERR Bad data format")
+	}
+
+	entry := &RdbEntry{Type: t}
+	if err = readValue(r, entry); err != nil {
+		return nil, fmt.Errorf("ERR Bad data format")
+	}
+
+	if r.Buffered() != 0 {
+		return nil, fmt.Errorf("ERR Bad data format")
+	}
+
+	return entry, nil
+}
@@ -0,0 +1,60 @@
+package encoding
+
+import (
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"reflect"
+	"testing"
+)
+
+func TestDumpPayload(t *testing.T) {
+	// DUMP of integer 10 from the redis documentation, rdb version 10
+	entry, err := RestorePayload([]byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Type != STRING || entry.Value != "10" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	payload, err := DumpPayload(&RdbEntry{Type: STRING, Value: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry, err = RestorePayload(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Type != STRING || entry.Value != "bar" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	for _, invalid := range [][]byte{
+		payload[:8],
+		append(append([]byte(nil), payload[:len(payload)-1]...), payload[len(payload)-1]^0xff),
+		// version 12 is not supported
+		append([]byte("\x00\x03bar\x0c\x00"), payload[len(payload)-8:]...),
+	} {
+		if _, err = RestorePayload(invalid); err == nil {
+			t.Errorf("expected error restoring %q", invalid)
+		}
+	}
+}
+
+func TestDumpStreamPayload(t *testing.T) {
+	stream := []storage.StreamKV{{Key: "1-1", Data: []string{"a", "1"}}, {Key: "1-2", Data: []string{"b", "2"}}}
+	payload, err := DumpPayload(&RdbEntry{Type: STREAM, Stream: stream})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := RestorePayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Type != STREAM || !reflect.DeepEqual(entry.Stream, stream) {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
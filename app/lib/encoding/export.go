@@ -0,0 +1,245 @@
+package encoding
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	EXPORT_JSON = "json"
+	EXPORT_RESP = "resp"
+)
+
+var typeNames = map[byte]string{
+	STRING: "string",
+	STREAM: "stream",
+}
+
+// TypeName returns name of the value type as reported by TYPE
+func TypeName(t byte) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("type-%d", t)
+}
+
+// JsonEntry is the key exported as json
+type JsonEntry struct {
+	Db       int               `json:"db"`
+	Key      string            `json:"key"`
+	Type     string            `json:"type"`
+	Value    string            `json:"value,omitempty"`
+	Entries  []JsonStreamEntry `json:"entries,omitempty"`
+	ExpireAt int64             `json:"expire_at_ms,omitempty"`
+	// stream metadata is exported only when it is not implied by the entries
+	LastId       string `json:"last_id,omitempty"`
+	EntriesAdded uint64 `json:"entries_added,omitempty"`
+	MaxDeletedId string `json:"max_deleted_id,omitempty"`
+}
+
+type JsonStreamEntry struct {
+	Id     string   `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+func NewJsonEntry(entry *RdbEntry) JsonEntry {
+	e := JsonEntry{Db: entry.Db, Key: entry.Key, Type: TypeName(entry.Type), Value: entry.Value}
+	for _, kv := range entry.Stream {
+		e.Entries = append(e.Entries, JsonStreamEntry{Id: kv.Key, Fields: kv.Data})
+	}
+
+	if !entry.Expire.IsZero() {
+		e.ExpireAt = entry.Expire.UnixMilli()
+	}
+
+	if entry.Type == STREAM && !streamMetaImplied(entry) {
+		e.LastId, e.EntriesAdded, e.MaxDeletedId = entry.StreamMeta.LastId, entry.StreamMeta.EntriesAdded, entry.StreamMeta.MaxDeletedId
+	}
+
+	return e
+}
+
+// RdbEntry converts the exported key back, the type is validated as it comes from the file
+func (e JsonEntry) RdbEntry() (*RdbEntry, error) {
+	entry := &RdbEntry{Db: e.Db, Key: e.Key, Value: e.Value}
+	entry.StreamMeta = storage.StreamMeta{LastId: e.LastId, EntriesAdded: e.EntriesAdded, MaxDeletedId: e.MaxDeletedId}
+	switch e.Type {
+	case "string":
+		entry.Type = STRING
+	case "stream":
+		entry.Type = STREAM
+	default:
+		return nil, fmt.Errorf("unsupported type")
+	}
+
+	for _, kv := range e.Entries {
+		entry.Stream = append(entry.Stream, storage.StreamKV{Key: kv.Id, Data: kv.Fields})
+	}
+
+	if e.ExpireAt != 0 {
+		entry.Expire = time.UnixMilli(e.ExpireAt)
+	}
+
+	return entry, nil
+}
+
+// EntryCommands returns commands recreating the entry in the selected db, expire time is absolute
+func EntryCommands(entry *RdbEntry) []*Array {
+	if entry.Type == STREAM {
+		cmds := make([]*Array, 0, len(entry.Stream))
+		for _, kv := range entry.Stream {
+			cmds = append(cmds, exportCommand(append([]string{"XADD", entry.Key, kv.Key}, kv.Data...)...))
+		}
+
+		if streamMetaImplied(entry) {
+			return cmds
+		}
+
+		meta := entry.StreamMeta
+		if meta.LastId == "" {
+			meta.LastId = entry.Stream[len(entry.Stream)-1].Key
+		}
+
+		if meta.MaxDeletedId == "" {
+			meta.MaxDeletedId = "0-0"
+		}
+
+		if meta.EntriesAdded < uint64(len(entry.Stream)) {
+			meta.EntriesAdded = uint64(len(entry.Stream))
+		}
+
+		// stream emptied by XDEL is created by adding the last entry again
+		if len(entry.Stream) == 0 {
+			cmds = append(cmds, exportCommand("XADD", entry.Key, meta.LastId, "", ""), exportCommand("XDEL", entry.Key, meta.LastId))
+		}
+
+		return append(cmds, exportCommand("XSETID", entry.Key, meta.LastId,
+			"ENTRIESADDED", strconv.FormatUint(meta.EntriesAdded, 10), "MAXDELETEDID", meta.MaxDeletedId))
+	}
+
+	set := exportCommand("SET", entry.Key, entry.Value)
+	if !entry.Expire.IsZero() {
+		set.Append(BulkString{S: []byte("PXAT")})
+		set.Append(BulkString{S: []byte(strconv.FormatInt(entry.Expire.UnixMilli(), 10))})
+	}
+
+	return []*Array{set}
+}
+
+// streamMetaImplied reports whether adding the entries alone restores metadata of the stream
+func streamMetaImplied(entry *RdbEntry) bool {
+	meta := entry.StreamMeta
+	if len(entry.Stream) == 0 {
+		return meta.LastId == ""
+	}
+
+	return meta.MaxDeletedId == "" && meta.EntriesAdded <= uint64(len(entry.Stream)) &&
+		(meta.LastId == "" || meta.LastId == entry.Stream[len(entry.Stream)-1].Key)
+}
+
+// SnapshotEntries visits keys of the dbs in the order they are written to the rdb
+func SnapshotEntries(dbs []*storage.DbSnapshot, visit func(entry *RdbEntry) error) error {
+	for _, db := range dbs {
+		for _, key := range sortedKeys(db.Strings) {
+			elem := db.Strings[key]
+			if err := visit(&RdbEntry{Db: db.Index, Type: STRING, Key: key, Value: elem.Value, Expire: elem.Expire}); err != nil {
+				return err
+			}
+		}
+
+		for _, key := range sortedKeys(db.Streams) {
+			stream := db.Streams[key]
+			if err := visit(&RdbEntry{Db: db.Index, Type: STREAM, Key: key, Stream: stream.Entries, StreamMeta: stream.StreamMeta,
+				StreamGroups: stream.Groups}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Exporter writes keys as json array or as commands recreating them, Close completes the output.
+// Consumer groups of streams have no command form, they are dropped with a warning
+type Exporter struct {
+	w      *bufio.Writer
+	json   *json.Encoder
+	logger *log.Logger
+	format string
+	db     int
+	n      int
+}
+
+func NewExporter(w io.Writer, format string) (*Exporter, error) {
+	if format != EXPORT_JSON && format != EXPORT_RESP {
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+
+	bw := bufio.NewWriter(w)
+	logger := log.New(os.Stdout, "EXPORT ", log.LstdFlags)
+	return &Exporter{w: bw, json: json.NewEncoder(bw), logger: logger, format: format, db: -1}, nil
+}
+
+func (e *Exporter) Write(entry *RdbEntry) error {
+	defer func() {
+		e.n++
+	}()
+
+	if len(entry.StreamGroups) != 0 {
+		e.logger.Printf("Warning: %d consumer groups of stream %q in db %d are not exported", len(entry.StreamGroups), entry.Key, entry.Db)
+	}
+
+	if e.format == EXPORT_JSON {
+		if e.n == 0 {
+			e.w.WriteString("[")
+		} else {
+			e.w.WriteString(",")
+		}
+
+		return e.json.Encode(NewJsonEntry(entry))
+	}
+
+	if entry.Db != e.db {
+		e.db = entry.Db
+		if _, err := exportCommand("SELECT", strconv.Itoa(e.db)).MarshalRESP(e.w); err != nil {
+			return err
+		}
+	}
+
+	for _, cmd := range EntryCommands(entry) {
+		if _, err := cmd.MarshalRESP(e.w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Exporter) Close() error {
+	if e.format == EXPORT_JSON {
+		if e.n == 0 {
+			e.w.WriteString("[")
+		}
+
+		e.w.WriteString("]\n")
+	}
+
+	return e.w.Flush()
+}
+
+func exportCommand(args ...string) *Array {
+	cmd := &Array{A: make([]Marshaller, 0, len(args))}
+	for _, arg := range args {
+		cmd.Append(BulkString{S: []byte(arg)})
+	}
+
+	return cmd
+}
@@ -1,10 +1,10 @@
 package encoding
 
 import (
-	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 )
 
 const (
@@ -16,89 +16,136 @@ const (
 	RDB_8BIT_STR__AS_INT = 0x03
 	RDB_16BIT_STR_AS_INT = 0x07
 	RDB_32BIT_STR_AS_INT = 0x0b
+
+	// first byte of 32 and 64 bit lengths as stored in the rdb files
+	RDB_32BIT_LEN = 0x80
+	RDB_64BIT_LEN = 0x81
+	// first byte of lzf compressed strings
+	RDB_LZF_STR = 0xc3
 )
 
-func Decode(r *bufio.Reader) (n uint32, isIntString bool, err error) {
-	b, err := r.Peek(1)
+// ByteReader is satisfied by *bufio.Reader, rdb is read byte by byte so that the reader is left
+// right after the rdb, e.g. when it is followed by commands of the append only file
+type ByteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Decode reads length encoded value, the two most significant bits of the first byte select the format:
+// 00 - 6 bit length, 01 - 14 bit length, 10 - 32 or 64 bit big endian length that follows,
+// 11 - string encoded as a signed integer of 8, 16 or 32 bits which is returned sign extended with isIntString set
+func Decode(r ByteReader) (n uint32, isIntString bool, err error) {
+	b, err := r.ReadByte()
 	if err != nil {
 		return 0, false, err
 	}
 
-	if b[0]&0xc0 == 0 {
-		if _, err := r.Discard(1); err != nil {
-			return 0, false, err
-		}
+	return decodeLength(b, r)
+}
 
-		return uint32(b[0]), false, nil
+func decodeLength(b byte, r ByteReader) (n uint32, isIntString bool, err error) {
+	length, isIntString, err := decodeLength64(b, r)
+	if err != nil {
+		return 0, false, err
 	}
 
-	if b[0]&0x40 != 0 && b[0]&0x80 == 0 {
-		b, err = r.Peek(2)
-		if err != nil {
-			return 0, false, err
-		}
-		if _, err := r.Discard(2); err != nil {
-			return 0, false, err
-		}
-
-		return uint32(binary.LittleEndian.Uint16(b) << 2), false, nil
+	if !isIntString && length > math.MaxUint32 {
+		return 0, false, fmt.Errorf("length %d is too big", length)
 	}
 
-	if b[0]&0x40 == 0 && b[0]&0x80 != 0 {
-		b, err = r.Peek(5)
-		if _, err := r.Discard(5); err != nil {
-			return 0, false, err
-		}
+	return uint32(length), isIntString, nil
+}
 
-		if err != nil {
-			return 0, false, err
-		}
+// DecodeUint64 reads length encoded number that may not fit into 32 bits, e.g. stream ids
+func DecodeUint64(r ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
 
-		return binary.LittleEndian.Uint32(b[1:]), false, nil
+	n, isIntString, err := decodeLength64(b, r)
+	if err == nil && isIntString {
+		return 0, fmt.Errorf("unexpected string encoded as integer %#x", b)
 	}
 
-	switch b[0] ^ 0xc0 {
-	case 0:
-		if _, err := r.Discard(1); err != nil {
-			return 0, false, err
-		}
-		b, err = r.Peek(1)
-		if err != nil {
-			return 0, false, err
-		}
-		if _, err := r.Discard(1); err != nil {
-			return 0, false, err
-		}
+	return n, err
+}
 
-		return uint32(b[0]), true, nil
+func decodeLength64(b byte, r ByteReader) (n uint64, isIntString bool, err error) {
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
 	case 1:
-		if _, err := r.Discard(1); err != nil {
-			return 0, true, err
-		}
-
-		b, err = r.Peek(2)
+		next, err := r.ReadByte()
 		if err != nil {
 			return 0, false, err
 		}
-		if _, err := r.Discard(2); err != nil {
-			return 0, false, err
-		}
-		return uint32(binary.LittleEndian.Uint16(b)), true, nil
+
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
 	case 2:
-		if _, err := r.Discard(1); err != nil {
-			return 0, false, err
+		switch b {
+		case RDB_32BIT_LEN:
+			buff := make([]byte, 4)
+			if _, err = io.ReadFull(r, buff); err != nil {
+				return 0, false, err
+			}
+
+			return uint64(binary.BigEndian.Uint32(buff)), false, nil
+		case RDB_64BIT_LEN:
+			buff := make([]byte, 8)
+			if _, err = io.ReadFull(r, buff); err != nil {
+				return 0, false, err
+			}
+
+			return binary.BigEndian.Uint64(buff), false, nil
 		}
-		b, err = r.Peek(4)
-		if err != nil {
-			return 0, false, err
-		}
-		if _, err := r.Discard(4); err != nil {
-			return 0, false, err
+	case 3:
+		switch b & 0x3f {
+		case 0:
+			v, err := r.ReadByte()
+			if err != nil {
+				return 0, false, err
+			}
+
+			return uint64(uint32(int8(v))), true, nil
+		case 1:
+			buff := make([]byte, 2)
+			if _, err = io.ReadFull(r, buff); err != nil {
+				return 0, false, err
+			}
+
+			return uint64(uint32(int16(binary.LittleEndian.Uint16(buff)))), true, nil
+		case 2:
+			buff := make([]byte, 4)
+			if _, err = io.ReadFull(r, buff); err != nil {
+				return 0, false, err
+			}
+
+			return uint64(binary.LittleEndian.Uint32(buff)), true, nil
 		}
-		return binary.LittleEndian.Uint32(b), true, nil
 	}
 
-	return 0, false, fmt.Errorf("unknown encoding")
+	return 0, false, fmt.Errorf("unknown encoding %#x", b)
+}
+
+// EncodeLength writes n in the smallest length encoding format read by Decode
+func EncodeLength(w io.Writer, n uint64) (int, error) {
+	switch {
+	case n < 1<<6:
+		return w.Write([]byte{byte(n)})
+	case n < 1<<14:
+		return w.Write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= math.MaxUint32:
+		b := make([]byte, 5)
+		b[0] = RDB_32BIT_LEN
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return w.Write(b)
+	default:
+		b := make([]byte, 9)
+		b[0] = RDB_64BIT_LEN
+		binary.BigEndian.PutUint64(b[1:], n)
+		return w.Write(b)
+	}
 }
 
 // Encode encodes a number n in little endian with the specified format and writes it to w.
@@ -0,0 +1,235 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	LP_HEADER_SIZE = 6
+	LP_EOF         = 0xff
+	// number of elements stored in the header when it does not fit into 16 bits
+	LP_NUMELE_UNKNOWN = math.MaxUint16
+)
+
+// Listpack is a serialized sequence of strings and integers: 4 bytes of total size and 2 bytes of number
+// of elements (both little endian), elements each followed by its backward length and the terminator
+type Listpack struct {
+	b   []byte
+	len int
+}
+
+func NewListpack() *Listpack {
+	return &Listpack{b: make([]byte, LP_HEADER_SIZE, 256)}
+}
+
+// Append appends s, strings holding canonical integers are stored as integers as redis does
+func (lp *Listpack) Append(s string) {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+		lp.AppendInt(v)
+		return
+	}
+
+	start := len(lp.b)
+	switch n := len(s); {
+	case n < 1<<6:
+		lp.b = append(lp.b, 0x80|byte(n))
+	case n < 1<<12:
+		lp.b = append(lp.b, 0xe0|byte(n>>8), byte(n))
+	default:
+		lp.b = append(lp.b, 0xf0)
+		lp.b = binary.LittleEndian.AppendUint32(lp.b, uint32(n))
+	}
+
+	lp.b = append(lp.b, s...)
+	lp.appendBacklen(len(lp.b) - start)
+}
+
+func (lp *Listpack) AppendInt(v int64) {
+	start := len(lp.b)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.b = append(lp.b, byte(v))
+	case v >= -1<<12 && v < 1<<12:
+		uv := uint16(v) & 0x1fff
+		lp.b = append(lp.b, 0xc0|byte(uv>>8), byte(uv))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		lp.b = append(lp.b, 0xf1)
+		lp.b = binary.LittleEndian.AppendUint16(lp.b, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		lp.b = append(lp.b, 0xf2, byte(v), byte(v>>8), byte(v>>16))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		lp.b = append(lp.b, 0xf3)
+		lp.b = binary.LittleEndian.AppendUint32(lp.b, uint32(v))
+	default:
+		lp.b = append(lp.b, 0xf4)
+		lp.b = binary.LittleEndian.AppendUint64(lp.b, uint64(v))
+	}
+
+	lp.appendBacklen(len(lp.b) - start)
+}
+
+// appendBacklen writes length of the element so that listpack can be iterated backwards,
+// the most significant 7 bits go first and every byte except the first has the highest bit set
+func (lp *Listpack) appendBacklen(l int) {
+	size := backlenSize(l)
+	for i := size - 1; i >= 0; i-- {
+		b := byte(l>>(7*i)) & 0x7f
+		if i != size-1 {
+			b |= 0x80
+		}
+		lp.b = append(lp.b, b)
+	}
+
+	lp.len++
+}
+
+func backlenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+
+	return 5
+}
+
+func (lp *Listpack) Len() int {
+	return lp.len
+}
+
+// Size returns number of bytes of the serialized listpack
+func (lp *Listpack) Size() int {
+	return len(lp.b) + 1
+}
+
+func (lp *Listpack) Bytes() []byte {
+	b := append(lp.b, LP_EOF)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	numele := lp.len
+	if numele > LP_NUMELE_UNKNOWN {
+		numele = LP_NUMELE_UNKNOWN
+	}
+
+	binary.LittleEndian.PutUint16(b[4:], uint16(numele))
+	return b
+}
+
+// ReadListpack returns elements of the serialized listpack, integers are formatted as decimal strings
+func ReadListpack(b []byte) ([]string, error) {
+	if len(b) < LP_HEADER_SIZE+1 || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, fmt.Errorf("invalid listpack size")
+	}
+
+	elements := make([]string, 0, binary.LittleEndian.Uint16(b[4:]))
+	for p := LP_HEADER_SIZE; ; {
+		if p >= len(b) {
+			return nil, fmt.Errorf("listpack is not terminated")
+		}
+
+		if b[p] == LP_EOF {
+			if p != len(b)-1 {
+				return nil, fmt.Errorf("unexpected listpack terminator at %d", p)
+			}
+
+			return elements, nil
+		}
+
+		element, n, err := readListpackElement(b[p:])
+		if err != nil {
+			return nil, err
+		}
+
+		elements = append(elements, element)
+		p += n + backlenSize(n)
+	}
+}
+
+// readListpackElement returns element and size of its encoding without the backward length
+func readListpackElement(b []byte) (string, int, error) {
+	var (
+		v    int64
+		size int
+		need = func(n int) error {
+			if len(b) < n {
+				return fmt.Errorf("listpack element out of bounds")
+			}
+			return nil
+		}
+	)
+
+	switch enc := b[0]; {
+	case enc&0x80 == 0:
+		return strconv.Itoa(int(enc)), 1, nil
+	case enc&0xc0 == 0x80:
+		n := int(enc & 0x3f)
+		if err := need(1 + n); err != nil {
+			return "", 0, err
+		}
+		return string(b[1 : 1+n]), 1 + n, nil
+	case enc&0xe0 == 0xc0:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		uv := int64(enc&0x1f)<<8 | int64(b[1])
+		if uv >= 1<<12 {
+			uv -= 1 << 13
+		}
+		return strconv.FormatInt(uv, 10), 2, nil
+	case enc&0xf0 == 0xe0:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		n := int(enc&0x0f)<<8 | int(b[1])
+		if err := need(2 + n); err != nil {
+			return "", 0, err
+		}
+		return string(b[2 : 2+n]), 2 + n, nil
+	case enc == 0xf0:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		n := int(binary.LittleEndian.Uint32(b[1:]))
+		if err := need(5 + n); err != nil {
+			return "", 0, err
+		}
+		return string(b[5 : 5+n]), 5 + n, nil
+	case enc == 0xf1:
+		size = 2
+	case enc == 0xf2:
+		size = 3
+	case enc == 0xf3:
+		size = 4
+	case enc == 0xf4:
+		size = 8
+	default:
+		return "", 0, fmt.Errorf("unknown listpack encoding %#x", enc)
+	}
+
+	if err := need(1 + size); err != nil {
+		return "", 0, err
+	}
+
+	switch size {
+	case 2:
+		v = int64(int16(binary.LittleEndian.Uint16(b[1:])))
+	case 3:
+		v = int64(b[1]) | int64(b[2])<<8 | int64(b[3])<<16
+		if v >= 1<<23 {
+			v -= 1 << 24
+		}
+	case 4:
+		v = int64(int32(binary.LittleEndian.Uint32(b[1:])))
+	case 8:
+		v = int64(binary.LittleEndian.Uint64(b[1:]))
+	}
+
+	return strconv.FormatInt(v, 10), 1 + size, nil
+}
@@ -0,0 +1,48 @@
+package encoding
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListpack(t *testing.T) {
+	elements := []string{
+		"0", "127", "128", "-1", "4095", "-4096", "4096", "32767", "-32768", "8388607", "-8388608",
+		"2147483647", "-2147483648", "9223372036854775807", "-9223372036854775808",
+		"", "a", "007", "+1", strings.Repeat("b", 63), strings.Repeat("c", 64), strings.Repeat("d", 4095),
+		strings.Repeat("e", 4096),
+	}
+
+	lp := NewListpack()
+	for _, e := range elements {
+		lp.Append(e)
+	}
+
+	b := lp.Bytes()
+	got, err := ReadListpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, elements) {
+		t.Errorf("expected %v, got %v", elements, got)
+	}
+
+	// listpack of "a", 1 and -1 as serialized by redis
+	expected := []byte{15, 0, 0, 0, 3, 0, 0x81, 'a', 2, 1, 1, 0xdf, 0xff, 2, 0xff}
+	lp = NewListpack()
+	lp.Append("a")
+	lp.AppendInt(1)
+	lp.AppendInt(-1)
+	if !bytes.Equal(lp.Bytes(), expected) {
+		t.Errorf("expected %v, got %v", expected, lp.Bytes())
+	}
+
+	for _, invalid := range [][]byte{b[:len(b)-1], {7, 0, 0, 0, 0, 0, 0}, {8, 0, 0, 0, 1, 0, 0x85, 0xff}} {
+		if _, err = ReadListpack(invalid); err == nil {
+			t.Errorf("expected error reading %v", invalid)
+		}
+	}
+}
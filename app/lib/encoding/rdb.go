@@ -10,7 +10,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -25,8 +27,16 @@ var (
 	EXPIRETIME     = byte(0xfd)
 	DB             = byte(0xfe)
 	EOF            = byte(0xff)
+	IDLE           = byte(0xf8)
+	FREQ           = byte(0xf9)
 	STRING         = byte(0x00)
 	STREAM         = byte(0x15)
+	RDB_VERSION    = "0011"
+)
+
+const (
+	RDB_EOF_PREFIX   = "EOF:"
+	RDB_EOF_MARK_LEN = 40
 )
 
 type Rdb struct {
@@ -34,6 +44,7 @@ type Rdb struct {
 	db       *sync.Map
 	version  []byte
 	metadata map[string]string
+	checksum uint64
 }
 
 func NewRdb(db *sync.Map) *Rdb {
@@ -60,12 +71,37 @@ func (rdb *Rdb) UnmarshalRESP(r *bufio.Reader) error {
 		return err
 	}
 
-	length, err := strconv.ParseInt(string(str[:len(str)-1]), 10, 64)
-	if err != nil {
+	header := string(str[:len(str)-1])
+	if _, err = r.Discard(len(TERMINATOR) - 1); err != nil {
 		return err
 	}
 
-	if _, err = r.Discard(len(TERMINATOR) - 1); err != nil {
+	// diskless transfer does not know the length upfront, instead the rdb is followed by the random mark
+	if strings.HasPrefix(header, RDB_EOF_PREFIX) {
+		mark := strings.TrimPrefix(header, RDB_EOF_PREFIX)
+		if len(mark) != RDB_EOF_MARK_LEN {
+			return fmt.Errorf("invalid rdb EOF mark %q", mark)
+		}
+
+		rdb.logger.Printf("Got diskless rdb with mark %s", mark)
+		if err = rdb.Load(r); err != nil {
+			return err
+		}
+
+		end := make([]byte, len(mark))
+		if _, err = io.ReadFull(r, end); err != nil {
+			return err
+		}
+
+		if string(end) != mark {
+			return fmt.Errorf("expected rdb EOF mark %q, got %q", mark, end)
+		}
+
+		return nil
+	}
+
+	length, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
 		return err
 	}
 
@@ -77,13 +113,46 @@ func (rdb *Rdb) UnmarshalRESP(r *bufio.Reader) error {
 	return nil
 }
 
+// RdbEntry is a key read from the rdb file, Size is the number of bytes taken by the encoded key and value
+type RdbEntry struct {
+	Db     int
+	Key    string
+	Type   byte
+	Value  string
+	Stream []storage.StreamKV
+	// StreamMeta keeps ids of the deleted entries from being reissued
+	StreamMeta   storage.StreamMeta
+	StreamGroups []storage.StreamGroup
+	Expire       time.Time
+	Size         int64
+}
+
+// Load reads rdb into the dbs
 func (rd *Rdb) Load(r *bufio.Reader) error {
+	dbs := make(map[int]*storage.RedisDataTypes)
+	return rd.Walk(r, func(entry *RdbEntry) error {
+		db, ok := dbs[entry.Db]
+		if !ok {
+			var err error
+			if db, err = rd.getDb(entry.Db); err != nil {
+				return err
+			}
+
+			dbs[entry.Db] = db
+		}
+
+		return StoreEntry(db, entry)
+	})
+}
+
+// Walk parses rdb calling visit for every key. The checksum is verified unless it is zero,
+// which means that checksum was disabled when the file was saved.
+func (rd *Rdb) Walk(r *bufio.Reader, visit func(entry *RdbEntry) error) error {
 	start := time.Now()
+	cr := &Crc64Reader{R: r}
 	magicString := make([]byte, len(MAGICSTRING))
-	_, err := r.Read(magicString)
-	if err != nil {
-		err = fmt.Errorf("error reading magic string %w", err)
-		return nil
+	if _, err := io.ReadFull(cr, magicString); err != nil {
+		return fmt.Errorf("error reading magic string %w", err)
 	}
 
 	if !bytes.Equal(magicString, MAGICSTRING) {
@@ -91,155 +160,305 @@ func (rd *Rdb) Load(r *bufio.Reader) error {
 	}
 
 	rd.logger.Println("Read magic string")
-	if _, err = r.Read(rd.version); err != nil {
+	if _, err := io.ReadFull(cr, rd.version); err != nil {
 		return err
 	}
 
 	rd.logger.Printf("RDB version: %s", rd.version)
-	if err = peekAndAssert(r, []byte{METADATA}); err != nil {
-		return err
-	}
+	var (
+		db     int
+		expire time.Time
+	)
 
-	metadata, err := r.ReadSlice(DB)
-	if err = r.UnreadByte(); err != nil {
-		return err
-	}
-
-	mReader := bufio.NewReader(bytes.NewBuffer(metadata[:len(metadata)-1]))
-	for err := peekAndAssert(mReader, []byte{METADATA}); err != nil; err = peekAndAssert(mReader, []byte{METADATA}) {
-		mReader.Discard(1)
-		key, err := DecodeString(mReader)
+	for {
+		offset := cr.N
+		op, err := cr.ReadByte()
 		if err != nil {
-			rd.logger.Printf("Error decoding metadata key: %s", err)
 			return err
 		}
 
-		value, err := DecodeString(mReader)
-		if err != nil {
-			return err
+		switch op {
+		case METADATA:
+			key, err := DecodeString(cr)
+			if err != nil {
+				rd.logger.Printf("Error decoding metadata key: %s", err)
+				return err
+			}
+
+			value, err := DecodeString(cr)
+			if err != nil {
+				return err
+			}
+
+			rd.metadata[key] = value
+		case DB:
+			// Note redis db index max is 2^4 - 1
+			idx, _, err := Decode(cr)
+			if err != nil {
+				return err
+			}
+
+			rd.logger.Printf("Reading DB %d", idx)
+			db = int(idx)
+		case RESIZEDB:
+			if _, _, err = Decode(cr); err != nil {
+				return err
+			}
+
+			if _, _, err = Decode(cr); err != nil {
+				return err
+			}
+		case EXPIRETIME:
+			kvExpire := make([]byte, 4)
+			if _, err = io.ReadFull(cr, kvExpire); err != nil {
+				return err
+			}
+
+			expire = time.Unix(int64(binary.LittleEndian.Uint32(kvExpire)), 0)
+		case EXPIRETIMEMS:
+			kvExpire := make([]byte, 8)
+			if _, err = io.ReadFull(cr, kvExpire); err != nil {
+				return err
+			}
+
+			expire = time.UnixMilli(int64(binary.LittleEndian.Uint64(kvExpire)))
+		case IDLE:
+			if _, _, err = Decode(cr); err != nil {
+				return err
+			}
+		case FREQ:
+			if _, err = cr.ReadByte(); err != nil {
+				return err
+			}
+		case EOF:
+			expected := cr.Crc
+			checksum := make([]byte, 8)
+			if _, err := io.ReadFull(r, checksum); err != nil {
+				return err
+			}
+
+			rd.checksum = binary.LittleEndian.Uint64(checksum)
+			if rd.checksum != 0 && rd.checksum != expected {
+				return fmt.Errorf("wrong rdb checksum expected %#x, got %#x", expected, rd.checksum)
+			}
+
+			rd.logger.Printf("Done parsing RDB in %s", time.Since(start))
+			return nil
+		default:
+			entry := &RdbEntry{Db: db, Type: op, Expire: expire}
+			if err = rd.readKey(cr, entry); err != nil {
+				return fmt.Errorf("error reading key at offset %d: %w", offset, err)
+			}
+
+			entry.Size = cr.N - offset
+			if visit != nil {
+				if err = visit(entry); err != nil {
+					return err
+				}
+			}
+
+			expire = time.Time{}
 		}
+	}
+}
 
-		rd.metadata[key] = value
+func (rd *Rdb) getDb(idx int) (*storage.RedisDataTypes, error) {
+	dbAny, _ := rd.db.LoadOrStore(idx, storage.NewDb(idx))
+	db, ok := dbAny.(*storage.RedisDataTypes)
+	if !ok {
+		return nil, fmt.Errorf("failed to assert type of db with index %d", idx)
 	}
 
-	if err := rd.readDb(r); err != nil {
-		return nil
+	return db, nil
+}
+
+func (rd *Rdb) readKey(r ByteReader, entry *RdbEntry) (err error) {
+	if entry.Key, err = DecodeString(r); err != nil {
+		return err
 	}
 
-	r.Discard(1)
-	checksum := make([]byte, 2)
-	if _, err := r.Read(checksum); err != nil {
+	return readValue(r, entry)
+}
+
+// readValue reads value of entry.Type, values are not length prefixed, so unknown type can not be skipped
+func readValue(r ByteReader, entry *RdbEntry) (err error) {
+	// Note: if extend new types decompose into type ValueType with parse method
+	switch entry.Type {
+	case STRING:
+		entry.Value, err = DecodeString(r)
+		return err
+	case STREAM, STREAM_LISTPACKS, STREAM_LISTPACKS_2:
+		entry.Stream, entry.StreamMeta, entry.StreamGroups, err = readStream(r, entry.Type)
+		// streams are always loaded into the latest encoding
+		entry.Type = STREAM
 		return err
+	default:
+		return fmt.Errorf("unsupported value type %d of key %q", entry.Type, entry.Key)
 	}
+}
 
-	rd.logger.Printf("Done parsing RDB in %s", time.Since(start))
-	return nil
+func writeValue(w io.Writer, entry *RdbEntry) error {
+	switch entry.Type {
+	case STRING:
+		_, err := EncodeString(w, entry.Value)
+		return err
+	case STREAM:
+		return writeStream(w, entry.Stream, entry.StreamMeta, entry.StreamGroups)
+	default:
+		return fmt.Errorf("unsupported value type %d of key %q", entry.Type, entry.Key)
+	}
 }
 
-func (rd *Rdb) readDb(r *bufio.Reader) error {
-	for idx, _, _, err := rd.assertAndReadDbMetadata(r); err == nil; idx, _, _, err = rd.assertAndReadDbMetadata(r) {
-		// Note redis db index max is 2^4 - 1
-		dbAny, _ := rd.db.LoadOrStore(int(idx), storage.NewDb(int(idx)))
-		db, ok := dbAny.(*storage.RedisDataTypes)
-		if !ok {
-			return fmt.Errorf("failed to assert type of db with index %d", idx)
-		}
+// StoreEntry sets value of the entry in db, expired entries are skipped
+func StoreEntry(db *storage.RedisDataTypes, entry *RdbEntry) error {
+	if !entry.Expire.IsZero() && entry.Expire.Before(time.Now()) {
+		return nil
+	}
 
-		if err = rd.readDbKeys(r, db); err != nil {
+	switch entry.Type {
+	case STRING:
+		return db.GetStorage(storage.STRINGS).(storage.StringsStorage).Set(entry.Key, entry.Value, entry.Expire)
+	case STREAM:
+		stream, err := db.GetStorage(storage.STREAMS).(*storage.StreamsIdx).GetOrCreateStream(entry.Key)
+		if err != nil {
 			return err
 		}
 
+		for _, kv := range entry.Stream {
+			if _, _, _, err = stream.Add(kv.Key, kv.Data); err != nil {
+				return fmt.Errorf("error adding entry %s to stream %q: %w", kv.Key, entry.Key, err)
+			}
+		}
+
+		// entries of the stream without metadata, e.g. imported from json, are the only ones ever added
+		meta := stream.Meta()
+		if storage.CompareStreamIds(entry.StreamMeta.LastId, meta.LastId) > 0 {
+			meta.LastId = entry.StreamMeta.LastId
+		}
+
+		if entry.StreamMeta.EntriesAdded > meta.EntriesAdded {
+			meta.EntriesAdded = entry.StreamMeta.EntriesAdded
+		}
+
+		meta.MaxDeletedId = entry.StreamMeta.MaxDeletedId
+		stream.SetMeta(meta)
+		stream.SetGroups(entry.StreamGroups)
+		return nil
 	}
 
-	return nil
+	return fmt.Errorf("unsupported value type %d of key %q", entry.Type, entry.Key)
 }
 
-func (rd *Rdb) readDbKeys(r *bufio.Reader, db *storage.RedisDataTypes) error {
-	for {
-		b, err := r.Peek(1)
-		if err != nil {
-			return err
-		}
+func (rd *Rdb) Version() string {
+	return string(rd.version)
+}
 
-		vType := b[0]
-		r.Discard(1)
-		expireTime := time.Time{}
-		switch b[0] {
-		case EOF, DB:
-			return nil
-		case EXPIRETIME:
-			kvExpire := make([]byte, 4)
-			if _, err = r.Read(kvExpire); err != nil {
-				return err
-			}
+func (rd *Rdb) Metadata() map[string]string {
+	return rd.metadata
+}
 
-			vType, _ = r.ReadByte()
+// Checksum returns checksum stored in the rdb, zero if the checksum was disabled
+func (rd *Rdb) Checksum() uint64 {
+	return rd.checksum
+}
 
-			expireTime = time.Unix(int64(binary.LittleEndian.Uint32(kvExpire)), 0)
-		case EXPIRETIMEMS:
-			kvExpire := make([]byte, 8)
-			if _, err = r.Read(kvExpire); err != nil {
-				return err
-			}
+func (rd *Rdb) SetLogOutput(w io.Writer) {
+	rd.logger.SetOutput(w)
+}
 
-			vType, _ = r.ReadByte()
-			expireTime = time.UnixMilli(int64(binary.LittleEndian.Uint64(kvExpire)))
-		}
+// WriteRdb writes dbs and metadata as auxiliary fields in rdb format followed by the checksum
+func WriteRdb(w io.Writer, dbs []*storage.DbSnapshot, metadata map[string]string) (int64, error) {
+	cw := &Crc64Writer{W: w}
+	bw := bufio.NewWriter(cw)
+	bw.Write(MAGICSTRING)
+	bw.WriteString(RDB_VERSION)
+	for _, key := range sortedKeys(metadata) {
+		bw.WriteByte(METADATA)
+		EncodeString(bw, key)
+		EncodeString(bw, metadata[key])
+	}
 
-		key, err := DecodeString(r)
-		if err != nil {
-			return err
+	for _, db := range dbs {
+		if db.Len() == 0 {
+			continue
 		}
 
-		value, err := DecodeString(r)
-		if err != nil {
-			return err
+		expires := 0
+		for _, elem := range db.Strings {
+			if !elem.Expire.IsZero() {
+				expires++
+			}
 		}
 
-		// Note: if extend new types decompose into type ValueType with parse method
-		switch vType {
-		case STRING:
-			db.GetStorage(storage.STRINGS).(storage.StringsStorage).Set(key, value, expireTime)
-		default:
-			rd.logger.Printf("skipping unknown type: %d", vType)
-		}
+		bw.WriteByte(DB)
+		EncodeLength(bw, uint64(db.Index))
+		bw.WriteByte(RESIZEDB)
+		EncodeLength(bw, uint64(db.Len()))
+		EncodeLength(bw, uint64(expires))
+		for _, key := range sortedKeys(db.Strings) {
+			elem := db.Strings[key]
+			if !elem.Expire.IsZero() {
+				expire := make([]byte, 8)
+				binary.LittleEndian.PutUint64(expire, uint64(elem.Expire.UnixMilli()))
+				bw.WriteByte(EXPIRETIMEMS)
+				bw.Write(expire)
+			}
 
-	}
-}
+			if err := writeEntry(bw, &RdbEntry{Type: STRING, Key: key, Value: elem.Value}); err != nil {
+				return cw.N, err
+			}
+		}
 
-func (rd *Rdb) assertAndReadDbMetadata(r *bufio.Reader) (idx byte, resize uint32, expire uint32, err error) {
-	if err = peekAndAssert(r, []byte{DB}); err != nil {
-		return
+		for _, key := range sortedKeys(db.Streams) {
+			stream := db.Streams[key]
+			if err := writeEntry(bw, &RdbEntry{Type: STREAM, Key: key, Stream: stream.Entries, StreamMeta: stream.StreamMeta,
+				StreamGroups: stream.Groups}); err != nil {
+				return cw.N, err
+			}
+		}
 	}
 
-	r.Discard(1)
-	rd.logger.Printf("Reading DB metadata\n")
-	idx, err = r.ReadByte()
-	if err != nil {
-		return
+	bw.WriteByte(EOF)
+	if err := bw.Flush(); err != nil {
+		return cw.N, err
 	}
 
-	if err = peekAndAssert(r, []byte{RESIZEDB}); err != nil {
-		return
-	}
+	n, err := cw.WriteChecksum()
+	return cw.N + int64(n), err
+}
 
-	r.Discard(1)
-	if resize, _, err = Decode(r); err != nil {
-		return
-	}
+func writeEntry(w *bufio.Writer, entry *RdbEntry) error {
+	w.WriteByte(entry.Type)
+	EncodeString(w, entry.Key)
+	return writeValue(w, entry)
+}
 
-	if expire, _, err = Decode(r); err != nil {
-		return
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
 	}
 
-	return
+	sort.Strings(keys)
+	return keys
 }
 
 func (r *Rdb) MarshalRESP(w io.Writer) (int, error) {
 	return w.Write(EMPTYRDBRAW)
 }
 
-func (r *Rdb) FullResync(w io.Writer) (int, error) {
-	// For now return empty RDB
-	return w.Write([]byte(fmt.Sprintf("$%d\r\n%s", len(EMPTYRDBRAW), EMPTYRDBRAW)))
+// WriteRdbDiskless writes rdb framed as sent to replica by diskless sync, mark has to be RDB_EOF_MARK_LEN long
+func WriteRdbDiskless(w io.Writer, dbs []*storage.DbSnapshot, metadata map[string]string, mark string) (int64, error) {
+	n, err := fmt.Fprintf(w, "$%s%s\r\n", RDB_EOF_PREFIX, mark)
+	if err != nil {
+		return int64(n), err
+	}
+
+	written, err := WriteRdb(w, dbs, metadata)
+	if err != nil {
+		return int64(n) + written, err
+	}
+
+	m, err := io.WriteString(w, mark)
+	return int64(n+m) + written, err
 }
@@ -0,0 +1,225 @@
+package encoding
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadEmptyRdb(t *testing.T) {
+	rdb := NewRdb(&sync.Map{})
+	r := bufio.NewReader(bytes.NewReader(EMPTYRDBRAW))
+	if err := rdb.Load(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if rdb.metadata["redis-ver"] != "7.2.0" {
+		t.Errorf("expected redis-ver 7.2.0, got %q", rdb.metadata["redis-ver"])
+	}
+
+	if rdb.metadata["redis-bits"] != "64" {
+		t.Errorf("expected redis-bits 64, got %q", rdb.metadata["redis-bits"])
+	}
+
+	if r.Buffered() != 0 {
+		t.Errorf("expected rdb to be fully consumed, %d bytes left", r.Buffered())
+	}
+}
+
+func TestWriteRdb(t *testing.T) {
+	expire := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	dbs := []*storage.DbSnapshot{
+		{
+			Index: 0,
+			Strings: map[string]storage.StringsElement{
+				"foo":  {Value: "bar"},
+				"long": {Value: string(bytes.Repeat([]byte("a"), 100))},
+			},
+		},
+		{
+			Index: 3,
+			Strings: map[string]storage.StringsElement{
+				"baz": {Value: "qux", Expire: expire},
+			},
+		},
+	}
+
+	buff := bytes.NewBuffer(nil)
+	n, err := WriteRdb(buff, dbs, map[string]string{"redis-ver": "7.2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int(n) != buff.Len() {
+		t.Errorf("expected %d written bytes, got %d", buff.Len(), n)
+	}
+
+	raw := buff.Bytes()
+	if crc := binary.LittleEndian.Uint64(raw[len(raw)-8:]); crc != Crc64(0, raw[:len(raw)-8]) {
+		t.Errorf("invalid checksum %x", crc)
+	}
+
+	db := &sync.Map{}
+	rdb := NewRdb(db)
+	if err = rdb.Load(bufio.NewReader(buff)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, snapshot := range dbs {
+		dbAny, ok := db.Load(snapshot.Index)
+		if !ok {
+			t.Fatalf("db %d is not loaded", snapshot.Index)
+		}
+
+		loaded := dbAny.(*storage.RedisDataTypes).Snapshot()
+		for key, elem := range snapshot.Strings {
+			if loaded.Strings[key] != elem {
+				t.Errorf("expected %v for key %q, got %v", elem, key, loaded.Strings[key])
+			}
+		}
+	}
+}
+
+func TestWalkShouldVerifyChecksum(t *testing.T) {
+	corrupted := append([]byte(nil), EMPTYRDBRAW...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if err := NewRdb(&sync.Map{}).Walk(bufio.NewReader(bytes.NewReader(corrupted)), nil); err == nil {
+		t.Errorf("expected checksum error")
+	}
+
+	disabled := append([]byte(nil), EMPTYRDBRAW...)
+	copy(disabled[len(disabled)-8:], make([]byte, 8))
+	if err := NewRdb(&sync.Map{}).Walk(bufio.NewReader(bytes.NewReader(disabled)), nil); err != nil {
+		t.Errorf("expected zero checksum to be skipped, got %s", err)
+	}
+}
+
+func TestWriteRdbStreams(t *testing.T) {
+	entries := make([]storage.StreamKV, 0, 250)
+	for i := 0; i < 250; i++ {
+		data := []string{"temperature", fmt.Sprint(i), "humidity", "high"}
+		if i%7 == 0 {
+			data = []string{"event", "reset"}
+		}
+
+		entries = append(entries, storage.StreamKV{Key: fmt.Sprintf("%d-%d", 1700000000000+int64(i/3), i%3), Data: data})
+	}
+
+	// the last entries were deleted
+	meta := storage.StreamMeta{LastId: "1700000000100-0", MaxDeletedId: "1700000000100-0", EntriesAdded: 260}
+	dbs := []*storage.DbSnapshot{{Index: 1, Streams: map[string]storage.StreamSnapshot{
+		"sensor": {Entries: entries, StreamMeta: meta},
+	}}}
+	buff := bytes.NewBuffer(nil)
+	if _, err := WriteRdb(buff, dbs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded []*RdbEntry
+	if err := NewRdb(&sync.Map{}).Walk(bufio.NewReader(buff), func(entry *RdbEntry) error {
+		loaded = append(loaded, entry)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded) != 1 || loaded[0].Db != 1 || loaded[0].Key != "sensor" || loaded[0].Type != STREAM {
+		t.Fatalf("unexpected entries %+v", loaded)
+	}
+
+	if !reflect.DeepEqual(loaded[0].Stream, entries) {
+		t.Errorf("expected %v, got %v", entries, loaded[0].Stream)
+	}
+
+	if loaded[0].StreamMeta != meta {
+		t.Errorf("expected %+v, got %+v", meta, loaded[0].StreamMeta)
+	}
+}
+
+func TestStreamConsumerGroupsRoundTrip(t *testing.T) {
+	entries := []storage.StreamKV{{Key: "1-1", Data: []string{"a", "1"}}, {Key: "1-2", Data: []string{"a", "2"}}}
+	groups := []storage.StreamGroup{
+		{Name: "idle", LastId: "0-0", EntriesRead: -1},
+		{Name: "workers", LastId: "1-2", EntriesRead: 2, Pending: []storage.StreamPendingEntry{
+			{Id: "1-1", DeliveryTime: 1700000000000, DeliveryCount: 1},
+			{Id: "1-2", DeliveryTime: 1700000000001, DeliveryCount: 3},
+		}, Consumers: []storage.StreamConsumer{
+			{Name: "bob", SeenTime: 1700000000003, ActiveTime: 1700000000000},
+			{Name: "alice", SeenTime: 1700000000002, ActiveTime: 1700000000001, Pending: []string{"1-2", "1-1"}},
+		}},
+	}
+
+	buff := bytes.NewBuffer(nil)
+	if err := writeStream(buff, entries, storage.StreamMeta{}, groups); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, _, loadedGroups, err := readStream(bufio.NewReader(bytes.NewReader(buff.Bytes())), STREAM)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !reflect.DeepEqual(loaded, entries) {
+		t.Errorf("expected %v, got %v", entries, loaded)
+	}
+
+	if !reflect.DeepEqual(loadedGroups, groups) {
+		t.Errorf("expected %+v, got %+v", groups, loadedGroups)
+	}
+
+	// pending entry of the consumer is the last 16 bytes of the value
+	b := buff.Bytes()
+	b[len(b)-1] = 9
+	if _, _, _, err = readStream(bufio.NewReader(bytes.NewReader(b)), STREAM); err == nil || !strings.Contains(err.Error(), "1-9") {
+		t.Errorf("expected consumer entry missing from the group pending entries to be refused, got %v", err)
+	}
+}
+
+func TestRdbDisklessFraming(t *testing.T) {
+	dbs := []*storage.DbSnapshot{{Index: 0, Strings: map[string]storage.StringsElement{"foo": {Value: "bar"}}}}
+	mark := string(bytes.Repeat([]byte("m"), RDB_EOF_MARK_LEN))
+	buff := bytes.NewBuffer(nil)
+	n, err := WriteRdbDiskless(buff, dbs, nil, mark)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int(n) != buff.Len() {
+		t.Errorf("expected %d written bytes, got %d", buff.Len(), n)
+	}
+
+	buff.WriteString("*1\r\n$4\r\nPING\r\n")
+	db := &sync.Map{}
+	r := bufio.NewReader(buff)
+	if err = NewRdb(db).UnmarshalRESP(r); err != nil {
+		t.Fatal(err)
+	}
+
+	dbAny, ok := db.Load(0)
+	if !ok {
+		t.Fatal("db 0 is not loaded")
+	}
+
+	if elem := dbAny.(*storage.RedisDataTypes).Snapshot().Strings["foo"]; elem.Value != "bar" {
+		t.Errorf("expected bar, got %q", elem.Value)
+	}
+
+	if rest, _ := r.ReadString('\n'); rest != "*1\r\n" {
+		t.Errorf("expected stream to continue after the mark, got %q", rest)
+	}
+
+	corrupted := bytes.NewBuffer(nil)
+	WriteRdbDiskless(corrupted, dbs, nil, mark)
+	corrupted.Truncate(corrupted.Len() - 1)
+	corrupted.WriteString("x")
+	if err = NewRdb(&sync.Map{}).UnmarshalRESP(bufio.NewReader(corrupted)); err == nil {
+		t.Error("expected error for wrong mark")
+	}
+}
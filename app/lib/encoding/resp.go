@@ -12,6 +12,7 @@ import (
 var (
 	TERMINATOR       = []byte("\r\n")
 	BULKSTRINGNULL   = []byte("$-1\r\n")
+	ARRAYNULL        = []byte("*-1\r\n")
 	SimpleStringType = []byte("+")
 	SimpleErrorType  = []byte("-")
 	SimpleIntType    = []byte(":")
@@ -45,11 +46,11 @@ type SimpleString struct {
 }
 
 func (s SimpleString) MarshalRESP(w io.Writer) (int, error) {
-	buff := make([]byte, 0, 64)
-	buff = append(buff, SimpleStringType...)
-	buff = append(buff, []byte(s.S)...)
-	buff = append(buff, TERMINATOR...)
-	return w.Write(buff)
+	buff := getBuffer()
+	buff.b = append(buff.b, SimpleStringType...)
+	buff.b = append(buff.b, s.S...)
+	buff.b = append(buff.b, TERMINATOR...)
+	return buff.writeTo(w)
 }
 func (s *SimpleString) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
 	if err = peekAndAssert(r, SimpleStringType); err != nil {
@@ -81,11 +82,11 @@ type SimpleError struct {
 }
 
 func (e SimpleError) MarshalRESP(w io.Writer) (int, error) {
-	buff := make([]byte, 0, 16)
-	buff = append(buff, SimpleErrorType...)
-	buff = append(buff, []byte(e.E)...)
-	buff = append(buff, TERMINATOR...)
-	return w.Write(buff)
+	buff := getBuffer()
+	buff.b = append(buff.b, SimpleErrorType...)
+	buff.b = append(buff.b, e.E...)
+	buff.b = append(buff.b, TERMINATOR...)
+	return buff.writeTo(w)
 }
 
 func (e *SimpleError) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
@@ -116,11 +117,11 @@ type SimpleInt struct {
 }
 
 func (i SimpleInt) MarshalRESP(w io.Writer) (int, error) {
-	buff := make([]byte, 0, 16)
-	buff = append(buff, SimpleIntType...)
-	buff = strconv.AppendInt(buff, i.I, 10)
-	buff = append(buff, TERMINATOR...)
-	return w.Write(buff)
+	buff := getBuffer()
+	buff.b = append(buff.b, SimpleIntType...)
+	buff.b = strconv.AppendInt(buff.b, i.I, 10)
+	buff.b = append(buff.b, TERMINATOR...)
+	return buff.writeTo(w)
 }
 
 func (i *SimpleInt) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
@@ -135,7 +136,7 @@ func (i *SimpleInt) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
 	}
 
 	n += len(str)
-	val, err := strconv.ParseInt(string(str[:len(str)-1]), 10, 64)
+	val, err := parseInt(str[:len(str)-1])
 	if err != nil {
 		return
 	}
@@ -164,13 +165,11 @@ func (b BulkString) MarshalRESP(w io.Writer) (int, error) {
 		return 0, fmt.Errorf("nil BulkString with EncodeNil=false")
 	}
 
-	buff := make([]byte, 0, 16)
-	buff = append(buff, BulkStringType...)
-	buff = strconv.AppendInt(buff, int64(len(b.S)), 10)
-	buff = append(buff, TERMINATOR...)
-	buff = append(buff, b.S...)
-	buff = append(buff, TERMINATOR...)
-	return w.Write(buff)
+	buff := getBuffer()
+	buff.b = appendHeader(buff.b, BulkStringType, len(b.S))
+	buff.b = append(buff.b, b.S...)
+	buff.b = append(buff.b, TERMINATOR...)
+	return buff.writeTo(w)
 
 }
 
@@ -189,7 +188,7 @@ func (b *BulkString) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
 		return n, err
 	}
 	n += len(str)
-	length, err := strconv.ParseInt(string(str[:len(str)-1]), 10, 64)
+	length, err := parseInt(str[:len(str)-1])
 	if err != nil {
 		return n, err
 	}
@@ -226,19 +225,7 @@ func (a *Array) AppendArray(arr *Array) {
 }
 
 func (a Array) MarshalRESP(w io.Writer) (int, error) {
-	buff := make([]byte, 0, 64)
-	buff = append(buff, ArrayType...)
-	buff = strconv.AppendInt(buff, int64(len(a.A)), 10)
-	buff = append(buff, TERMINATOR...)
-	elementsBuff := bytes.NewBuffer(make([]byte, 0, 64))
-	for _, v := range a.A {
-		n, err := v.MarshalRESP(elementsBuff)
-		if err != nil {
-			return n, err
-		}
-	}
-	buff = append(buff, elementsBuff.Bytes()...)
-	return w.Write(buff)
+	return marshalAggregate(w, ArrayType, len(a.A), a.A)
 }
 
 func (a *Array) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
@@ -252,7 +239,7 @@ func (a *Array) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
 		return n, err
 	}
 	n += len(str)
-	length, err := strconv.ParseInt(string(str[:len(str)-1]), 10, 64)
+	length, err := parseInt(str[:len(str)-1])
 	if err != nil {
 		return n, err
 	}
@@ -260,6 +247,11 @@ func (a *Array) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
 		return n, err
 	}
 	n += len(TERMINATOR) - 1
+	if length < 0 {
+		a.A = nil
+		return n, nil
+	}
+
 	a.A = make([]Marshaller, length)
 	for i := 0; i < int(length); i++ {
 		var resp Any
@@ -273,6 +265,13 @@ func (a *Array) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
 	return n, nil
 }
 
+// NilArray is the null array reply, e.g. EXEC of the transaction aborted by WATCH
+type NilArray struct{}
+
+func (NilArray) MarshalRESP(w io.Writer) (int, error) {
+	return w.Write(ARRAYNULL)
+}
+
 type Any struct {
 	I                   interface{}
 	EncodeBulkStringNil bool
@@ -316,20 +315,15 @@ func (a Any) MarshalRESP(w io.Writer) (n int, err error) {
 		b := BulkString{S: nil, EncodeNil: a.EncodeBulkStringNil}
 		return b.MarshalRESP(w)
 	case []interface{}:
-		var arrayPrefix = make([]byte, 0, 32)
-		arrayPrefix = append(arrayPrefix, ArrayType...)
-		arrayPrefix = strconv.AppendInt(arrayPrefix, int64(len(v)), 10)
-		arrayPrefix = append(arrayPrefix, TERMINATOR...)
-		arrayBuff := bytes.NewBuffer(arrayPrefix)
-		var read int
+		buff := getBuffer()
+		buff.b = appendHeader(buff.b, ArrayType, len(v))
 		for _, i := range v {
 			resp := Any{I: i}
-			if read, err = resp.MarshalRESP(arrayBuff); err != nil {
+			if _, err = resp.MarshalRESP(buff); err != nil {
 				return n, err
 			}
-			n += read
 		}
-		return w.Write(arrayBuff.Bytes())
+		return buff.writeTo(w)
 	case []Marshaller:
 		arr := Array{A: v}
 		return arr.MarshalRESP(w)
@@ -343,7 +337,17 @@ func (a *Any) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
 	if err != nil {
 		return n, err
 	}
-	switch peeked[0] {
+	// peeking further may move the buffered bytes, so the type is copied first
+	typ := peeked[0]
+	// only aggregates and bulk strings have the length, simple types may start with '?'
+	switch typ {
+	case BulkStringType[0], ArrayType[0], MapType[0], SetType[0], PushType[0]:
+		if streamed, err := r.Peek(2); err == nil && streamed[1] == StreamedLengthValue[0] {
+			return a.unmarshalStreamed(r)
+		}
+	}
+
+	switch typ {
 	case SimpleStringType[0]:
 		var s SimpleString
 		n, err = s.UnmarshalRESP(r)
@@ -379,10 +383,92 @@ func (a *Any) UnmarshalRESP(r *bufio.Reader) (n int, err error) {
 			return n, err
 		}
 		a.I = arr
+	case NullType[0]:
+		var null Null
+		n, err = null.UnmarshalRESP(r)
+		a.I = null
+	case BooleanType[0]:
+		var b Boolean
+		n, err = b.UnmarshalRESP(r)
+		a.I = b
+	case DoubleType[0]:
+		var d Double
+		n, err = d.UnmarshalRESP(r)
+		a.I = d
+	case BigNumberType[0]:
+		var b BigNumber
+		n, err = b.UnmarshalRESP(r)
+		a.I = b
+	case BulkErrorType[0]:
+		var e BulkError
+		n, err = e.UnmarshalRESP(r)
+		a.I = e
+	case VerbatimStringType[0]:
+		var v VerbatimString
+		n, err = v.UnmarshalRESP(r)
+		a.I = v
+	case MapType[0]:
+		var m Map
+		n, err = m.UnmarshalRESP(r)
+		a.I = m
+	case SetType[0]:
+		var s Set
+		n, err = s.UnmarshalRESP(r)
+		a.I = s
+	case PushType[0]:
+		var p Push
+		n, err = p.UnmarshalRESP(r)
+		a.I = p
+	case AttributeType[0]:
+		var attr Attribute
+		n, err = attr.UnmarshalRESP(r)
+		a.I = attr
 	default:
-		return n, fmt.Errorf("unknown RESP type: %s", peeked)
+		return n, fmt.Errorf("unknown RESP type: %c", typ)
 	}
-	return n, nil
+	return n, err
+}
+
+// unmarshalStreamed reads the string or the aggregate of unknown length as the plain one
+func (a *Any) unmarshalStreamed(r *bufio.Reader) (int, error) {
+	peeked, _ := r.Peek(1)
+	switch peeked[0] {
+	case BulkStringType[0]:
+		_, n, err := readLength(r, BulkStringType)
+		if err != nil {
+			return n, err
+		}
+
+		b, read, err := unmarshalStreamedString(r)
+		a.I = b
+		return n + read, err
+	case MapType[0]:
+		var m Map
+		n, err := m.UnmarshalRESP(r)
+		a.I = m
+		return n, err
+	case SetType[0]:
+		var s Set
+		n, err := s.UnmarshalRESP(r)
+		a.I = s
+		return n, err
+	case PushType[0]:
+		var p Push
+		n, err := p.UnmarshalRESP(r)
+		a.I = p
+		return n, err
+	case ArrayType[0]:
+		_, n, err := readLength(r, ArrayType)
+		if err != nil {
+			return n, err
+		}
+
+		elements, read, err := unmarshalElements(r, -1)
+		a.I = Array{A: elements}
+		return n + read, err
+	}
+
+	return 0, fmt.Errorf("unknown streamed RESP type: %s", peeked)
 }
 
 // TODO
@@ -0,0 +1,722 @@
+package encoding
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	NULL                = []byte("_\r\n")
+	STREAMED_END        = []byte(".\r\n")
+	NullType            = []byte("_")
+	BooleanType         = []byte("#")
+	DoubleType          = []byte(",")
+	BigNumberType       = []byte("(")
+	BulkErrorType       = []byte("!")
+	VerbatimStringType  = []byte("=")
+	MapType             = []byte("%")
+	SetType             = []byte("~")
+	AttributeType       = []byte("|")
+	PushType            = []byte(">")
+	StreamedChunkType   = []byte(";")
+	StreamedLengthValue = []byte("?")
+)
+
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// readLine reads the rest of the line after the type byte, the returned slice is valid until the next read
+func readLine(r *bufio.Reader, typ []byte) (line []byte, n int, err error) {
+	if err = peekAndAssert(r, typ); err != nil {
+		return nil, n, err
+	}
+
+	if n, err = r.Discard(len(typ)); err != nil {
+		return nil, n, err
+	}
+
+	line, err = r.ReadSlice(TERMINATOR[len(TERMINATOR)-1])
+	n += len(line)
+	if err != nil {
+		return nil, n, err
+	}
+
+	if len(line) < len(TERMINATOR) || line[len(line)-2] != TERMINATOR[0] {
+		return nil, n, fmt.Errorf("expected line terminated by CRLF, got %q", line)
+	}
+
+	return line[:len(line)-len(TERMINATOR)], n, nil
+}
+
+// readLength reads the length of the aggregate or the blob, -1 means that the length is streamed
+func readLength(r *bufio.Reader, typ []byte) (length int, n int, err error) {
+	line, n, err := readLine(r, typ)
+	if err != nil {
+		return 0, n, err
+	}
+
+	if bytes.Equal(line, StreamedLengthValue) {
+		return -1, n, nil
+	}
+
+	l, err := parseInt(line)
+	if length = int(l); err == nil && length < 0 {
+		err = fmt.Errorf("invalid length %d", length)
+	}
+
+	return length, n, err
+}
+
+// readBlob reads the body of the blob of the given length followed by CRLF
+func readBlob(r *bufio.Reader, length int) ([]byte, int, error) {
+	b := make([]byte, length+len(TERMINATOR))
+	n, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, n, err
+	}
+
+	if !bytes.Equal(b[length:], TERMINATOR) {
+		return nil, n, fmt.Errorf("expected blob terminated by CRLF, got %q", b[length:])
+	}
+
+	return b[:length], n, nil
+}
+
+func appendHeader(buff []byte, typ []byte, length int) []byte {
+	buff = append(buff, typ...)
+	buff = strconv.AppendInt(buff, int64(length), 10)
+	return append(buff, TERMINATOR...)
+}
+
+// marshalAggregate writes the header followed by the elements, the reply is written at once
+func marshalAggregate(w io.Writer, typ []byte, length int, elements []Marshaller) (int, error) {
+	buff := getBuffer()
+	buff.b = appendHeader(buff.b, typ, length)
+	for _, m := range elements {
+		if _, err := m.MarshalRESP(buff); err != nil {
+			return 0, err
+		}
+	}
+
+	return buff.writeTo(w)
+}
+
+// unmarshalElements reads length elements, or the elements up to the end marker when the length is streamed
+func unmarshalElements(r *bufio.Reader, length int) ([]Marshaller, int, error) {
+	n := 0
+	if length >= 0 {
+		elements := make([]Marshaller, length)
+		for i := range elements {
+			var a Any
+			read, err := a.UnmarshalRESP(r)
+			n += read
+			if err != nil {
+				return nil, n, err
+			}
+
+			elements[i] = a.I.(Marshaller)
+		}
+
+		return elements, n, nil
+	}
+
+	elements := make([]Marshaller, 0, 8)
+	for {
+		peeked, err := r.Peek(len(STREAMED_END))
+		if err != nil {
+			return nil, n, err
+		}
+
+		if bytes.Equal(peeked, STREAMED_END) {
+			read, err := r.Discard(len(STREAMED_END))
+			return elements, n + read, err
+		}
+
+		var a Any
+		read, err := a.UnmarshalRESP(r)
+		n += read
+		if err != nil {
+			return nil, n, err
+		}
+
+		elements = append(elements, a.I.(Marshaller))
+	}
+}
+
+// Null is the single null type of RESP3, RESP2 has null bulk string and null array instead
+type Null struct{}
+
+func (Null) MarshalRESP(w io.Writer) (int, error) {
+	return w.Write(NULL)
+}
+
+func (*Null) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	line, n, err := readLine(r, NullType)
+	if err == nil && len(line) != 0 {
+		err = fmt.Errorf("unexpected null %q", line)
+	}
+
+	return n, err
+}
+
+type Boolean struct {
+	B bool
+}
+
+func (b Boolean) MarshalRESP(w io.Writer) (int, error) {
+	if b.B {
+		return w.Write([]byte("#t\r\n"))
+	}
+
+	return w.Write([]byte("#f\r\n"))
+}
+
+func (b *Boolean) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	line, n, err := readLine(r, BooleanType)
+	if err != nil {
+		return n, err
+	}
+
+	switch string(line) {
+	case "t":
+		b.B = true
+	case "f":
+		b.B = false
+	default:
+		return n, fmt.Errorf("invalid boolean %q", line)
+	}
+
+	return n, nil
+}
+
+type Double struct {
+	F float64
+}
+
+func (d Double) MarshalRESP(w io.Writer) (int, error) {
+	buff := append(make([]byte, 0, 32), DoubleType...)
+	buff = append(buff, formatDouble(d.F)...)
+	buff = append(buff, TERMINATOR...)
+	return w.Write(buff)
+}
+
+func (d *Double) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	line, n, err := readLine(r, DoubleType)
+	if err != nil {
+		return n, err
+	}
+
+	d.F, err = parseDouble(string(line))
+	return n, err
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func parseDouble(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+// BigNumber is integer outside of the range of SimpleInt
+type BigNumber struct {
+	N *big.Int
+}
+
+func (b BigNumber) MarshalRESP(w io.Writer) (int, error) {
+	if b.N == nil {
+		return 0, fmt.Errorf("nil BigNumber")
+	}
+
+	buff := append(make([]byte, 0, 32), BigNumberType...)
+	buff = b.N.Append(buff, 10)
+	buff = append(buff, TERMINATOR...)
+	return w.Write(buff)
+}
+
+func (b *BigNumber) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	line, n, err := readLine(r, BigNumberType)
+	if err != nil {
+		return n, err
+	}
+
+	var ok bool
+	if b.N, ok = new(big.Int).SetString(string(line), 10); !ok {
+		return n, fmt.Errorf("invalid big number %q", line)
+	}
+
+	return n, nil
+}
+
+func (b BigNumber) String() string {
+	return b.N.String()
+}
+
+// BulkError is the error that may contain any bytes, including new lines
+type BulkError struct {
+	E string
+}
+
+func (e BulkError) MarshalRESP(w io.Writer) (int, error) {
+	buff := appendHeader(make([]byte, 0, 16+len(e.E)), BulkErrorType, len(e.E))
+	buff = append(buff, e.E...)
+	buff = append(buff, TERMINATOR...)
+	return w.Write(buff)
+}
+
+func (e *BulkError) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	length, n, err := readLength(r, BulkErrorType)
+	if err != nil {
+		return n, err
+	}
+
+	if length < 0 {
+		return n, fmt.Errorf("streamed bulk error is not supported")
+	}
+
+	b, read, err := readBlob(r, length)
+	e.E = string(b)
+	return n + read, err
+}
+
+func (e BulkError) Error() string {
+	return fmt.Sprintf("Redis error: %s", e.E)
+}
+
+// VerbatimString is the string with the three bytes long format, e.g. txt or mkd
+type VerbatimString struct {
+	Format string
+	S      []byte
+}
+
+func (v VerbatimString) MarshalRESP(w io.Writer) (int, error) {
+	if len(v.Format) != 3 {
+		return 0, fmt.Errorf("invalid verbatim string format %q", v.Format)
+	}
+
+	buff := appendHeader(make([]byte, 0, 16+len(v.S)), VerbatimStringType, len(v.Format)+1+len(v.S))
+	buff = append(buff, v.Format...)
+	buff = append(buff, ':')
+	buff = append(buff, v.S...)
+	buff = append(buff, TERMINATOR...)
+	return w.Write(buff)
+}
+
+func (v *VerbatimString) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	length, n, err := readLength(r, VerbatimStringType)
+	if err != nil {
+		return n, err
+	}
+
+	if length < 4 {
+		return n, fmt.Errorf("invalid verbatim string length %d", length)
+	}
+
+	b, read, err := readBlob(r, length)
+	n += read
+	if err != nil {
+		return n, err
+	}
+
+	if b[3] != ':' {
+		return n, fmt.Errorf("invalid verbatim string %q", b)
+	}
+
+	v.Format, v.S = string(b[:3]), b[4:]
+	return n, nil
+}
+
+func (v *VerbatimString) String() string {
+	return string(v.S)
+}
+
+type MapEntry struct {
+	Key   Marshaller
+	Value Marshaller
+}
+
+// Map is the ordered map reply, RESP2 clients receive the keys and the values in the flat array
+type Map struct {
+	Entries []MapEntry
+}
+
+func (m *Map) Append(key, value Marshaller) {
+	m.Entries = append(m.Entries, MapEntry{Key: key, Value: value})
+}
+
+// flat returns the keys and the values interleaved
+func (m Map) flat() []Marshaller {
+	flat := make([]Marshaller, 0, 2*len(m.Entries))
+	for _, e := range m.Entries {
+		flat = append(flat, e.Key, e.Value)
+	}
+
+	return flat
+}
+
+func (m Map) MarshalRESP(w io.Writer) (int, error) {
+	return marshalAggregate(w, MapType, len(m.Entries), m.flat())
+}
+
+func (m *Map) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	return m.unmarshal(r, MapType)
+}
+
+func (m *Map) unmarshal(r *bufio.Reader, typ []byte) (int, error) {
+	length, n, err := readLength(r, typ)
+	if err != nil {
+		return n, err
+	}
+
+	if length >= 0 {
+		length *= 2
+	}
+
+	flat, read, err := unmarshalElements(r, length)
+	n += read
+	if err != nil {
+		return n, err
+	}
+
+	if len(flat)%2 != 0 {
+		return n, fmt.Errorf("map with odd number of elements %d", len(flat))
+	}
+
+	m.Entries = make([]MapEntry, 0, len(flat)/2)
+	for i := 0; i < len(flat); i += 2 {
+		m.Append(flat[i], flat[i+1])
+	}
+
+	return n, nil
+}
+
+// Set is the unordered collection of unique elements
+type Set struct {
+	A []Marshaller
+}
+
+func (s *Set) Append(m Marshaller) {
+	s.A = append(s.A, m)
+}
+
+func (s Set) MarshalRESP(w io.Writer) (int, error) {
+	return marshalAggregate(w, SetType, len(s.A), s.A)
+}
+
+func (s *Set) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	length, n, err := readLength(r, SetType)
+	if err != nil {
+		return n, err
+	}
+
+	a, read, err := unmarshalElements(r, length)
+	s.A = a
+	return n + read, err
+}
+
+// Push is the out of band data, e.g. published message, RESP2 clients receive it as the array
+type Push struct {
+	A []Marshaller
+}
+
+func (p Push) MarshalRESP(w io.Writer) (int, error) {
+	return marshalAggregate(w, PushType, len(p.A), p.A)
+}
+
+func (p *Push) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	length, n, err := readLength(r, PushType)
+	if err != nil {
+		return n, err
+	}
+
+	a, read, err := unmarshalElements(r, length)
+	p.A = a
+	return n + read, err
+}
+
+// Attribute is the auxiliary data of the reply, RESP2 clients receive the reply only
+type Attribute struct {
+	Attrs Map
+	Reply Marshaller
+}
+
+func (a Attribute) MarshalRESP(w io.Writer) (int, error) {
+	if a.Reply == nil {
+		return 0, fmt.Errorf("attribute without reply")
+	}
+
+	buff := bytes.NewBuffer(make([]byte, 0, 64))
+	if _, err := marshalAggregate(buff, AttributeType, len(a.Attrs.Entries), a.Attrs.flat()); err != nil {
+		return 0, err
+	}
+
+	if _, err := a.Reply.MarshalRESP(buff); err != nil {
+		return 0, err
+	}
+
+	return w.Write(buff.Bytes())
+}
+
+func (a *Attribute) UnmarshalRESP(r *bufio.Reader) (int, error) {
+	n, err := a.Attrs.unmarshal(r, AttributeType)
+	if err != nil {
+		return n, err
+	}
+
+	var reply Any
+	read, err := reply.UnmarshalRESP(r)
+	a.Reply = reply.I.(Marshaller)
+	return n + read, err
+}
+
+// Streamed marshals the string or the aggregate of unknown length, the string is sent in a single chunk.
+// The unmarshalled streamed replies are the plain BulkString, Array, Map, Set or Push
+type Streamed struct {
+	M Marshaller
+}
+
+func (s Streamed) MarshalRESP(w io.Writer) (int, error) {
+	var (
+		typ      []byte
+		elements []Marshaller
+	)
+
+	switch v := s.M.(type) {
+	case BulkString:
+		buff := append(make([]byte, 0, 32+len(v.S)), BulkStringType...)
+		buff = append(buff, StreamedLengthValue...)
+		buff = append(buff, TERMINATOR...)
+		if len(v.S) > 0 {
+			buff = appendHeader(buff, StreamedChunkType, len(v.S))
+			buff = append(buff, v.S...)
+			buff = append(buff, TERMINATOR...)
+		}
+
+		buff = appendHeader(buff, StreamedChunkType, 0)
+		return w.Write(buff)
+	case Array:
+		typ, elements = ArrayType, v.A
+	case Map:
+		typ, elements = MapType, v.flat()
+	case Set:
+		typ, elements = SetType, v.A
+	case Push:
+		typ, elements = PushType, v.A
+	default:
+		return 0, fmt.Errorf("type %T can not be streamed", s.M)
+	}
+
+	buff := bytes.NewBuffer(append(append(append(make([]byte, 0, 64), typ...), StreamedLengthValue...), TERMINATOR...))
+	for _, m := range elements {
+		if _, err := m.MarshalRESP(buff); err != nil {
+			return 0, err
+		}
+	}
+
+	buff.Write(STREAMED_END)
+	return w.Write(buff.Bytes())
+}
+
+// unmarshalStreamedString reads the chunks of the streamed bulk string up to the empty one
+func unmarshalStreamedString(r *bufio.Reader) (BulkString, int, error) {
+	b := BulkString{S: []byte{}}
+	n := 0
+	for {
+		length, read, err := readLength(r, StreamedChunkType)
+		n += read
+		if err != nil {
+			return b, n, err
+		}
+
+		if length == 0 {
+			return b, n, nil
+		}
+
+		chunk, read, err := readBlob(r, length)
+		n += read
+		if err != nil {
+			return b, n, err
+		}
+
+		b.S = append(b.S, chunk...)
+	}
+}
+
+// ForProtocol converts the reply to the types of the protocol version. RESP2 replies get the closest RESP2
+// types, e.g. maps are flattened to arrays, RESP3 replies get the single null type
+func ForProtocol(m Marshaller, proto int) Marshaller {
+	if proto == RESP3 {
+		m, _ = toResp3(m)
+		return m
+	}
+
+	m, _ = toResp2(m)
+	return m
+}
+
+// toResp2 returns the converted reply and reports whether it differs from the original one
+func toResp2(m Marshaller) (Marshaller, bool) {
+	switch v := m.(type) {
+	case Null:
+		return BulkString{EncodeNil: true}, true
+	case Boolean:
+		if v.B {
+			return SimpleInt{I: 1}, true
+		}
+
+		return SimpleInt{I: 0}, true
+	case Double:
+		return BulkString{S: []byte(formatDouble(v.F))}, true
+	case BigNumber:
+		if v.N == nil {
+			return v, false
+		}
+
+		return BulkString{S: []byte(v.N.String())}, true
+	case BulkError:
+		return SimpleError{E: v.E}, true
+	case VerbatimString:
+		return BulkString{S: v.S}, true
+	case Attribute:
+		reply, _ := toResp2(v.Reply)
+		return reply, true
+	case Streamed:
+		inner, _ := toResp2(v.M)
+		return inner, true
+	case Map:
+		a, _ := convertElements(v.flat(), toResp2)
+		return Array{A: a}, true
+	case Set:
+		a, _ := convertElements(v.A, toResp2)
+		return Array{A: a}, true
+	case Push:
+		a, _ := convertElements(v.A, toResp2)
+		return Array{A: a}, true
+	case Array:
+		var changed bool
+		if v.A != nil {
+			v.A, changed = convertElements(v.A, toResp2)
+		}
+
+		return v, changed
+	case Any:
+		if i, ok := v.I.(Marshaller); ok {
+			var changed bool
+			v.I, changed = toResp2(i)
+			return v, changed
+		}
+	}
+
+	return m, false
+}
+
+func toResp3(m Marshaller) (Marshaller, bool) {
+	var changed bool
+	switch v := m.(type) {
+	case BulkString:
+		if v.EncodeNil && v.S == nil {
+			return Null{}, true
+		}
+	case NilArray:
+		return Null{}, true
+	case Array:
+		if v.A != nil {
+			v.A, changed = convertElements(v.A, toResp3)
+		}
+
+		return v, changed
+	case Set:
+		v.A, changed = convertElements(v.A, toResp3)
+		return v, changed
+	case Push:
+		v.A, changed = convertElements(v.A, toResp3)
+		return v, changed
+	case Map:
+		v.Entries, changed = convertEntries(v.Entries)
+		return v, changed
+	case Attribute:
+		var replyChanged bool
+		v.Attrs.Entries, changed = convertEntries(v.Attrs.Entries)
+		v.Reply, replyChanged = toResp3(v.Reply)
+		return v, changed || replyChanged
+	case Streamed:
+		v.M, changed = toResp3(v.M)
+		return v, changed
+	case Any:
+		switch i := v.I.(type) {
+		case Marshaller:
+			v.I, changed = toResp3(i)
+			return v, changed
+		case nil:
+			if v.EncodeBulkStringNil {
+				return Null{}, true
+			}
+		}
+	}
+
+	return m, false
+}
+
+// convertElements converts the elements, the slice is copied only when some of them changes
+func convertElements(a []Marshaller, convert func(Marshaller) (Marshaller, bool)) ([]Marshaller, bool) {
+	converted, copied := a, false
+	for i, m := range a {
+		c, changed := convert(m)
+		if !changed {
+			continue
+		}
+
+		if !copied {
+			converted, copied = append(make([]Marshaller, 0, len(a)), a...), true
+		}
+
+		converted[i] = c
+	}
+
+	return converted, copied
+}
+
+func convertEntries(entries []MapEntry) ([]MapEntry, bool) {
+	converted, copied := entries, false
+	for i, e := range entries {
+		key, keyChanged := toResp3(e.Key)
+		value, valueChanged := toResp3(e.Value)
+		if !keyChanged && !valueChanged {
+			continue
+		}
+
+		if !copied {
+			converted, copied = append(make([]MapEntry, 0, len(entries)), entries...), true
+		}
+
+		converted[i] = MapEntry{Key: key, Value: value}
+	}
+
+	return converted, copied
+}
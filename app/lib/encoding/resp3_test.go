@@ -0,0 +1,155 @@
+package encoding
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalResp3(t *testing.T) {
+	n, _ := new(big.Int).SetString("3492890328409238509324850943850943825024385", 10)
+	tests := []struct {
+		input    Marshaller
+		expected string
+	}{
+		{Null{}, "_\r\n"},
+		{Boolean{true}, "#t\r\n"},
+		{Boolean{false}, "#f\r\n"},
+		{Double{1.23}, ",1.23\r\n"},
+		{Double{10}, ",10\r\n"},
+		{Double{math.Inf(1)}, ",inf\r\n"},
+		{Double{math.Inf(-1)}, ",-inf\r\n"},
+		{BigNumber{n}, "(3492890328409238509324850943850943825024385\r\n"},
+		{BulkError{"SYNTAX invalid\r\nsyntax"}, "!22\r\nSYNTAX invalid\r\nsyntax\r\n"},
+		{VerbatimString{"txt", []byte("Some string")}, "=15\r\ntxt:Some string\r\n"},
+		{
+			Map{Entries: []MapEntry{{SimpleString{"first"}, SimpleInt{1}}, {SimpleString{"second"}, SimpleInt{2}}}},
+			"%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n",
+		},
+		{Set{A: []Marshaller{SimpleString{"orange"}, SimpleInt{1}}}, "~2\r\n+orange\r\n:1\r\n"},
+		{Push{A: []Marshaller{BulkString{S: []byte("message")}}}, ">1\r\n$7\r\nmessage\r\n"},
+		{
+			Attribute{Attrs: Map{Entries: []MapEntry{{SimpleString{"ttl"}, SimpleInt{3600}}}}, Reply: SimpleInt{2039123}},
+			"|1\r\n+ttl\r\n:3600\r\n:2039123\r\n",
+		},
+		{Streamed{Array{A: []Marshaller{SimpleInt{1}, SimpleInt{2}}}}, "*?\r\n:1\r\n:2\r\n.\r\n"},
+		{Streamed{Map{Entries: []MapEntry{{SimpleString{"a"}, SimpleInt{1}}}}}, "%?\r\n+a\r\n:1\r\n.\r\n"},
+		{Streamed{BulkString{S: []byte("Hello")}}, "$?\r\n;5\r\nHello\r\n;0\r\n"},
+	}
+
+	for _, tc := range tests {
+		var b bytes.Buffer
+		n, err := tc.input.MarshalRESP(&b)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if n != len(tc.expected) {
+			t.Errorf("expected %d bytes, got %d", len(tc.expected), n)
+		}
+		if b.String() != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, b.String())
+		}
+	}
+}
+
+func TestUnmarshalResp3(t *testing.T) {
+	n, _ := new(big.Int).SetString("-3492890328409238509324850943850943825024385", 10)
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"_\r\n", Null{}},
+		{"#t\r\n", Boolean{true}},
+		{",1.23\r\n", Double{1.23}},
+		{",-inf\r\n", Double{math.Inf(-1)}},
+		{",1e3\r\n", Double{1000}},
+		{"(-3492890328409238509324850943850943825024385\r\n", BigNumber{n}},
+		{"!21\r\nSYNTAX invalid syntax\r\n", BulkError{"SYNTAX invalid syntax"}},
+		{"=15\r\ntxt:Some string\r\n", VerbatimString{"txt", []byte("Some string")}},
+		{
+			"%2\r\n+first\r\n:1\r\n$6\r\nsecond\r\n_\r\n",
+			Map{Entries: []MapEntry{{SimpleString{"first"}, SimpleInt{1}}, {BulkString{S: []byte("second")}, Null{}}}},
+		},
+		{"~2\r\n+orange\r\n#f\r\n", Set{A: []Marshaller{SimpleString{"orange"}, Boolean{false}}}},
+		{">2\r\n+pubsub\r\n+message\r\n", Push{A: []Marshaller{SimpleString{"pubsub"}, SimpleString{"message"}}}},
+		{
+			"|1\r\n+key-popularity\r\n,0.1923\r\n*1\r\n:1\r\n",
+			Attribute{
+				Attrs: Map{Entries: []MapEntry{{SimpleString{"key-popularity"}, Double{0.1923}}}},
+				Reply: Array{A: []Marshaller{SimpleInt{1}}},
+			},
+		},
+		{"*?\r\n:1\r\n*?\r\n+a\r\n.\r\n.\r\n", Array{A: []Marshaller{SimpleInt{1}, Array{A: []Marshaller{SimpleString{"a"}}}}}},
+		{"~?\r\n+a\r\n.\r\n", Set{A: []Marshaller{SimpleString{"a"}}}},
+		{"%?\r\n+a\r\n:1\r\n.\r\n", Map{Entries: []MapEntry{{SimpleString{"a"}, SimpleInt{1}}}}},
+		{"$?\r\n;4\r\nHell\r\n;5\r\no wor\r\n;1\r\nd\r\n;0\r\n", BulkString{S: []byte("Hello word")}},
+	}
+
+	for _, tc := range tests {
+		var a Any
+		n, err := a.UnmarshalRESP(bufio.NewReader(strings.NewReader(tc.input)))
+		if err != nil {
+			t.Errorf("unexpected error unmarshalling %q: %s", tc.input, err)
+			continue
+		}
+		if n != len(tc.input) {
+			t.Errorf("expected %d bytes to be read from %q, got %d", len(tc.input), tc.input, n)
+		}
+		if !reflect.DeepEqual(a.I, tc.expected) {
+			t.Errorf("expected %#v, got %#v", tc.expected, a.I)
+		}
+	}
+}
+
+func TestUnmarshalResp3Invalid(t *testing.T) {
+	for _, input := range []string{"#x\r\n", ",abc\r\n", "(12a\r\n", "=2\r\nab\r\n", "=5\r\ntxtab\r\n", "%1\r\n+a\r\n.\r\n", "_a\r\n"} {
+		var a Any
+		if _, err := a.UnmarshalRESP(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("expected error unmarshalling %q, got %#v", input, a.I)
+		}
+	}
+}
+
+func TestForProtocol(t *testing.T) {
+	reply := Array{A: []Marshaller{
+		Map{Entries: []MapEntry{{BulkString{S: []byte("a")}, Boolean{true}}}},
+		Set{A: []Marshaller{Double{1.5}}},
+		BulkString{EncodeNil: true},
+		Any{I: NilArray{}},
+		Attribute{Attrs: Map{Entries: []MapEntry{{SimpleString{"ttl"}, SimpleInt{1}}}}, Reply: VerbatimString{"txt", []byte("v")}},
+		Push{A: []Marshaller{Null{}}},
+		BulkError{"ERR bulk"},
+	}}
+
+	tests := []struct {
+		proto    int
+		expected string
+	}{
+		{RESP2, "*7\r\n*2\r\n$1\r\na\r\n:1\r\n*1\r\n$3\r\n1.5\r\n$-1\r\n*-1\r\n$1\r\nv\r\n*1\r\n$-1\r\n-ERR bulk\r\n"},
+		{RESP3, "*7\r\n%1\r\n$1\r\na\r\n#t\r\n~1\r\n,1.5\r\n_\r\n_\r\n|1\r\n+ttl\r\n:1\r\n=5\r\ntxt:v\r\n>1\r\n_\r\n!8\r\nERR bulk\r\n"},
+	}
+
+	for _, tc := range tests {
+		var b bytes.Buffer
+		if _, err := ForProtocol(reply, tc.proto).MarshalRESP(&b); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		if b.String() != tc.expected {
+			t.Errorf("expected RESP%d reply %q, got %q", tc.proto, tc.expected, b.String())
+		}
+	}
+
+	// conversion does not modify the original reply
+	if _, ok := reply.A[2].(BulkString); !ok {
+		t.Errorf("expected original reply to be kept, got %#v", reply.A[2])
+	}
+
+	plain := Array{A: []Marshaller{SimpleInt{1}, BulkString{S: []byte("a")}}}
+	if converted := ForProtocol(plain, RESP3).(Array); &converted.A[0] != &plain.A[0] {
+		t.Errorf("expected reply without RESP2 nulls not to be copied")
+	}
+}
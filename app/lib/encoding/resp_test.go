@@ -334,6 +334,10 @@ func TestRespArray_UnmarshalRESP(t *testing.T) {
 				},
 			},
 		},
+		{
+			i:        []byte("*-1\r\n"),
+			expected: Array{},
+		},
 	}
 
 	for _, test := range tc {
@@ -380,6 +384,14 @@ func TestSimplePrimitivesInAnyResp_UnmarshalRESP(t *testing.T) {
 			input:    []byte("-error\r\n"),
 			expected: SimpleError{"error"},
 		},
+		{
+			input:    []byte("+?\r\n"),
+			expected: SimpleString{"?"},
+		},
+		{
+			input:    []byte("-?bad\r\n"),
+			expected: SimpleError{"?bad"},
+		},
 		{
 			input:    []byte(":123\r\n"),
 			expected: SimpleInt{123},
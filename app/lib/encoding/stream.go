@@ -0,0 +1,568 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// older stream encodings, only read
+	STREAM_LISTPACKS   = byte(0x0f)
+	STREAM_LISTPACKS_2 = byte(0x13)
+
+	STREAM_ITEM_FLAG_DELETED    = 1
+	STREAM_ITEM_FLAG_SAMEFIELDS = 2
+
+	// limits of a single listpack node, defaults of stream-node-max-entries and stream-node-max-bytes
+	STREAM_NODE_MAX_ENTRIES = 100
+	STREAM_NODE_MAX_BYTES   = 4096
+)
+
+type streamId struct {
+	ms  uint64
+	seq uint64
+}
+
+func parseStreamId(id string) (streamId, error) {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return streamId{}, fmt.Errorf("invalid stream id %q", id)
+	}
+
+	var (
+		sid streamId
+		err error
+	)
+
+	if sid.ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return streamId{}, fmt.Errorf("invalid stream id %q", id)
+	}
+
+	if sid.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+		return streamId{}, fmt.Errorf("invalid stream id %q", id)
+	}
+
+	return sid, nil
+}
+
+func (id streamId) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+// raw is the big endian representation used as the key of listpack nodes and in PELs
+func (id streamId) raw() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, id.ms)
+	binary.BigEndian.PutUint64(b[8:], id.seq)
+	return b
+}
+
+func writeStreamId(w io.Writer, id streamId) error {
+	if _, err := EncodeLength(w, id.ms); err != nil {
+		return err
+	}
+
+	_, err := EncodeLength(w, id.seq)
+	return err
+}
+
+func readStreamId(r ByteReader) (id streamId, err error) {
+	if id.ms, err = DecodeUint64(r); err != nil {
+		return id, err
+	}
+
+	id.seq, err = DecodeUint64(r)
+	return id, err
+}
+
+// writeStream writes entries as listpack nodes followed by stream metadata, every node starts with
+// the master entry holding fields of the first entry, entries with the same fields store values only.
+func writeStream(w io.Writer, entries []storage.StreamKV, meta storage.StreamMeta, groups []storage.StreamGroup) error {
+	type node struct {
+		master streamId
+		lp     *Listpack
+	}
+
+	var (
+		nodes        []node
+		first, last  streamId
+		masterFields []string
+		count        int
+		buff         *Listpack
+	)
+
+	flush := func() {
+		if buff == nil {
+			return
+		}
+
+		// master entry is written once number of entries in the node is known
+		lp := NewListpack()
+		lp.AppendInt(int64(count))
+		lp.AppendInt(0)
+		lp.AppendInt(int64(len(masterFields)))
+		for _, field := range masterFields {
+			lp.Append(field)
+		}
+
+		lp.AppendInt(0)
+		lp.b = append(lp.b, buff.b[LP_HEADER_SIZE:]...)
+		lp.len += buff.len
+		nodes[len(nodes)-1].lp = lp
+		buff = nil
+	}
+
+	for i, entry := range entries {
+		id, err := parseStreamId(entry.Key)
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			first = id
+		}
+
+		last = id
+		if buff == nil || count == STREAM_NODE_MAX_ENTRIES || buff.Size() > STREAM_NODE_MAX_BYTES {
+			flush()
+			nodes = append(nodes, node{master: id})
+			masterFields = make([]string, 0, len(entry.Data)/2)
+			for j := 0; j < len(entry.Data); j += 2 {
+				masterFields = append(masterFields, entry.Data[j])
+			}
+
+			buff, count = NewListpack(), 0
+		}
+
+		master := nodes[len(nodes)-1].master
+		sameFields := len(entry.Data) == 2*len(masterFields)
+		for j := 0; sameFields && j < len(masterFields); j++ {
+			sameFields = entry.Data[2*j] == masterFields[j]
+		}
+
+		flags := 0
+		if sameFields {
+			flags = STREAM_ITEM_FLAG_SAMEFIELDS
+		}
+
+		buff.AppendInt(int64(flags))
+		buff.AppendInt(int64(id.ms - master.ms))
+		buff.AppendInt(int64(id.seq - master.seq))
+		if sameFields {
+			for j := 1; j < len(entry.Data); j += 2 {
+				buff.Append(entry.Data[j])
+			}
+
+			buff.AppendInt(int64(len(masterFields) + 3))
+		} else {
+			buff.AppendInt(int64(len(entry.Data) / 2))
+			for _, v := range entry.Data {
+				buff.Append(v)
+			}
+
+			buff.AppendInt(int64(len(entry.Data) + 1 + 3))
+		}
+
+		count++
+	}
+
+	flush()
+	if _, err := EncodeLength(w, uint64(len(nodes))); err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		if _, err := EncodeString(w, string(n.master.raw())); err != nil {
+			return err
+		}
+
+		if _, err := EncodeString(w, string(n.lp.Bytes())); err != nil {
+			return err
+		}
+	}
+
+	// metadata outlives the deleted entries, entries of stream without metadata are the only ones ever added
+	maxDeleted, added := streamId{}, uint64(len(entries))
+	if meta.LastId != "" {
+		id, err := parseStreamId(meta.LastId)
+		if err != nil {
+			return err
+		}
+
+		if id.ms > last.ms || id.ms == last.ms && id.seq > last.seq {
+			last = id
+		}
+	}
+
+	if meta.MaxDeletedId != "" {
+		var err error
+		if maxDeleted, err = parseStreamId(meta.MaxDeletedId); err != nil {
+			return err
+		}
+	}
+
+	if meta.EntriesAdded > added {
+		added = meta.EntriesAdded
+	}
+
+	// length, last id, first id, max deleted entry id, entries added and number of consumer groups
+	EncodeLength(w, uint64(len(entries)))
+	writeStreamId(w, last)
+	writeStreamId(w, first)
+	writeStreamId(w, maxDeleted)
+	EncodeLength(w, added)
+	return writeStreamGroups(w, groups)
+}
+
+// writeStreamGroups writes consumer groups in the latest encoding, which has entries read of the groups and
+// active time of the consumers
+func writeStreamGroups(w io.Writer, groups []storage.StreamGroup) error {
+	if _, err := EncodeLength(w, uint64(len(groups))); err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if _, err := EncodeString(w, group.Name); err != nil {
+			return err
+		}
+
+		last, err := parseStreamId(group.LastId)
+		if err != nil {
+			return err
+		}
+
+		writeStreamId(w, last)
+		// -1 is written as unsigned like redis does
+		EncodeLength(w, uint64(group.EntriesRead))
+		EncodeLength(w, uint64(len(group.Pending)))
+		for _, pending := range group.Pending {
+			id, err := parseStreamId(pending.Id)
+			if err != nil {
+				return err
+			}
+
+			w.Write(id.raw())
+			writeMillisecondTime(w, pending.DeliveryTime)
+			EncodeLength(w, pending.DeliveryCount)
+		}
+
+		EncodeLength(w, uint64(len(group.Consumers)))
+		for _, consumer := range group.Consumers {
+			EncodeString(w, consumer.Name)
+			writeMillisecondTime(w, consumer.SeenTime)
+			writeMillisecondTime(w, consumer.ActiveTime)
+			EncodeLength(w, uint64(len(consumer.Pending)))
+			for _, pending := range consumer.Pending {
+				id, err := parseStreamId(pending)
+				if err != nil {
+					return err
+				}
+
+				if _, err = w.Write(id.raw()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// readStream reads stream of any of the listpack encodings with its consumer groups
+func readStream(r ByteReader, t byte) ([]storage.StreamKV, storage.StreamMeta, []storage.StreamGroup, error) {
+	var meta storage.StreamMeta
+	entries, err := readStreamEntries(r)
+	if err != nil {
+		return nil, meta, nil, err
+	}
+
+	if _, err = DecodeUint64(r); err != nil {
+		return nil, meta, nil, err
+	}
+
+	last, err := readStreamId(r)
+	if err != nil {
+		return nil, meta, nil, err
+	}
+
+	meta.LastId, meta.EntriesAdded = last.String(), uint64(len(entries))
+	if t != STREAM_LISTPACKS {
+		// first id is known from the entries
+		if _, err = readStreamId(r); err != nil {
+			return nil, meta, nil, err
+		}
+
+		maxDeleted, err := readStreamId(r)
+		if err != nil {
+			return nil, meta, nil, err
+		}
+
+		if meta.EntriesAdded, err = DecodeUint64(r); err != nil {
+			return nil, meta, nil, err
+		}
+
+		if maxDeleted != (streamId{}) {
+			meta.MaxDeletedId = maxDeleted.String()
+		}
+	}
+
+	groups, err := readStreamGroups(r, t)
+	if err != nil {
+		return nil, meta, nil, err
+	}
+
+	return entries, meta, groups, nil
+}
+
+// readStreamGroups reads consumer groups, pending entries of the consumers have to be pending in the group
+func readStreamGroups(r ByteReader, t byte) ([]storage.StreamGroup, error) {
+	n, err := DecodeUint64(r)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	// counts are not trusted to preallocate, the value may be corrupted
+	var groups []storage.StreamGroup
+	for i := uint64(0); i < n; i++ {
+		group := storage.StreamGroup{EntriesRead: -1}
+		if group.Name, err = DecodeString(r); err != nil {
+			return nil, err
+		}
+
+		last, err := readStreamId(r)
+		if err != nil {
+			return nil, err
+		}
+
+		group.LastId = last.String()
+		if t != STREAM_LISTPACKS {
+			entriesRead, err := DecodeUint64(r)
+			if err != nil {
+				return nil, err
+			}
+
+			group.EntriesRead = int64(entriesRead)
+		}
+
+		pending, err := DecodeUint64(r)
+		if err != nil {
+			return nil, err
+		}
+
+		delivered := make(map[string]bool)
+		for j := uint64(0); j < pending; j++ {
+			entry := storage.StreamPendingEntry{}
+			id, err := readRawStreamId(r)
+			if err != nil {
+				return nil, err
+			}
+
+			if entry.DeliveryTime, err = readMillisecondTime(r); err != nil {
+				return nil, err
+			}
+
+			if entry.DeliveryCount, err = DecodeUint64(r); err != nil {
+				return nil, err
+			}
+
+			entry.Id = id.String()
+			delivered[entry.Id] = true
+			group.Pending = append(group.Pending, entry)
+		}
+
+		consumers, err := DecodeUint64(r)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := uint64(0); j < consumers; j++ {
+			consumer := storage.StreamConsumer{}
+			if consumer.Name, err = DecodeString(r); err != nil {
+				return nil, err
+			}
+
+			if consumer.SeenTime, err = readMillisecondTime(r); err != nil {
+				return nil, err
+			}
+
+			// consumers of the older encodings were active when they were seen
+			consumer.ActiveTime = consumer.SeenTime
+			if t == STREAM {
+				if consumer.ActiveTime, err = readMillisecondTime(r); err != nil {
+					return nil, err
+				}
+			}
+
+			pending, err := DecodeUint64(r)
+			if err != nil {
+				return nil, err
+			}
+
+			for k := uint64(0); k < pending; k++ {
+				id, err := readRawStreamId(r)
+				if err != nil {
+					return nil, err
+				}
+
+				if !delivered[id.String()] {
+					return nil, fmt.Errorf("pending entry %s of consumer %q is not pending in group %q", id, consumer.Name, group.Name)
+				}
+
+				consumer.Pending = append(consumer.Pending, id.String())
+			}
+
+			group.Consumers = append(group.Consumers, consumer)
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func readRawStreamId(r ByteReader) (streamId, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return streamId{}, err
+	}
+
+	return streamId{ms: binary.BigEndian.Uint64(b), seq: binary.BigEndian.Uint64(b[8:])}, nil
+}
+
+func writeMillisecondTime(w io.Writer, t int64) error {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t))
+	_, err := w.Write(b)
+	return err
+}
+
+func readMillisecondTime(r ByteReader) (int64, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
+
+// readStreamEntries reads listpack nodes of the stream, deleted entries are skipped
+func readStreamEntries(r ByteReader) ([]storage.StreamKV, error) {
+	nodes, err := DecodeUint64(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []storage.StreamKV
+	for ; nodes > 0; nodes-- {
+		key, err := DecodeString(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(key) != 16 {
+			return nil, fmt.Errorf("invalid stream node key of length %d", len(key))
+		}
+
+		raw, err := DecodeString(r)
+		if err != nil {
+			return nil, err
+		}
+
+		elements, err := ReadListpack([]byte(raw))
+		if err != nil {
+			return nil, err
+		}
+
+		master := streamId{ms: binary.BigEndian.Uint64([]byte(key)), seq: binary.BigEndian.Uint64([]byte(key[8:]))}
+		if entries, err = readStreamNode(entries, master, elements); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+func readStreamNode(entries []storage.StreamKV, master streamId, elements []string) ([]storage.StreamKV, error) {
+	ints := func(s []string) ([]uint64, error) {
+		v := make([]uint64, len(s))
+		for i := range s {
+			n, err := strconv.ParseInt(s[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("expected integer in stream node, got %q", s[i])
+			}
+			v[i] = uint64(n)
+		}
+		return v, nil
+	}
+
+	if len(elements) < 3 {
+		return nil, fmt.Errorf("invalid stream master entry")
+	}
+
+	header, err := ints(elements[:3])
+	if err != nil {
+		return nil, err
+	}
+
+	numFields := int(header[2])
+	if len(elements) < 4+numFields || elements[3+numFields] != "0" {
+		return nil, fmt.Errorf("invalid stream master entry")
+	}
+
+	fields := elements[3 : 3+numFields]
+	p := 4 + numFields
+	for total := header[0] + header[1]; total > 0; total-- {
+		if p+3 > len(elements) {
+			return nil, fmt.Errorf("stream node is truncated")
+		}
+
+		entry, err := ints(elements[p : p+3])
+		if err != nil {
+			return nil, err
+		}
+
+		p += 3
+		flags, id := entry[0], streamId{ms: master.ms + entry[1], seq: master.seq + entry[2]}
+		var data []string
+		if flags&STREAM_ITEM_FLAG_SAMEFIELDS != 0 {
+			if p+numFields > len(elements) {
+				return nil, fmt.Errorf("stream node is truncated")
+			}
+
+			data = make([]string, 0, 2*numFields)
+			for i, field := range fields {
+				data = append(data, field, elements[p+i])
+			}
+
+			p += numFields
+		} else {
+			if p >= len(elements) {
+				return nil, fmt.Errorf("stream node is truncated")
+			}
+
+			n, err := strconv.Atoi(elements[p])
+			if err != nil || p+1+2*n > len(elements) {
+				return nil, fmt.Errorf("stream node is truncated")
+			}
+
+			data = append([]string(nil), elements[p+1:p+1+2*n]...)
+			p += 1 + 2*n
+		}
+
+		// lp-count used to iterate backwards
+		p++
+		if flags&STREAM_ITEM_FLAG_DELETED == 0 {
+			entries = append(entries, storage.StreamKV{Key: id.String(), Data: data})
+		}
+	}
+
+	if p != len(elements) {
+		return nil, fmt.Errorf("unexpected %d elements at the end of stream node", len(elements)-p)
+	}
+
+	return entries, nil
+}
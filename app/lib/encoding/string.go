@@ -1,23 +1,120 @@
 package encoding
 
 import (
-	"bufio"
 	"fmt"
+	"io"
 )
 
-func DecodeString(r *bufio.Reader) (string, error) {
-	length, isStringInt, err := Decode(r)
+func DecodeString(r ByteReader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	if b == RDB_LZF_STR {
+		return decodeLzfString(r)
+	}
+
+	length, isStringInt, err := decodeLength(b, r)
 	if err != nil {
 		return "", err
 	}
 	if isStringInt {
-		return fmt.Sprint(length), err
+		return fmt.Sprint(int32(length)), err
+	}
+
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+
+	return string(s), nil
+}
+
+// decodeLzfString reads compressed and uncompressed lengths followed by the lzf compressed data
+func decodeLzfString(r ByteReader) (string, error) {
+	clen, _, err := Decode(r)
+	if err != nil {
+		return "", err
+	}
+
+	ulen, _, err := Decode(r)
+	if err != nil {
+		return "", err
+	}
+
+	in := make([]byte, clen)
+	if _, err = io.ReadFull(r, in); err != nil {
+		return "", err
 	}
 
-	b := make([]byte, length)
-	if _, err := r.Read(b); err != nil {
+	out, err := lzfDecompress(in, int(ulen))
+	if err != nil {
 		return "", err
 	}
 
-	return string(b), nil
+	return string(out), nil
+}
+
+// lzfDecompress decodes sequence of literal runs (control byte < 32 followed by control+1 bytes)
+// and back references (3 high bits of control byte are length, 5 low bits with the next byte are offset)
+func lzfDecompress(in []byte, ulen int) ([]byte, error) {
+	out := make([]byte, 0, ulen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 1<<5 {
+			ctrl++
+			if ip+ctrl > len(in) || len(out)+ctrl > ulen {
+				return nil, fmt.Errorf("lzf literal run out of bounds")
+			}
+
+			out = append(out, in[ip:ip+ctrl]...)
+			ip += ctrl
+			continue
+		}
+
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, fmt.Errorf("lzf back reference out of bounds")
+			}
+
+			length += int(in[ip])
+			ip++
+		}
+
+		if ip >= len(in) {
+			return nil, fmt.Errorf("lzf back reference out of bounds")
+		}
+
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		length += 2
+		if ref < 0 || len(out)+length > ulen {
+			return nil, fmt.Errorf("lzf back reference out of bounds")
+		}
+
+		// reference may overlap bytes being written, so it is copied byte by byte
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != ulen {
+		return nil, fmt.Errorf("lzf decompressed length %d, expected %d", len(out), ulen)
+	}
+
+	return out, nil
+}
+
+// EncodeString writes s as length prefixed string
+func EncodeString(w io.Writer, s string) (int, error) {
+	n, err := EncodeLength(w, uint64(len(s)))
+	if err != nil {
+		return n, err
+	}
+
+	written, err := io.WriteString(w, s)
+	return n + written, err
 }
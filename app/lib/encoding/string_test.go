@@ -34,3 +34,20 @@ func TestDecodeString(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeLzfString(t *testing.T) {
+	// literal "a" followed by back reference of 9 bytes at distance 1
+	compressed := []byte{RDB_LZF_STR, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00}
+	got, err := DecodeString(bufio.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "aaaaaaaaaa" {
+		t.Errorf("got %q, expected %q", got, "aaaaaaaaaa")
+	}
+
+	if _, err = DecodeString(bufio.NewReader(bytes.NewReader([]byte{RDB_LZF_STR, 3, 10, 0x00, 'a', 0xe0}))); err == nil {
+		t.Errorf("expected error decoding corrupted lzf string")
+	}
+}
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"time"
+)
+
+// activeExpireCycle deletes expired keys nobody accesses, replicas and the AOF receive DEL of every deleted key,
+// so keys expire on replicas when the master says so
+func (s *RedisServer) activeExpireCycle() {
+	ticker := time.NewTicker(ACTIVE_EXPIRE_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.close:
+			return
+		case <-ticker.C:
+		}
+
+		deadline := time.Now().Add(ACTIVE_EXPIRE_BUDGET)
+		s.db.Range(func(_, value interface{}) bool {
+			db, ok := value.(*storage.RedisDataTypes)
+			if !ok {
+				return true
+			}
+
+			// the db is sampled again while more than a quarter of the sample is expired
+			for time.Now().Before(deadline) {
+				if s.expireKeys(db) <= storage.PICK_NUMBER/4 {
+					break
+				}
+			}
+
+			return time.Now().Before(deadline)
+		})
+	}
+}
+
+// expireKeys deletes expired keys of a sample as a write command would and returns their number
+func (s *RedisServer) expireKeys(db *storage.RedisDataTypes) int {
+	return s.deleteExpired(db, db.ExpireKeys)
+}
+
+// expireAccessed deletes the expired keys the command is about to access, so the master deletes them once for
+// itself, its replicas and the AOF, replicas keep the keys until DEL of the master and read them as missing
+func (s *RedisServer) expireAccessed(db *storage.RedisDataTypes, keys []string) {
+	if !db.Expired(keys) {
+		return
+	}
+
+	s.deleteExpired(db, func() []string {
+		return db.ExpireAccessed(keys)
+	})
+}
+
+// deleteExpired deletes keys returned by expire as a write command would and returns their number
+func (s *RedisServer) deleteExpired(db *storage.RedisDataTypes, expire func() []string) int {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+	// replicas wait for DEL of the master, the loaded dataset is expired once it is loaded
+	persistence := s.config.PersistenceConfig
+	if s.config.ReplicaOf() != "" || (persistence != nil && persistence.Loading.Load()) {
+		return 0
+	}
+
+	if s.aof != nil {
+		release := s.aof.Hold()
+		defer release()
+	}
+
+	// dbs loaded from the RDB are told about the server once selected by a client
+	db.OnKeyEvent(s.keyEvent)
+	keys := expire()
+	for _, key := range keys {
+		del := resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("DEL")}, resp.BulkString{S: []byte(key)}}}
+		if s.aof != nil {
+			if err := s.aof.Feed(db.Index(), &del); err != nil {
+				s.logger.Printf("Failed to feed AOF: %s", err)
+			}
+		}
+
+		s.PropagateToAll(db.Index(), &del)
+	}
+
+	return len(keys)
+}
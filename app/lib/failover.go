@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/replication"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HandleFailover starts coordinated failover to the replica at TO host port or to the most up to date one,
+// FAILOVER ABORT cancels failover waiting for the replica. Writes are paused until the replica catches up,
+// FORCE starts failover even when it did not within TIMEOUT
+func HandleFailover(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	var (
+		host, port   string
+		timeout      time.Duration
+		force, abort bool
+		args         = req.Args.A
+	)
+
+	for i := 0; i < len(args); i++ {
+		arg, ok := args[i].(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+
+		switch strings.ToUpper(string(arg.S)) {
+		case "TO":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+
+			h, okHost := args[i+1].(resp.BulkString)
+			p, okPort := args[i+2].(resp.BulkString)
+			if !okHost || !okPort {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+
+			if _, err := strconv.ParseUint(string(p.S), 10, 16); err != nil {
+				return nil, fmt.Errorf("ERR Invalid target port")
+			}
+
+			host, port = string(h.S), string(p.S)
+			i += 2
+		case "TIMEOUT":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+
+			ms, err := intArg(args[i+1])
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("ERR FAILOVER timeout must be greater than 0")
+			}
+
+			timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case "FORCE":
+			force = true
+		case "ABORT":
+			abort = true
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+
+	if abort {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+
+		return "OK", req.s.abortFailover()
+	}
+
+	if force && (timeout == 0 || host == "") {
+		return nil, fmt.Errorf("ERR FAILOVER with force option requires both a timeout and target HOST and IP.")
+	}
+
+	config := req.s.config.ReplicationConfig
+	if req.s.config.ReplicaOf() != "" {
+		return nil, fmt.Errorf("ERR FAILOVER is not valid when server is a replica.")
+	}
+
+	var target *replication.Slave
+	for _, slave := range config.Slaves() {
+		if host != "" && slave.Port() == port && sameHost(host, slave.IP()) {
+			if !slave.Online() {
+				return nil, fmt.Errorf("ERR FAILOVER target replica is not online.")
+			}
+
+			target = slave
+			break
+		}
+
+		if host == "" && slave.Online() && (target == nil || slave.GetOffset() > target.GetOffset()) {
+			target = slave
+		}
+	}
+
+	if target == nil && host != "" {
+		return nil, fmt.Errorf("ERR FAILOVER target HOST and PORT is not a replica.")
+	}
+
+	if target == nil {
+		return nil, fmt.Errorf("ERR FAILOVER requires connected replicas.")
+	}
+
+	if host == "" {
+		host, port = target.IP(), target.Port()
+	}
+
+	req.s.mu.Lock()
+	defer req.s.mu.Unlock()
+	if replication.FailoverState(config.Failover.Load()) != replication.FAILOVER_NONE {
+		return nil, fmt.Errorf("ERR FAILOVER already in progress.")
+	}
+
+	config.Failover.Store(int32(replication.FAILOVER_WAIT_FOR_SYNC))
+	req.s.failoverAbort = make(chan struct{})
+	go req.s.failover(target, net.JoinHostPort(host, port), timeout, force, req.s.failoverAbort)
+	return "OK", nil
+}
+
+func sameHost(host, ip string) bool {
+	if host == ip {
+		return true
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if addr == ip {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *RedisServer) abortFailover() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failoverAbort == nil {
+		return fmt.Errorf("ERR No failover in progress.")
+	}
+
+	close(s.failoverAbort)
+	s.failoverAbort = nil
+	return nil
+}
+
+// failover pauses writes until target acknowledges the whole replication stream and turns the server into
+// its replica, target promotes itself on PSYNC FAILOVER and continues our history, so nobody needs full resync
+func (s *RedisServer) failover(target *replication.Slave, addr string, timeout time.Duration, force bool, abort <-chan struct{}) {
+	config := s.config.ReplicationConfig
+	defer config.Failover.Store(int32(replication.FAILOVER_NONE))
+	s.writes.Lock()
+	defer s.writes.Unlock()
+	w := &waiter{offset: config.MasterReplOffset.Load(), slave: target, done: make(chan struct{})}
+	s.mu.Lock()
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+	s.notifyWaiters()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	caughtUp, aborted := true, false
+	select {
+	case <-w.done:
+	case <-expired:
+		caughtUp = false
+	case <-abort:
+		aborted = true
+	}
+
+	s.mu.Lock()
+	s.removeWaiter(w)
+	if s.failoverAbort == abort {
+		s.failoverAbort = nil
+	}
+	s.mu.Unlock()
+	switch {
+	case aborted:
+		s.logger.Printf("FAILOVER to %s aborted by user", addr)
+		return
+	case !caughtUp && !force:
+		s.logger.Printf("FAILOVER to %s aborted: target replica did not catch up in time", addr)
+		return
+	}
+
+	config.Failover.Store(int32(replication.FAILOVER_IN_PROGRESS))
+	s.role.Lock()
+	defer s.role.Unlock()
+	s.mu.Lock()
+	s.config.SetReplicaOf(addr)
+	// dataset and offset are ours, so the new master is able to continue them
+	s.replHistory = true
+	s.mu.Unlock()
+	if err := s.startReplication(addr, true); err != nil {
+		s.logger.Printf("FAILOVER to %s failed, staying master: %s", addr, err)
+		s.mu.Lock()
+		s.config.SetReplicaOf("")
+		config.Role = "master"
+		s.mu.Unlock()
+		return
+	}
+
+	s.logger.Printf("FAILOVER to %s succeeded", addr)
+}
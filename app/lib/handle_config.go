@@ -4,8 +4,47 @@ import (
 	"context"
 	"fmt"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"strconv"
+	"time"
 )
 
+var configGetters = map[string]func(config *ServerConfig) string{
+	"dir":                         func(c *ServerConfig) string { return c.PersistenceConfig.Dir },
+	"dbfilename":                  func(c *ServerConfig) string { return c.PersistenceConfig.File },
+	"appendonly":                  func(c *ServerConfig) string { return yesNo(c.PersistenceConfig.AppendOnly) },
+	"appenddirname":               func(c *ServerConfig) string { return c.PersistenceConfig.AppendDirname },
+	"appendfilename":              func(c *ServerConfig) string { return c.PersistenceConfig.AppendFilename },
+	"appendfsync":                 func(c *ServerConfig) string { return c.PersistenceConfig.AppendFsync },
+	"aof-load-truncated":          func(c *ServerConfig) string { return yesNo(c.PersistenceConfig.AofLoadTruncated) },
+	"aof-use-rdb-preamble":        func(c *ServerConfig) string { return yesNo(c.PersistenceConfig.AofUseRdbPreamble) },
+	"auto-aof-rewrite-percentage": func(c *ServerConfig) string { return fmt.Sprint(c.PersistenceConfig.AutoAofRewritePercentage) },
+	"auto-aof-rewrite-min-size":   func(c *ServerConfig) string { return fmt.Sprint(c.PersistenceConfig.AutoAofRewriteMinSize) },
+	"repl-diskless-sync":          func(c *ServerConfig) string { return yesNo(c.ReplicationConfig.ReplDisklessSync) },
+	"replica-read-only":           func(c *ServerConfig) string { return yesNo(c.ReplicationConfig.ReplicaReadOnly) },
+	"repl-ping-replica-period":    func(c *ServerConfig) string { return seconds(c.ReplicationConfig.ReplPingReplicaPeriod) },
+	"min-replicas-to-write":       func(c *ServerConfig) string { return fmt.Sprint(c.ReplicationConfig.MinReplicasToWrite) },
+	"min-replicas-max-lag":        func(c *ServerConfig) string { return seconds(c.ReplicationConfig.MinReplicasMaxLag) },
+	"repl-timeout":                func(c *ServerConfig) string { return seconds(c.ReplicationConfig.ReplTimeout) },
+	"cluster-enabled":             func(c *ServerConfig) string { return yesNo(c.ClusterConfig.Enabled) },
+	"cluster-node-timeout":        func(c *ServerConfig) string { return fmt.Sprint(c.ClusterConfig.NodeTimeout.Milliseconds()) },
+	"cluster-config-file":         func(c *ServerConfig) string { return c.ClusterConfig.ConfigFile },
+	"replica-priority":            func(c *ServerConfig) string { return fmt.Sprint(c.ReplicationConfig.ReplicaPriority) },
+	"notify-keyspace-events":      func(c *ServerConfig) string { return NotifyFlags(c.NotifyKeyspaceEvents.Load()).String() },
+}
+
+// configSetters are the parameters changed at runtime
+var configSetters = map[string]func(config *ServerConfig, value string) error{
+	"notify-keyspace-events": func(c *ServerConfig, value string) error {
+		flags, err := ParseNotifyFlags(value)
+		if err != nil {
+			return err
+		}
+
+		c.NotifyKeyspaceEvents.Store(int32(flags))
+		return nil
+	},
+}
+
 func HandleConfig(ctx context.Context, req *RESPRequest) (interface{}, error) {
 	if len(req.Args.A) < 2 {
 		return nil, fmt.Errorf("ERR wrong number of arguments")
@@ -21,23 +60,54 @@ func HandleConfig(ctx context.Context, req *RESPRequest) (interface{}, error) {
 	}
 
 	switch string(command.S) {
-	case "set":
-		return nil, nil
+	case "set", "SET":
+		if len(req.Args.A)%2 != 1 {
+			return nil, fmt.Errorf("ERR wrong number of arguments for 'config|set' command")
+		}
+
+		for i := 1; i < len(req.Args.A); i += 2 {
+			key, ok := req.Args.A[i].(resp.BulkString)
+			value, valueOk := req.Args.A[i+1].(resp.BulkString)
+			if !ok || !valueOk {
+				return nil, fmt.Errorf("ERR invalid key type")
+			}
+
+			set, ok := configSetters[string(key.S)]
+			if !ok {
+				return nil, fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", key.S)
+			}
+
+			if err := set(req.s.config, string(value.S)); err != nil {
+				return nil, fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", key.S, err)
+			}
+		}
+
+		return "OK", nil
 	case "get", "GET":
 		var key resp.BulkString
 		if key, ok = req.Args.A[1].(resp.BulkString); !ok {
 			return nil, fmt.Errorf("ERR invalid key type")
 		}
 
-		switch string(key.S) {
-		case "dir":
-			return resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("dir")}, resp.BulkString{S: []byte(req.s.config.PersistenceConfig.Dir)}}}, nil
-		case "dbfilename":
-			return resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("dbfilename")}, resp.BulkString{S: []byte(req.s.config.PersistenceConfig.File)}}}, nil
-		default:
+		get, ok := configGetters[string(key.S)]
+		if !ok {
 			return nil, fmt.Errorf("ERR invalid key")
 		}
+
+		return resp.Map{Entries: []resp.MapEntry{{Key: resp.BulkString{S: key.S}, Value: resp.BulkString{S: []byte(get(req.s.config))}}}}, nil
 	default:
 		return nil, fmt.Errorf("ERR invalid command")
 	}
 }
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+
+	return "no"
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(d.Seconds()))
+}
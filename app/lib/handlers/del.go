@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+)
+
+func HandleDel(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	if len(req.Args.A) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'del' command")
+	}
+
+	deleted := 0
+	for _, arg := range req.Args.A {
+		key, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR invalid key type, expected string, got %T", arg)
+		}
+
+		if req.Db.GetType(key.String()) == storage.NONE {
+			continue
+		}
+
+		ok, err := req.Db.Delete(key.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			req.Notify(lib.NOTIFY_GENERIC, "del", key.String())
+			deleted++
+		}
+	}
+
+	if deleted == 0 {
+		req.SkipPropagation()
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpEntry returns the key as RDB entry with its expire time, nil when the key does not exist
+func dumpEntry(db *storage.RedisDataTypes, key string) (*resp.RdbEntry, error) {
+	switch db.GetType(key) {
+	case storage.STRINGS:
+		elem, ok, err := db.GetStorage(storage.STRINGS).(storage.StringsStorage).GetElement(key)
+		if err != nil || !ok {
+			return nil, err
+		}
+
+		return &resp.RdbEntry{Type: resp.STRING, Key: key, Value: elem.Value, Expire: elem.Expire}, nil
+	case storage.STREAMS:
+		stream, err := db.GetStorage(storage.STREAMS).(*storage.StreamsIdx).GetOrCreateStream(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return &resp.RdbEntry{Type: resp.STREAM, Key: key, Stream: stream.Entries(), StreamMeta: stream.Meta(), StreamGroups: stream.Groups()}, nil
+	}
+
+	return nil, nil
+}
+
+func HandleDump(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	if len(req.Args.A) != 1 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'dump' command")
+	}
+
+	key, ok := req.Args.A[0].(resp.BulkString)
+	if !ok {
+		return nil, fmt.Errorf("ERR invalid key type, expected string, got %T", req.Args.A[0])
+	}
+
+	entry, err := dumpEntry(req.Db, key.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return resp.BulkString{S: nil, EncodeNil: true}, nil
+	}
+
+	payload, err := resp.DumpPayload(entry)
+	if err != nil {
+		return nil, fmt.Errorf("ERR %s", err)
+	}
+
+	return payload, nil
+}
+
+type restoreArgs struct {
+	key     string
+	ttl     int64
+	payload []byte
+	replace bool
+	absTtl  bool
+}
+
+func parseRestoreArgs(args []resp.Marshaller) (*restoreArgs, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'restore' command")
+	}
+
+	str := make([]string, len(args))
+	for i, arg := range args {
+		bulk, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR invalid argument type, expected string, got %T", arg)
+		}
+
+		str[i] = string(bulk.S)
+	}
+
+	ttl, err := strconv.ParseInt(str[1], 10, 64)
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("ERR Invalid TTL value, must be >= 0")
+	}
+
+	restore := &restoreArgs{key: str[0], ttl: ttl, payload: []byte(str[2])}
+	for i := 3; i < len(str); i++ {
+		switch strings.ToUpper(str[i]) {
+		case "REPLACE":
+			restore.replace = true
+		case "ABSTTL":
+			restore.absTtl = true
+		case "IDLETIME", "FREQ":
+			// eviction is not implemented, so values are only validated
+			if i+1 >= len(str) {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+
+			if v, err := strconv.ParseInt(str[i+1], 10, 64); err != nil || v < 0 {
+				return nil, fmt.Errorf("ERR Invalid %s value, must be >= 0", strings.ToUpper(str[i]))
+			}
+			i++
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+
+	return restore, nil
+}
+
+func HandleRestore(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	args, err := parseRestoreArgs(req.Args.A)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := resp.RestorePayload(args.payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if !args.replace && req.Db.GetType(args.key) != storage.NONE {
+		if _, ok, err := req.Db.GetStorage(storage.STRINGS).(storage.StringsStorage).Get(args.key); ok || err != nil {
+			return nil, fmt.Errorf("BUSYKEY Target key name already exists.")
+		}
+	}
+
+	var expire time.Time
+	switch {
+	case args.ttl != 0 && args.absTtl:
+		expire = time.UnixMilli(args.ttl)
+	case args.ttl != 0:
+		expire = time.Now().Add(time.Duration(args.ttl) * time.Millisecond)
+	}
+
+	deleted, err := req.Db.Delete(args.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !expire.IsZero() && !expire.After(time.Now()) {
+		if deleted {
+			req.Notify(lib.NOTIFY_GENERIC, "del", args.key)
+		}
+
+		return "OK", nil
+	}
+
+	entry.Key, entry.Expire = args.key, expire
+	if err = resp.StoreEntry(req.Db, entry); err != nil {
+		return nil, err
+	}
+
+	req.Notify(lib.NOTIFY_GENERIC, "restore", args.key)
+
+	// relative ttl is converted to the absolute one, so the command logged to the append only file
+	// restores the same expire time when replayed
+	if !expire.IsZero() && !args.absTtl {
+		req.Args.A[1] = resp.BulkString{S: []byte(strconv.FormatInt(expire.UnixMilli(), 10))}
+		req.Args.Append(resp.BulkString{S: []byte("ABSTTL")})
+	}
+
+	return "OK", nil
+}
@@ -19,6 +19,8 @@ func HandleInfo(ctx context.Context, req *lib.RESPRequest) (interface{}, error)
 	switch string(section.S) {
 	case "replication":
 		return req.Config.ReplicationConfig, nil
+	case "persistence":
+		return req.Config.PersistenceConfig, nil
 	default:
 		return nil, fmt.Errorf("ERR invalid section: %s", section.S)
 	}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type migrateArgs struct {
+	addr     string
+	keys     []string
+	db       int
+	timeout  time.Duration
+	copy     bool
+	replace  bool
+	username string
+	password string
+}
+
+func parseMigrateArgs(args []resp.Marshaller) (*migrateArgs, error) {
+	if len(args) < 5 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'migrate' command")
+	}
+
+	str := make([]string, len(args))
+	for i, arg := range args {
+		bulk, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR invalid argument type, expected string, got %T", arg)
+		}
+
+		str[i] = string(bulk.S)
+	}
+
+	db, err := strconv.Atoi(str[3])
+	if err != nil {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+
+	timeout, err := strconv.ParseInt(str[4], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	migrate := &migrateArgs{
+		addr:    net.JoinHostPort(str[0], str[1]),
+		db:      db,
+		timeout: time.Duration(timeout) * time.Millisecond,
+	}
+
+	for i := 5; i < len(str); i++ {
+		switch strings.ToUpper(str[i]) {
+		case "COPY":
+			migrate.copy = true
+		case "REPLACE":
+			migrate.replace = true
+		case "AUTH":
+			if i+1 >= len(str) {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+
+			migrate.password = str[i+1]
+			i++
+		case "AUTH2":
+			if i+2 >= len(str) {
+				return nil, fmt.Errorf("ERR syntax error")
+			}
+
+			migrate.username, migrate.password = str[i+1], str[i+2]
+			i += 2
+		case "KEYS":
+			if str[2] != "" {
+				return nil, fmt.Errorf("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+
+			migrate.keys = str[i+1:]
+			i = len(str)
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+
+	if migrate.keys == nil {
+		migrate.keys = str[2:3]
+	}
+
+	return migrate, nil
+}
+
+// HandleMigrate moves keys to another instance with RESTORE of their DUMP payloads, keys are deleted here
+// once the target stores them unless COPY is given, the first error of the target is replied after the keys it
+// stored are deleted
+func HandleMigrate(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	args, err := parseMigrateArgs(req.Args.A)
+	if err != nil {
+		return nil, err
+	}
+
+	restore := "RESTORE"
+	if req.Config.ClusterConfig.Enabled {
+		restore = "RESTORE-ASKING"
+	}
+
+	cmds := make([]resp.Array, 0, len(args.keys)+2)
+	if args.password != "" {
+		auth := []string{"AUTH", args.password}
+		if args.username != "" {
+			auth = []string{"AUTH", args.username, args.password}
+		}
+
+		cmds = append(cmds, bulkArray(auth...))
+	}
+
+	if args.db != 0 {
+		cmds = append(cmds, bulkArray("SELECT", strconv.Itoa(args.db)))
+	}
+
+	prelude := len(cmds)
+	keys := make([]string, 0, len(args.keys))
+	for _, key := range args.keys {
+		entry, err := dumpEntry(req.Db, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry == nil {
+			continue
+		}
+
+		var ttl int64
+		if !entry.Expire.IsZero() {
+			if ttl = time.Until(entry.Expire).Milliseconds(); ttl <= 0 {
+				continue
+			}
+		}
+
+		payload, err := resp.DumpPayload(entry)
+		if err != nil {
+			return nil, fmt.Errorf("ERR %s", err)
+		}
+
+		cmd := bulkArray(restore, key, strconv.FormatInt(ttl, 10), string(payload))
+		if args.replace {
+			cmd.Append(resp.BulkString{S: []byte("REPLACE")})
+		}
+
+		cmds = append(cmds, cmd)
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		req.SkipPropagation()
+		return "NOKEY", nil
+	}
+
+	restored, err := sendMigrate(args, cmds, prelude)
+	if args.copy {
+		req.SkipPropagation()
+		if err != nil {
+			return nil, err
+		}
+
+		return "OK", nil
+	}
+
+	// keys the target failed to store are kept in place, so migration of them is retried with REPLACE
+	del := make([]resp.Marshaller, 0, len(keys))
+	for i, key := range keys {
+		if !restored[i] {
+			continue
+		}
+
+		if _, err := req.Db.Delete(key); err != nil {
+			return nil, err
+		}
+
+		req.Notify(lib.NOTIFY_GENERIC, "del", key)
+		del = append(del, resp.BulkString{S: []byte(key)})
+	}
+
+	if len(del) == 0 {
+		req.SkipPropagation()
+		return nil, err
+	}
+
+	// the keys are deleted on replicas and in the AOF rather than migrated again
+	req.RewriteCommand("del", del...)
+	if err != nil {
+		// replied as a value, so the deleted keys are still propagated
+		return resp.SimpleError{E: err.Error()}, nil
+	}
+
+	return "OK", nil
+}
+
+// sendMigrate pipelines the commands to the target and checks their replies, it reports which of the commands
+// following the first prelude ones were acknowledged, replies to the prelude commands fail the whole migration
+func sendMigrate(args *migrateArgs, cmds []resp.Array, prelude int) ([]bool, error) {
+	restored := make([]bool, len(cmds)-prelude)
+	conn, err := net.DialTimeout("tcp", args.addr, args.timeout)
+	if err != nil {
+		return restored, fmt.Errorf("IOERR error or timeout connecting to the client")
+	}
+
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	if err = conn.SetWriteDeadline(time.Now().Add(args.timeout)); err != nil {
+		return restored, fmt.Errorf("IOERR error or timeout writing to target instance")
+	}
+
+	for _, cmd := range cmds {
+		if _, err = cmd.MarshalRESP(w); err != nil {
+			return restored, fmt.Errorf("IOERR error or timeout writing to target instance")
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return restored, fmt.Errorf("IOERR error or timeout writing to target instance")
+	}
+
+	var targetErr error
+	r := bufio.NewReader(conn)
+	for i := range cmds {
+		if err = conn.SetReadDeadline(time.Now().Add(args.timeout)); err != nil {
+			return restored, fmt.Errorf("IOERR error or timeout reading to target instance")
+		}
+
+		// keys acknowledged before the connection failed are stored by the target
+		reply := resp.Any{}
+		if _, err = reply.UnmarshalRESP(r); err != nil {
+			return restored, fmt.Errorf("IOERR error or timeout reading to target instance")
+		}
+
+		e, failed := reply.I.(resp.SimpleError)
+		switch {
+		case failed && i < prelude:
+			return restored, fmt.Errorf("ERR Target instance replied with error: %s", e.E)
+		case failed && targetErr == nil:
+			targetErr = fmt.Errorf("ERR Target instance replied with error: %s", e.E)
+		case !failed && i >= prelude:
+			restored[i-prelude] = true
+		}
+	}
+
+	return restored, targetErr
+}
+
+func bulkArray(args ...string) resp.Array {
+	arr := resp.Array{A: make([]resp.Marshaller, 0, len(args))}
+	for _, arg := range args {
+		arr.Append(resp.BulkString{S: []byte(arg)})
+	}
+
+	return arr
+}
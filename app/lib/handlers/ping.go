@@ -3,8 +3,21 @@ package handlers
 import (
 	"context"
 	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
 )
 
 func HandlePing(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	// subscribed RESP2 connection receives messages as arrays, so PING is replied in the same shape
+	if req.Subscribed() && req.Protocol() == resp.RESP2 {
+		msg := resp.BulkString{S: []byte{}}
+		if len(req.Args.A) > 0 {
+			if b, ok := req.Args.A[0].(resp.BulkString); ok {
+				msg = b
+			}
+		}
+
+		return resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("pong")}, msg}}, nil
+	}
+
 	return "PONG", nil
 }
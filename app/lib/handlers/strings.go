@@ -9,6 +9,7 @@ import (
 	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -72,67 +73,26 @@ func parseSetArgs(args *[]resp.Marshaller) (*SetArgs, error) {
 					return nil, errors.New("ERR invalid argument, XX and NX are mutually exclusive")
 				}
 				setArgs.XX = true
-			case "EX", "ex":
+			case "EX", "ex", "PX", "px", "EXAT", "exat", "PXAT", "pxat":
 				if i+1 >= len(*args) {
 					return nil, errors.New("ERR wrong number of arguments")
 				}
-				switch v := (*args)[i+1].(type) {
-				case resp.SimpleInt:
-					i++
-					expireTime := time.Now().Add(time.Duration(v.I) * time.Second)
-					setArgs.Expire = expireTime
-				case resp.BulkString:
-					i++
-					parsedTime, err := strconv.ParseInt(string(v.S), 10, 64)
-					if err != nil {
-						return nil, errors.New("ERR invalid expire time")
-					}
-					expireTime := time.Now().Add(time.Duration(parsedTime) * time.Second)
-					setArgs.Expire = expireTime
-				default:
-					return nil, errors.New("ERR invalid expire time")
-				}
-			case "PX", "px":
-				if i+1 >= len(*args) {
-					return nil, errors.New("ERR wrong number of arguments")
-				}
-				switch v := (*args)[i+1].(type) {
-				case resp.SimpleInt:
-					i++
-					expireTime := time.Now().Add(time.Duration(v.I) * time.Millisecond)
-					setArgs.Expire = expireTime
-				case resp.BulkString:
-					i++
-					parsedTime, err := strconv.ParseInt(string(v.S), 10, 64)
-					if err != nil {
-						return nil, errors.New("ERR invalid expire time")
-					}
-					expireTime := time.Now().Add(time.Duration(parsedTime) * time.Millisecond)
-					setArgs.Expire = expireTime
-				default:
-					return nil, errors.New("ERR invalid expire time")
-				}
-			case "EXAT", "exat":
-				if i+1 >= len(*args) {
-					return nil, errors.New("ERR wrong number of arguments")
-				}
-				if expire, ok := ((*args)[i+1]).(resp.SimpleInt); !ok {
+
+				i++
+				n, err := intArg((*args)[i])
+				if err != nil {
 					return nil, errors.New("ERR invalid expire time")
-				} else {
-					i++
-					expireTime := time.Unix(expire.I, 0)
-					setArgs.Expire = expireTime
-				}
-			case "PXAT", "pxat":
-				if i+1 >= len(*args) {
-					return nil, errors.New("ERR wrong number of arguments")
 				}
-				if expire, ok := ((*args)[i+1]).(resp.SimpleInt); !ok {
-					return nil, errors.New("ERR invalid expire time")
-				} else {
-					i++
-					expireTime := time.UnixMilli(expire.I)
-					setArgs.Expire = expireTime
+
+				switch strings.ToUpper(val) {
+				case "EX":
+					setArgs.Expire = time.Now().Add(time.Duration(n) * time.Second)
+				case "PX":
+					setArgs.Expire = time.Now().Add(time.Duration(n) * time.Millisecond)
+				case "EXAT":
+					setArgs.Expire = time.Unix(n, 0)
+				case "PXAT":
+					setArgs.Expire = time.UnixMilli(n)
 				}
 			case "GET", "get":
 				setArgs.GET = true
@@ -148,24 +108,64 @@ func parseSetArgs(args *[]resp.Marshaller) (*SetArgs, error) {
 	return &setArgs, nil
 }
 
+func intArg(arg resp.Marshaller) (int64, error) {
+	switch v := arg.(type) {
+	case resp.SimpleInt:
+		return v.I, nil
+	case resp.BulkString:
+		return strconv.ParseInt(string(v.S), 10, 64)
+	}
+
+	return 0, fmt.Errorf("expected integer, got %T", arg)
+}
+
+// rewriteSet propagates SET as plain write with absolute expire, so replicas and the AOF get the same
+// expire time regardless of when the command is applied
+func rewriteSet(req *lib.RESPRequest, setArgs *SetArgs) {
+	args := []resp.Marshaller{resp.BulkString{S: []byte(setArgs.Key)}, resp.BulkString{S: []byte(setArgs.Value)}}
+	if !setArgs.Expire.IsZero() {
+		args = append(args, resp.BulkString{S: []byte("PXAT")}, resp.BulkString{S: []byte(strconv.FormatInt(setArgs.Expire.UnixMilli(), 10))})
+	}
+
+	req.RewriteCommand("SET", args...)
+}
+
+func notifySet(req *lib.RESPRequest, setArgs *SetArgs) {
+	req.Notify(lib.NOTIFY_STRING, "set", setArgs.Key)
+	if !setArgs.Expire.IsZero() {
+		req.Notify(lib.NOTIFY_GENERIC, "expire", setArgs.Key)
+	}
+}
+
 func HandleSet(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
 	setArgs, err := parseSetArgs(&req.Args.A)
 	if err != nil {
 		return nil, err
 	}
 
+	// writes are executed one by one, so nobody modifies the key between the checks and the set
 	strStore := req.Db.GetStorage(storage.STRINGS).(storage.StringsStorage)
 	if setArgs.NX {
 		// set only if [N]ot e[X]ists
 		if _, ok, err := strStore.Get(setArgs.Key); ok || err != nil {
-			return nil, err
+			req.SkipPropagation()
+			if err != nil {
+				return nil, err
+			}
+
+			return resp.BulkString{EncodeNil: true}, nil
 		}
 	}
 
 	if setArgs.XX {
 		// set only if [e]xists
 		if _, ok, err := strStore.Get(setArgs.Key); !ok || err != nil {
-			return nil, err
+			req.SkipPropagation()
+			if err != nil {
+				return nil, err
+			}
+
+			return resp.BulkString{EncodeNil: true}, nil
 		}
 	}
 
@@ -180,6 +180,8 @@ func HandleSet(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
 			return nil, err
 		}
 
+		rewriteSet(req, setArgs)
+		notifySet(req, setArgs)
 		return oldValue, err
 	}
 
@@ -187,6 +189,8 @@ func HandleSet(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
 		return nil, err
 	}
 
+	rewriteSet(req, setArgs)
+	notifySet(req, setArgs)
 	return "OK", err
 }
 
@@ -206,6 +210,7 @@ func HandleGet(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
 		return nil, err
 	}
 	if !ok {
+		req.Notify(lib.NOTIFY_KEY_MISS, "keymiss", string(key.S))
 		return resp.BulkString{S: nil, EncodeNil: true}, nil
 	}
 
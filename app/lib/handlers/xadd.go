@@ -53,5 +53,9 @@ func HandleXAdd(ctx context.Context, req *lib.RESPRequest) (interface{}, error)
 		return nil, err
 	}
 
+	// log the generated id, so replaying the command results in the same entry
+	req.Args.A[1] = resp.BulkString{S: []byte(k)}
+	req.Notify(lib.NOTIFY_STREAM, "xadd", stream.String())
+
 	return []byte(k), nil
 }
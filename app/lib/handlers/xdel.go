@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+)
+
+// HandleXDel deletes entries of the stream, the stream itself is kept even when it becomes empty
+func HandleXDel(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	if len(req.Args.A) < 2 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'xdel' command")
+	}
+
+	stream, ok := req.Args.A[0].(resp.BulkString)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type of the key, got %T", req.Args.A[0])
+	}
+
+	ids := make([]string, 0, len(req.Args.A)-1)
+	for _, arg := range req.Args.A[1:] {
+		id, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type of the id, got %T", arg)
+		}
+
+		normalized, err := storage.NormalizeStreamId(id.String())
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, normalized)
+	}
+
+	if req.Db.GetType(stream.String()) == storage.NONE {
+		req.SkipPropagation()
+		return 0, nil
+	}
+
+	s, err := req.Db.GetStorage(storage.STREAMS).(*storage.StreamsIdx).GetOrCreateStream(stream.String())
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := s.Delete(ids)
+	if deleted == 0 {
+		req.SkipPropagation()
+		return 0, nil
+	}
+
+	req.Notify(lib.NOTIFY_STREAM, "xdel", stream.String())
+	return deleted, nil
+}
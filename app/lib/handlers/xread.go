@@ -122,6 +122,27 @@ func parseXReadArgs(args *resp.Array) (*xReadArgs, error) {
 	return &readArgs, nil
 }
 
+// XReadKeys returns streams of XREAD, i.e. the first half of the arguments following STREAMS
+func XReadKeys(args []resp.Marshaller) []string {
+	for i, arg := range args {
+		if s, ok := arg.(resp.BulkString); !ok || !strings.EqualFold(string(s.S), "STREAMS") {
+			continue
+		}
+
+		streams := args[i+1:]
+		keys := make([]string, 0, len(streams)/2)
+		for _, stream := range streams[:len(streams)/2] {
+			if key, ok := stream.(resp.BulkString); ok {
+				keys = append(keys, string(key.S))
+			}
+		}
+
+		return keys
+	}
+
+	return nil
+}
+
 func HandleXRead(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
 	args, err := parseXReadArgs(req.Args)
 	if err != nil {
@@ -129,6 +150,11 @@ func HandleXRead(ctx context.Context, req *lib.RESPRequest) (interface{}, error)
 	}
 
 	res := resp.Array{}
+	// blocking read of a transaction replies right away as if the timeout fired
+	if req.InTransaction() && args.block != -1 {
+		args.block = time.Nanosecond
+	}
+
 	if args.block == 0 {
 		// connection io timeout, though should remove it
 		args.block = time.Second * 10
@@ -174,7 +200,12 @@ func HandleXRead(ctx context.Context, req *lib.RESPRequest) (interface{}, error)
 					case kv := <-ch:
 						if strings.Compare(kv.Key, stream.start) == 1 || strings.Compare(kv.Key, stream.start) == 0 {
 							req.Logger.Printf("%s > %s", kv.Key, stream.stream)
-							read <- kv
+							select {
+							case read <- kv:
+							case <-done:
+								return
+							}
+
 							continue
 						}
 
@@ -184,13 +215,21 @@ func HandleXRead(ctx context.Context, req *lib.RESPRequest) (interface{}, error)
 				}
 			}()
 
-			select {
-			case <-timeout:
+			timedOut := false
+			req.Block(func() {
+				select {
+				case <-timeout:
+					timedOut = true
+				case kv := <-read:
+					kvs = append(kvs, kv)
+				}
+			})
+
+			// stops the subscriber when the read timed out as well
+			close(done)
+
+			if timedOut {
 				return resp.BulkString{S: nil, EncodeNil: true}, nil
-			case kv := <-read:
-				done <- struct{}{}
-				kvs = append(kvs, kv)
-				break
 			}
 		}
 
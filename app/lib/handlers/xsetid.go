@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"strconv"
+	"strings"
+)
+
+// HandleXSetId sets the last id of the stream and optionally its entries added counter and max deleted id,
+// e.g. XSETID key last [ENTRIESADDED n] [MAXDELETEDID id]
+func HandleXSetId(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	if len(req.Args.A) < 2 || len(req.Args.A)%2 != 0 {
+		return nil, fmt.Errorf("ERR syntax error")
+	}
+
+	args := make([]string, 0, len(req.Args.A))
+	for _, arg := range req.Args.A {
+		s, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type of the argument, got %T", arg)
+		}
+
+		args = append(args, s.String())
+	}
+
+	last, err := storage.NormalizeStreamId(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var entriesAdded *uint64
+	maxDeleted := ""
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "entriesadded":
+			n, err := strconv.ParseUint(args[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("ERR entries_added must be positive")
+			}
+
+			entriesAdded = &n
+		case "maxdeletedid":
+			if maxDeleted, err = storage.NormalizeStreamId(args[i+1]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+
+	if req.Db.GetType(args[0]) == storage.NONE {
+		return nil, fmt.Errorf("ERR no such key")
+	}
+
+	s, err := req.Db.GetStorage(storage.STREAMS).(*storage.StreamsIdx).GetOrCreateStream(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if entries := s.Entries(); len(entries) != 0 && storage.CompareStreamIds(last, entries[len(entries)-1].Key) < 0 {
+		return nil, fmt.Errorf("ERR The ID specified in XSETID is smaller than the target stream top item")
+	}
+
+	meta := s.Meta()
+	meta.LastId = last
+	if entriesAdded != nil {
+		if *entriesAdded < uint64(s.Len()) {
+			return nil, fmt.Errorf("ERR The entries_added specified in XSETID is smaller than the target stream length")
+		}
+
+		meta.EntriesAdded = *entriesAdded
+	}
+
+	if maxDeleted != "" {
+		if storage.CompareStreamIds(last, maxDeleted) < 0 {
+			return nil, fmt.Errorf("ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+		}
+
+		meta.MaxDeletedId = maxDeleted
+	}
+
+	s.SetMeta(meta)
+	req.Notify(lib.NOTIFY_STREAM, "xsetid", args[0])
+	return "OK", nil
+}
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_USER is the only user, it has no password, so it authenticates with any of them
+const DEFAULT_USER = "default"
+
+// HandleHello switches the protocol of the connection and replies with the server properties, the reply
+// is already sent in the negotiated protocol
+func HandleHello(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	args, err := stringArgs(req.Args.A)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := req.protocol
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("ERR Protocol version is not an integer or out of range")
+		}
+
+		if v != resp.RESP2 && v != resp.RESP3 {
+			return nil, fmt.Errorf("NOPROTO unsupported protocol version")
+		}
+
+		protocol = v
+	}
+
+	name, setName := "", false
+	for i := 1; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "AUTH" && i+2 < len(args):
+			if args[i+1] != DEFAULT_USER {
+				return nil, fmt.Errorf("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+
+			i += 2
+		case opt == "SETNAME" && i+1 < len(args):
+			name, setName = args[i+1], true
+			for j := 0; j < len(name); j++ {
+				if name[j] < '!' || name[j] > '~' {
+					return nil, fmt.Errorf("ERR Client names cannot contain spaces, newlines or special characters.")
+				}
+			}
+
+			i++
+		default:
+			return nil, fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[i])
+		}
+	}
+
+	req.protocol = protocol
+	if req.sub != nil {
+		req.sub.protocol.Store(int32(protocol))
+	}
+
+	if setName {
+		req.name = name
+	}
+
+	mode, role := "standalone", "master"
+	if req.s.cluster != nil {
+		mode = "cluster"
+	}
+
+	if req.s.config.ReplicaOf() != "" {
+		role = "replica"
+	}
+
+	var m resp.Map
+	m.Append(resp.BulkString{S: []byte("server")}, resp.BulkString{S: []byte("redis")})
+	m.Append(resp.BulkString{S: []byte("version")}, resp.BulkString{S: []byte(persistence.REDIS_VERSION)})
+	m.Append(resp.BulkString{S: []byte("proto")}, resp.SimpleInt{I: int64(protocol)})
+	m.Append(resp.BulkString{S: []byte("id")}, resp.SimpleInt{I: req.id})
+	m.Append(resp.BulkString{S: []byte("mode")}, resp.BulkString{S: []byte(mode)})
+	m.Append(resp.BulkString{S: []byte("role")}, resp.BulkString{S: []byte(role)})
+	m.Append(resp.BulkString{S: []byte("modules")}, resp.Array{A: []resp.Marshaller{}})
+	return m, nil
+}
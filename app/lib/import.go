@@ -0,0 +1,351 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type commandErrors struct {
+	count int
+	first string
+}
+
+// ImportSummary counts commands executed by the bulk import and errors grouped by command
+type ImportSummary struct {
+	Commands int
+	Errors   int
+	byCmd    map[string]*commandErrors
+}
+
+func (is *ImportSummary) add(command string, err error) {
+	is.Commands++
+	if err == nil {
+		return
+	}
+
+	is.Errors++
+	if is.byCmd == nil {
+		is.byCmd = make(map[string]*commandErrors)
+	}
+
+	if e, ok := is.byCmd[command]; ok {
+		e.count++
+		return
+	}
+
+	is.byCmd[command] = &commandErrors{count: 1, first: err.Error()}
+}
+
+func (is *ImportSummary) MarshalRESP(w io.Writer) (int, error) {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "# Import\r\ncommands:%d\r\nerrors:%d\r\n", is.Commands, is.Errors)
+	commands := make([]string, 0, len(is.byCmd))
+	for command := range is.byCmd {
+		commands = append(commands, command)
+	}
+
+	sort.Strings(commands)
+	for _, command := range commands {
+		e := is.byCmd[command]
+		fmt.Fprintf(&b, "errorstat_%s:count=%d,first=%s\r\n", command, e.count, e.first)
+	}
+
+	return resp.BulkString{S: []byte(b.String())}.MarshalRESP(w)
+}
+
+// Import executes stream of RESP commands, as produced for redis-cli --pipe, starting at db, or keys exported
+// as json into their dbs, commands are executed by the internal client, so replies are not written anywhere
+func (s *RedisServer) Import(r io.Reader, db int) (*ImportSummary, error) {
+	var (
+		summary = &ImportSummary{}
+		client  = s.newInternalRequest(io.Discard)
+		br      = bufio.NewReader(r)
+		offset  int64
+	)
+
+	if err := client.SetDb(db); err != nil {
+		return summary, err
+	}
+
+	if b, err := br.Peek(1); err == nil && b[0] == '[' {
+		return summary, s.importJson(br, client, summary)
+	}
+
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return summary, nil
+		}
+
+		args := resp.Array{}
+		n, err := args.UnmarshalRESP(br)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		// the cause is not replied, it may quote content of the file
+		if err != nil {
+			s.logger.Printf("Protocol error importing at offset %d: %s", offset, err)
+			return summary, fmt.Errorf("ERR Protocol error at offset %d after %d commands", offset, summary.Commands)
+		}
+
+		offset += int64(n)
+		s.importCommand(client, summary, &args)
+	}
+}
+
+// importJson recreates keys of the json export with the commands restoring them
+func (s *RedisServer) importJson(r io.Reader, client *RESPRequest, summary *ImportSummary) error {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		s.logger.Printf("Invalid JSON importing keys: %s", err)
+		return fmt.Errorf("ERR Invalid JSON")
+	}
+
+	for i := 0; dec.More(); i++ {
+		e := resp.JsonEntry{}
+		if err := dec.Decode(&e); err != nil {
+			s.logger.Printf("Invalid JSON importing key %d: %s", i, err)
+			return fmt.Errorf("ERR Invalid JSON at key %d after %d commands", i, summary.Commands)
+		}
+
+		entry, err := e.RdbEntry()
+		if err != nil || e.Db < 0 {
+			return fmt.Errorf("ERR Invalid type or db of key %d after %d commands", i, summary.Commands)
+		}
+
+		if entry.Db != client.Db.Index() {
+			if err = client.SetDb(entry.Db); err != nil {
+				return err
+			}
+		}
+
+		for _, cmd := range resp.EntryCommands(entry) {
+			s.importCommand(client, summary, cmd)
+		}
+	}
+
+	return nil
+}
+
+// importCommand executes the imported command and adds it to the summary, commands accessing the dataset are
+// not executed in the middle of a transaction of other clients
+func (s *RedisServer) importCommand(client *RESPRequest, summary *ImportSummary, args *resp.Array) {
+	command, _ := s.router.getCommand(&args.A)
+	handler, err := s.router.ResolveRequest(args)
+	if err != nil {
+		summary.add(command, err)
+		return
+	}
+
+	// files importing each other would never end
+	flags := s.router.Flags(command)
+	if flags&CMD_BULK != 0 {
+		summary.add(command, fmt.Errorf("ERR Command not allowed inside IMPORT"))
+		return
+	}
+
+	if flags&(CMD_WRITE|CMD_READONLY) != 0 {
+		s.exec.RLock()
+		defer s.exec.RUnlock()
+	}
+
+	summary.add(command, s.execute(client, handler, args))
+}
+
+// Export writes keys of every db to p as json or as RESP commands restoring them, the file is replaced once
+// the export is complete
+func (s *RedisServer) Export(p, format string) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(p), "temp-export-*")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	exporter, err := resp.NewExporter(f, format)
+	if err != nil {
+		return err
+	}
+
+	if err = resp.SnapshotEntries(s.snapshot(), exporter.Write); err != nil {
+		return err
+	}
+
+	if err = exporter.Close(); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// workingDir returns the directory IMPORT and EXPORT are limited to with symlinks resolved
+func (s *RedisServer) workingDir() (string, error) {
+	dir, err := filepath.Abs(s.config.PersistenceConfig.Dir)
+	if err != nil {
+		return "", fmt.Errorf("ERR %s", err)
+	}
+
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", fmt.Errorf("ERR %s", err)
+	}
+
+	return dir, nil
+}
+
+func insideDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// importPath resolves the file to import, relative paths are relative to dir and only regular files inside dir
+// are allowed, so clients can not read arbitrary files of the server
+func (s *RedisServer) importPath(p string) (string, error) {
+	dir, err := s.workingDir()
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", fmt.Errorf("ERR No such file in the working directory")
+	}
+
+	if !insideDir(dir, resolved) {
+		return "", fmt.Errorf("ERR File to import must be inside the working directory")
+	}
+
+	if info, err := os.Stat(resolved); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("ERR File to import must be a regular file")
+	}
+
+	return resolved, nil
+}
+
+// HandleImport bulk loads file of RESP commands on the server into the current db, or keys exported as json,
+// the file has to be inside the working directory
+func HandleImport(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) != 1 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'import' command")
+	}
+
+	// keys of the imported commands may belong to any slot
+	if req.s.cluster != nil {
+		return nil, fmt.Errorf("ERR IMPORT is not allowed in cluster mode")
+	}
+
+	p, ok := req.Args.A[0].(resp.BulkString)
+	if !ok {
+		return nil, fmt.Errorf("ERR invalid path type, expected string, got %T", req.Args.A[0])
+	}
+
+	resolved, err := req.s.importPath(string(p.S))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("ERR %s", err)
+	}
+
+	defer f.Close()
+	summary, err := req.s.Import(f, req.Db.Index())
+	if err != nil {
+		return nil, err
+	}
+
+	req.Logger.Printf("Imported %s: %d commands, %d errors", p.S, summary.Commands, summary.Errors)
+	return summary, nil
+}
+
+// exportPath resolves the file to export to like importPath, the file may not exist yet
+func (s *RedisServer) exportPath(p string) (string, error) {
+	dir, err := s.workingDir()
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+
+	parent, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return "", fmt.Errorf("ERR No such directory in the working directory")
+	}
+
+	resolved := filepath.Join(parent, filepath.Base(p))
+	if !insideDir(dir, resolved) || resolved == dir {
+		return "", fmt.Errorf("ERR File to export must be inside the working directory")
+	}
+
+	if info, err := os.Lstat(resolved); err == nil && !info.Mode().IsRegular() {
+		return "", fmt.Errorf("ERR File to export must be a regular file")
+	}
+
+	return resolved, nil
+}
+
+// HandleExport writes keys of every db to a file inside the working directory, RESP commands restoring them
+// by default or json, both are read by IMPORT
+func HandleExport(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) < 1 || len(req.Args.A) > 2 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'export' command")
+	}
+
+	args := make([]string, len(req.Args.A))
+	for i, arg := range req.Args.A {
+		bulk, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR invalid argument type, expected string, got %T", arg)
+		}
+
+		args[i] = string(bulk.S)
+	}
+
+	format := resp.EXPORT_RESP
+	if len(args) == 2 {
+		format = strings.ToLower(args[1])
+		if format != resp.EXPORT_RESP && format != resp.EXPORT_JSON {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+	}
+
+	resolved, err := req.s.exportPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err = req.s.Export(resolved, format); err != nil {
+		req.Logger.Printf("Failed to export %s: %s", resolved, err)
+		return nil, fmt.Errorf("ERR Failed to export keys")
+	}
+
+	return "OK", nil
+}
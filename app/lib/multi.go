@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+)
+
+var (
+	multiCommand = resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("MULTI")}}}
+	execCommand  = resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("EXEC")}}}
+)
+
+// transaction is the state of the client between MULTI and EXEC
+type transaction struct {
+	queue []queued
+	// set when a command failed to queue, EXEC discards the transaction
+	aborted bool
+	// set by EXEC holding the locks of the dataset, so wrappers of the commands do not take them again
+	locked    bool
+	executing bool
+	// set once MULTI is propagated to replicas or logged to the AOF, the block is closed by EXEC
+	replicated bool
+	logged     bool
+}
+
+type queued struct {
+	handler Handler
+	command string
+	args    *resp.Array
+}
+
+type watchedKey struct {
+	db      *storage.RedisDataTypes
+	key     string
+	version uint64
+}
+
+// isTransactionCommand reports commands executed right away by the client in the transaction
+func isTransactionCommand(command string) bool {
+	switch command {
+	case "multi", "exec", "discard", "watch":
+		return true
+	}
+
+	return false
+}
+
+// InTransaction reports that the command is executed by EXEC, such commands must not block
+func (req *RESPRequest) InTransaction() bool {
+	return req.multi != nil && req.multi.executing
+}
+
+// queue adds the command to the transaction, commands are validated, so EXEC does not run transaction that
+// is known to fail
+func (req *RESPRequest) queue(router *Router, handler Handler) error {
+	if err := router.checkArity(req.Command, len(req.Args.A)+1); err != nil {
+		return err
+	}
+
+	// e.g. IMPORT would wait for the lock EXEC holds
+	if router.Flags(req.Command)&CMD_NOMULTI != 0 {
+		return fmt.Errorf("ERR Command not allowed inside a transaction")
+	}
+
+	// arguments are copied, the slice is reused by the next command
+	args := &resp.Array{A: append(make([]resp.Marshaller, 0, len(req.Args.A)), req.Args.A...)}
+	req.multi.queue = append(req.multi.queue, queued{handler: handler, command: req.Command, args: args})
+	return nil
+}
+
+// unwatch forgets all the watched keys
+func (req *RESPRequest) unwatch() {
+	for _, w := range req.watched {
+		w.db.Unwatch(w.key)
+	}
+
+	req.watched = nil
+}
+
+// touched reports that any of the watched keys was modified since WATCH
+func (req *RESPRequest) touched() bool {
+	for _, w := range req.watched {
+		if w.db.Version(w.key) != w.version {
+			return true
+		}
+	}
+
+	return false
+}
+
+func HandleMulti(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) != 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'multi' command")
+	}
+
+	if req.multi != nil {
+		return nil, fmt.Errorf("ERR MULTI calls can not be nested")
+	}
+
+	req.multi = &transaction{}
+	return "OK", nil
+}
+
+func HandleDiscard(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) != 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'discard' command")
+	}
+
+	if req.multi == nil {
+		return nil, fmt.Errorf("ERR DISCARD without MULTI")
+	}
+
+	req.multi = nil
+	req.unwatch()
+	return "OK", nil
+}
+
+// HandleWatch makes EXEC of the following transaction fail when any of the keys is modified before it
+func HandleWatch(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'watch' command")
+	}
+
+	if req.multi != nil {
+		return nil, fmt.Errorf("ERR WATCH inside MULTI is not allowed")
+	}
+
+loop:
+	for _, arg := range req.Args.A {
+		key, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR invalid key type, expected string, got %T", arg)
+		}
+
+		for _, w := range req.watched {
+			if w.db == req.Db && w.key == string(key.S) {
+				continue loop
+			}
+		}
+
+		req.watched = append(req.watched, watchedKey{db: req.Db, key: string(key.S), version: req.Db.Watch(string(key.S))})
+	}
+
+	return "OK", nil
+}
+
+func HandleUnwatch(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) != 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'unwatch' command")
+	}
+
+	req.unwatch()
+	return "OK", nil
+}
+
+// HandleExec executes the queued commands, none of the other clients is served in the meantime. Replicas and
+// the AOF receive the writes of the transaction wrapped in MULTI and EXEC, so they apply them atomically
+func HandleExec(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) != 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'exec' command")
+	}
+
+	t := req.multi
+	if t == nil {
+		return nil, fmt.Errorf("ERR EXEC without MULTI")
+	}
+
+	defer func() {
+		req.multi = nil
+		req.unwatch()
+	}()
+
+	if t.aborted {
+		return nil, fmt.Errorf("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	// internal clients replaying the AOF or the stream of the master execute commands one by one anyway
+	if req.conn != nil {
+		req.s.exec.Lock()
+		defer req.s.exec.Unlock()
+		// nothing is propagated between MULTI and EXEC, e.g. PING or GETACK
+		req.s.writes.Lock()
+		defer req.s.writes.Unlock()
+		if req.s.aof != nil {
+			release := req.s.aof.Hold()
+			defer release()
+		}
+
+		t.locked = true
+	}
+
+	if req.touched() {
+		return resp.NilArray{}, nil
+	}
+
+	t.executing = true
+	command := req.Command
+	replies := resp.Array{A: make([]resp.Marshaller, 0, len(t.queue))}
+	for _, q := range t.queue {
+		req.Command, req.Args, req.skipPropagation = q.command, q.args, false
+		res, err := q.handler.HandleResp(ctx, req)
+		switch {
+		case err != nil:
+			replies.Append(resp.SimpleError{E: err.Error()})
+		case res == nil:
+			replies.Append(resp.BulkString{EncodeNil: true})
+		default:
+			replies.Append(resp.Any{I: res})
+		}
+	}
+
+	req.Command = command
+	if t.replicated {
+		req.s.PropagateToAll(req.Db.Index(), &execCommand)
+	}
+
+	if t.logged {
+		if err := req.s.aof.Feed(req.Db.Index(), &execCommand); err != nil {
+			req.Logger.Printf("Failed to feed AOF: %s", err)
+		}
+	}
+
+	return replies, nil
+}
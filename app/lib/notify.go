@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"strconv"
+	"strings"
+)
+
+// NotifyFlags select classes of keyspace notifications, they are set by notify-keyspace-events
+type NotifyFlags int32
+
+const (
+	// NOTIFY_KEYSPACE publishes the event to __keyspace@<db>__:<key>
+	NOTIFY_KEYSPACE NotifyFlags = 1 << iota
+	// NOTIFY_KEYEVENT publishes the key to __keyevent@<db>__:<event>
+	NOTIFY_KEYEVENT
+	NOTIFY_GENERIC
+	NOTIFY_STRING
+	NOTIFY_LIST
+	NOTIFY_SET
+	NOTIFY_HASH
+	NOTIFY_ZSET
+	NOTIFY_EXPIRED
+	NOTIFY_EVICTED
+	NOTIFY_STREAM
+	NOTIFY_KEY_MISS
+	NOTIFY_MODULE
+	NOTIFY_NEW
+
+	NOTIFY_ALL = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH | NOTIFY_ZSET |
+		NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM | NOTIFY_MODULE
+)
+
+// notifyFlagChars are the characters of the classes in the order of the config string
+var notifyFlagChars = []struct {
+	c    byte
+	flag NotifyFlags
+}{
+	{'g', NOTIFY_GENERIC},
+	{'$', NOTIFY_STRING},
+	{'l', NOTIFY_LIST},
+	{'s', NOTIFY_SET},
+	{'h', NOTIFY_HASH},
+	{'z', NOTIFY_ZSET},
+	{'x', NOTIFY_EXPIRED},
+	{'e', NOTIFY_EVICTED},
+	{'t', NOTIFY_STREAM},
+	{'d', NOTIFY_MODULE},
+	{'K', NOTIFY_KEYSPACE},
+	{'E', NOTIFY_KEYEVENT},
+	{'m', NOTIFY_KEY_MISS},
+	{'n', NOTIFY_NEW},
+}
+
+// ParseNotifyFlags parses the classes of notify-keyspace-events, A is the alias of g$lshzxetd
+func ParseNotifyFlags(s string) (NotifyFlags, error) {
+	var flags NotifyFlags
+loop:
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= NOTIFY_ALL
+			continue
+		}
+
+		for _, f := range notifyFlagChars {
+			if f.c == s[i] {
+				flags |= f.flag
+				continue loop
+			}
+		}
+
+		return 0, fmt.Errorf("invalid keyspace notification class %q", s[i])
+	}
+
+	return flags, nil
+}
+
+func (flags NotifyFlags) String() string {
+	var b strings.Builder
+	for _, f := range notifyFlagChars {
+		switch {
+		case f.flag&NOTIFY_ALL != 0 && flags&NOTIFY_ALL == NOTIFY_ALL:
+			if f.flag == NOTIFY_GENERIC {
+				b.WriteByte('A')
+			}
+		case flags&f.flag != 0:
+			b.WriteByte(f.c)
+		}
+	}
+
+	return b.String()
+}
+
+// Notify publishes keyspace notification of the event of the key in the current db, commands notify every
+// modification of the keys
+func (req *RESPRequest) Notify(class NotifyFlags, event, key string) {
+	req.s.notify(req.Db.Index(), class, event, key)
+}
+
+func (s *RedisServer) notify(db int, class NotifyFlags, event, key string) {
+	flags := NotifyFlags(s.config.NotifyKeyspaceEvents.Load())
+	if flags&class == 0 {
+		return
+	}
+
+	idx := strconv.Itoa(db)
+	if flags&NOTIFY_KEYSPACE != 0 {
+		s.pubsub.publish("__keyspace@"+idx+"__:"+key, event, false)
+	}
+
+	if flags&NOTIFY_KEYEVENT != 0 {
+		s.pubsub.publish("__keyevent@"+idx+"__:"+event, key, false)
+	}
+}
+
+// keyEvent notifies keys created and expired by the storage
+func (s *RedisServer) keyEvent(db int, event, key string) {
+	class := NOTIFY_NEW
+	if event == storage.EVENT_EXPIRED {
+		class = NOTIFY_EXPIRED
+	}
+
+	s.notify(db, class, event, key)
+}
@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestNotifyFlags(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected string
+	}{
+		{"", ""},
+		{"Ex", "xE"},
+		{"KEA", "AKE"},
+		{"g$lshzxetdKE", "AKE"},
+		{"Kg$mn", "g$Kmn"},
+	} {
+		flags, err := ParseNotifyFlags(tc.s)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+
+		if s := flags.String(); s != tc.expected {
+			t.Errorf("expected %q of %q, got %q", tc.expected, tc.s, s)
+		}
+	}
+
+	if _, err := ParseNotifyFlags("KEy"); err == nil {
+		t.Errorf("expected unknown class to fail")
+	}
+}
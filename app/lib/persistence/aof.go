@@ -0,0 +1,550 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// Aof appends every executed write command to the append only file in RESP format,
+// the same format clients use to send commands, so the log can be replayed through the router.
+// The AOF consists of multiple parts tracked by the manifest: a base file with the snapshot of the dataset
+// produced by the last rewrite, and incr files with commands executed after it.
+type Aof struct {
+	mu *sync.Mutex
+	// commands hold read lock from execution till they are fed, rewrite takes write lock to switch incr file
+	// and take the snapshot, so every command ends up either in the snapshot or in the new incr file
+	rewriteMu *sync.RWMutex
+	logger    *log.Logger
+	config    *Config
+	dir       string
+	manifest  *Manifest
+	// current incr file
+	f *os.File
+	// total size of base and incr files
+	size int64
+	// index of the db selected by the last command written to the log, -1 forces SELECT on the first write
+	db int
+	// set when data was written but not yet fsynced, used by everysec policy
+	dirty    bool
+	snapshot func() []*storage.DbSnapshot
+	rewrites *sync.WaitGroup
+	close    chan struct{}
+}
+
+func aofDir(config *Config) string {
+	return path.Join(config.Dir, config.AppendDirname)
+}
+
+func manifestPath(config *Config) string {
+	return path.Join(aofDir(config), config.AppendFilename+".manifest")
+}
+
+// OpenAof opens the last incr file from the manifest for appending, creating one if there is none,
+// snapshot is used to get the dataset on rewrite
+func OpenAof(config *Config, manifest *Manifest, snapshot func() []*storage.DbSnapshot) (*Aof, error) {
+	dir := aofDir(config)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Incr) == 0 {
+		manifest = manifest.clone()
+		manifest.Incr = append(manifest.Incr, manifest.nextIncr(config.AppendFilename))
+		if err := manifest.Persist(manifestPath(config)); err != nil {
+			return nil, err
+		}
+	}
+
+	incr := manifest.Incr[len(manifest.Incr)-1]
+	f, err := os.OpenFile(path.Join(dir, incr.Name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	aof := &Aof{
+		mu:        &sync.Mutex{},
+		rewriteMu: &sync.RWMutex{},
+		logger:    log.New(os.Stdout, "AOF ", log.Lmicroseconds|log.Lshortfile),
+		config:    config,
+		dir:       dir,
+		manifest:  manifest,
+		f:         f,
+		db:        -1,
+		snapshot:  snapshot,
+		rewrites:  &sync.WaitGroup{},
+		close:     make(chan struct{}),
+	}
+
+	if aof.size, err = aof.filesSize(manifest.Files()); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	config.AofCurrentSize.Store(aof.size)
+	config.AofBaseSize.Store(aof.size)
+	config.AofLastWriteStatus.Store(true)
+	config.AofLastBgrewriteStatus.Store(true)
+	config.AofLastRewriteTimeSec.Store(-1)
+	go aof.startCron()
+	return aof, nil
+}
+
+func (a *Aof) filesSize(files []*AofFile) (int64, error) {
+	var size int64
+	for _, file := range files {
+		stat, err := os.Stat(path.Join(a.dir, file.Name))
+		if err != nil {
+			return 0, err
+		}
+
+		size += stat.Size()
+	}
+
+	return size, nil
+}
+
+// Hold postpones switching to the new incr file by the rewrite until release is called
+func (a *Aof) Hold() (release func()) {
+	a.rewriteMu.RLock()
+	return a.rewriteMu.RUnlock
+}
+
+// Feed writes command executed against db with index db to the log, emitting SELECT if the db differs from the
+// previously logged one
+func (a *Aof) Feed(db int, cmd *resp.Array) error {
+	buff := bytes.NewBuffer(make([]byte, 0, 128))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if db != a.db {
+		if _, err := (resp.Array{A: []resp.Marshaller{
+			resp.BulkString{S: []byte("SELECT")},
+			resp.BulkString{S: []byte(strconv.Itoa(db))},
+		}}).MarshalRESP(buff); err != nil {
+			return err
+		}
+	}
+
+	if _, err := cmd.MarshalRESP(buff); err != nil {
+		return err
+	}
+
+	n, err := a.f.Write(buff.Bytes())
+	if err != nil {
+		a.config.AofLastWriteStatus.Store(false)
+		// partial write would leave a broken command in the middle of the log, try to remove it
+		if n > 0 {
+			if stat, serr := a.f.Stat(); serr == nil {
+				if terr := a.f.Truncate(stat.Size() - int64(n)); terr != nil {
+					a.logger.Printf("Failed to remove partial write from AOF: %s", terr)
+				}
+			}
+		}
+
+		return fmt.Errorf("error writing to AOF: %w", err)
+	}
+
+	a.db = db
+	a.size += int64(n)
+	a.config.AofCurrentSize.Store(a.size)
+	a.config.AofLastWriteStatus.Store(true)
+	switch a.config.AppendFsync {
+	case FSYNC_ALWAYS:
+		if err = a.f.Sync(); err != nil {
+			a.config.AofLastWriteStatus.Store(false)
+			return fmt.Errorf("error fsyncing AOF: %w", err)
+		}
+
+		a.config.markFsync()
+	case FSYNC_EVERYSEC:
+		a.dirty = true
+	}
+
+	return nil
+}
+
+// startCron fsyncs the log every second with everysec policy and triggers rewrite once the log grows
+// by auto-aof-rewrite-percentage since the last rewrite
+func (a *Aof) startCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.close:
+			return
+		case <-ticker.C:
+			if a.config.AppendFsync == FSYNC_EVERYSEC {
+				if err := a.Sync(); err != nil {
+					a.logger.Printf("Failed to fsync AOF: %s", err)
+				}
+			}
+
+			if a.shouldRewrite() {
+				a.logger.Printf("Starting automatic rewriting of AOF on %d%% growth", a.config.AutoAofRewritePercentage)
+				if err := a.Rewrite(); err != nil && err != ErrRewriteInProgress {
+					a.logger.Printf("Failed to start AOF rewrite: %s", err)
+				}
+			}
+		}
+	}
+}
+
+func (a *Aof) shouldRewrite() bool {
+	if a.config.AutoAofRewritePercentage <= 0 || a.config.AofRewriteInProgress.Load() {
+		return false
+	}
+
+	size := a.Size()
+	if size < a.config.AutoAofRewriteMinSize {
+		return false
+	}
+
+	base := a.config.AofBaseSize.Load()
+	if base == 0 {
+		base = 1
+	}
+
+	return size*100/base-100 >= int64(a.config.AutoAofRewritePercentage)
+}
+
+// Sync flushes written data to the disk if there is any
+func (a *Aof) Sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.dirty {
+		return nil
+	}
+
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+
+	a.dirty = false
+	a.config.markFsync()
+	return nil
+}
+
+func (a *Aof) Size() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size
+}
+
+// Rewrite starts background rewrite of the AOF: commands are redirected to the new incr file, while
+// the snapshot of the dataset is written to the new base file. Once the base file is written manifest
+// is updated to the new base and incr files, and files of the previous generation are deleted.
+func (a *Aof) Rewrite() error {
+	if !a.config.AofRewriteInProgress.CompareAndSwap(false, true) {
+		return ErrRewriteInProgress
+	}
+
+	start := time.Now()
+	a.rewriteMu.Lock()
+	incr, err := a.switchIncr()
+	if err != nil {
+		a.rewriteMu.Unlock()
+		a.config.AofRewriteInProgress.Store(false)
+		a.config.AofLastBgrewriteStatus.Store(false)
+		return err
+	}
+
+	snapshot := a.snapshot()
+	a.rewriteMu.Unlock()
+	a.rewrites.Add(1)
+	go func() {
+		defer a.rewrites.Done()
+		defer a.config.AofRewriteInProgress.Store(false)
+		if err := a.rewriteBase(snapshot, incr); err != nil {
+			a.logger.Printf("Background AOF rewrite failed: %s", err)
+			a.config.AofLastBgrewriteStatus.Store(false)
+			return
+		}
+
+		a.config.AofLastBgrewriteStatus.Store(true)
+		a.config.AofLastRewriteTimeSec.Store(int64(time.Since(start).Seconds()))
+		a.config.AofRewrites.Add(1)
+		a.logger.Printf("Background AOF rewrite finished successfully in %s", time.Since(start))
+	}()
+
+	return nil
+}
+
+// switchIncr opens new incr file and makes it the target of Feed
+func (a *Aof) switchIncr() (*AofFile, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	manifest := a.manifest.clone()
+	incr := manifest.nextIncr(a.config.AppendFilename)
+	f, err := os.OpenFile(path.Join(a.dir, incr.Name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Incr = append(manifest.Incr, incr)
+	if err = manifest.Persist(manifestPath(a.config)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	if err = a.f.Sync(); err != nil {
+		a.logger.Printf("Failed to fsync AOF: %s", err)
+	}
+
+	a.f.Close()
+	a.f = f
+	a.db = -1
+	a.dirty = false
+	a.manifest = manifest
+	return incr, nil
+}
+
+// rewriteBase writes snapshot to the new base file and makes it the base of the AOF, dropping every file that
+// precedes incr
+func (a *Aof) rewriteBase(snapshot []*storage.DbSnapshot, incr *AofFile) error {
+	tmp := path.Join(a.dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+	if err = a.writeBase(f, snapshot); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	manifest := a.manifest.clone()
+	base := manifest.nextBase(a.config.AppendFilename, a.config.AofUseRdbPreamble)
+	if err = os.Rename(tmp, path.Join(a.dir, base.Name)); err != nil {
+		return err
+	}
+
+	if manifest.Base != nil {
+		manifest.History = append(manifest.History, &AofFile{Name: manifest.Base.Name, Seq: manifest.Base.Seq, Type: AOF_HISTORY})
+	}
+
+	for len(manifest.Incr) != 0 && manifest.Incr[0].Seq < incr.Seq {
+		manifest.History = append(manifest.History, &AofFile{Name: manifest.Incr[0].Name, Seq: manifest.Incr[0].Seq, Type: AOF_HISTORY})
+		manifest.Incr = manifest.Incr[1:]
+	}
+
+	manifest.Base = base
+	if err = manifest.Persist(manifestPath(a.config)); err != nil {
+		os.Remove(path.Join(a.dir, base.Name))
+		return err
+	}
+
+	a.manifest = manifest
+	for _, h := range manifest.History {
+		if err = os.Remove(path.Join(a.dir, h.Name)); err != nil && !os.IsNotExist(err) {
+			a.logger.Printf("Failed to remove history file %s: %s", h.Name, err)
+		}
+	}
+
+	manifest = manifest.clone()
+	manifest.History = nil
+	if err = manifest.Persist(manifestPath(a.config)); err != nil {
+		a.logger.Printf("Failed to persist manifest without history files: %s", err)
+	} else {
+		a.manifest = manifest
+	}
+
+	baseSize, err := a.filesSize([]*AofFile{base})
+	if err != nil {
+		return err
+	}
+
+	if a.size, err = a.filesSize(manifest.Files()); err != nil {
+		return err
+	}
+
+	a.config.AofBaseSize.Store(baseSize)
+	a.config.AofCurrentSize.Store(a.size)
+	return nil
+}
+
+func (a *Aof) writeBase(w io.Writer, snapshot []*storage.DbSnapshot) error {
+	bw := bufio.NewWriter(w)
+	if a.config.AofUseRdbPreamble {
+		metadata := RdbMetadata()
+		metadata["aof-base"] = "1"
+		if _, err := resp.WriteRdb(bw, snapshot, metadata); err != nil {
+			return err
+		}
+	} else if err := writeCommands(bw, snapshot); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func (a *Aof) Close() error {
+	close(a.close)
+	a.rewrites.Wait()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.f.Sync(); err != nil {
+		a.logger.Printf("Failed to fsync AOF on close: %s", err)
+	}
+
+	return a.f.Close()
+}
+
+// LoadAof loads every part of the AOF listed in the manifest. AOF written before multi part AOF was
+// introduced is upgraded by moving it into the AOF dir as the base file. Returns the manifest of the loaded
+// AOF and the number of applied commands.
+func LoadAof(config *Config, loadRdb func(r *bufio.Reader) error, apply func(args *resp.Array) error) (*Manifest, int, error) {
+	manifest, err := LoadManifest(manifestPath(config))
+	if os.IsNotExist(err) {
+		return upgradeLegacyAof(config, loadRdb, apply)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cmds := 0
+	files := manifest.Files()
+	for i, file := range files {
+		// only the last file could be cut off by a crash, the others are complete by construction
+		n, err := loadFile(path.Join(aofDir(config), file.Name), config.AofLoadTruncated && i == len(files)-1, loadRdb, apply)
+		cmds += n
+		if err != nil {
+			return nil, cmds, err
+		}
+	}
+
+	return manifest, cmds, nil
+}
+
+func upgradeLegacyAof(config *Config, loadRdb func(r *bufio.Reader) error, apply func(args *resp.Array) error) (*Manifest, int, error) {
+	manifest := &Manifest{}
+	legacy := path.Join(config.Dir, config.AppendFilename)
+	n, err := loadFile(legacy, config.AofLoadTruncated, loadRdb, apply)
+	if os.IsNotExist(err) {
+		return manifest, 0, nil
+	}
+
+	if err != nil {
+		return nil, n, err
+	}
+
+	if err = os.MkdirAll(aofDir(config), 0755); err != nil {
+		return nil, n, err
+	}
+
+	if err = os.Rename(legacy, path.Join(aofDir(config), config.AppendFilename)); err != nil {
+		return nil, n, err
+	}
+
+	manifest.Base = &AofFile{Name: config.AppendFilename, Seq: 1, Type: AOF_BASE}
+	manifest.baseSeq = 1
+	if err = manifest.Persist(manifestPath(config)); err != nil {
+		return nil, n, err
+	}
+
+	log.Printf("Upgraded AOF %s to the multi part AOF in %s", legacy, aofDir(config))
+	return manifest, n, nil
+}
+
+// loadFile reads every command from the AOF at path and calls apply for it. If the file starts with rdb
+// preamble, it is passed to loadRdb first. If the file ends in the middle of a command and allowTruncated
+// is set, the file is truncated to the last complete command, otherwise an error is returned.
+// Returns the number of applied commands.
+func loadFile(p string, allowTruncated bool, loadRdb func(r *bufio.Reader) error, apply func(args *resp.Array) error) (int, error) {
+	offset, cmds, err := CheckAofFile(p, loadRdb, apply)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		if !allowTruncated {
+			return cmds, fmt.Errorf("unexpected end of file reading the append only file %s at offset %d, "+
+				"set aof-load-truncated to load it anyway", p, offset)
+		}
+
+		log.Printf("AOF %s was truncated, cutting it to the last valid command at offset %d", p, offset)
+		if err = os.Truncate(p, offset); err != nil {
+			return cmds, fmt.Errorf("failed to truncate AOF: %w", err)
+		}
+
+		return cmds, nil
+	}
+
+	return cmds, err
+}
+
+// CheckAofFile reads commands of the append only file at p returning offset after the last valid command,
+// file ending in the middle of a command results in error wrapping io.ErrUnexpectedEOF.
+// Rdb preamble is read by loadRdb, apply is optional.
+func CheckAofFile(p string, loadRdb func(r *bufio.Reader) error, apply func(args *resp.Array) error) (int64, int, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer f.Close()
+	var (
+		r      = bufio.NewReader(f)
+		offset int64
+		cmds   int
+	)
+
+	if magic, _ := r.Peek(len(resp.MAGICSTRING)); bytes.Equal(magic, resp.MAGICSTRING) {
+		if err = loadRdb(r); err != nil {
+			return 0, 0, fmt.Errorf("error loading rdb preamble of %s: %w", p, err)
+		}
+
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		offset = pos - int64(r.Buffered())
+	}
+
+	for {
+		if _, err = r.Peek(1); err == io.EOF {
+			return offset, cmds, nil
+		}
+
+		args := resp.Array{}
+		n, err := args.UnmarshalRESP(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return offset, cmds, fmt.Errorf("%s ends in the middle of a command: %w", p, io.ErrUnexpectedEOF)
+		}
+
+		if err != nil {
+			return offset, cmds, fmt.Errorf("bad file format reading the append only file %s at offset %d: %w", p, offset, err)
+		}
+
+		if apply != nil {
+			if err = apply(&args); err != nil {
+				return offset, cmds, fmt.Errorf("error applying command at offset %d: %w", offset, err)
+			}
+		}
+
+		offset += int64(n)
+		cmds++
+	}
+}
@@ -0,0 +1,276 @@
+package persistence
+
+import (
+	"bufio"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestConfig(t *testing.T) *Config {
+	return &Config{
+		Dir:               t.TempDir(),
+		AppendDirname:     "appendonlydir",
+		AppendFilename:    "appendonly.aof",
+		AppendFsync:       FSYNC_ALWAYS,
+		AofUseRdbPreamble: true,
+	}
+}
+
+func TestFeedShouldSelectDb(t *testing.T) {
+	config := newTestConfig(t)
+	aof, err := OpenAof(config, &Manifest{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := resp.Array{A: []resp.Marshaller{
+		resp.BulkString{S: []byte("set")},
+		resp.BulkString{S: []byte("foo")},
+		resp.BulkString{S: []byte("bar")},
+	}}
+	for _, db := range []int{0, 0, 1} {
+		if err = aof.Feed(db, &set); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n" +
+		"*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n" +
+		"*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	b, err := os.ReadFile(path.Join(config.Dir, config.AppendDirname, "appendonly.aof.1.incr.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, b)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	const valid = "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	type tt struct {
+		content        string
+		allowTruncated bool
+		cmds           int
+		size           int
+		err            bool
+	}
+
+	tests := []tt{
+		{content: valid, cmds: 2, size: len(valid)},
+		{content: valid + "*3\r\n$3\r\nset\r\n$3\r\nba", allowTruncated: true, cmds: 2, size: len(valid)},
+		{content: valid + "*3\r\n$3\r\nset\r\n$3\r\nba", allowTruncated: false, cmds: 2, err: true},
+		{content: valid + "*3\r\n", allowTruncated: true, cmds: 2, size: len(valid)},
+		{content: valid + "garbage\r\n", allowTruncated: true, cmds: 2, err: true},
+	}
+
+	for i, test := range tests {
+		p := path.Join(t.TempDir(), "appendonly.aof")
+		if err := os.WriteFile(p, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var applied []string
+		n, err := loadFile(p, test.allowTruncated, nil, func(args *resp.Array) error {
+			applied = append(applied, args.String())
+			return nil
+		})
+		if (err != nil) != test.err {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+
+		if n != test.cmds || len(applied) != test.cmds {
+			t.Errorf("%d: expected %d commands, got %d", i, test.cmds, n)
+		}
+
+		if test.err {
+			continue
+		}
+
+		stat, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if int(stat.Size()) != test.size {
+			t.Errorf("%d: expected file of size %d, got %d", i, test.size, stat.Size())
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	const manifest = "file appendonly.aof.2.base.rdb seq 2 type b\n" +
+		"file appendonly.aof.1.base.rdb seq 1 type h\n" +
+		"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+		"file appendonly.aof.4.incr.aof seq 4 type i\n"
+
+	m, err := ParseManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*AofFile{
+		{Name: "appendonly.aof.2.base.rdb", Seq: 2, Type: AOF_BASE},
+		{Name: "appendonly.aof.3.incr.aof", Seq: 3, Type: AOF_INCR},
+		{Name: "appendonly.aof.4.incr.aof", Seq: 4, Type: AOF_INCR},
+	}
+	if !reflect.DeepEqual(m.Files(), expected) {
+		t.Errorf("expected %v, got %v", expected, m.Files())
+	}
+
+	if next := m.nextIncr("appendonly.aof"); next.Name != "appendonly.aof.5.incr.aof" {
+		t.Errorf("expected next incr appendonly.aof.5.incr.aof, got %s", next.Name)
+	}
+
+	out := strings.Builder{}
+	if _, err = m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != manifest {
+		t.Errorf("expected %q, got %q", manifest, out.String())
+	}
+
+	for _, invalid := range []string{
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq 2 type i\nfile b seq 1 type i\n",
+		"file a seq 1 type x\n",
+		"file a seq\n",
+	} {
+		if _, err = ParseManifest(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	for _, preamble := range []bool{true, false} {
+		config := newTestConfig(t)
+		config.AofUseRdbPreamble = preamble
+		db := &sync.Map{}
+		dataset := storage.NewDb(0)
+		db.Store(0, dataset)
+		strs := dataset.GetStorage(storage.STRINGS).(storage.StringsStorage)
+		strs.Set("foo", "bar", time.Time{})
+		stream, _ := dataset.GetStorage(storage.STREAMS).(*storage.StreamsIdx).GetOrCreateStream("stream")
+		stream.Add("1-1", []string{"a", "b"})
+
+		aof, err := OpenAof(config, &Manifest{}, func() []*storage.DbSnapshot {
+			return []*storage.DbSnapshot{dataset.Snapshot()}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = aof.Rewrite(); err != nil {
+			t.Fatal(err)
+		}
+
+		// written after the switch to the new incr file
+		set := resp.Array{A: []resp.Marshaller{
+			resp.BulkString{S: []byte("SET")},
+			resp.BulkString{S: []byte("baz")},
+			resp.BulkString{S: []byte("qux")},
+		}}
+		if err = aof.Feed(0, &set); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = aof.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			rdbLoaded bool
+			applied   []string
+			loaded    = &sync.Map{}
+		)
+		m, _, err := LoadAof(config, func(r *bufio.Reader) error {
+			rdbLoaded = true
+			return resp.NewRdb(loaded).Load(r)
+		}, func(args *resp.Array) error {
+			applied = append(applied, join(args))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m.Base == nil || m.Base.Seq != 1 || len(m.Incr) != 1 || m.Incr[0].Seq != 2 || len(m.History) != 0 {
+			t.Errorf("unexpected manifest after rewrite %+v", m)
+		}
+
+		if _, err = os.Stat(path.Join(aofDir(config), "appendonly.aof.1.incr.aof")); !os.IsNotExist(err) {
+			t.Errorf("expected incr file of the previous generation to be deleted, got %v", err)
+		}
+
+		if rdbLoaded != preamble {
+			t.Errorf("expected rdb preamble to be loaded: %t", preamble)
+		}
+
+		expected := []string{"SELECT 0", "SET baz qux"}
+		if preamble {
+			db, ok := loaded.Load(0)
+			if !ok || !reflect.DeepEqual(db.(*storage.RedisDataTypes).Snapshot(), dataset.Snapshot()) {
+				t.Errorf("expected rdb preamble to hold the dataset")
+			}
+		} else {
+			expected = []string{"SELECT 0", "SET foo bar", "XADD stream 1-1 a b", "SELECT 0", "SET baz qux"}
+		}
+
+		if !reflect.DeepEqual(applied, expected) {
+			t.Errorf("expected %v, got %v", expected, applied)
+		}
+	}
+}
+
+func TestLoadLegacyAof(t *testing.T) {
+	config := newTestConfig(t)
+	const legacy = "*3\r\n$3\r\nset\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	if err := os.WriteFile(path.Join(config.Dir, config.AppendFilename), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, n, err := LoadAof(config, nil, func(args *resp.Array) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("expected 1 command, got %d", n)
+	}
+
+	loaded, err := LoadManifest(manifestPath(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded.Files(), m.Files()) || m.Base == nil || m.Base.Name != config.AppendFilename {
+		t.Errorf("unexpected manifest %v", loaded.Files())
+	}
+}
+
+func join(args *resp.Array) string {
+	parts := make([]string, 0, len(args.A))
+	for _, arg := range args.A {
+		parts = append(parts, string(arg.(resp.BulkString).S))
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,209 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	AOF_BASE    = byte('b')
+	AOF_HISTORY = byte('h')
+	AOF_INCR    = byte('i')
+)
+
+type AofFile struct {
+	Name string
+	Seq  int64
+	Type byte
+}
+
+// Manifest tracks files of the multi part AOF, the dataset is the base file followed by incr files in order,
+// history files are left overs of the previous rewrite that are going to be deleted
+type Manifest struct {
+	Base    *AofFile
+	Incr    []*AofFile
+	History []*AofFile
+	// last used sequence numbers, sequences are never reused even if files are deleted
+	baseSeq int64
+	incrSeq int64
+}
+
+func LoadManifest(p string) (*Manifest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return ParseManifest(f)
+}
+
+// ParseManifest reads manifest in format of "file <name> seq <seq> type <b|h|i>" lines, lines starting
+// with # are ignored
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line %d: %q", line, text)
+		}
+
+		file := &AofFile{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				file.Name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid seq on manifest line %d: %w", line, err)
+				}
+				file.Seq = seq
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, fmt.Errorf("invalid type on manifest line %d: %q", line, fields[i+1])
+				}
+				file.Type = fields[i+1][0]
+			}
+		}
+
+		if file.Name == "" || file.Seq == 0 {
+			return nil, fmt.Errorf("incomplete manifest line %d: %q", line, text)
+		}
+
+		switch file.Type {
+		case AOF_BASE:
+			if m.Base != nil {
+				return nil, fmt.Errorf("found duplicate base file on manifest line %d", line)
+			}
+			m.Base = file
+			m.baseSeq = file.Seq
+		case AOF_INCR:
+			if file.Seq <= m.incrSeq {
+				return nil, fmt.Errorf("incr files are out of order on manifest line %d", line)
+			}
+			m.Incr = append(m.Incr, file)
+			m.incrSeq = file.Seq
+		case AOF_HISTORY:
+			m.History = append(m.History, file)
+		default:
+			return nil, fmt.Errorf("unknown file type on manifest line %d: %q", line, file.Type)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	buff := bytes.NewBuffer(make([]byte, 0, 256))
+	if m.Base != nil {
+		fmt.Fprintf(buff, "file %s seq %d type %c\n", m.Base.Name, m.Base.Seq, AOF_BASE)
+	}
+
+	for _, f := range m.History {
+		fmt.Fprintf(buff, "file %s seq %d type %c\n", f.Name, f.Seq, AOF_HISTORY)
+	}
+
+	for _, f := range m.Incr {
+		fmt.Fprintf(buff, "file %s seq %d type %c\n", f.Name, f.Seq, AOF_INCR)
+	}
+
+	n, err := w.Write(buff.Bytes())
+	return int64(n), err
+}
+
+// Persist atomically replaces manifest at p: content is written to a temporary file which is fsynced
+// and renamed over the old manifest, so a crash leaves either the old or the new manifest
+func (m *Manifest) Persist(p string) error {
+	tmp := path.Join(path.Dir(p), "temp-"+path.Base(p))
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = m.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, p); err != nil {
+		return err
+	}
+
+	return fsyncDir(path.Dir(p))
+}
+
+// Files returns files holding the dataset in order they have to be loaded
+func (m *Manifest) Files() []*AofFile {
+	files := make([]*AofFile, 0, len(m.Incr)+1)
+	if m.Base != nil {
+		files = append(files, m.Base)
+	}
+
+	return append(files, m.Incr...)
+}
+
+func (m *Manifest) clone() *Manifest {
+	c := *m
+	c.Incr = append([]*AofFile(nil), m.Incr...)
+	c.History = append([]*AofFile(nil), m.History...)
+	return &c
+}
+
+func (m *Manifest) nextIncr(filename string) *AofFile {
+	m.incrSeq++
+	return &AofFile{
+		Name: fmt.Sprintf("%s.%d.incr.aof", filename, m.incrSeq),
+		Seq:  m.incrSeq,
+		Type: AOF_INCR,
+	}
+}
+
+func (m *Manifest) nextBase(filename string, rdbPreamble bool) *AofFile {
+	m.baseSeq++
+	ext := "aof"
+	if rdbPreamble {
+		ext = "rdb"
+	}
+
+	return &AofFile{
+		Name: fmt.Sprintf("%s.%d.base.%s", filename, m.baseSeq, ext),
+		Seq:  m.baseSeq,
+		Type: AOF_BASE,
+	}
+}
+
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+	return d.Sync()
+}
@@ -1,6 +1,109 @@
 package persistence
 
+import (
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// REDIS_VERSION is the version of redis whose persistence formats are implemented
+	REDIS_VERSION = "7.2.0"
+
+	FSYNC_ALWAYS   = "always"
+	FSYNC_EVERYSEC = "everysec"
+	FSYNC_NO       = "no"
+)
+
 type Config struct {
 	Dir  string
 	File string
+	// Save makes server write the rdb on shutdown
+	Save bool
+	// AppendOnly enables logging of every write command into the AOF
+	AppendOnly bool
+	// AppendDirname is the directory inside Dir holding the AOF files and the manifest
+	AppendDirname  string
+	AppendFilename string
+	// AppendFsync is one of FSYNC_ALWAYS, FSYNC_EVERYSEC or FSYNC_NO
+	AppendFsync string
+	// AofLoadTruncated allows to start with an AOF whose last command was cut off,
+	// the file is truncated to the last valid command
+	AofLoadTruncated bool
+	// AofUseRdbPreamble makes rewrite produce base file in rdb format instead of commands
+	AofUseRdbPreamble bool
+	// AutoAofRewritePercentage triggers rewrite once AOF grows by the given percentage since the last rewrite,
+	// 0 disables automatic rewrite
+	AutoAofRewritePercentage int
+	// AutoAofRewriteMinSize is the size AOF has to reach before automatic rewrite is considered
+	AutoAofRewriteMinSize int64
+
+	// Runtime state reported by INFO persistence
+	Loading                atomic.Bool
+	AofCurrentSize         atomic.Int64
+	AofBaseSize            atomic.Int64
+	AofLastWriteStatus     atomic.Bool
+	AofLastFsync           atomic.Int64
+	AofRewriteInProgress   atomic.Bool
+	AofLastBgrewriteStatus atomic.Bool
+	AofLastRewriteTimeSec  atomic.Int64
+	AofRewrites            atomic.Uint64
+	RdbBgsaveInProgress    atomic.Bool
+	RdbLastBgsaveStatus    atomic.Bool
+	RdbLastSaveTime        atomic.Int64
+}
+
+func (c *Config) MarshalRESP(w io.Writer) (int, error) {
+	const format = "# Persistence\r\n" +
+		"loading:%d\r\n" +
+		"rdb_bgsave_in_progress:%d\r\n" +
+		"rdb_last_save_time:%d\r\n" +
+		"rdb_last_bgsave_status:%s\r\n" +
+		"aof_enabled:%d\r\n" +
+		"aof_rewrite_in_progress:%d\r\n" +
+		"aof_rewrites:%d\r\n" +
+		"aof_last_rewrite_time_sec:%d\r\n" +
+		"aof_last_bgrewrite_status:%s\r\n" +
+		"aof_last_write_status:%s\r\n" +
+		"aof_current_size:%d\r\n" +
+		"aof_base_size:%d\r\n" +
+		"aof_last_fsync_time:%d\r\n"
+
+	return resp.BulkString{S: []byte(fmt.Sprintf(format,
+		boolToInt(c.Loading.Load()),
+		boolToInt(c.RdbBgsaveInProgress.Load()),
+		c.RdbLastSaveTime.Load(),
+		status(c.RdbLastBgsaveStatus.Load()),
+		boolToInt(c.AppendOnly),
+		boolToInt(c.AofRewriteInProgress.Load()),
+		c.AofRewrites.Load(),
+		c.AofLastRewriteTimeSec.Load(),
+		status(!c.AppendOnly || c.AofLastBgrewriteStatus.Load()),
+		status(!c.AppendOnly || c.AofLastWriteStatus.Load()),
+		c.AofCurrentSize.Load(),
+		c.AofBaseSize.Load(),
+		c.AofLastFsync.Load(),
+	))}.MarshalRESP(w)
+}
+
+func (c *Config) markFsync() {
+	c.AofLastFsync.Store(time.Now().Unix())
+}
+
+func status(ok bool) string {
+	if ok {
+		return "ok"
+	}
+
+	return "err"
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
 }
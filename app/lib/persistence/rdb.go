@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// RdbMetadata returns auxiliary fields written to every rdb produced by the server
+func RdbMetadata() map[string]string {
+	mem := runtime.MemStats{}
+	runtime.ReadMemStats(&mem)
+	return map[string]string{
+		"redis-ver":  REDIS_VERSION,
+		"redis-bits": strconv.Itoa(strconv.IntSize),
+		"ctime":      strconv.FormatInt(time.Now().Unix(), 10),
+		"used-mem":   strconv.FormatUint(mem.Alloc, 10),
+	}
+}
+
+// SaveRdb replaces rdb at Dir/File with the snapshot, the file is written to a temporary file first,
+// so a crash during save never leaves a partially written rdb
+func SaveRdb(config *Config, snapshot []*storage.DbSnapshot, metadata map[string]string) error {
+	p := path.Join(config.Dir, config.File)
+	tmp := path.Join(config.Dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	err := writeRdbFile(tmp, snapshot, metadata)
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+
+	if err == nil {
+		err = fsyncDir(path.Dir(p))
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save rdb %s: %w", p, err)
+	}
+
+	config.RdbLastSaveTime.Store(time.Now().Unix())
+	return nil
+}
+
+func writeRdbFile(p string, snapshot []*storage.DbSnapshot, metadata map[string]string) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = resp.WriteRdb(f, snapshot, metadata); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
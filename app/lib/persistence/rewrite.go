@@ -0,0 +1,21 @@
+package persistence
+
+import (
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"io"
+)
+
+// writeCommands writes the shortest sequence of commands recreating the snapshot, stream metadata included
+func writeCommands(w io.Writer, snapshot []*storage.DbSnapshot) error {
+	exporter, err := resp.NewExporter(w, resp.EXPORT_RESP)
+	if err != nil {
+		return err
+	}
+
+	if err = resp.SnapshotEntries(snapshot, exporter.Write); err != nil {
+		return err
+	}
+
+	return exporter.Close()
+}
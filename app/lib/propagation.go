@@ -1,40 +1,304 @@
 package lib
 
 import (
-	"context"
+	"bytes"
 	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/replication"
 	"log"
+	"strconv"
+	"time"
 )
 
-func (s *RedisServer) PropagateToAll(buff []byte) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	s.logger.Printf("Propagating to all slaves, %d", len(s.slaves))
+// PropagateToAll writes cmd executed against db to every slave and adds it to the replication stream,
+// SELECT is emitted when db differs from the previously propagated one, negative db is used by commands
+// that do not depend on it. Slaves are registered under the same lock, that way they do not miss any write
+// between the handshake and the registration
+func (s *RedisServer) PropagateToAll(db int, cmd *resp.Array) {
+	buff := bytes.NewBuffer(make([]byte, 0, 128))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if db >= 0 && db != s.replDb {
+		(resp.Array{A: []resp.Marshaller{
+			resp.BulkString{S: []byte("SELECT")},
+			resp.BulkString{S: []byte(strconv.Itoa(db))},
+		}}).MarshalRESP(buff)
+		s.replDb = db
+	}
+
+	cmd.MarshalRESP(buff)
+	s.propagate(buff.Bytes())
+}
+
+// propagate feeds the backlog and advances replication offset, must be called with s.mu held
+func (s *RedisServer) propagate(buff []byte) {
+	if backlog := s.config.ReplicationConfig.Backlog; backlog != nil {
+		backlog.Feed(buff)
+	}
+
+	s.config.ReplicationConfig.MasterReplOffset.Add(uint64(len(buff)))
+
+	alive := s.slaves[:0]
 	for _, r := range s.slaves {
 		if _, err := r.Propagate(buff); err != nil {
-			s.logger.Printf("Error writing to replica: %s", err)
+			s.logger.Printf("Error writing to replica %s, dropping it: %s", r.GetAddr(), err)
+			s.config.ReplicationConfig.ConnectedSlaves.Add(^uint64(0))
+			continue
+		}
+
+		alive = append(alive, r)
+	}
+
+	if len(alive) != len(s.slaves) {
+		s.config.ReplicationConfig.SetSlaves(alive)
+	}
+
+	s.slaves = alive
+}
+
+// addSlave must be called with s.mu held
+func (s *RedisServer) addSlave(slave *replication.Slave) {
+	s.slaves = append(s.slaves, slave)
+	s.config.ReplicationConfig.ConnectedSlaves.Add(1)
+	s.config.ReplicationConfig.SetSlaves(s.slaves)
+}
+
+// dropSlaves closes connection of every replica, they have to synchronize again, must be called with s.mu held
+func (s *RedisServer) dropSlaves() {
+	for _, slave := range s.slaves {
+		slave.Close()
+	}
+}
+
+func (s *RedisServer) removeSlave(slave *replication.Slave) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.slaves {
+		if r == slave {
+			s.slaves = append(s.slaves[:i], s.slaves[i+1:]...)
+			s.config.ReplicationConfig.ConnectedSlaves.Add(^uint64(0))
+			s.config.ReplicationConfig.SetSlaves(s.slaves)
+			return
 		}
 	}
 }
 
+// ConnectMaster makes the first attempt to connect to the configured master and keeps reconnecting
+// in background whenever the link is down
 func (s *RedisServer) ConnectMaster() error {
-	if s.config.ReplicaOf != "" {
-		s.config.ReplicationConfig.Role = "slave"
-		master, err := replication.NewReplicaOf(s.db, s.config.ReplicaOf, fmt.Sprint(s.config.Port), s.propagation)
-		if err != nil {
-			s.logger.Printf("Failed to connect to master %v: %s", s.config.ReplicaOf, err)
-			return err
+	if s.config.ReplicaOf() == "" {
+		return nil
+	}
+
+	return s.startReplication(s.config.ReplicaOf(), false)
+}
+
+// startReplication connects to the master at addr, with failover the master, which has to be our replica,
+// is asked to promote itself and replication is stopped when the first attempt fails. Nothing is done when
+// the master was changed again in the meantime
+func (s *RedisServer) startReplication(addr string, failover bool) error {
+	s.consumers.Do(s.initPropagationConsumptionFromMaster)
+	s.mu.Lock()
+	if s.config.ReplicaOf() != addr {
+		s.mu.Unlock()
+		return nil
+	}
+
+	if s.replStop != nil {
+		close(s.replStop)
+	}
+
+	stop := make(chan struct{})
+	s.replStop = stop
+	s.config.ReplicationConfig.Role = "slave"
+	s.mu.Unlock()
+	link, err := s.connectMaster(addr, failover)
+	if err != nil && failover {
+		s.stopReplication()
+		return err
+	}
+
+	go s.replicationLoop(addr, stop, link)
+	return err
+}
+
+// stopReplication closes the link to the master and stops reconnecting, commands already read from
+// the master are applied before it returns
+func (s *RedisServer) stopReplication() {
+	s.mu.Lock()
+	if s.replStop != nil {
+		close(s.replStop)
+		s.replStop = nil
+	}
+	s.mu.Unlock()
+	if link := s.config.ReplicationConfig.Master.Swap(nil); link != nil {
+		link.Close()
+		link.WaitApplied()
+	}
+}
+
+// replicationLoop waits for the link to drop and reconnects with exponential backoff until stop is closed
+func (s *RedisServer) replicationLoop(addr string, stop <-chan struct{}, link *replication.ReplicaOf) {
+	backoff := REPL_MIN_BACKOFF
+	for {
+		if link != nil {
+			select {
+			case <-stop:
+				link.Close()
+				return
+			case <-s.close:
+				link.Close()
+				return
+			case <-link.Done():
+				s.logger.Printf("Lost connection to master %s", addr)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-s.close:
+			return
+		case <-time.After(backoff):
+		}
+
+		var err error
+		if link, err = s.connectMaster(addr, false); err != nil {
+			if backoff *= 2; backoff > REPL_MAX_BACKOFF {
+				backoff = REPL_MAX_BACKOFF
+			}
+
+			continue
+		}
+
+		backoff = REPL_MIN_BACKOFF
+	}
+}
+
+func (s *RedisServer) connectMaster(addr string, failover bool) (*replication.ReplicaOf, error) {
+	config := s.config.ReplicationConfig
+	if prev := config.Master.Load(); prev != nil {
+		prev.WaitApplied()
+	}
+
+	replid, offset := "?", int64(-1)
+	if s.replHistory {
+		replid, offset = config.MasterReplid, int64(config.MasterReplOffset.Load())+1
+	}
+
+	link := replication.NewReplicaOf(s.db, addr, fmt.Sprint(s.config.Port), s.propagation)
+	link.Failover = failover
+	config.Master.Store(link)
+	if err := link.Connect(replid, offset); err != nil {
+		s.logger.Printf("Failed to connect to master %v: %s", addr, err)
+		return nil, err
+	}
+
+	s.adoptReplicationState(link)
+	go link.ListenAndAccept()
+	go s.sendAcks(link)
+	return link, nil
+}
+
+// sendAcks reports replication offset to the master every second until the link is closed, link that
+// has not received anything, not even PING, for repl-timeout is closed
+func (s *RedisServer) sendAcks(link *replication.ReplicaOf) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-link.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if timeout := s.config.ReplicationConfig.ReplTimeout; timeout > 0 && time.Since(link.LastIo()) > timeout {
+			s.logger.Printf("Master %s timed out", link.Host())
+			link.Close()
+			return
+		}
+
+		if err := link.Ack(s.config.ReplicationConfig.MasterReplOffset.Load()); err != nil {
+			s.logger.Printf("Error sending ACK to master %s: %s", link.Host(), err)
+			link.Close()
+			return
+		}
+	}
+}
+
+// pingReplicas sends PING to replicas every repl-ping-replica-period, so they are able to detect
+// that the master is down, and drops replicas that did not ACK for repl-timeout
+func (s *RedisServer) pingReplicas() {
+	config := s.config.ReplicationConfig
+	if config.ReplPingReplicaPeriod <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(config.ReplPingReplicaPeriod)
+	defer ticker.Stop()
+	ping := resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("PING")}}}
+	for {
+		select {
+		case <-s.close:
+			return
+		case <-ticker.C:
 		}
-		s.replicaOf = master
-		go s.initPropagationConsumptionFromMaster()
+
+		// replicas forward the stream of their master
+		if config.Master.Load() != nil {
+			continue
+		}
+
+		s.mu.RLock()
+		slaves := append([]*replication.Slave(nil), s.slaves...)
+		s.mu.RUnlock()
+		for _, slave := range slaves {
+			if config.ReplTimeout > 0 && slave.Lag() > config.ReplTimeout {
+				s.logger.Printf("Replica %s timed out", slave.GetAddr())
+				slave.Close()
+			}
+		}
+
+		// pings would move the offset while writes are paused by FAILOVER
+		if len(slaves) > 0 && s.writes.TryRLock() {
+			s.PropagateToAll(-1, &ping)
+			s.writes.RUnlock()
+		}
+	}
+}
+
+// adoptReplicationState continues replication history of the master after the handshake
+func (s *RedisServer) adoptReplicationState(master *replication.ReplicaOf) {
+	config := s.config.ReplicationConfig
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case master.FullResync:
+		// dataset of sub-replicas belongs to the replaced history
+		s.dropSlaves()
+		config.MasterReplid = master.Replid
+		config.MasterReplOffset.Store(master.Offset)
+		config.MasterReplid2 = ""
+		config.SecondReplOffset.Store(0)
+		if config.Backlog != nil {
+			config.Backlog.Reset(master.Offset + 1)
+		}
+	case master.Replid != "" && master.Replid != config.MasterReplid:
+		// master was promoted since the last sync, its replication history continues ours
+		config.ShiftReplid(master.Replid)
+		s.dropSlaves()
 	}
-	return nil
+
+	s.replHistory = true
 }
 
 func (s *RedisServer) initPropagationConsumptionFromMaster() {
 	for i := 0; i < PROPAGATION_CONSUMERS; i++ {
 		go func(i int) {
+			// master stream is executed by a single client, so SELECT affects the following commands
+			client := s.newInternalRequest(nil)
+			client.Propagation = true
+			var link *replication.ReplicaOf
 			for {
 				select {
 				case _, ok := <-s.close:
@@ -43,35 +307,28 @@ func (s *RedisServer) initPropagationConsumptionFromMaster() {
 						return
 					}
 				case req := <-s.propagation:
-					handler, err := s.router.ResolveRequest(req.Args)
-					if err != nil {
-						s.logger.Printf("error resolving request: %s", err)
-						return
+					if req.Link != link {
+						// replica starts with db 0 selected after loading the rdb, partial resync continues
+						// the stream with the same db
+						if link = req.Link; link.FullResync {
+							client.SetDb(0)
+						}
 					}
 
-					rq := &RESPRequest{
-						Args:        req.Args,
-						Logger:      s.logger,
-						s:           s,
-						W:           req.Writer,
-						Propagation: true,
-					}
-
-					if err := rq.SetDb(0); err != nil {
-						s.logger.Printf("unexpected error setting db with idex %d", 0)
-						return
-					}
-
-					req.Args.A = req.Args.A[1:]
-					_, err = handler.HandleResp(context.Background(), rq)
-
-					if err != nil {
-						s.logger.Printf("error propagating to replica: %s", err)
-						return
+					// the stream is forwarded to sub-replicas as is, so they share replication id and offset
+					// with the master, lock makes the execution and the offset consistent for PSYNC
+					s.writes.RLock()
+					client.W = req.Writer
+					if err := s.replay(client, req.Args); err != nil {
+						s.logger.Printf("error resolving request: %s", err)
 					}
 
-					s.config.ReplicationConfig.MasterReplOffset.Add(uint64(req.N))
+					s.mu.Lock()
+					s.propagate(req.Raw)
+					s.mu.Unlock()
+					s.writes.RUnlock()
 					log.Printf("Offset: %d", s.config.ReplicationConfig.MasterReplOffset.Load())
+					req.Link.Applied()
 				}
 			}
 		}(i)
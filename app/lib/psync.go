@@ -1,23 +1,60 @@
 package lib
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/replication"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+	"io"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// HandlePsync continues replication from the backlog when replica history is still there, otherwise sends
+// the whole dataset. Invalid arguments are treated as a request for full resynchronization.
+// PSYNC <replid> <offset> FAILOVER is sent by the master demoted by FAILOVER, replica promotes itself
+// and continues replication of the old master as its secondary history
 func HandlePsync(ctx context.Context, req *RESPRequest) (interface{}, error) {
-	req.Logger.Printf("Sending resync to %s", req.RemoteAddr)
-	if _, err := (resp.SimpleString{S: fmt.Sprintf("FULLRESYNC %s %d", req.s.config.ReplicationConfig.MasterReplid,
-		req.s.config.ReplicationConfig.MasterReplOffset.Load())}).MarshalRESP(req.W); err != nil {
-		return nil, err
+	var (
+		replid string
+		offset int64 = -1
+	)
+
+	if len(req.Args.A) == 3 {
+		if arg, ok := req.Args.A[2].(resp.BulkString); !ok || !strings.EqualFold(string(arg.S), "failover") {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+
+		id, _ := req.Args.A[0].(resp.BulkString)
+		if req.s.config.ReplicationConfig.Master.Load() == nil {
+			return nil, fmt.Errorf("ERR PSYNC FAILOVER can't be sent to a master.")
+		}
+
+		if string(id.S) != req.s.config.ReplicationConfig.MasterReplid {
+			return nil, fmt.Errorf("ERR PSYNC FAILOVER replid must match my replid.")
+		}
+
+		req.s.role.Lock()
+		req.s.promote()
+		req.s.role.Unlock()
 	}
 
-	req.Logger.Printf("Sending full resync to %s", req.RemoteAddr)
-	if _, err := req.s.rdb.FullResync(req.W); err != nil {
-		return nil, err
+	if len(req.Args.A) >= 2 {
+		id, okId := req.Args.A[0].(resp.BulkString)
+		off, okOff := req.Args.A[1].(resp.BulkString)
+		if okId && okOff {
+			replid = string(id.S)
+			if n, err := strconv.ParseInt(string(off.S), 10, 64); err == nil {
+				offset = n
+			}
+		}
 	}
+
 	if err := req.conn.SetReadDeadline(time.Time{}); err != nil {
 		return nil, err
 	}
@@ -25,10 +62,110 @@ func HandlePsync(ctx context.Context, req *RESPRequest) (interface{}, error) {
 		return nil, err
 	}
 
-	req.s.config.ReplicationConfig.ConnectedSlaves.Add(1)
+	// replica writes to the connection on its own, so the sync is not buffered
+	if err := req.flush(); err != nil {
+		return nil, err
+	}
+
+	req.W = req.conn
+
+	config := req.s.config.ReplicationConfig
+	slave := replication.NewReplica(req.conn, req.r, req.listeningPort, req.s.acks)
+	// no write is executed while the lock is held, so the replica gets every write after the offset it is told
+	req.s.writes.Lock()
+	req.s.mu.Lock()
+	if offset > 0 && config.CanContinue(replid, uint64(offset)) {
+		req.Logger.Printf("Continuing replication of %s from %d", req.RemoteAddr, offset)
+		backlog, _ := config.Backlog.Range(uint64(offset))
+		err := req.s.continueSync(req.W, backlog)
+		if err == nil {
+			req.s.addSlave(slave)
+		}
+
+		req.s.mu.Unlock()
+		req.s.writes.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		req.Logger.Printf("Sending full resync to %s", req.RemoteAddr)
+		_, err := (resp.SimpleString{S: fmt.Sprintf("FULLRESYNC %s %d", config.MasterReplid,
+			config.MasterReplOffset.Load())}).MarshalRESP(req.W)
+		snapshot, metadata := req.s.snapshot(), req.s.rdbMetadata()
+		if err == nil {
+			slave.StartSync()
+			req.s.addSlave(slave)
+			// replica starts with db 0 selected after loading the rdb
+			req.s.replDb = 0
+		}
+
+		req.s.mu.Unlock()
+		req.s.writes.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = req.s.sendRdb(req.W, snapshot, metadata); err == nil {
+			err = slave.EndSync()
+		}
+
+		if err != nil {
+			req.s.removeSlave(slave)
+			return nil, err
+		}
+	}
+
 	req.Logger.Printf("Slave connected: %s", req.RemoteAddr)
-	req.s.logger.SetPrefix(fmt.Sprintf("master[%d]", req.s.config.ReplicationConfig.ConnectedSlaves.Load()))
-	<-ctx.Done()
-	req.s.config.ReplicationConfig.ConnectedSlaves.Swap(uint64(req.s.config.ReplicationConfig.ConnectedSlaves.Load() - 1))
+	req.s.logger.SetPrefix(fmt.Sprintf("master[%d]", config.ConnectedSlaves.Load()))
+	// connection is owned by the slave from now on, replica only sends ACKs
+	if err := slave.ReadAcks(); err != nil && err != io.EOF {
+		req.Logger.Printf("Lost connection to replica %s: %s", req.RemoteAddr, err)
+	}
+
+	req.s.removeSlave(slave)
+	req.closed = true
 	return nil, nil
 }
+
+func (s *RedisServer) continueSync(w io.Writer, backlog []byte) error {
+	if _, err := (resp.SimpleString{S: fmt.Sprintf("CONTINUE %s", s.config.ReplicationConfig.MasterReplid)}).MarshalRESP(w); err != nil {
+		return err
+	}
+
+	_, err := w.Write(backlog)
+	return err
+}
+
+// sendRdb transfers the snapshot to replica, by default rdb is written to a temporary file, as its length
+// has to be sent first, with repl-diskless-sync it is streamed directly to the socket
+func (s *RedisServer) sendRdb(w io.Writer, snapshot []*storage.DbSnapshot, metadata map[string]string) error {
+	if s.config.ReplicationConfig.ReplDisklessSync {
+		mark := bytes.NewBuffer(make([]byte, 0, resp.RDB_EOF_MARK_LEN))
+		utils.RandomAlphanumericString(mark, resp.RDB_EOF_MARK_LEN)
+		_, err := resp.WriteRdbDiskless(w, snapshot, metadata, mark.String())
+		return err
+	}
+
+	f, err := os.CreateTemp(s.config.PersistenceConfig.Dir, "temp-repl-*.rdb")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+	n, err := resp.WriteRdb(f, snapshot, metadata)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(w, "$%d\r\n", n); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,543 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// PUBSUB_BUFFER is the number of messages queued for the subscriber, subscriber that does not keep up with
+	// the publishers is disconnected
+	PUBSUB_BUFFER        = 1024
+	PUBSUB_WRITE_TIMEOUT = 10 * time.Second
+)
+
+type subscriptionKind int
+
+const (
+	channelSubscription subscriptionKind = iota
+	patternSubscription
+	shardSubscription
+)
+
+var subscriptionReplies = [...]struct{ subscribe, unsubscribe string }{
+	channelSubscription: {"subscribe", "unsubscribe"},
+	patternSubscription: {"psubscribe", "punsubscribe"},
+	shardSubscription:   {"ssubscribe", "sunsubscribe"},
+}
+
+// pubsub is the registry of subscribers of channels, patterns and shard channels
+type pubsub struct {
+	mu   sync.RWMutex
+	subs [len(subscriptionReplies)]map[string]map[*subscriber]bool
+}
+
+func newPubsub() *pubsub {
+	p := &pubsub{}
+	for i := range p.subs {
+		p.subs[i] = make(map[string]map[*subscriber]bool)
+	}
+
+	return p
+}
+
+// subscriber is the connection that subscribed to some channels, its replies and the published messages are
+// written by a single goroutine from the queue, so publishers never wait for the connection
+type subscriber struct {
+	conn      net.Conn
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	// replies to the command being executed, queued at once so messages are not interleaved with them
+	buf bytes.Buffer
+	// subscriptions are modified under pubsub.mu by the connection only
+	subs [len(subscriptionReplies)]map[string]bool
+	// protocol of the connection, HELLO may change it while publishers read it
+	protocol atomic.Int32
+}
+
+func newSubscriber(conn net.Conn, protocol int) *subscriber {
+	sub := &subscriber{conn: conn, out: make(chan []byte, PUBSUB_BUFFER), closed: make(chan struct{})}
+	for i := range sub.subs {
+		sub.subs[i] = make(map[string]bool)
+	}
+
+	sub.protocol.Store(int32(protocol))
+
+	go sub.writeLoop()
+	return sub
+}
+
+// count returns the number of subscriptions reported in replies, shard channels are counted apart
+func (sub *subscriber) count(kind subscriptionKind) int {
+	if kind == shardSubscription {
+		return len(sub.subs[shardSubscription])
+	}
+
+	return len(sub.subs[channelSubscription]) + len(sub.subs[patternSubscription])
+}
+
+func (sub *subscriber) subscribed() bool {
+	return sub.count(channelSubscription)+sub.count(shardSubscription) > 0
+}
+
+// send queues the message, the connection is closed when the queue is full, like Redis drops clients over
+// the output buffer limit
+func (sub *subscriber) send(b []byte) {
+	select {
+	case sub.out <- b:
+	default:
+		sub.close()
+	}
+}
+
+// flush queues the replies to the last command, the connection waits for the writer unlike publishers
+func (sub *subscriber) flush() {
+	if sub.buf.Len() == 0 {
+		return
+	}
+
+	b := append([]byte(nil), sub.buf.Bytes()...)
+	sub.buf.Reset()
+	select {
+	case sub.out <- b:
+	case <-sub.closed:
+	}
+}
+
+func (sub *subscriber) close() {
+	sub.closeOnce.Do(func() {
+		close(sub.closed)
+		sub.conn.Close()
+	})
+}
+
+func (sub *subscriber) writeLoop() {
+	for {
+		select {
+		case <-sub.closed:
+			return
+		case b := <-sub.out:
+			if err := sub.conn.SetWriteDeadline(time.Now().Add(PUBSUB_WRITE_TIMEOUT)); err != nil {
+				sub.close()
+				return
+			}
+
+			if _, err := sub.conn.Write(b); err != nil {
+				sub.close()
+				return
+			}
+		}
+	}
+}
+
+// subscribe adds the subscription, it returns false when the subscriber already has it
+func (p *pubsub) subscribe(kind subscriptionKind, sub *subscriber, name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if sub.subs[kind][name] {
+		return false
+	}
+
+	subs := p.subs[kind][name]
+	if subs == nil {
+		subs = make(map[*subscriber]bool)
+		p.subs[kind][name] = subs
+	}
+
+	subs[sub] = true
+	sub.subs[kind][name] = true
+	return true
+}
+
+func (p *pubsub) unsubscribe(kind subscriptionKind, sub *subscriber, name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remove(kind, sub, name)
+}
+
+// remove must be called with p.mu held
+func (p *pubsub) remove(kind subscriptionKind, sub *subscriber, name string) bool {
+	if !sub.subs[kind][name] {
+		return false
+	}
+
+	delete(sub.subs[kind], name)
+	delete(p.subs[kind][name], sub)
+	if len(p.subs[kind][name]) == 0 {
+		delete(p.subs[kind], name)
+	}
+
+	return true
+}
+
+// drop removes all subscriptions of the closed connection
+func (p *pubsub) drop(sub *subscriber) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for kind := range sub.subs {
+		for name := range sub.subs[kind] {
+			p.remove(subscriptionKind(kind), sub, name)
+		}
+	}
+}
+
+// publish delivers the message to the subscribers of the channel and of the matching patterns, shard channels
+// are not matched by patterns. It returns the number of the subscribers that received the message
+func (p *pubsub) publish(channel, message string, shard bool) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	kind, typ := channelSubscription, "message"
+	if shard {
+		kind, typ = shardSubscription, "smessage"
+	}
+
+	n := 0
+	if subs := p.subs[kind][channel]; len(subs) > 0 {
+		m := push{args: []string{typ, channel, message}}
+		for sub := range subs {
+			sub.send(m.bytes(sub))
+			n++
+		}
+	}
+
+	if shard {
+		return n
+	}
+
+	for pattern, subs := range p.subs[patternSubscription] {
+		if !utils.GlobMatch(pattern, channel) {
+			continue
+		}
+
+		m := push{args: []string{"pmessage", pattern, channel, message}}
+		for sub := range subs {
+			sub.send(m.bytes(sub))
+			n++
+		}
+	}
+
+	return n
+}
+
+// names returns the sorted channels with subscribers matching the pattern, empty pattern matches all of them
+func (p *pubsub) names(kind subscriptionKind, pattern string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := make([]string, 0, len(p.subs[kind]))
+	for name := range p.subs[kind] {
+		if pattern == "" || utils.GlobMatch(pattern, name) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (p *pubsub) numsub(kind subscriptionKind, name string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.subs[kind][name])
+}
+
+// push is the message delivered to the subscribers, it is marshalled once for each protocol in use
+type push struct {
+	args  []string
+	resp2 []byte
+	resp3 []byte
+}
+
+func (m *push) bytes(sub *subscriber) []byte {
+	if sub.protocol.Load() == resp.RESP3 {
+		if m.resp3 == nil {
+			m.resp3 = marshalPush(resp.RESP3, m.args...)
+		}
+
+		return m.resp3
+	}
+
+	if m.resp2 == nil {
+		m.resp2 = marshalPush(resp.RESP2, m.args...)
+	}
+
+	return m.resp2
+}
+
+func marshalPush(protocol int, args ...string) []byte {
+	p := resp.Push{A: make([]resp.Marshaller, 0, len(args))}
+	for _, arg := range args {
+		p.A = append(p.A, resp.BulkString{S: []byte(arg)})
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, 64))
+	resp.ForProtocol(p, protocol).MarshalRESP(b)
+	return b.Bytes()
+}
+
+// isPubsubCommand reports commands allowed to the connection in the subscribed state
+func isPubsubCommand(command string) bool {
+	switch command {
+	case "subscribe", "psubscribe", "ssubscribe", "unsubscribe", "punsubscribe", "sunsubscribe", "ping", "quit", "reset":
+		return true
+	}
+
+	return false
+}
+
+// Subscribed reports that the connection subscribed to some channels, it only receives messages then
+func (req *RESPRequest) Subscribed() bool {
+	return req.sub != nil && req.sub.subscribed()
+}
+
+// unsubscribeAll drops subscriptions of the closed connection
+func (req *RESPRequest) unsubscribeAll() {
+	if req.sub == nil {
+		return
+	}
+
+	req.s.pubsub.drop(req.sub)
+	req.sub.close()
+}
+
+func stringArgs(args []resp.Marshaller) ([]string, error) {
+	str := make([]string, 0, len(args))
+	for _, arg := range args {
+		b, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR invalid argument type, expected string, got %T", arg)
+		}
+
+		str = append(str, string(b.S))
+	}
+
+	return str, nil
+}
+
+func (req *RESPRequest) subscribe(kind subscriptionKind) (interface{}, error) {
+	command := subscriptionReplies[kind].subscribe
+	if len(req.Args.A) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", command)
+	}
+
+	names, err := stringArgs(req.Args.A)
+	if err != nil {
+		return nil, err
+	}
+
+	// replies to the subscription would be mixed with the replies of EXEC
+	if req.conn == nil || req.multi != nil {
+		return nil, fmt.Errorf("ERR Command not allowed inside a transaction")
+	}
+
+	if req.sub == nil {
+		// the connection is written by the subscriber since then
+		if err = req.flush(); err != nil {
+			return nil, err
+		}
+
+		req.sub = newSubscriber(req.conn, req.protocol)
+		req.W = &req.sub.buf
+		// subscriber waits for the messages without sending any command
+		if err = req.conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range names {
+		req.s.pubsub.subscribe(kind, req.sub, name)
+		req.writeSubscription(command, resp.BulkString{S: []byte(name)}, req.sub.count(kind))
+	}
+
+	return nil, nil
+}
+
+// unsubscribe removes the subscriptions in the arguments or all of them
+func (req *RESPRequest) unsubscribe(kind subscriptionKind) (interface{}, error) {
+	command := subscriptionReplies[kind].unsubscribe
+	names, err := stringArgs(req.Args.A)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.multi != nil {
+		return nil, fmt.Errorf("ERR Command not allowed inside a transaction")
+	}
+
+	if len(names) == 0 && req.sub != nil {
+		for name := range req.sub.subs[kind] {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	if len(names) == 0 {
+		count := 0
+		if req.sub != nil {
+			count = req.sub.count(kind)
+		}
+
+		req.writeSubscription(command, resp.BulkString{EncodeNil: true}, count)
+		return nil, nil
+	}
+
+	for _, name := range names {
+		count := 0
+		if req.sub != nil {
+			req.s.pubsub.unsubscribe(kind, req.sub, name)
+			count = req.sub.count(kind)
+		}
+
+		req.writeSubscription(command, resp.BulkString{S: []byte(name)}, count)
+	}
+
+	return nil, nil
+}
+
+// writeSubscription writes confirmation of the subscription change, there is one for each channel
+func (req *RESPRequest) writeSubscription(command string, name resp.BulkString, count int) {
+	resp.ForProtocol(resp.Push{A: []resp.Marshaller{
+		resp.BulkString{S: []byte(command)},
+		name,
+		resp.Any{I: count},
+	}}, req.protocol).MarshalRESP(req.W)
+}
+
+// publish delivers the message to the local subscribers and to the rest of the cluster over the bus, standalone
+// master propagates it to its replicas
+func (req *RESPRequest) publish(shard bool) (interface{}, error) {
+	command := "publish"
+	if shard {
+		command = "spublish"
+	}
+
+	if len(req.Args.A) != 2 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", command)
+	}
+
+	args, err := stringArgs(req.Args.A)
+	if err != nil {
+		return nil, err
+	}
+
+	n := req.s.pubsub.publish(args[0], args[1], shard)
+	switch {
+	case req.s.cluster != nil:
+		req.s.cluster.Publish(args[0], args[1], shard)
+	case !req.Propagation && req.s.config.ReplicaOf() == "" && !req.s.config.PersistenceConfig.Loading.Load():
+		// snapshot of the full resync must match the replication offset
+		if req.multi == nil || !req.multi.locked {
+			req.s.writes.RLock()
+			defer req.s.writes.RUnlock()
+		}
+
+		cmd := resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte(strings.ToUpper(command))}, req.Args.A[0], req.Args.A[1]}}
+		req.s.PropagateToAll(-1, &cmd)
+	}
+
+	return n, nil
+}
+
+func HandleSubscribe(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	return req.subscribe(channelSubscription)
+}
+
+// HandlePSubscribe subscribes to all channels matching the glob-style patterns
+func HandlePSubscribe(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	return req.subscribe(patternSubscription)
+}
+
+// HandleSSubscribe subscribes to shard channels, in cluster mode their messages stay within the nodes serving
+// the slot of the channel
+func HandleSSubscribe(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	return req.subscribe(shardSubscription)
+}
+
+func HandleUnsubscribe(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	return req.unsubscribe(channelSubscription)
+}
+
+func HandlePUnsubscribe(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	return req.unsubscribe(patternSubscription)
+}
+
+func HandleSUnsubscribe(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	return req.unsubscribe(shardSubscription)
+}
+
+func HandlePublish(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	return req.publish(false)
+}
+
+func HandleSPublish(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	return req.publish(true)
+}
+
+// HandlePubsub handles PUBSUB subcommands introspecting the subscriptions of this node
+func HandlePubsub(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	args, err := stringArgs(req.Args.A)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'pubsub' command")
+	}
+
+	wrongArgs := fmt.Errorf("ERR wrong number of arguments for 'pubsub|%s' command", strings.ToLower(args[0]))
+	p := req.s.pubsub
+	switch sub := strings.ToUpper(args[0]); sub {
+	case "CHANNELS", "SHARDCHANNELS":
+		if len(args) > 2 {
+			return nil, wrongArgs
+		}
+
+		kind, pattern := channelSubscription, ""
+		if sub == "SHARDCHANNELS" {
+			kind = shardSubscription
+		}
+
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+
+		names := p.names(kind, pattern)
+		arr := resp.Array{A: make([]resp.Marshaller, 0, len(names))}
+		for _, name := range names {
+			arr.Append(resp.BulkString{S: []byte(name)})
+		}
+
+		return arr, nil
+	case "NUMSUB", "SHARDNUMSUB":
+		kind := channelSubscription
+		if sub == "SHARDNUMSUB" {
+			kind = shardSubscription
+		}
+
+		arr := resp.Array{A: make([]resp.Marshaller, 0, 2*(len(args)-1))}
+		for _, name := range args[1:] {
+			arr.Append(resp.BulkString{S: []byte(name)})
+			arr.Append(resp.Any{I: p.numsub(kind, name)})
+		}
+
+		return arr, nil
+	case "NUMPAT":
+		if len(args) != 1 {
+			return nil, wrongArgs
+		}
+
+		return len(p.names(patternSubscription, "")), nil
+	}
+
+	return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[0])
+}
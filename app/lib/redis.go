@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/cluster"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/replication"
 	"github.com/codecrafters-io/redis-starter-go/app/utils"
 	"log"
@@ -14,6 +16,7 @@ import (
 	"path"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,10 +25,31 @@ var (
 
 	// TODO: add mutex to propagation
 	PROPAGATION_CONSUMERS = 1
+
+	// delays between attempts to reconnect to the master
+	REPL_MIN_BACKOFF = 100 * time.Millisecond
+	REPL_MAX_BACKOFF = 10 * time.Second
+
+	// delay between attempts to send GETACK requested by WAIT while a write is being propagated
+	GETACK_RETRY = 10 * time.Millisecond
+
+	// period of the cycle deleting expired keys nobody accesses and the time it may spend on every run
+	ACTIVE_EXPIRE_PERIOD = 100 * time.Millisecond
+	ACTIVE_EXPIRE_BUDGET = 25 * time.Millisecond
 )
 
 type RedisServer struct {
-	mu       *sync.RWMutex
+	mu *sync.RWMutex
+	// writes is held by write commands from the execution to the propagation, so replicas and the AOF receive
+	// them in the order of the execution and full resync takes snapshot that matches the replication offset.
+	// It is held for reading by everything else propagated to replicas
+	writes *sync.RWMutex
+	// exec is held for reading by commands accessing the dataset and for writing by EXEC, so transactions
+	// are not interleaved with commands of other clients
+	exec *sync.RWMutex
+	// role is held while the master of the server is changed, so REPLICAOF, FAILOVER and the cluster
+	// change it one by one
+	role     *sync.Mutex
 	logger   *log.Logger
 	listener net.Listener
 	close    chan struct{}
@@ -35,8 +59,28 @@ type RedisServer struct {
 	// map[int]*storage.RedisDataTypes
 	db          *sync.Map
 	propagation chan *replication.REPLRequest
-	replicaOf   *replication.ReplicaOf
 	slaves      []*replication.Slave
+	aof         *persistence.Aof
+	saves       *sync.WaitGroup
+	// index of the db selected by the last propagated command, replicas start with db 0 after full resync
+	replDb int
+	// closed to stop reconnecting to the master
+	replStop  chan struct{}
+	consumers *sync.Once
+	// replHistory is set when replication id and offset of the replica belong to its master
+	replHistory bool
+	// blocked WAITs, resolved by ACKs of the replicas
+	waiters []*waiter
+	acks    chan struct{}
+	// set when WAIT needs fresh offsets of the replicas
+	getAck bool
+	// closed by FAILOVER ABORT
+	failoverAbort chan struct{}
+	// nil unless cluster mode is enabled
+	cluster *cluster.Cluster
+	pubsub  *pubsub
+	// last id given to the client connection
+	clientID atomic.Int64
 }
 
 func New(config *ServerConfig, router *Router) (*RedisServer, error) {
@@ -45,10 +89,8 @@ func New(config *ServerConfig, router *Router) (*RedisServer, error) {
 	}
 
 	logger := log.New(os.Stdout, fmt.Sprintf("master %d: ", config.Port), log.Lmicroseconds|log.Lshortfile)
-	var propagation chan *replication.REPLRequest = nil
-	if config.ReplicaOf != "" {
+	if config.ReplicaOf() != "" {
 		logger.SetPrefix("slave")
-		propagation = make(chan *replication.REPLRequest, 100)
 	}
 
 	replID := bytes.NewBuffer(make([]byte, 0, 40))
@@ -62,6 +104,9 @@ func New(config *ServerConfig, router *Router) (*RedisServer, error) {
 	db := sync.Map{}
 	s := RedisServer{
 		mu:          &sync.RWMutex{},
+		writes:      &sync.RWMutex{},
+		exec:        &sync.RWMutex{},
+		role:        &sync.Mutex{},
 		logger:      logger,
 		listener:    listener,
 		router:      router,
@@ -69,9 +114,48 @@ func New(config *ServerConfig, router *Router) (*RedisServer, error) {
 		close:       make(chan struct{}),
 		slaves:      make([]*replication.Slave, 0, 4),
 		config:      config,
-		propagation: propagation,
+		propagation: make(chan *replication.REPLRequest, 100),
+		consumers:   &sync.Once{},
+		saves:       &sync.WaitGroup{},
+		acks:        make(chan struct{}, 1),
+		pubsub:      newPubsub(),
+	}
+	if config.ClusterConfig != nil && config.ClusterConfig.Enabled {
+		s.cluster = cluster.New(config.ClusterConfig, config.Port)
+		if err = s.cluster.Load(); err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		// replica restored from the cluster config connects its master like the configured one
+		if addr := s.cluster.MasterAddr(); addr != "" {
+			config.SetReplicaOf(addr)
+		}
+	}
+
+	config.PersistenceConfig.RdbLastBgsaveStatus.Store(true)
+	if config.PersistenceConfig.AppendOnly {
+		// append only file is always more up to date than the snapshot, so rdb is not read
+		if err = s.loadAof(); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	} else {
+		s.loadDb()
+	}
+
+	replConfig := config.ReplicationConfig
+	replConfig.Backlog = replication.NewBacklog(replConfig.ReplBacklogSize, replConfig.MasterReplOffset.Load()+1)
+	if s.cluster != nil {
+		if err = s.cluster.Start(config.Host, clusterReplication{&s}); err != nil {
+			listener.Close()
+			return nil, err
+		}
 	}
-	s.loadDb()
+
+	go s.pingReplicas()
+	go s.waitersLoop()
+	go s.activeExpireCycle()
 	return &s, nil
 }
 
@@ -108,6 +192,8 @@ func (s *RedisServer) loadDb() {
 			fmt.Printf("Failed to unmarshal rdb: %s", err)
 			os.Exit(1)
 		}
+
+		s.restoreReplicationState(s.rdb.Metadata())
 	}
 
 }
@@ -138,7 +224,35 @@ func (s *RedisServer) ListenAndServe() error {
 }
 
 func (s *RedisServer) Close() error {
+	select {
+	case <-s.close:
+		return nil
+	default:
+	}
+
 	s.logger.Println("Closing server")
 	close(s.close)
+	if s.cluster != nil {
+		s.cluster.Close()
+	}
+
+	s.mu.Lock()
+	for _, slave := range s.slaves {
+		slave.Close()
+	}
+	s.mu.Unlock()
+	s.saves.Wait()
+	if s.config.PersistenceConfig.Save && s.rdbConfigured() {
+		if err := s.Save(); err != nil {
+			s.logger.Printf("Error saving rdb on shutdown: %s", err)
+		}
+	}
+
+	if s.aof != nil {
+		if err := s.aof.Close(); err != nil {
+			s.logger.Printf("Error closing AOF: %s", err)
+		}
+	}
+
 	return s.listener.Close()
 }
@@ -1,32 +1,59 @@
 package lib
 
 import (
-	"bytes"
 	"context"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"strings"
 )
 
+// ReplWrapper propagates successfully executed write commands to replicas
 type ReplWrapper struct {
 	Next Handler
 }
 
 func (h ReplWrapper) HandleResp(ctx context.Context, req *RESPRequest) (interface{}, error) {
-	args := resp.Array{A: make([]resp.Marshaller, len(req.Args.A))}
-	copy(args.A, req.Args.A)
+	// stream of the master is forwarded by the consumer, which holds the lock as well
+	if req.Propagation {
+		return h.Next.HandleResp(ctx, req)
+	}
+
+	// writes are executed, logged and propagated one by one, so replicas and the AOF apply them in the order
+	// they were executed, EXEC holds the lock for the whole transaction
+	if req.multi == nil || !req.multi.locked {
+		req.s.writes.Lock()
+		defer req.s.writes.Unlock()
+	}
+
+	// server could be turned into replica while the write was paused by FAILOVER, writes of clients
+	// of writable replica are local
+	if req.s.config.ReplicaOf() != "" {
+		if err := req.s.rejectCommand(CMD_WRITE); err != nil && !req.s.config.PersistenceConfig.Loading.Load() {
+			return nil, err
+		}
+
+		return h.Next.HandleResp(ctx, req)
+	}
+
 	// Need to check if write was successful before propagating
 	res, err := h.Next.HandleResp(ctx, req)
-	if err != nil {
-		return nil, err
+	if err != nil || req.skipPropagation {
+		return res, err
 	}
-	buff := bytes.NewBuffer(make([]byte, 0, 1024))
-	arr := resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("SET")}}}
-	arr.AppendArray(&args)
-	arr.MarshalRESP(buff)
-	req.Logger.Printf("propagation %q", buff)
-	req.s.PropagateToAll(buff.Bytes())
-	if !req.Propagation {
-		req.s.config.ReplicationConfig.MasterReplOffset.Add(uint64(len(buff.Bytes())))
+
+	// commands replayed from the AOF on startup are already known to the replicas
+	if req.s.config.PersistenceConfig.Loading.Load() {
+		return res, nil
+	}
+
+	// handlers rewrite their arguments to make the effect deterministic, so they are copied after the execution
+	cmd := resp.Array{A: make([]resp.Marshaller, 0, len(req.Args.A)+1)}
+	cmd.Append(resp.BulkString{S: []byte(strings.ToUpper(req.Command))})
+	cmd.A = append(cmd.A, req.Args.A...)
+	if t := req.multi; t != nil && !t.replicated {
+		req.s.PropagateToAll(req.Db.Index(), &multiCommand)
+		t.replicated = true
 	}
 
+	req.s.PropagateToAll(req.Db.Index(), &cmd)
 	return res, nil
 }
@@ -6,7 +6,6 @@ import (
 	"context"
 	"fmt"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
-	"github.com/codecrafters-io/redis-starter-go/app/lib/replication"
 	"log"
 )
 
@@ -18,8 +17,14 @@ func HandleReplicationConf(ctx context.Context, req *RESPRequest) (interface{},
 			if len(req.Args.A) < 2 {
 				return nil, fmt.Errorf("ERR wrong number of arguments for command")
 			}
-			log.Printf("Adding replica on port %s", req.Args.A[1].(resp.BulkString).S)
-			req.s.slaves = append(req.s.slaves, replication.NewReplica(req.conn, fmt.Sprint(len(req.s.slaves))))
+			port, ok := req.Args.A[1].(resp.BulkString)
+			if !ok {
+				return nil, fmt.Errorf("ERR invalid port type")
+			}
+
+			// replica is registered after PSYNC, when it is known from which offset to stream
+			log.Printf("Replica listening on port %s", port.S)
+			req.listeningPort = string(port.S)
 			return "OK", nil
 		case "capa", "CAPA":
 			return "OK", nil
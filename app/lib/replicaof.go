@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+	"strconv"
+	"strings"
+)
+
+// HandleReplicaOf makes the server replica of another master, REPLICAOF NO ONE turns replica into master
+func HandleReplicaOf(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) != 2 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'replicaof' command")
+	}
+
+	if req.s.cluster != nil {
+		return nil, fmt.Errorf("ERR REPLICAOF not allowed in cluster mode.")
+	}
+
+	host, okHost := req.Args.A[0].(resp.BulkString)
+	port, okPort := req.Args.A[1].(resp.BulkString)
+	if !okHost || !okPort {
+		return nil, fmt.Errorf("ERR syntax error")
+	}
+
+	req.s.role.Lock()
+	defer req.s.role.Unlock()
+	if strings.EqualFold(string(host.S), "no") && strings.EqualFold(string(port.S), "one") {
+		if req.s.config.ReplicaOf() != "" {
+			req.s.promote()
+		}
+
+		return "OK", nil
+	}
+
+	if _, err := strconv.ParseUint(string(port.S), 10, 16); err != nil {
+		return nil, fmt.Errorf("ERR Invalid master port")
+	}
+
+	addr := string(host.S) + ":" + string(port.S)
+	if addr == req.s.config.ReplicaOf() {
+		return "OK Already connected to specified master", nil
+	}
+
+	req.s.stopReplication()
+	req.s.config.SetReplicaOf(addr)
+	go req.s.startReplication(addr, false)
+	return "OK", nil
+}
+
+// promote stops replication and starts new replication history, replicas of the old master are able
+// to continue partially as the old history is kept as the secondary one, must be called with s.role held
+func (s *RedisServer) promote() {
+	s.stopReplication()
+	replID := bytes.NewBuffer(make([]byte, 0, 40))
+	utils.RandomAlphanumericString(replID, 40)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.SetReplicaOf("")
+	s.config.ReplicationConfig.Role = "master"
+	s.config.ReplicationConfig.ShiftReplid(replID.String())
+	// sub-replicas reconnect to learn the new id, stream continues without assumption about selected db
+	s.dropSlaves()
+	s.replDb = -1
+	s.logger.Printf("Promoted to master with replication id %s", replID)
+}
+
+// rejectCommand returns error when command of normal client can not be executed in the current server state,
+// the replication link and the AOF are not checked
+func (s *RedisServer) rejectCommand(flags CommandFlags) error {
+	if flags&CMD_WRITE != 0 && s.config.ReplicaOf() != "" && s.config.ReplicationConfig.ReplicaReadOnly {
+		return fmt.Errorf("READONLY You can't write against a read only replica.")
+	}
+
+	config := s.config.ReplicationConfig
+	if flags&CMD_WRITE != 0 && s.config.ReplicaOf() == "" && config.MinReplicasToWrite > 0 &&
+		config.GoodSlaves() < config.MinReplicasToWrite {
+		return fmt.Errorf("NOREPLICAS Not enough good replicas to write.")
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package replication
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Backlog keeps the tail of the replication stream in a circular buffer, so replicas that lost connection
+// are able to continue from their offset instead of loading the whole dataset
+type Backlog struct {
+	mu  sync.RWMutex
+	buf []byte
+	// next write position in buf
+	idx     int
+	histlen int
+	// replication offset of the first byte in the backlog
+	offset uint64
+}
+
+// NewBacklog creates empty backlog whose first byte is going to be at offset, i.e. master_repl_offset + 1
+func NewBacklog(size int, offset uint64) *Backlog {
+	return &Backlog{
+		buf:    make([]byte, size),
+		offset: offset,
+	}
+}
+
+func (b *Backlog) Feed(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	size := len(b.buf)
+	end := b.offset + uint64(b.histlen) + uint64(len(p))
+	b.histlen += len(p)
+	if b.histlen > size {
+		b.histlen = size
+	}
+
+	b.offset = end - uint64(b.histlen)
+	if len(p) > size {
+		// only the last size bytes fit
+		b.idx = (b.idx + len(p) - size) % size
+		p = p[len(p)-size:]
+	}
+
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % size
+		p = p[n:]
+	}
+}
+
+// Range returns content of the backlog starting at offset, false if the offset is not in the backlog
+func (b *Backlog) Range(offset uint64) ([]byte, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if offset < b.offset || offset > b.offset+uint64(b.histlen) {
+		return nil, false
+	}
+
+	skip := int(offset - b.offset)
+	n := b.histlen - skip
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	out := make([]byte, 0, n)
+	if start+n <= len(b.buf) {
+		return append(out, b.buf[start:start+n]...), true
+	}
+
+	out = append(out, b.buf[start:]...)
+	return append(out, b.buf[:n-(len(b.buf)-start)]...), true
+}
+
+// Reset drops the content, used when replication history changes, e.g. replica loaded a new dataset
+func (b *Backlog) Reset(offset uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.idx, b.histlen, b.offset = 0, 0, offset
+}
+
+func (b *Backlog) First() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.offset
+}
+
+func (b *Backlog) Histlen() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.histlen
+}
+
+func (b *Backlog) Size() int {
+	return len(b.buf)
+}
+
+// String keeps logs of INFO replies readable, the buffer itself is not printed
+func (b *Backlog) String() string {
+	return fmt.Sprintf("backlog first:%d histlen:%d size:%d", b.First(), b.Histlen(), b.Size())
+}
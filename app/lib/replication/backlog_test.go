@@ -0,0 +1,41 @@
+package replication
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBacklog(t *testing.T) {
+	b := NewBacklog(8, 101)
+	if got, ok := b.Range(101); !ok || len(got) != 0 {
+		t.Errorf("expected empty range at the next offset, got %q %t", got, ok)
+	}
+
+	b.Feed([]byte("abcde"))
+	if got, ok := b.Range(103); !ok || !bytes.Equal(got, []byte("cde")) {
+		t.Errorf("expected cde, got %q %t", got, ok)
+	}
+
+	// wraps around dropping the first 4 bytes
+	b.Feed([]byte("fghijkl"))
+	if b.First() != 105 || b.Histlen() != 8 {
+		t.Errorf("expected backlog to start at 105 with 8 bytes, got %d %d", b.First(), b.Histlen())
+	}
+
+	if _, ok := b.Range(104); ok {
+		t.Errorf("expected offset 104 to be out of the backlog")
+	}
+
+	if got, ok := b.Range(105); !ok || !bytes.Equal(got, []byte("efghijkl")) {
+		t.Errorf("expected efghijkl, got %q %t", got, ok)
+	}
+
+	if _, ok := b.Range(114); ok {
+		t.Errorf("expected offset after the end to be out of the backlog")
+	}
+
+	b.Feed([]byte("0123456789"))
+	if got, ok := b.Range(b.First()); !ok || !bytes.Equal(got, []byte("23456789")) || b.First() != 115 {
+		t.Errorf("expected 23456789 at 115, got %q at %d", got, b.First())
+	}
+}
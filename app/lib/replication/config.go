@@ -5,25 +5,118 @@ import (
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
 	"io"
 	"log"
+	"net"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
+// FailoverState is the progress of coordinated failover started with FAILOVER
+type FailoverState int32
+
+const (
+	FAILOVER_NONE FailoverState = iota
+	FAILOVER_WAIT_FOR_SYNC
+	FAILOVER_IN_PROGRESS
+)
+
+func (s FailoverState) String() string {
+	switch s {
+	case FAILOVER_WAIT_FOR_SYNC:
+		return "waiting-for-sync"
+	case FAILOVER_IN_PROGRESS:
+		return "failover-in-progress"
+	}
+
+	return "no-failover"
+}
+
 type ReplicationConfig struct {
-	Role               string
-	ConnectedSlaves    atomic.Uint64
-	MasterReplid       string
-	MasterReplOffset   atomic.Uint64
-	SecondReplOffset   atomic.Uint64
-	ReplBacklogActive  int
-	ReplBacklogSize    int
-	ReplBacklogFirst   int
-	ReplBacklogHistlen int
+	Role             string
+	ConnectedSlaves  atomic.Uint64
+	MasterReplid     string
+	MasterReplOffset atomic.Uint64
+	// MasterReplid2 is the replication id of the previous master, replicas of it are able to continue
+	// replication until SecondReplOffset
+	MasterReplid2    string
+	SecondReplOffset atomic.Uint64
+	ReplBacklogSize  int
+	Backlog          *Backlog
+	// ReplDisklessSync streams rdb directly to the replica socket instead of writing it to disk first
+	ReplDisklessSync bool
+	// ReplicaReadOnly rejects write commands of normal clients on replica
+	ReplicaReadOnly bool
+	// ReplPingReplicaPeriod is the interval of PINGs sent by master to its replicas
+	ReplPingReplicaPeriod time.Duration
+	// ReplTimeout is the time after which link without any traffic is considered down
+	ReplTimeout time.Duration
+	// MinReplicasToWrite is the number of replicas with ACK lag up to MinReplicasMaxLag required to accept
+	// writes, 0 disables the check
+	MinReplicasToWrite int
+	MinReplicasMaxLag  time.Duration
+	// ReplicaPriority is used by sentinel to pick the replica to promote, lower is preferred, 0 is never promoted
+	ReplicaPriority int
+	// Master is the current link of the replica, nil for master
+	Master   atomic.Pointer[ReplicaOf]
+	Failover atomic.Int32
+	slaves   atomic.Pointer[[]*Slave]
+}
+
+// Slaves returns replicas connected when INFO was last updated
+func (r *ReplicationConfig) Slaves() []*Slave {
+	if s := r.slaves.Load(); s != nil {
+		return *s
+	}
+
+	return nil
+}
+
+// SetSlaves publishes connected replicas reported by INFO
+func (r *ReplicationConfig) SetSlaves(slaves []*Slave) {
+	s := append([]*Slave(nil), slaves...)
+	r.slaves.Store(&s)
+}
+
+// GoodSlaves returns the number of online replicas that sent ACK within MinReplicasMaxLag
+func (r *ReplicationConfig) GoodSlaves() int {
+	n := 0
+	for _, slave := range r.Slaves() {
+		if slave.Online() && slave.Lag() <= r.MinReplicasMaxLag {
+			n++
+		}
+	}
+
+	return n
+}
+
+// ShiftReplid starts new replication history, e.g. after replica is promoted, keeping the current one as secondary
+func (r *ReplicationConfig) ShiftReplid(id string) {
+	r.MasterReplid2 = r.MasterReplid
+	r.SecondReplOffset.Store(r.MasterReplOffset.Load() + 1)
+	r.MasterReplid = id
+}
+
+// CanContinue reports whether replica that has replication history up to offset - 1 of the replid
+// is able to continue from the backlog
+func (r *ReplicationConfig) CanContinue(replid string, offset uint64) bool {
+	if r.Backlog == nil {
+		return false
+	}
+
+	if replid != r.MasterReplid && (replid != r.MasterReplid2 || offset > r.SecondReplOffset.Load()) {
+		return false
+	}
+
+	_, ok := r.Backlog.Range(offset)
+	return ok
 }
 
 func (r *ReplicationConfig) MarshalRESP(w io.Writer) (int, error) {
-	const format = `role:%s
-					connected_slaves:%d
+	const format = `role:%s%s
+					master_failover_state:%s
+					connected_slaves:%d%s
 					master_replid:%s
+					master_replid2:%s
 					master_repl_offset:%d
 					second_repl_offset:%d
 					repl_backlog_active:%d
@@ -31,15 +124,66 @@ func (r *ReplicationConfig) MarshalRESP(w io.Writer) (int, error) {
 					repl_backlog_first_byte_offset:%d
 					repl_backlog_histlen:%d`
 	log.Printf("Role %s", r.Role)
+	var (
+		active, histlen int
+		first           uint64
+		replid2         = r.MasterReplid2
+		secondOffset    = int64(-1)
+	)
+
+	if r.Backlog != nil {
+		active, first, histlen = 1, r.Backlog.First(), r.Backlog.Histlen()
+	}
+
+	if replid2 == "" {
+		replid2 = strings.Repeat("0", 40)
+	} else {
+		secondOffset = int64(r.SecondReplOffset.Load())
+	}
+
+	var slaves strings.Builder
+	for i, slave := range r.Slaves() {
+		fmt.Fprintf(&slaves, "\nslave%d:%s", i, slave.Info())
+	}
+
+	if r.MinReplicasToWrite > 0 {
+		fmt.Fprintf(&slaves, "\nmin_slaves_good_slaves:%d", r.GoodSlaves())
+	}
+
 	return resp.BulkString{S: []byte(fmt.Sprintf(format,
 		r.Role,
+		r.masterInfo(),
+		FailoverState(r.Failover.Load()),
 		r.ConnectedSlaves.Load(),
+		slaves.String(),
 		r.MasterReplid,
+		replid2,
 		r.MasterReplOffset.Load(),
-		-1,
-		r.ReplBacklogActive,
+		secondOffset,
+		active,
 		r.ReplBacklogSize,
-		r.ReplBacklogFirst,
-		r.ReplBacklogHistlen,
+		first,
+		histlen,
 	))}.MarshalRESP(w)
 }
+
+func (r *ReplicationConfig) masterInfo() string {
+	link := r.Master.Load()
+	if link == nil {
+		return ""
+	}
+
+	host, port, _ := net.SplitHostPort(link.Host())
+	status, lastIo := "down", int64(-1)
+	if link.State() == REPL_STATE_CONNECTED {
+		status, lastIo = "up", int64(time.Since(link.LastIo()).Seconds())
+	}
+
+	syncing := 0
+	if link.State() == REPL_STATE_TRANSFER {
+		syncing = 1
+	}
+
+	return fmt.Sprintf("\nmaster_host:%s\nmaster_port:%s\nmaster_link_status:%s\nmaster_last_io_seconds_ago:%d\nmaster_sync_in_progress:%d\nslave_priority:%d",
+		host, port, status, lastIo, syncing, r.ReplicaPriority)
+}
@@ -4,78 +4,246 @@ import (
 	"bufio"
 	"fmt"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// LinkState is the state of the replica connection to its master
+type LinkState int32
+
+const (
+	REPL_STATE_CONNECT LinkState = iota
+	REPL_STATE_CONNECTING
+	REPL_STATE_HANDSHAKE
+	REPL_STATE_TRANSFER
+	REPL_STATE_CONNECTED
+)
+
+func (s LinkState) String() string {
+	switch s {
+	case REPL_STATE_CONNECTING:
+		return "connecting"
+	case REPL_STATE_HANDSHAKE:
+		return "handshake"
+	case REPL_STATE_TRANSFER:
+		return "transfer"
+	case REPL_STATE_CONNECTED:
+		return "connected"
+	}
+
+	return "connect"
+}
+
+// HANDSHAKE_TIMEOUT limits every read and write before the link is connected, including the rdb transfer
+var HANDSHAKE_TIMEOUT = 60 * time.Second
+
+// ReplicaOf is a single connection to the master, once it is closed a new one has to be created to reconnect
 type ReplicaOf struct {
 	logger      *log.Logger
 	r           *bufio.Reader
+	rec         *recorder
 	conn        net.Conn
+	host        string
+	port        string
 	propagation chan<- *REPLRequest
 	db          *sync.Map
+	state       atomic.Int32
+	// unix time of the last read from the master
+	lastIo atomic.Int64
+	done   chan struct{}
+	// closed is guarded by mu, no command is added to inflight once the link is closed
+	mu     sync.Mutex
+	closed bool
+	// commands read from the master and not yet applied
+	inflight sync.WaitGroup
+	// ACKs and GETACK replies are written from different goroutines
+	wmu sync.Mutex
+	// FullResync is set when master sent the dataset, otherwise replication continues from the requested offset
+	FullResync bool
+	// Replid and Offset are replication id and offset reported by the master, Replid is empty on +CONTINUE
+	// without new id
+	Replid string
+	Offset uint64
+	// Failover asks the master, which has to be our replica, to promote itself during the handshake
+	Failover bool
 }
 
 type REPLRequest struct {
 	Logger *log.Logger
 	Writer io.Writer
 	Args   *resp.Array
-	// Length in bytes of the Args array read from the reader
-	N int
+	// Raw is the Args array exactly as it was sent by the master
+	Raw []byte
+	// Link the request was read from, Applied has to be called once request is executed
+	Link *ReplicaOf
 }
 
 func (r *ReplicaOf) GetAddr() net.Addr {
 	return r.conn.RemoteAddr()
 }
 
-// NewReplicaOf create replica of host by making a handshake sending listening port - port
-func NewReplicaOf(db *sync.Map, host, port string, propagation chan<- *REPLRequest) (*ReplicaOf, error) {
-	conn, err := net.DialTimeout("tcp", host, time.Second*10)
-	if err != nil {
-		return nil, err
-	}
-	logger := log.New(os.Stdout, fmt.Sprintf("replica %s of %s: ", port, host), log.LstdFlags|log.Lshortfile)
-	logger.Printf("Connected to master %s", conn.RemoteAddr())
-	repl := &ReplicaOf{
-		logger:      logger,
-		conn:        conn,
-		r:           bufio.NewReader(conn),
+// NewReplicaOf creates replica link to master at host, port is the listening port sent during the handshake
+func NewReplicaOf(db *sync.Map, host, port string, propagation chan<- *REPLRequest) *ReplicaOf {
+	return &ReplicaOf{
+		logger:      log.New(os.Stdout, fmt.Sprintf("replica %s of %s: ", port, host), log.LstdFlags|log.Lshortfile),
+		host:        host,
+		port:        port,
 		db:          db,
 		propagation: propagation,
+		done:        make(chan struct{}),
 	}
+}
 
-	logger.Printf("Stage 1: PING")
-	if err = repl.pingMaster(); err != nil {
-		return nil, err
+// Connect makes a handshake, replid and offset are used to ask for partial resynchronization, "?" and -1
+// request full one. Commands are not read until ListenAndAccept is called
+func (r *ReplicaOf) Connect(replid string, offset int64) (err error) {
+	defer func() {
+		if err != nil {
+			r.Close()
+		}
+	}()
+
+	r.state.Store(int32(REPL_STATE_CONNECTING))
+	conn, err := net.DialTimeout("tcp", r.host, time.Second*10)
+	if err != nil {
+		return err
 	}
-	logger.Printf("Stage 2: PORT")
-	if err = repl.replConfPort(port); err != nil {
-		return nil, err
+
+	// replication may be stopped while dialing, Close reads the connection under the lock
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		conn.Close()
+		return fmt.Errorf("replication of %s was stopped", r.host)
 	}
-	logger.Printf("Stage 3: CAPA")
-	if err = repl.replConfCapa(); err != nil {
-		return nil, err
+
+	r.conn = conn
+	r.mu.Unlock()
+
+	r.rec = &recorder{r: r.conn}
+	r.r = bufio.NewReader(r.rec)
+	r.logger.Printf("Connected to master %s", r.conn.RemoteAddr())
+	if err = r.conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT)); err != nil {
+		return err
 	}
-	logger.Printf("Stage 4: PSYNC")
-	if err = repl.pSync(); err != nil {
-		return nil, err
+
+	r.state.Store(int32(REPL_STATE_HANDSHAKE))
+	r.logger.Printf("Stage 1: PING")
+	if err = r.pingMaster(); err != nil {
+		return err
 	}
-	logger.Printf("Stage 5: Reading RDB")
-	if _, err = repl.ReadRDB(); err != nil {
-		logger.Printf("Error reading RDB: %s", err)
-		return nil, err
+	r.logger.Printf("Stage 2: PORT")
+	if err = r.replConfPort(r.port); err != nil {
+		return err
+	}
+	r.logger.Printf("Stage 3: CAPA")
+	if err = r.replConfCapa(); err != nil {
+		return err
+	}
+	r.logger.Printf("Stage 4: PSYNC")
+	if err = r.pSync(replid, offset); err != nil {
+		return err
+	}
+
+	if r.FullResync {
+		r.state.Store(int32(REPL_STATE_TRANSFER))
+		r.logger.Printf("Stage 5: Reading RDB")
+		if _, err = r.ReadRDB(); err != nil {
+			r.logger.Printf("Error reading RDB: %s", err)
+			return err
+		}
+	}
+
+	if err = r.conn.SetDeadline(time.Time{}); err != nil {
+		return err
 	}
 
-	logger.Printf("Stage 6: Listening for propagation")
-	go repl.ListenAndAccept()
-	return repl, nil
+	// commands are read after the handshake and the rdb
+	r.rec.take(r.r.Buffered())
+	r.lastIo.Store(time.Now().Unix())
+	r.state.Store(int32(REPL_STATE_CONNECTED))
+	return nil
+}
+
+// Close drops the connection, Done is closed afterwards
+func (r *ReplicaOf) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	if r.conn != nil {
+		r.conn.Close()
+	}
+
+	r.closed = true
+	r.state.Store(int32(REPL_STATE_CONNECT))
+	close(r.done)
+}
+
+func (r *ReplicaOf) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *ReplicaOf) State() LinkState {
+	return LinkState(r.state.Load())
+}
+
+func (r *ReplicaOf) Host() string {
+	return r.host
+}
+
+func (r *ReplicaOf) LastIo() time.Time {
+	return time.Unix(r.lastIo.Load(), 0)
+}
+
+// Write sends b to the master, used to reply to REPLCONF GETACK
+func (r *ReplicaOf) Write(b []byte) (int, error) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+	return r.conn.Write(b)
+}
+
+// Ack reports offset processed by the replica to the master
+func (r *ReplicaOf) Ack(offset uint64) error {
+	_, err := (resp.Array{A: []resp.Marshaller{
+		resp.BulkString{S: []byte("REPLCONF")},
+		resp.BulkString{S: []byte("ACK")},
+		resp.BulkString{S: []byte(strconv.FormatUint(offset, 10))},
+	}}).MarshalRESP(r)
+	return err
+}
+
+func (r *ReplicaOf) Applied() {
+	r.inflight.Done()
+}
+
+// WaitApplied blocks until every command read from the master is executed, so the replication offset
+// accounts for the whole stream, link has to be closed
+func (r *ReplicaOf) WaitApplied() {
+	r.inflight.Wait()
 }
 
 func (r *ReplicaOf) ReadRDB() (*resp.Rdb, error) {
+	var err error
+	r.db.Range(func(_, v any) bool {
+		err = v.(*storage.RedisDataTypes).Flush()
+		return err == nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
 	rdb := resp.NewRdb(r.db)
 	if err := rdb.UnmarshalRESP(r.r); err != nil {
 		return nil, err
@@ -134,8 +302,13 @@ func (r *ReplicaOf) replConfCapa() error {
 	return nil
 }
 
-func (r *ReplicaOf) pSync() error {
-	if _, err := (resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("PSYNC")}, resp.BulkString{S: []byte("?")}, resp.BulkString{S: []byte("-1")}}}.MarshalRESP(r.conn)); err != nil {
+func (r *ReplicaOf) pSync(replid string, offset int64) error {
+	cmd := resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("PSYNC")}, resp.BulkString{S: []byte(replid)}, resp.BulkString{S: []byte(strconv.FormatInt(offset, 10))}}}
+	if r.Failover {
+		cmd.Append(resp.BulkString{S: []byte("FAILOVER")})
+	}
+
+	if _, err := cmd.MarshalRESP(r.conn); err != nil {
 		return err
 	}
 	res := resp.SimpleString{}
@@ -143,36 +316,82 @@ func (r *ReplicaOf) pSync() error {
 		return err
 	}
 	r.logger.Printf("Got PSYNC response: %s", res)
+	parts := strings.Fields(res.S)
+	switch {
+	case len(parts) == 3 && parts[0] == "FULLRESYNC":
+		n, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC offset %q", parts[2])
+		}
+
+		r.FullResync, r.Replid, r.Offset = true, parts[1], n
+	case len(parts) > 0 && parts[0] == "CONTINUE":
+		if len(parts) > 1 {
+			r.Replid = parts[1]
+		}
+	default:
+		return fmt.Errorf("unexpected PSYNC response %q", res.S)
+	}
+
 	return nil
 }
 
 func (r *ReplicaOf) ListenAndAccept() error {
 	r.logger.Printf("Listening for propagation from %s", r.conn.RemoteAddr())
+	defer r.Close()
 	for {
 		var (
 			args resp.Array
 			err  error
-			n    int
 		)
 
-		if n, err = args.UnmarshalRESP(r.r); err != nil && err != io.EOF {
+		if _, err = args.UnmarshalRESP(r.r); err != nil {
+			if err == io.EOF {
+				r.logger.Printf("Connection closed by %s", r.conn.RemoteAddr())
+				return nil
+			}
+
 			r.logger.Printf("Error reading request from master: %s", err)
-			continue
+			return err
 		}
 
-		r.logger.Printf("read %d, with %s bytes from %s", n, args, r.conn.RemoteAddr())
-		if err == io.EOF {
-			r.logger.Printf("Connection closed by %s", r.conn.RemoteAddr())
+		raw := r.rec.take(r.r.Buffered())
+		r.lastIo.Store(time.Now().Unix())
+		r.logger.Printf("read %d, with %s bytes from %s", len(raw), args, r.conn.RemoteAddr())
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
 			return nil
 		}
 
+		r.inflight.Add(1)
+		r.mu.Unlock()
 		r.propagation <- &REPLRequest{
-			Writer: r.conn,
+			Writer: r,
 			Args:   &args,
-			N:      n,
+			Raw:    raw,
 			Logger: r.logger,
+			Link:   r,
 		}
-
 	}
+}
+
+// recorder keeps bytes read from the connection until they are consumed by the reader above it
+type recorder struct {
+	r    io.Reader
+	buff []byte
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buff = append(r.buff, p[:n]...)
+	return n, err
+}
 
+// take returns bytes consumed since the previous call, buffered is the number of bytes read ahead
+func (r *recorder) take(buffered int) []byte {
+	n := len(r.buff) - buffered
+	consumed := append([]byte(nil), r.buff[:n]...)
+	r.buff = append(r.buff[:0], r.buff[n:]...)
+	return consumed
 }
@@ -8,16 +8,31 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	SLAVE_STATE_SEND_BULK = "send_bulk"
+	SLAVE_STATE_ONLINE    = "online"
+)
+
 type Slave struct {
 	conn   net.Conn
 	logger *log.Logger
 	mu     sync.Mutex
 	offset uint64
 	r      *bufio.Reader
+	// port the replica is listening on, reported by REPLCONF listening-port
+	port    string
+	state   string
+	ackTime time.Time
+	// notified without blocking on every ACK
+	acked chan<- struct{}
+	// while replica receives the rdb, propagated writes are kept in pending and sent once the transfer is done
+	syncing bool
+	pending []byte
 }
 
 func (r *Slave) GetAddr() net.Addr {
@@ -30,58 +45,125 @@ func (r *Slave) GetOffset() uint64 {
 	return r.offset
 }
 
-func NewReplica(conn net.Conn, i string) *Slave {
+// NewReplica creates slave of the replica connected with conn, r has to be the reader of the connection
+// used by the handshake, as it may have buffered data. acked is notified whenever replica reports its offset
+func NewReplica(conn net.Conn, r *bufio.Reader, port string, acked chan<- struct{}) *Slave {
 	return &Slave{
-		conn:   conn,
-		logger: log.New(os.Stdout, fmt.Sprintf("replication %s: ", i), log.Lmicroseconds|log.Lshortfile),
-		mu:     sync.Mutex{},
-		r:      bufio.NewReader(conn),
+		conn:    conn,
+		logger:  log.New(os.Stdout, fmt.Sprintf("replication %s: ", conn.RemoteAddr()), log.Lmicroseconds|log.Lshortfile),
+		mu:      sync.Mutex{},
+		r:       r,
+		port:    port,
+		state:   SLAVE_STATE_ONLINE,
+		ackTime: time.Now(),
+		acked:   acked,
 	}
 }
 
 func (r *Slave) Propagate(b []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if r.syncing {
+		r.pending = append(r.pending, b...)
+		return len(b), nil
+	}
+
 	return r.conn.Write(b)
 }
 
-func (r *Slave) GetAck(timeout time.Duration) (uint64, error) {
+func (r *Slave) Close() error {
+	return r.conn.Close()
+}
+
+// StartSync buffers propagated writes until EndSync
+func (r *Slave) StartSync() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.conn.SetDeadline(time.Now().Add(timeout))
-	defer func() {
-		r.conn.SetDeadline(time.Time{})
-		r.logger.Printf("Reset read deadline")
-	}()
-	if _, err := (&resp.Array{
-		A: []resp.Marshaller{
-			resp.BulkString{S: []byte("REPLCONF")},
-			resp.BulkString{S: []byte("GETACK")},
-			resp.BulkString{S: []byte("*")},
-		},
-	}).MarshalRESP(r.conn); err != nil {
-		return r.offset, fmt.Errorf("failed to send getack")
-	}
+	r.syncing = true
+	r.state = SLAVE_STATE_SEND_BULK
+}
 
-	offsetRes := resp.Array{}
-	if _, err := offsetRes.UnmarshalRESP(r.r); err != nil {
-		return r.offset, err
-	}
+// EndSync sends writes buffered during the rdb transfer
+func (r *Slave) EndSync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.syncing = false
+	r.state = SLAVE_STATE_ONLINE
+	r.ackTime = time.Now()
+	pending := r.pending
+	r.pending = nil
+	_, err := r.conn.Write(pending)
+	return err
+}
 
-	if len(offsetRes.A) < 3 {
-		return r.offset, fmt.Errorf("invalid offset response")
-	}
+// ReadAcks reads REPLCONF ACK sent by the replica until the connection is closed
+func (r *Slave) ReadAcks() error {
+	for {
+		cmd := resp.Array{}
+		if _, err := cmd.UnmarshalRESP(r.r); err != nil {
+			return err
+		}
+
+		if len(cmd.A) != 3 {
+			continue
+		}
+
+		name, _ := cmd.A[0].(resp.BulkString)
+		sub, _ := cmd.A[1].(resp.BulkString)
+		arg, _ := cmd.A[2].(resp.BulkString)
+		if !strings.EqualFold(string(name.S), "replconf") || !strings.EqualFold(string(sub.S), "ack") {
+			r.logger.Printf("Unexpected command from replica: %s", cmd)
+			continue
+		}
 
-	if v, ok := offsetRes.A[2].(resp.BulkString); ok {
-		offset, err := strconv.ParseInt(string(v.S), 10, 64)
+		offset, err := strconv.ParseUint(string(arg.S), 10, 64)
 		if err != nil {
-			return r.offset, err
+			r.logger.Printf("Invalid ack offset %q", arg.S)
+			continue
 		}
 
-		r.offset = uint64(offset)
-		r.logger.Printf("Got ack %d", r.offset)
-		return uint64(offset), nil
+		r.mu.Lock()
+		r.offset, r.ackTime = offset, time.Now()
+		r.mu.Unlock()
+		select {
+		case r.acked <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// IP is the address replica is connected from
+func (r *Slave) IP() string {
+	ip, _, _ := net.SplitHostPort(r.conn.RemoteAddr().String())
+	return ip
+}
+
+// Port is the port replica listens on
+func (r *Slave) Port() string {
+	return r.port
+}
+
+// Info returns replica line of INFO replication
+func (r *Slave) Info() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("ip=%s,port=%s,state=%s,offset=%d,lag=%d", r.IP(), r.port, r.state, r.offset, int64(time.Since(r.ackTime).Seconds()))
+}
+
+// Online reports whether replica finished the initial synchronization
+func (r *Slave) Online() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state == SLAVE_STATE_ONLINE
+}
+
+// Lag is the time since the last ACK of the replica, replica that is still loading the rdb is not lagging
+func (r *Slave) Lag() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.syncing {
+		return 0
 	}
 
-	return r.offset, fmt.Errorf("invalid offset response")
+	return time.Since(r.ackTime)
 }
@@ -7,13 +7,20 @@ import (
 	"fmt"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/storage"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
 	"io"
 	"log"
 	"net"
 	"os"
-	"reflect"
+	"strings"
 	"sync"
-	"time"
+)
+
+const (
+	// PROTO_INLINE_MAX_SIZE limits the length of the inline command, the connection sending longer one is closed
+	PROTO_INLINE_MAX_SIZE = 64 * 1024
+	// OUTPUT_BUFFER_SIZE is the size of the buffer replies to the pipelined commands are collected in
+	OUTPUT_BUFFER_SIZE = 16 * 1024
 )
 
 var loggerPool = sync.Pool{
@@ -42,19 +49,46 @@ type RESPRequest struct {
 	Db          *storage.RedisDataTypes
 	Config      *ServerConfig
 	Args        *resp.Array
+	Command     string
 	RemoteAddr  net.Addr
 	Propagation bool
+	// set by write handlers when command did not change the dataset, e.g. SET NX of existing key
+	skipPropagation bool
+	// port reported by replica with REPLCONF listening-port
+	listeningPort string
+	// set by ASKING for the next command
+	asking bool
+	// transaction started by MULTI and keys watched for it
+	multi   *transaction
+	watched []watchedKey
+	// set while the command holds the dataset lock for reading
+	locked bool
+	// set once the connection subscribes, writes of the connection go through it since then
+	sub *subscriber
+	// protocol version negotiated by HELLO, replies are converted to its types
+	protocol int
+	id       int64
+	name     string
+	// replies are buffered until all the pipelined commands read so far are executed
+	out *bufio.Writer
+	// arguments of the last command, the slice and the arguments are reused by the next one
+	commands resp.CommandReader
+	argv     []resp.Marshaller
 }
 
 func NewRequest(rwc net.Conn, s *RedisServer) *RESPRequest {
+	out := bufio.NewWriterSize(rwc, OUTPUT_BUFFER_SIZE)
 	req := &RESPRequest{
 		conn:       rwc,
 		RemoteAddr: rwc.RemoteAddr(),
-		W:          rwc,
+		W:          out,
+		out:        out,
 		r:          bufio.NewReader(rwc),
 		s:          s,
 		Config:     s.config,
 		Args:       &resp.Array{},
+		protocol:   resp.RESP2,
+		id:         s.clientID.Add(1),
 	}
 
 	logger, ok := loggerPool.Get().(*log.Logger)
@@ -72,6 +106,87 @@ func NewRequest(rwc net.Conn, s *RedisServer) *RESPRequest {
 	return req
 }
 
+// newInternalRequest creates request that is not bound to any connection, used to execute commands
+// read from the append only file
+func (s *RedisServer) newInternalRequest(w io.Writer) *RESPRequest {
+	req := &RESPRequest{
+		W:        w,
+		s:        s,
+		Config:   s.config,
+		Logger:   s.logger,
+		Args:     &resp.Array{},
+		protocol: resp.RESP2,
+	}
+
+	if err := req.SetDb(0); err != nil {
+		s.logger.Printf("unexpected error: %s", err)
+	}
+
+	return req
+}
+
+// RewriteCommand replaces the command logged to the AOF and propagated to replicas, so they reproduce
+// the exact effect of the execution, e.g. relative expire is sent as absolute one
+func (req *RESPRequest) RewriteCommand(name string, args ...resp.Marshaller) {
+	req.Command = strings.ToLower(name)
+	req.Args.A = args
+}
+
+// SkipPropagation marks that the write command did nothing, so it is neither logged nor propagated
+func (req *RESPRequest) SkipPropagation() {
+	req.skipPropagation = true
+}
+
+// call executes the command, commands accessing the dataset are not executed in the middle of a transaction,
+// bulk commands leave it to the commands they execute
+func (req *RESPRequest) call(ctx context.Context, handler Handler, flags CommandFlags, keys []string) (interface{}, error) {
+	if flags&(CMD_WRITE|CMD_READONLY) != 0 && flags&CMD_BULK == 0 {
+		req.s.exec.RLock()
+		req.locked = true
+		defer func() {
+			req.locked = false
+			req.s.exec.RUnlock()
+		}()
+
+		// keys expired on access are deleted before the command sees them
+		if len(keys) > 0 {
+			req.s.expireAccessed(req.Db, keys)
+		}
+	}
+
+	return handler.HandleResp(ctx, req)
+}
+
+// Block runs wait of the blocking command without holding the dataset lock, so the writes it waits for are
+// not blocked by a pending transaction
+func (req *RESPRequest) Block(wait func()) {
+	if req.locked {
+		req.s.exec.RUnlock()
+		defer req.s.exec.RLock()
+	}
+
+	// replies to the preceding pipelined commands are not held until the wait is over
+	if err := req.flush(); err != nil {
+		req.Logger.Printf("Failed to write to %s: %s", req.RemoteAddr, err)
+	}
+
+	wait()
+}
+
+// fail replies with the error, the error discards the transaction being queued
+func (req *RESPRequest) fail(err error) {
+	req.Logger.Printf("Reponde with error: %s", err)
+	resp.SimpleError{E: err.Error()}.MarshalRESP(req.W)
+	if req.multi != nil {
+		req.multi.aborted = true
+	}
+}
+
+// Protocol returns the RESP version of the connection, replies are converted to it after the handler returns
+func (req *RESPRequest) Protocol() int {
+	return req.protocol
+}
+
 func (req *RESPRequest) SetDb(idx int) error {
 	dbAny, _ := req.s.db.LoadOrStore(idx, storage.NewDb(idx))
 	db, ok := dbAny.(*storage.RedisDataTypes)
@@ -79,6 +194,7 @@ func (req *RESPRequest) SetDb(idx int) error {
 		return fmt.Errorf("unexpected error asserting new db type")
 	}
 
+	db.OnKeyEvent(req.s.keyEvent)
 	req.Db = db
 	return nil
 }
@@ -86,13 +202,14 @@ func (req *RESPRequest) SetDb(idx int) error {
 func (req *RESPRequest) Handle(router *Router) {
 	var (
 		ctx, cancel = context.WithCancel(context.Background())
-		start       time.Time
-		n           int
 		err         error
 	)
 
 	defer cancel()
 	defer loggerPool.Put(req.Logger)
+	defer req.unwatch()
+	defer req.unsubscribeAll()
+	defer req.flush()
 	defer func() {
 		if err := recover(); err != nil {
 			req.Logger.Printf("Reponde with error: %s", err)
@@ -100,9 +217,24 @@ func (req *RESPRequest) Handle(router *Router) {
 		}
 	}()
 	for {
-		start = time.Now()
-		req.Logger.Printf("Reading request from %s", req.RemoteAddr)
-		n, err = req.read(req.r)
+		if req.sub != nil {
+			req.sub.flush()
+		}
+
+		// replies to the pipelined commands are sent at once, when there is no command left in the read buffer
+		if req.r.Buffered() == 0 {
+			if err = req.flush(); err != nil {
+				req.Logger.Printf("Failed to write to %s: %s", req.RemoteAddr, err)
+				break
+			}
+		}
+
+		// arguments of the executed commands are not used anymore, unlike the ones queued by MULTI
+		if req.multi == nil {
+			req.commands.Release()
+		}
+
+		_, err = req.read(req.r)
 		if err == io.EOF {
 			req.Logger.Printf("Connection closed by %s", req.RemoteAddr)
 			break
@@ -113,31 +245,96 @@ func (req *RESPRequest) Handle(router *Router) {
 			break
 		}
 
-		req.Logger.Printf("read %d bytes from %s", n, req.RemoteAddr)
+		// e.g. slow subscriber dropped by the publisher
+		if errors.Is(err, net.ErrClosed) {
+			req.Logger.Printf("Connection of %s closed", req.RemoteAddr)
+			break
+		}
+
+		// connections of closed server are dropped, so clients like sentinel notice it is down
+		select {
+		case <-req.s.close:
+			req.Logger.Printf("Server closed, dropping connection from %s", req.RemoteAddr)
+			return
+		default:
+		}
+
+		if errors.Is(err, resp.ErrProtocol) {
+			req.fail(err)
+			return
+		}
+
 		if err != nil {
-			req.Logger.Printf("Reponde with error: %s", err)
-			resp.SimpleError{E: err.Error()}.MarshalRESP(req.W)
+			req.fail(err)
 			continue
 		}
-		req.Logger.Printf("Request: %s from %s", req.Args, req.RemoteAddr)
+
+		// e.g. empty line typed over telnet
+		if len(req.Args.A) == 0 {
+			continue
+		}
+
 		handler, err := router.ResolveRequest(req.Args)
 		if err != nil {
-			req.Logger.Printf("Reponde with error: %s", err)
-			resp.SimpleError{fmt.Sprintf("%s", err)}.MarshalRESP(req.W)
+			req.fail(err)
+			continue
+		}
+
+		req.Command, _ = router.getCommand(&req.Args.A)
+		req.skipPropagation = false
+		asking := req.asking
+		req.asking = false
+		keys := router.Keys(req.Command, req.Args.A)
+		// replicas of the cluster redirect to the master rather than reject writes
+		if req.s.cluster != nil {
+			if err = req.s.clusterRedirect(req, keys, asking || router.Flags(req.Command)&CMD_ASKING != 0); err != nil {
+				req.fail(err)
+				continue
+			}
+		}
+
+		if err = req.s.rejectCommand(router.Flags(req.Command)); err != nil {
+			req.fail(err)
+			continue
+		}
+
+		// RESP3 clients receive messages as pushes, so they keep executing any command
+		if req.Subscribed() && req.protocol == resp.RESP2 && !isPubsubCommand(req.Command) {
+			req.fail(fmt.Errorf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", req.Command))
 			continue
 		}
 
 		req.Args.A = req.Args.A[1:]
-		res, err := handler.HandleResp(ctx, req)
+		if req.multi != nil && !isTransactionCommand(req.Command) {
+			if err = req.queue(router, handler); err != nil {
+				req.fail(err)
+				continue
+			}
+
+			if _, err = (resp.SimpleString{S: "QUEUED"}).MarshalRESP(req.W); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		res, err := req.call(ctx, handler, router.Flags(req.Command), keys)
 		if err != nil {
 			req.Logger.Printf("Reponde with error: %s", err)
 			resp.SimpleError{E: err.Error()}.MarshalRESP(req.W)
 			continue
 		}
 
+		if req.closed {
+			return
+		}
+
+		if m, ok := res.(resp.Marshaller); ok {
+			res = resp.ForProtocol(m, req.protocol)
+		}
+
 		if res != nil {
-			req.Logger.Printf("Response: %s, type %s to %s in %s", res, reflect.TypeOf(res), req.RemoteAddr, time.Now().Sub(start))
-			if _, err = (resp.Any{I: res}.MarshalRESP(req.W)); err != nil {
+			if _, err = (resp.Any{I: res}).MarshalRESP(req.W); err != nil {
 				return
 			}
 		}
@@ -145,8 +342,61 @@ func (req *RESPRequest) Handle(router *Router) {
 }
 
 func (req *RESPRequest) read(r *bufio.Reader) (n int, err error) {
-	if n, err = req.Args.UnmarshalRESP(r); err != nil {
+	peeked, err := r.Peek(1)
+	if err != nil {
 		return n, err
 	}
+
+	if peeked[0] != resp.ArrayType[0] {
+		return req.readInline(r)
+	}
+
+	req.Args.A, n, err = req.commands.Read(r, req.argv[:0])
+	req.argv = req.Args.A
 	return n, err
 }
+
+// flush writes the buffered replies, commands flush before they block or hand the connection over
+func (req *RESPRequest) flush() error {
+	if req.out == nil {
+		return nil
+	}
+
+	return req.out.Flush()
+}
+
+// readInline reads the command sent as the line of space separated arguments, so the server can be used by
+// hand, e.g. over telnet
+func (req *RESPRequest) readInline(r *bufio.Reader) (int, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > PROTO_INLINE_MAX_SIZE {
+			return len(line), fmt.Errorf("%w: too big inline request", resp.ErrProtocol)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != nil {
+			return len(line), err
+		}
+
+		break
+	}
+
+	args, err := utils.SplitArgs(line)
+	if err != nil {
+		return len(line), fmt.Errorf("%w: unbalanced quotes in request", resp.ErrProtocol)
+	}
+
+	req.Args.A = req.argv[:0]
+	for _, arg := range args {
+		req.Args.Append(resp.BulkString{S: arg})
+	}
+
+	req.argv = req.Args.A
+	return len(line), nil
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"context"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/replication"
+	"net"
+	"strconv"
+)
+
+// HandleRole replies with role of the server, master lists its replicas and replica reports state of the link
+func HandleRole(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	config := req.s.config.ReplicationConfig
+	offset := int64(config.MasterReplOffset.Load())
+	if addr := req.s.config.ReplicaOf(); addr != "" {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.ParseInt(port, 10, 64)
+		state := "connect"
+		if link := config.Master.Load(); link != nil {
+			switch link.State() {
+			case replication.REPL_STATE_TRANSFER:
+				state = "sync"
+			default:
+				state = link.State().String()
+			}
+		}
+
+		return resp.Array{A: []resp.Marshaller{
+			resp.BulkString{S: []byte("slave")},
+			resp.BulkString{S: []byte(host)},
+			resp.SimpleInt{I: p},
+			resp.BulkString{S: []byte(state)},
+			resp.SimpleInt{I: offset},
+		}}, nil
+	}
+
+	slaves := resp.Array{A: make([]resp.Marshaller, 0, len(config.Slaves()))}
+	for _, slave := range config.Slaves() {
+		slaves.Append(resp.Array{A: []resp.Marshaller{
+			resp.BulkString{S: []byte(slave.IP())},
+			resp.BulkString{S: []byte(slave.Port())},
+			resp.BulkString{S: []byte(strconv.FormatUint(slave.GetOffset(), 10))},
+		}})
+	}
+
+	return resp.Array{A: []resp.Marshaller{
+		resp.BulkString{S: []byte("master")},
+		resp.SimpleInt{I: offset},
+		slaves,
+	}}, nil
+}
@@ -7,22 +7,124 @@ import (
 	"strings"
 )
 
+// CommandFlags is the command metadata used to decide how the command is executed and propagated
+type CommandFlags uint8
+
+const (
+	// CMD_WRITE commands may modify the dataset, their effect is logged to the AOF and propagated to replicas
+	CMD_WRITE CommandFlags = 1 << iota
+	// CMD_READONLY commands only read the dataset
+	CMD_READONLY
+	// CMD_ASKING commands are served in the slot being imported as if they were preceded by ASKING
+	CMD_ASKING
+	// CMD_NOMULTI commands can not be queued by MULTI
+	CMD_NOMULTI
+	// CMD_BULK commands write by executing other commands, which are locked, logged and propagated one by one
+	// instead of them
+	CMD_BULK
+)
+
+// KeysFunc returns keys accessed by the command, arguments exclude the command name
+type KeysFunc func(args []resp.Marshaller) []string
+
+// FirstKey is KeysFunc of commands accessing the key in the first argument
+func FirstKey(args []resp.Marshaller) []string {
+	if len(args) == 0 {
+		return nil
+	}
+
+	if key, ok := args[0].(resp.BulkString); ok {
+		return []string{string(key.S)}
+	}
+
+	return nil
+}
+
+// AllKeys is KeysFunc of commands accessing keys in all the arguments
+func AllKeys(args []resp.Marshaller) []string {
+	keys := make([]string, 0, len(args))
+	for _, arg := range args {
+		if key, ok := arg.(resp.BulkString); ok {
+			keys = append(keys, string(key.S))
+		}
+	}
+
+	return keys
+}
+
 type Router struct {
 	handlers map[string]Handler
+	flags    map[string]CommandFlags
+	keys     map[string]KeysFunc
+	arity    map[string]int
+	// names of the registered commands, so they are looked up without allocating
+	names map[string]string
 }
 
 func NewRouter() *Router {
 	return &Router{
 		handlers: make(map[string]Handler),
+		flags:    make(map[string]CommandFlags),
+		keys:     make(map[string]KeysFunc),
+		arity:    make(map[string]int),
+		names:    make(map[string]string),
+	}
+}
+
+// RegisterArity sets the number of arguments of the command including its name, negative arity is the minimal
+// number of arguments
+func (r *Router) RegisterArity(path string, arity int) {
+	r.arity[path] = arity
+}
+
+// checkArity validates number of arguments of the command including its name, commands without registered
+// arity validate arguments on their own
+func (r *Router) checkArity(command string, n int) error {
+	arity, ok := r.arity[strings.ToLower(command)]
+	if !ok || arity == n || (arity < 0 && n >= -arity) {
+		return nil
 	}
+
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+}
+
+// RegisterKeys sets how keys of the command are found, so cluster is able to check their slots
+func (r *Router) RegisterKeys(path string, keys KeysFunc) {
+	r.keys[path] = keys
+}
+
+// Keys returns keys accessed by the command, args include the command name
+func (r *Router) Keys(command string, args []resp.Marshaller) []string {
+	keys, ok := r.keys[strings.ToLower(command)]
+	if !ok || len(args) == 0 {
+		return nil
+	}
+
+	return keys(args[1:])
+}
+
+// RegisterCommand registers handler wrapped according to the flags
+func (r *Router) RegisterCommand(path string, handler Handler, flags CommandFlags) {
+	if flags&CMD_WRITE != 0 && flags&CMD_BULK == 0 {
+		handler = ReplWrapper{Next: AofWrapper{Next: handler}}
+	}
+
+	r.handlers[path] = handler
+	r.names[path] = path
+	r.flags[path] = flags
+}
+
+func (r *Router) Flags(command string) CommandFlags {
+	return r.flags[strings.ToLower(command)]
 }
 
 func (r *Router) RegisterHandlerFunc(path string, handler func(ctx context.Context, req *RESPRequest) (interface{}, error)) {
-	r.handlers[path] = HandleFunc(handler)
+	r.RegisterHandler(path, HandleFunc(handler))
 }
 
 func (r *Router) RegisterHandler(path string, handler Handler) {
 	r.handlers[path] = handler
+	r.names[path] = path
 }
 
 func (r *Router) ResolveRequest(args *resp.Array) (Handler, error) {
@@ -48,8 +150,29 @@ func (r *Router) getCommand(args *[]resp.Marshaller) (string, error) {
 	case resp.SimpleString:
 		return strings.ToLower(command.S), nil
 	case resp.BulkString:
-		return strings.ToLower(string(command.S)), nil
+		return r.name(command.S), nil
 	}
 
 	return "", fmt.Errorf("invalid command type: %T", (*args)[0])
 }
+
+// name returns the lower case name of the command, names of the registered commands are not allocated
+func (r *Router) name(b []byte) string {
+	var buf [32]byte
+	if len(b) <= len(buf) {
+		lower := buf[:len(b)]
+		for i, c := range b {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+
+			lower[i] = c
+		}
+
+		if name, ok := r.names[string(lower)]; ok {
+			return name
+		}
+	}
+
+	return strings.ToLower(string(b))
+}
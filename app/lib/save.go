@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
+	"strconv"
+)
+
+// rdbMetadata adds replication state to the auxiliary fields, so restarted master is able
+// to continue partial replication
+func (s *RedisServer) rdbMetadata() map[string]string {
+	metadata := persistence.RdbMetadata()
+	metadata["repl-id"] = s.config.ReplicationConfig.MasterReplid
+	metadata["repl-offset"] = strconv.FormatUint(s.config.ReplicationConfig.MasterReplOffset.Load(), 10)
+	return metadata
+}
+
+// restoreReplicationState continues replication history saved in the rdb aux fields
+func (s *RedisServer) restoreReplicationState(metadata map[string]string) {
+	id, offset := metadata["repl-id"], metadata["repl-offset"]
+	if id == "" || offset == "" {
+		return
+	}
+
+	n, err := strconv.ParseUint(offset, 10, 64)
+	if err != nil {
+		s.logger.Printf("Invalid repl-offset in rdb: %s", offset)
+		return
+	}
+
+	s.config.ReplicationConfig.MasterReplid = id
+	s.config.ReplicationConfig.MasterReplOffset.Store(n)
+	s.replHistory = true
+	s.logger.Printf("Restored replication id %s and offset %d from rdb", id, n)
+}
+
+func (s *RedisServer) Save() error {
+	return persistence.SaveRdb(s.config.PersistenceConfig, s.snapshot(), s.rdbMetadata())
+}
+
+// BgSave takes snapshot of the dataset and writes it in background
+func (s *RedisServer) BgSave() error {
+	config := s.config.PersistenceConfig
+	if !config.RdbBgsaveInProgress.CompareAndSwap(false, true) {
+		return fmt.Errorf("ERR Background save already in progress")
+	}
+
+	snapshot, metadata := s.snapshot(), s.rdbMetadata()
+	s.saves.Add(1)
+	go func() {
+		defer s.saves.Done()
+		defer config.RdbBgsaveInProgress.Store(false)
+		if err := persistence.SaveRdb(config, snapshot, metadata); err != nil {
+			s.logger.Printf("Background saving error: %s", err)
+			config.RdbLastBgsaveStatus.Store(false)
+			return
+		}
+
+		s.logger.Printf("Background saving terminated with success")
+		config.RdbLastBgsaveStatus.Store(true)
+	}()
+
+	return nil
+}
+
+func (s *RedisServer) rdbConfigured() bool {
+	return s.config.PersistenceConfig != nil && s.config.PersistenceConfig.File != ""
+}
+
+func HandleSave(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if !req.s.rdbConfigured() {
+		return nil, fmt.Errorf("ERR rdb file is not configured")
+	}
+
+	if req.s.config.PersistenceConfig.RdbBgsaveInProgress.Load() {
+		return nil, fmt.Errorf("ERR Background save already in progress")
+	}
+
+	if err := req.s.Save(); err != nil {
+		return nil, fmt.Errorf("ERR %s", err)
+	}
+
+	return "OK", nil
+}
+
+func HandleBgSave(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if !req.s.rdbConfigured() {
+		return nil, fmt.Errorf("ERR rdb file is not configured")
+	}
+
+	if err := req.s.BgSave(); err != nil {
+		return nil, err
+	}
+
+	return "Background saving started", nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"strconv"
 )
 
 func HandleSelect(ctx context.Context, req *RESPRequest) (interface{}, error) {
@@ -11,12 +12,25 @@ func HandleSelect(ctx context.Context, req *RESPRequest) (interface{}, error) {
 		return nil, fmt.Errorf("wrong number of arguments for select command")
 	}
 
-	db, ok := req.Args.A[0].(resp.SimpleInt)
-	if !ok {
+	var db int64
+	switch v := req.Args.A[0].(type) {
+	case resp.SimpleInt:
+		db = v.I
+	case resp.BulkString:
+		i, err := strconv.ParseInt(string(v.S), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ERR value is not an integer or out of range")
+		}
+		db = i
+	default:
 		return nil, fmt.Errorf("wrong type of index argument, expected %T, got %T", resp.SimpleInt{}, req.Args.A[0])
 	}
 
-	if err := req.SetDb(int(db.I)); err != nil {
+	if req.s.cluster != nil && db != 0 {
+		return nil, fmt.Errorf("ERR SELECT is not allowed in cluster mode")
+	}
+
+	if err := req.SetDb(int(db)); err != nil {
 		return nil, err
 	}
 
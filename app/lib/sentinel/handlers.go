@@ -0,0 +1,288 @@
+package sentinel
+
+import (
+	"context"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/lib"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *Sentinel) RegisterHandlers(router *lib.Router) {
+	router.RegisterHandlerFunc("sentinel", s.HandleSentinel)
+	router.RegisterHandlerFunc("role", s.HandleRole)
+}
+
+// HandleRole replies with names of the monitored masters
+func (s *Sentinel) HandleRole(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := resp.Array{A: make([]resp.Marshaller, 0, len(s.masters))}
+	for _, name := range s.masterNames() {
+		names.Append(resp.BulkString{S: []byte(name)})
+	}
+
+	return resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte("sentinel")}, names}}, nil
+}
+
+func (s *Sentinel) HandleSentinel(ctx context.Context, req *lib.RESPRequest) (interface{}, error) {
+	args := make([]string, 0, len(req.Args.A))
+	for _, arg := range req.Args.A {
+		b, ok := arg.(resp.BulkString)
+		if !ok {
+			return nil, fmt.Errorf("ERR syntax error")
+		}
+
+		args = append(args, string(b.S))
+	}
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'sentinel' command")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := strings.ToUpper(args[0])
+	switch {
+	case sub == "MYID" && len(args) == 1:
+		return resp.BulkString{S: []byte(s.runid)}, nil
+	case sub == "MASTERS" && len(args) == 1:
+		masters := resp.Array{A: make([]resp.Marshaller, 0, len(s.masters))}
+		for _, name := range s.masterNames() {
+			masters.Append(s.masterFields(s.masters[name]))
+		}
+
+		return masters, nil
+	case sub == "IS-MASTER-DOWN-BY-ADDR" && len(args) == 5:
+		return s.isMasterDown(args[1], args[2], args[3], args[4])
+	case sub == "HELLO" && len(args) == 9:
+		return s.hello(args[1:])
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("ERR Unknown sentinel subcommand or wrong number of arguments for '%s'", args[0])
+	}
+
+	m, ok := s.masters[args[1]]
+	if !ok {
+		if sub == "GET-MASTER-ADDR-BY-NAME" {
+			return resp.BulkString{EncodeNil: true}, nil
+		}
+
+		return nil, fmt.Errorf("ERR No such master with that name")
+	}
+
+	switch sub {
+	case "MASTER":
+		return s.masterFields(m), nil
+	case "REPLICAS", "SLAVES":
+		replicas := resp.Array{A: make([]resp.Marshaller, 0, len(m.replicas))}
+		for _, addr := range sortedKeys(m.replicas) {
+			replicas.Append(s.replicaFields(m, m.replicas[addr]))
+		}
+
+		return replicas, nil
+	case "SENTINELS":
+		sentinels := resp.Array{A: make([]resp.Marshaller, 0, len(m.sentinels))}
+		for _, addr := range sortedKeys(m.sentinels) {
+			p := m.sentinels[addr]
+			host, port, _ := net.SplitHostPort(addr)
+			sentinels.Append(fields(
+				"name", addr,
+				"ip", host,
+				"port", port,
+				"runid", p.runid,
+				"last-hello-message", strconv.FormatInt(time.Since(p.lastHello).Milliseconds(), 10),
+			))
+		}
+
+		return sentinels, nil
+	case "GET-MASTER-ADDR-BY-NAME":
+		host, port, _ := net.SplitHostPort(m.inst.addr)
+		return resp.Array{A: []resp.Marshaller{resp.BulkString{S: []byte(host)}, resp.BulkString{S: []byte(port)}}}, nil
+	case "FAILOVER":
+		if m.failover {
+			return nil, fmt.Errorf("INPROG Failover already in progress")
+		}
+
+		if s.selectReplica(m) == "" {
+			return nil, fmt.Errorf("NOGOODSLAVE No suitable replica to promote")
+		}
+
+		m.forceFailover = true
+		return "OK", nil
+	}
+
+	return nil, fmt.Errorf("ERR Unknown sentinel subcommand or wrong number of arguments for '%s'", args[0])
+}
+
+// isMasterDown replies whether the master is subjectively down, with runid other than "*" the sentinel
+// votes for the requester, once per epoch. Must be called with s.mu held
+func (s *Sentinel) isMasterDown(host, port, epochArg, runid string) (interface{}, error) {
+	epoch, err := strconv.ParseUint(epochArg, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ERR invalid epoch")
+	}
+
+	addr := net.JoinHostPort(host, port)
+	var m *master
+	for _, candidate := range s.masters {
+		if candidate.inst.addr == addr {
+			m = candidate
+		}
+	}
+
+	down := int64(0)
+	if m != nil && m.inst.sdown(m.config.DownAfter) {
+		down = 1
+	}
+
+	leader, leaderEpoch := "*", uint64(0)
+	if m != nil && runid != "*" {
+		if epoch > s.epoch {
+			s.epoch = epoch
+		}
+
+		if m.leaderEpoch < epoch {
+			m.leader, m.leaderEpoch = runid, epoch
+			// the elected sentinel gets time to finish the failover before this one tries itself
+			if runid != s.runid {
+				s.delayElection(m, 2*m.config.FailoverTimeout)
+			}
+			s.logger.Printf("+vote-for-leader %s %d", runid, epoch)
+		}
+
+		leader, leaderEpoch = m.leader, m.leaderEpoch
+	}
+
+	return resp.Array{A: []resp.Marshaller{
+		resp.SimpleInt{I: down},
+		resp.BulkString{S: []byte(leader)},
+		resp.SimpleInt{I: int64(leaderEpoch)},
+	}}, nil
+}
+
+// hello handles announcement of another sentinel: ip port runid epoch master-name master-ip master-port
+// config-epoch. Master promoted in newer epoch replaces the current one. Must be called with s.mu held
+func (s *Sentinel) hello(args []string) (interface{}, error) {
+	epoch, err1 := strconv.ParseUint(args[3], 10, 64)
+	configEpoch, err2 := strconv.ParseUint(args[7], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("ERR invalid epoch")
+	}
+
+	m, ok := s.masters[args[4]]
+	if !ok {
+		return nil, fmt.Errorf("ERR No such master with that name")
+	}
+
+	addr := net.JoinHostPort(args[0], args[1])
+	if addr == s.addr() {
+		return "OK", nil
+	}
+
+	p, ok := m.sentinels[addr]
+	if !ok {
+		s.logger.Printf("+sentinel %s master %s", addr, m.config.Name)
+		p = newPeer(addr)
+		m.sentinels[addr] = p
+	}
+
+	p.runid, p.lastHello = args[2], time.Now()
+	if epoch > s.epoch {
+		s.logger.Printf("+new-epoch %d", epoch)
+		s.epoch = epoch
+	}
+
+	if masterAddr := net.JoinHostPort(args[5], args[6]); configEpoch > m.configEpoch && masterAddr != m.inst.addr {
+		s.switchMaster(m, masterAddr, configEpoch)
+	} else if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+	}
+
+	return "OK", nil
+}
+
+// masterFields must be called with s.mu held
+func (s *Sentinel) masterFields(m *master) resp.Array {
+	host, port, _ := net.SplitHostPort(m.inst.addr)
+	flags := "master"
+	if m.inst.sdown(m.config.DownAfter) {
+		flags += ",s_down"
+	}
+
+	if m.odown {
+		flags += ",o_down"
+	}
+
+	if m.failover {
+		flags += ",failover_in_progress"
+	}
+
+	return fields(
+		"name", m.config.Name,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.config.Quorum),
+		"config-epoch", strconv.FormatUint(m.configEpoch, 10),
+		"down-after-milliseconds", strconv.FormatInt(m.config.DownAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(m.config.FailoverTimeout.Milliseconds(), 10),
+	)
+}
+
+// replicaFields must be called with s.mu held
+func (s *Sentinel) replicaFields(m *master, r *instance) resp.Array {
+	host, port, _ := net.SplitHostPort(r.addr)
+	flags := "slave"
+	if r.sdown(m.config.DownAfter) {
+		flags += ",s_down"
+	}
+
+	linkStatus := "err"
+	if r.linkUp {
+		linkStatus = "ok"
+	}
+
+	return fields(
+		"name", r.addr,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"role-reported", r.role,
+		"master-host", r.masterHost,
+		"master-port", r.masterPort,
+		"master-link-status", linkStatus,
+		"slave-priority", strconv.Itoa(r.priority),
+		"slave-repl-offset", strconv.FormatUint(r.offset, 10),
+	)
+}
+
+func fields(kv ...string) resp.Array {
+	arr := resp.Array{A: make([]resp.Marshaller, 0, len(kv))}
+	for _, v := range kv {
+		arr.Append(resp.BulkString{S: []byte(v)})
+	}
+
+	return arr
+}
+
+func (s *Sentinel) masterNames() []string {
+	return sortedKeys(s.masters)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,269 @@
+package sentinel
+
+import (
+	"bufio"
+	"fmt"
+	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// instance is monitored master or replica, fields are guarded by Sentinel.mu
+type instance struct {
+	addr string
+	// lastPong is the time of the last valid reply to PING
+	lastPong time.Time
+	infoAt   time.Time
+	role     string
+	// roleSince is the time the role was reported first
+	roleSince  time.Time
+	masterHost string
+	masterPort string
+	linkUp     bool
+	priority   int
+	offset     uint64
+	// reconfAt is the time REPLICAOF was last sent to turn the instance into replica
+	reconfAt time.Time
+	stop     chan struct{}
+}
+
+func newInstance(addr string) *instance {
+	return &instance{
+		addr:     addr,
+		lastPong: time.Now(),
+		priority: 100,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (i *instance) sdown(downAfter time.Duration) bool {
+	return time.Since(i.lastPong) > downAfter
+}
+
+// monitor pings the instance and reads its INFO until it is replaced by switchMaster
+func (s *Sentinel) monitor(m *master, inst *instance) {
+	c := &client{addr: inst.addr}
+	defer c.Close()
+	ticker := time.NewTicker(s.config.PingPeriod)
+	defer ticker.Stop()
+	var lastInfo time.Time
+	for {
+		if _, err := c.Do("PING"); err == nil || isValidPingError(err) {
+			s.mu.Lock()
+			inst.lastPong = time.Now()
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		// replicas are watched closely while the master is down, as one of them is going to be promoted
+		period := s.config.InfoPeriod
+		if m.odown || m.failover {
+			period = s.config.PingPeriod
+		}
+		s.mu.Unlock()
+		if time.Since(lastInfo) >= period {
+			if res, err := c.Do("INFO", "replication"); err == nil {
+				lastInfo = time.Now()
+				s.updateInfo(m, inst, parseInfo(infoText(res)))
+			}
+		}
+
+		select {
+		case <-s.close:
+			return
+		case <-inst.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func isValidPingError(err error) bool {
+	return strings.HasPrefix(err.Error(), "LOADING") || strings.HasPrefix(err.Error(), "MASTERDOWN")
+}
+
+// updateInfo discovers replicas of the master and turns instances that report master role, e.g. the old
+// master that is back after failover, into replicas of the current master
+func (s *Sentinel) updateInfo(m *master, inst *instance, fields map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inst != m.inst && m.replicas[inst.addr] != inst {
+		return
+	}
+
+	now := time.Now()
+	if role := fields["role"]; role != inst.role {
+		inst.role, inst.roleSince = role, now
+	}
+
+	inst.infoAt = now
+	inst.masterHost, inst.masterPort = fields["master_host"], fields["master_port"]
+	inst.linkUp = fields["master_link_status"] == "up"
+	if priority, err := strconv.Atoi(fields["slave_priority"]); err == nil {
+		inst.priority = priority
+	}
+
+	if offset, err := strconv.ParseUint(fields["master_repl_offset"], 10, 64); err == nil {
+		inst.offset = offset
+	}
+
+	if inst == m.inst && inst.role == "master" {
+		for _, addr := range replicaAddrs(fields) {
+			if _, ok := m.replicas[addr]; !ok && addr != m.inst.addr {
+				s.logger.Printf("+slave %s master %s", addr, m.config.Name)
+				r := newInstance(addr)
+				m.replicas[addr] = r
+				go s.monitor(m, r)
+			}
+		}
+	}
+
+	// the role is given some time, so other sentinels learn about the failover that promoted the instance
+	if inst != m.inst && inst.role == "master" && !m.failover && !m.inst.sdown(m.config.DownAfter) &&
+		now.Sub(inst.roleSince) > 4*s.config.HelloPeriod && now.Sub(inst.reconfAt) > s.config.InfoPeriod {
+		inst.reconfAt = now
+		host, port, _ := net.SplitHostPort(m.inst.addr)
+		s.logger.Printf("+convert-to-slave %s master %s", inst.addr, m.config.Name)
+		go call(inst.addr, "REPLICAOF", host, port)
+	}
+}
+
+func infoText(res resp.Any) string {
+	switch v := res.I.(type) {
+	case resp.BulkString:
+		return string(v.S)
+	case resp.SimpleString:
+		return v.S
+	}
+
+	return ""
+}
+
+// parseInfo returns fields of INFO reply
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.IndexByte(line, ':'); i > 0 && !strings.HasPrefix(line, "#") {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+
+	return fields
+}
+
+// replicaAddrs returns addresses from slaveN:ip=...,port=... fields of master INFO
+func replicaAddrs(fields map[string]string) []string {
+	addrs := make([]string, 0)
+	for k, v := range fields {
+		if _, err := strconv.Atoi(strings.TrimPrefix(k, "slave")); err != nil || !strings.HasPrefix(k, "slave") {
+			continue
+		}
+
+		var ip, port string
+		for _, kv := range strings.Split(v, ",") {
+			switch {
+			case strings.HasPrefix(kv, "ip="):
+				ip = strings.TrimPrefix(kv, "ip=")
+			case strings.HasPrefix(kv, "port="):
+				port = strings.TrimPrefix(kv, "port=")
+			}
+		}
+
+		if ip != "" && port != "" {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+
+	return addrs
+}
+
+// client is a connection to monitored instance or another sentinel, it is dialed on demand and dropped
+// on any error
+type client struct {
+	mu   sync.Mutex
+	addr string
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Do sends command and returns its reply, error reply is returned as error
+func (c *client) Do(args ...string) (resp.Any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := resp.Any{}
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, SENTINEL_TIMEOUT)
+		if err != nil {
+			return res, err
+		}
+
+		c.conn, c.r = conn, bufio.NewReader(conn)
+	}
+
+	cmd := resp.Array{A: make([]resp.Marshaller, 0, len(args))}
+	for _, arg := range args {
+		cmd.Append(resp.BulkString{S: []byte(arg)})
+	}
+
+	if err := c.conn.SetDeadline(time.Now().Add(SENTINEL_TIMEOUT)); err != nil {
+		c.close()
+		return res, err
+	}
+
+	if _, err := cmd.MarshalRESP(c.conn); err != nil {
+		c.close()
+		return res, err
+	}
+
+	if _, err := res.UnmarshalRESP(c.r); err != nil {
+		c.close()
+		return res, err
+	}
+
+	if e, ok := res.I.(resp.SimpleError); ok {
+		return res, fmt.Errorf("%s", e.E)
+	}
+
+	return res, nil
+}
+
+func (c *client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
+}
+
+func (c *client) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// call sends a single command over a new connection
+func call(addr string, args ...string) (resp.Any, error) {
+	c := &client{addr: addr}
+	defer c.Close()
+	return c.Do(args...)
+}
+
+// parseDownReply parses reply to SENTINEL IS-MASTER-DOWN-BY-ADDR
+func parseDownReply(res resp.Any) (down bool, leader string, epoch uint64, ok bool) {
+	arr, isArr := res.I.(resp.Array)
+	if !isArr || len(arr.A) != 3 {
+		return false, "", 0, false
+	}
+
+	d, ok1 := arr.A[0].(resp.SimpleInt)
+	l, ok2 := arr.A[1].(resp.BulkString)
+	e, ok3 := arr.A[2].(resp.SimpleInt)
+	if !ok1 || !ok2 || !ok3 {
+		return false, "", 0, false
+	}
+
+	return d.I == 1, string(l.S), uint64(e.I), true
+}
@@ -0,0 +1,461 @@
+package sentinel
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// SENTINEL_MAX_DESYNC spreads the start of leader election, so sentinels do not vote for themselves at once
+	SENTINEL_MAX_DESYNC = time.Second
+	// SENTINEL_TIMEOUT limits every request sent to the instances and other sentinels
+	SENTINEL_TIMEOUT = 500 * time.Millisecond
+)
+
+type MasterConfig struct {
+	Name   string
+	Host   string
+	Port   string
+	Quorum int
+	// DownAfter is the time without valid reply to PING after which instance is subjectively down
+	DownAfter       time.Duration
+	FailoverTimeout time.Duration
+	// KnownSentinels are addresses of other sentinels monitoring the master, the rest is learned from hellos
+	KnownSentinels []string
+}
+
+func NewMasterConfig(name, host, port string, quorum int) *MasterConfig {
+	return &MasterConfig{
+		Name:            name,
+		Host:            host,
+		Port:            port,
+		Quorum:          quorum,
+		DownAfter:       30 * time.Second,
+		FailoverTimeout: 180 * time.Second,
+	}
+}
+
+type Config struct {
+	// Host and Port are announced to other sentinels
+	Host        string
+	Port        int
+	Masters     []*MasterConfig
+	PingPeriod  time.Duration
+	InfoPeriod  time.Duration
+	HelloPeriod time.Duration
+}
+
+func GetDefaultConfig() *Config {
+	return &Config{
+		Host:        "127.0.0.1",
+		Port:        26379,
+		PingPeriod:  time.Second,
+		InfoPeriod:  10 * time.Second,
+		HelloPeriod: 2 * time.Second,
+	}
+}
+
+// master is the state of monitored master, guarded by Sentinel.mu
+type master struct {
+	config    *MasterConfig
+	inst      *instance
+	replicas  map[string]*instance
+	sentinels map[string]*peer
+	// configEpoch is the epoch of the failover that promoted the current master
+	configEpoch uint64
+	odown       bool
+	// electionAt is the earliest time leader election is started once the master is objectively down
+	electionAt time.Time
+	// vote of this sentinel in leaderEpoch
+	leader      string
+	leaderEpoch uint64
+	failover    bool
+	// set by SENTINEL FAILOVER, failover is started without agreement of other sentinels
+	forceFailover bool
+}
+
+// peer is another sentinel monitoring the same master
+type peer struct {
+	addr      string
+	runid     string
+	lastHello time.Time
+	c         *client
+}
+
+// Sentinel monitors masters and their replicas, once quorum of sentinels agrees that the master is down,
+// elected sentinel promotes the best replica and reconfigures the rest to replicate from it
+type Sentinel struct {
+	mu     sync.Mutex
+	config *Config
+	logger *log.Logger
+	runid  string
+	// epoch is the current epoch, incremented by every leader election
+	epoch   uint64
+	masters map[string]*master
+	// rand spreads elections of sentinels, guarded by mu
+	rand      *rand.Rand
+	close     chan struct{}
+	closeOnce sync.Once
+}
+
+func New(config *Config) *Sentinel {
+	if config == nil {
+		config = GetDefaultConfig()
+	}
+
+	runid := bytes.NewBuffer(make([]byte, 0, 40))
+	utils.RandomAlphanumericString(runid, 40)
+	s := &Sentinel{
+		config:  config,
+		logger:  log.New(os.Stdout, fmt.Sprintf("sentinel %d: ", config.Port), log.Lmicroseconds|log.Lshortfile),
+		runid:   runid.String(),
+		masters: make(map[string]*master, len(config.Masters)),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		close:   make(chan struct{}),
+	}
+
+	for _, c := range config.Masters {
+		m := &master{
+			config:    c,
+			inst:      newInstance(net.JoinHostPort(c.Host, c.Port)),
+			replicas:  make(map[string]*instance),
+			sentinels: make(map[string]*peer),
+		}
+
+		for _, addr := range c.KnownSentinels {
+			if addr != s.addr() {
+				m.sentinels[addr] = newPeer(addr)
+			}
+		}
+
+		s.masters[c.Name] = m
+	}
+
+	return s
+}
+
+func newPeer(addr string) *peer {
+	return &peer{addr: addr, c: &client{addr: addr}}
+}
+
+func (s *Sentinel) addr() string {
+	return net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port))
+}
+
+// Run monitors configured masters until Close is called
+func (s *Sentinel) Run() {
+	s.mu.Lock()
+	for _, m := range s.masters {
+		s.logger.Printf("+monitor master %s %s quorum %d", m.config.Name, m.inst.addr, m.config.Quorum)
+		go s.monitor(m, m.inst)
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(s.config.PingPeriod)
+	defer ticker.Stop()
+	var lastHello time.Time
+	for {
+		select {
+		case <-s.close:
+			return
+		case <-ticker.C:
+		}
+
+		for _, m := range s.masters {
+			s.check(m)
+		}
+
+		if time.Since(lastHello) >= s.config.HelloPeriod {
+			s.sendHellos()
+			lastHello = time.Now()
+		}
+	}
+}
+
+func (s *Sentinel) Close() {
+	s.closeOnce.Do(func() {
+		close(s.close)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.masters {
+		for _, p := range m.sentinels {
+			p.c.Close()
+		}
+	}
+}
+
+// check detects objective down of the master and starts failover once this sentinel is elected
+func (s *Sentinel) check(m *master) {
+	s.mu.Lock()
+	force := m.forceFailover
+	if !m.inst.sdown(m.config.DownAfter) && !force {
+		if m.odown {
+			s.logger.Printf("-odown master %s %s", m.config.Name, m.inst.addr)
+		}
+
+		m.odown, m.electionAt = false, time.Time{}
+		s.mu.Unlock()
+		return
+	}
+
+	if m.failover {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	if !force {
+		down := 1 + s.askPeers(m, "*", 0)
+		s.mu.Lock()
+		odown := down >= m.config.Quorum
+		if odown && !m.odown {
+			s.logger.Printf("+odown master %s %s #quorum %d/%d", m.config.Name, m.inst.addr, down, m.config.Quorum)
+			if m.electionAt.Before(time.Now()) {
+				s.delayElection(m, 0)
+			}
+		}
+
+		m.odown = odown
+		ready := odown && !time.Now().Before(m.electionAt)
+		s.mu.Unlock()
+		if !ready {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.epoch++
+	epoch := s.epoch
+	m.leader, m.leaderEpoch = s.runid, epoch
+	m.forceFailover = false
+	needed := len(m.sentinels)/2 + 1
+	if needed < m.config.Quorum {
+		needed = m.config.Quorum
+	}
+	s.mu.Unlock()
+	s.logger.Printf("+new-epoch %d, +try-failover master %s", epoch, m.config.Name)
+	if !force {
+		if votes := 1 + s.askPeers(m, s.runid, epoch); votes < needed {
+			s.logger.Printf("-failover-abort-not-elected master %s, %d of %d votes", m.config.Name, votes, needed)
+			s.mu.Lock()
+			s.delayElection(m, 2*m.config.FailoverTimeout)
+			s.mu.Unlock()
+			return
+		}
+	}
+
+	s.logger.Printf("+elected-leader master %s epoch %d", m.config.Name, epoch)
+	s.mu.Lock()
+	m.failover = true
+	s.mu.Unlock()
+	go s.failover(m, epoch)
+}
+
+// delayElection postpones leader election by d and a random delay, so the sentinels do not split their
+// votes again. Must be called with s.mu held
+func (s *Sentinel) delayElection(m *master, d time.Duration) {
+	m.electionAt = time.Now().Add(d + time.Duration(s.rand.Int63n(int64(SENTINEL_MAX_DESYNC)+1)))
+}
+
+// askPeers sends SENTINEL IS-MASTER-DOWN-BY-ADDR to other sentinels, with runid "*" it returns the number
+// of sentinels that consider the master down, otherwise the number of votes for runid in epoch
+func (s *Sentinel) askPeers(m *master, runid string, epoch uint64) int {
+	s.mu.Lock()
+	host, port, _ := net.SplitHostPort(m.inst.addr)
+	peers := make([]*peer, 0, len(m.sentinels))
+	for _, p := range m.sentinels {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		n  int
+	)
+
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			res, err := p.c.Do("SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.FormatUint(epoch, 10), runid)
+			if err != nil {
+				return
+			}
+
+			down, leader, leaderEpoch, ok := parseDownReply(res)
+			if !ok {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if (runid == "*" && down) || (runid != "*" && leader == runid && leaderEpoch == epoch) {
+				n++
+			}
+		}(p)
+	}
+
+	wg.Wait()
+	return n
+}
+
+// failover promotes the best replica and points the others to it
+func (s *Sentinel) failover(m *master, epoch uint64) {
+	defer func() {
+		s.mu.Lock()
+		m.failover = false
+		s.mu.Unlock()
+	}()
+
+	abort := func(reason string) {
+		s.logger.Printf("-failover-abort-%s master %s", reason, m.config.Name)
+		s.mu.Lock()
+		s.delayElection(m, 2*m.config.FailoverTimeout)
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	candidate := s.selectReplica(m)
+	s.mu.Unlock()
+	if candidate == "" {
+		abort("no-good-slave")
+		return
+	}
+
+	s.logger.Printf("+selected-slave %s master %s", candidate, m.config.Name)
+	if _, err := call(candidate, "REPLICAOF", "NO", "ONE"); err != nil {
+		abort("slave-error")
+		return
+	}
+
+	for deadline := time.Now().Add(m.config.FailoverTimeout); ; time.Sleep(s.config.PingPeriod) {
+		if time.Now().After(deadline) {
+			abort("slave-timeout")
+			return
+		}
+
+		if res, err := call(candidate, "INFO", "replication"); err == nil && parseInfo(infoText(res))["role"] == "master" {
+			break
+		}
+	}
+
+	s.logger.Printf("+promoted-slave %s master %s", candidate, m.config.Name)
+	s.mu.Lock()
+	s.switchMaster(m, candidate, epoch)
+	replicas := make([]string, 0, len(m.replicas))
+	for addr, r := range m.replicas {
+		if !r.sdown(m.config.DownAfter) {
+			replicas = append(replicas, addr)
+		}
+	}
+	s.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(candidate)
+	for _, addr := range replicas {
+		if _, err := call(addr, "REPLICAOF", host, port); err != nil {
+			s.logger.Printf("-slave-reconf %s: %s", addr, err)
+			continue
+		}
+
+		s.logger.Printf("+slave-reconf-sent %s", addr)
+	}
+
+	s.logger.Printf("+failover-end master %s", m.config.Name)
+}
+
+// selectReplica returns address of the replica to promote, replicas that are down, have priority 0 or
+// did not report recently are skipped, lower priority wins and then higher offset. Must be called with s.mu held
+func (s *Sentinel) selectReplica(m *master) string {
+	candidates := make([]*instance, 0, len(m.replicas))
+	for _, r := range m.replicas {
+		if r.sdown(m.config.DownAfter) || r.role != "slave" || r.priority == 0 ||
+			time.Since(r.infoAt) > 5*s.config.InfoPeriod {
+			continue
+		}
+
+		candidates = append(candidates, r)
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+
+		if a.offset != b.offset {
+			return a.offset > b.offset
+		}
+
+		return a.addr < b.addr
+	})
+
+	return candidates[0].addr
+}
+
+// switchMaster starts monitoring addr as the master, the previous one is kept as its replica, so it is
+// reconfigured once it is back. Must be called with s.mu held
+func (s *Sentinel) switchMaster(m *master, addr string, epoch uint64) {
+	s.logger.Printf("+switch-master %s %s %s", m.config.Name, m.inst.addr, addr)
+	old := m.inst
+	close(old.stop)
+	replicas := make(map[string]*instance, len(m.replicas))
+	for a, r := range m.replicas {
+		close(r.stop)
+		if a != addr {
+			replicas[a] = newInstance(a)
+		}
+	}
+
+	replicas[old.addr] = newInstance(old.addr)
+	m.inst = newInstance(addr)
+	m.replicas = replicas
+	m.configEpoch = epoch
+	m.odown, m.electionAt = false, time.Time{}
+	go s.monitor(m, m.inst)
+	for _, r := range m.replicas {
+		go s.monitor(m, r)
+	}
+}
+
+// sendHellos announces this sentinel and its view of the masters to other sentinels, so they learn about
+// each other and about the failovers
+func (s *Sentinel) sendHellos() {
+	type hello struct {
+		p    *peer
+		args []string
+	}
+
+	s.mu.Lock()
+	hellos := make([]hello, 0)
+	host, port, _ := net.SplitHostPort(s.addr())
+	for _, m := range s.masters {
+		mhost, mport, _ := net.SplitHostPort(m.inst.addr)
+		for _, p := range m.sentinels {
+			hellos = append(hellos, hello{p, []string{"SENTINEL", "HELLO", host, port, s.runid,
+				strconv.FormatUint(s.epoch, 10), m.config.Name, mhost, mport, strconv.FormatUint(m.configEpoch, 10)}})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, h := range hellos {
+		if _, err := h.p.c.Do(h.args...); err != nil {
+			s.logger.Printf("Error sending hello to %s: %s", h.p.addr, err)
+		}
+	}
+}
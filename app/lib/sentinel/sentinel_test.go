@@ -0,0 +1,50 @@
+package sentinel
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseInfo(t *testing.T) {
+	fields := parseInfo("# Replication\r\nrole:master\r\n\t\t\tconnected_slaves:2\r\n" +
+		"slave0:ip=127.0.0.1,port=6380,state=online,offset=10,lag=0\r\n" +
+		"slave1:ip=127.0.0.1,port=6381,state=online,offset=8,lag=1\r\nmaster_repl_offset:10\r\n")
+	if fields["role"] != "master" || fields["connected_slaves"] != "2" || fields["master_repl_offset"] != "10" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+
+	addrs := replicaAddrs(fields)
+	sort.Strings(addrs)
+	if len(addrs) != 2 || addrs[0] != "127.0.0.1:6380" || addrs[1] != "127.0.0.1:6381" {
+		t.Errorf("unexpected replicas %v", addrs)
+	}
+}
+
+func TestSelectReplica(t *testing.T) {
+	s := New(&Config{InfoPeriod: time.Second})
+	m := &master{config: &MasterConfig{DownAfter: time.Second}, replicas: make(map[string]*instance)}
+	add := func(addr string, priority int, offset uint64) *instance {
+		r := newInstance(addr)
+		r.role, r.infoAt, r.priority, r.offset = "slave", time.Now(), priority, offset
+		m.replicas[addr] = r
+		return r
+	}
+
+	add("127.0.0.1:6380", 100, 10)
+	add("127.0.0.1:6381", 100, 20)
+	if got := s.selectReplica(m); got != "127.0.0.1:6381" {
+		t.Errorf("expected replica with the highest offset, got %s", got)
+	}
+
+	add("127.0.0.1:6382", 50, 0)
+	if got := s.selectReplica(m); got != "127.0.0.1:6382" {
+		t.Errorf("expected replica with the lowest priority, got %s", got)
+	}
+
+	m.replicas["127.0.0.1:6382"].priority = 0
+	m.replicas["127.0.0.1:6381"].lastPong = time.Now().Add(-2 * time.Second)
+	if got := s.selectReplica(m); got != "127.0.0.1:6380" {
+		t.Errorf("expected replicas that are down or with priority 0 to be skipped, got %s", got)
+	}
+}
@@ -24,7 +24,7 @@ type RedisDataTypes struct {
 }
 
 func NewDb(idx int) *RedisDataTypes {
-	kType := newKeyType()
+	kType := newKeyType(idx)
 	return &RedisDataTypes{
 		index:    idx,
 		keyTypes: kType,
@@ -38,6 +38,10 @@ func NewDb(idx int) *RedisDataTypes {
 	}
 }
 
+func (db RedisDataTypes) Index() int {
+	return db.index
+}
+
 func (db RedisDataTypes) GetType(key string) DataType {
 	return db.keyTypes.GetType(key)
 }
@@ -45,3 +49,79 @@ func (db RedisDataTypes) GetType(key string) DataType {
 func (db RedisDataTypes) GetStorage(t DataType) TypedStorage {
 	return db.dataTypes[t]
 }
+
+// OnKeyEvent sets the function told about keys created and expired by the storage
+func (db RedisDataTypes) OnKeyEvent(fn KeyEventFunc) {
+	db.keyTypes.onKeyEvent.Store(fn)
+}
+
+// Watch starts tracking modifications of the key, the returned version changes once the key is modified
+func (db RedisDataTypes) Watch(key string) uint64 {
+	return db.keyTypes.Watch(key)
+}
+
+func (db RedisDataTypes) Unwatch(key string) {
+	db.keyTypes.Unwatch(key)
+}
+
+// Version returns current version of the watched key
+func (db RedisDataTypes) Version(key string) uint64 {
+	return db.keyTypes.Version(key)
+}
+
+// Keys returns every key of the db regardless of its type
+func (db RedisDataTypes) Keys() []string {
+	return db.keyTypes.Keys()
+}
+
+// Delete removes key of any type
+func (db RedisDataTypes) Delete(key string) (bool, error) {
+	switch db.keyTypes.GetType(key) {
+	case STRINGS:
+		return db.dataTypes[STRINGS].(StringsStorage).Delete(key)
+	case STREAMS:
+		return db.dataTypes[STREAMS].(*StreamsIdx).Delete(key)
+	}
+
+	return false, nil
+}
+
+// ExpireKeys deletes up to PICK_NUMBER expired keys, found by sampling the keys with expire time, and returns them
+func (db RedisDataTypes) ExpireKeys() []string {
+	return db.dataTypes[STRINGS].(*StringsProxy).expireKeys()
+}
+
+// Expired tells whether any of the keys exists with expire time in the past
+func (db RedisDataTypes) Expired(keys []string) bool {
+	strings := db.dataTypes[STRINGS].(*StringsProxy)
+	for _, key := range keys {
+		if strings.storage.expired(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExpireAccessed deletes the expired keys accessed by a command and returns them
+func (db RedisDataTypes) ExpireAccessed(keys []string) []string {
+	return db.dataTypes[STRINGS].(*StringsProxy).expire(append([]string(nil), keys...))
+}
+
+// Flush removes every key of the db
+func (db RedisDataTypes) Flush() error {
+	snapshot := db.Snapshot()
+	for key := range snapshot.Strings {
+		if _, err := db.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	for key := range snapshot.Streams {
+		if _, err := db.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
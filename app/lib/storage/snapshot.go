@@ -0,0 +1,21 @@
+package storage
+
+// DbSnapshot is a point in time copy of the db content, used to persist the db without holding storage locks
+type DbSnapshot struct {
+	Index   int
+	Strings map[string]StringsElement
+	Streams map[string]StreamSnapshot
+}
+
+func (db RedisDataTypes) Snapshot() *DbSnapshot {
+	return &DbSnapshot{
+		Index:   db.index,
+		Strings: db.dataTypes[STRINGS].(StringsStorage).Snapshot(),
+		Streams: db.dataTypes[STREAMS].(*StreamsIdx).Snapshot(),
+	}
+}
+
+// Len returns number of keys in the snapshot
+func (s *DbSnapshot) Len() int {
+	return len(s.Strings) + len(s.Streams)
+}
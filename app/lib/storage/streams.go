@@ -3,6 +3,8 @@ package storage
 import (
 	"fmt"
 	"github.com/armon/go-radix"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -12,8 +14,10 @@ type StreamDataType struct {
 	// For use case here the ideal would be to implement new radix tree optimized for
 	// range queries(iteration from subtree to root to leafs that are located after current leaf) and blocking behavior,
 	// though I decided to use already implemented tree
-	tree *radix.Tree
-	mu   *sync.RWMutex
+	tree   *radix.Tree
+	meta   *StreamMeta
+	groups *[]StreamGroup
+	mu     *sync.RWMutex
 }
 
 type StreamKV struct {
@@ -21,11 +25,54 @@ type StreamKV struct {
 	Data []string
 }
 
+// StreamMeta is the state of the stream that outlives its entries, ids of the deleted entries are never
+// reissued, empty id is 0-0
+type StreamMeta struct {
+	LastId       string
+	MaxDeletedId string
+	EntriesAdded uint64
+}
+
+// StreamGroup is a consumer group of the stream, groups are not served by any command yet, they are only kept
+// to be written back as they were loaded
+type StreamGroup struct {
+	Name   string
+	LastId string
+	// -1 when unknown
+	EntriesRead int64
+	Pending     []StreamPendingEntry
+	Consumers   []StreamConsumer
+}
+
+// StreamPendingEntry is an entry delivered to a consumer of the group and not acknowledged yet
+type StreamPendingEntry struct {
+	Id            string
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+// StreamConsumer is a consumer of the group with ids of its pending entries, times are unix milliseconds
+type StreamConsumer struct {
+	Name       string
+	SeenTime   int64
+	ActiveTime int64
+	Pending    []string
+}
+
+// StreamSnapshot is a copy of the stream entries with its metadata
+type StreamSnapshot struct {
+	Entries []StreamKV
+	StreamMeta
+	Groups []StreamGroup
+}
+
 func NewStream(stream string) *StreamDataType {
 	return &StreamDataType{
-		mu:   &sync.RWMutex{},
-		name: stream,
-		tree: radix.New(),
+		mu:     &sync.RWMutex{},
+		name:   stream,
+		tree:   radix.New(),
+		meta:   &StreamMeta{},
+		groups: new([]StreamGroup),
 	}
 }
 
@@ -36,9 +83,60 @@ func (st StreamDataType) GetType() DataType {
 func (st StreamDataType) Add(key string, data []string) (old interface{}, ok bool) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
+	st.meta.LastId = key
+	st.meta.EntriesAdded++
 	return st.tree.Insert(key, data)
 }
 
+// Delete removes entries with the ids and returns number of the removed entries
+func (st StreamDataType) Delete(ids []string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	deleted := 0
+	for _, id := range ids {
+		if _, ok := st.tree.Delete(id); !ok {
+			continue
+		}
+
+		deleted++
+		if CompareStreamIds(id, st.meta.MaxDeletedId) > 0 {
+			st.meta.MaxDeletedId = id
+		}
+	}
+
+	return deleted
+}
+
+func (st StreamDataType) Len() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.tree.Len()
+}
+
+func (st StreamDataType) Meta() StreamMeta {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return *st.meta
+}
+
+func (st StreamDataType) SetMeta(meta StreamMeta) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	*st.meta = meta
+}
+
+func (st StreamDataType) Groups() []StreamGroup {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return *st.groups
+}
+
+func (st StreamDataType) SetGroups(groups []StreamGroup) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	*st.groups = groups
+}
+
 func (st StreamDataType) Min(prefix string) (key string, val interface{}) {
 	st.mu.RLock()
 	defer st.mu.RUnlock()
@@ -99,3 +197,43 @@ func (st StreamDataType) Range(start, end string) []StreamKV {
 
 	return kv
 }
+
+// Entries returns all entries of the stream ordered by id
+func (st StreamDataType) Entries() []StreamKV {
+	st.mu.RLock()
+	kv := make([]StreamKV, 0, st.tree.Len())
+	st.tree.Walk(func(s string, v interface{}) bool {
+		kv = append(kv, StreamKV{
+			Key:  s,
+			Data: v.([]string),
+		})
+
+		return false
+	})
+	st.mu.RUnlock()
+
+	// tree is ordered lexicographically, which differs from id order when ids have different number of digits
+	sort.Slice(kv, func(i, j int) bool {
+		return CompareStreamIds(kv[i].Key, kv[j].Key) < 0
+	})
+
+	return kv
+}
+
+// NormalizeStreamId validates explicit id given as <ms>-<seq> or <ms> and returns it as <ms>-<seq>
+func NormalizeStreamId(id string) (string, error) {
+	ms, seq, hasSeq := strings.Cut(id, "-")
+	t, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+	}
+
+	var s uint64
+	if hasSeq {
+		if s, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return "", fmt.Errorf("ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+
+	return fmt.Sprintf("%d-%d", t, s), nil
+}
@@ -44,6 +44,7 @@ func (si StreamsIdx) GetOrCreateStream(stream string) (*StreamProxy, error) {
 			stream:      st,
 			kType:       si.kTypes,
 			subscribers: make(map[string]chan<- StreamKV),
+			subMu:       &sync.Mutex{},
 		}
 
 		si.streams[stream] = s
@@ -52,6 +53,35 @@ func (si StreamsIdx) GetOrCreateStream(stream string) (*StreamProxy, error) {
 	return s, nil
 }
 
+func (si StreamsIdx) Delete(stream string) (bool, error) {
+	if ok, err := si.kTypes.AssertKeyTypeOrNone(stream, STREAMS); err != nil || !ok {
+		return false, err
+	}
+
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.kTypes.Delete(stream)
+	delete(si.streams, stream)
+	return true, nil
+}
+
+// Snapshot returns entries and metadata of every stream, including streams emptied by XDEL, streams created
+// by reads of missing keys are not part of the keyspace
+func (si StreamsIdx) Snapshot() map[string]StreamSnapshot {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	snapshot := make(map[string]StreamSnapshot, len(si.streams))
+	for name, s := range si.streams {
+		if si.kTypes.GetType(name) != STREAMS {
+			continue
+		}
+
+		snapshot[name] = StreamSnapshot{Entries: s.stream.Entries(), StreamMeta: s.stream.Meta(), Groups: s.stream.Groups()}
+	}
+
+	return snapshot
+}
+
 func (si StreamsIdx) GetType() DataType {
 	return STREAMS
 }
@@ -102,32 +132,67 @@ func parseStreamKey(key string) (timestamp StreamKey, sequence StreamKey, err er
 	return
 }
 
+// CompareStreamIds compares two "<ms>-<seq>" ids numerically, returns -1, 0 or 1 like strings.Compare
+func CompareStreamIds(a, b string) int {
+	aT, aS, errA := parseStreamKey(a)
+	bT, bS, errB := parseStreamKey(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+
+	switch {
+	case aT.key < bT.key || aT.key == bT.key && aS.key < bS.key:
+		return -1
+	case aT.key == bT.key && aS.key == bS.key:
+		return 0
+	}
+
+	return 1
+}
+
 type StreamProxy struct {
 	stream *StreamDataType
 	kType  *keyTypeMap
-	// simple pubsub to solve blocking read problem
+	// simple pubsub to solve blocking read problem, blocked readers subscribe from their own goroutines
 	subscribers map[string]chan<- StreamKV
+	subMu       *sync.Mutex
 }
 
 func (st StreamProxy) Unsubscribe(id string) {
+	st.subMu.Lock()
+	defer st.subMu.Unlock()
 	delete(st.subscribers, id)
 }
 
 func (st StreamProxy) Subscribe() (string, <-chan StreamKV) {
+	st.subMu.Lock()
+	defer st.subMu.Unlock()
 	id := fmt.Sprint(time.Now().UnixNano())
+	for _, ok := st.subscribers[id]; ok; _, ok = st.subscribers[id] {
+		id += "'"
+	}
+
 	ch := make(chan StreamKV, 10)
 	st.subscribers[id] = ch
 	return id, ch
 }
 
+// Post notifies subscribers about the added entry, subscriber that is not keeping up misses the entry rather
+// than blocking the writer
 func (st StreamProxy) Post(key StreamKV) {
+	st.subMu.Lock()
+	defer st.subMu.Unlock()
 	for _, subscriber := range st.subscribers {
-		subscriber <- key
+		select {
+		case subscriber <- key:
+		default:
+		}
 	}
 }
 
 func (st StreamProxy) Add(k string, data []string) (old interface{}, key string, ok bool, err error) {
-	mx, _ := st.stream.Max("")
+	// ids are compared with the last added id, so ids of the deleted entries are not reissued
+	mx := st.stream.Meta().LastId
 	mxT, mxS, err := parseStreamKey(mx)
 	if err != nil {
 		return nil, k, false, err
@@ -140,21 +205,18 @@ func (st StreamProxy) Add(k string, data []string) (old interface{}, key string,
 
 	if timestamp.generate {
 		timestamp.key = time.Now().UnixMilli()
+		// clock went backwards
+		if timestamp.key < mxT.key {
+			timestamp.key = mxT.key
+		}
 	}
 
 	if sequence.generate {
-		mxPrefix, _ := st.stream.Max(fmt.Sprintf("%d-", timestamp.key))
-		_, nSeq, err := parseStreamKey(mxPrefix)
-		if err != nil {
-			return nil, key, false, err
-		}
-
-		if mxPrefix != "" {
-			sequence.key = nSeq.key + 1
-		}
-
-		// "0-*" case when tree is empty
-		if timestamp.key == 0 && nSeq.key == 0 {
+		switch {
+		case mx != "" && timestamp.key == mxT.key:
+			sequence.key = mxS.key + 1
+		// "0-*" case when nothing was added
+		case timestamp.key == 0:
 			sequence.key = 1
 		}
 	}
@@ -175,6 +237,34 @@ func (st StreamProxy) Add(k string, data []string) (old interface{}, key string,
 	return nil, k, false, nil
 }
 
+// Delete removes entries with the ids, the stream is kept even when it is empty
+func (st StreamProxy) Delete(ids []string) int {
+	return st.stream.Delete(ids)
+}
+
+func (st StreamProxy) Len() int {
+	return st.stream.Len()
+}
+
+func (st StreamProxy) Meta() StreamMeta {
+	return st.stream.Meta()
+}
+
+// SetMeta replaces metadata of the stream, stream without entries is created as well
+func (st StreamProxy) SetMeta(meta StreamMeta) {
+	st.kType.SetType(st.stream.name, STREAMS)
+	st.stream.SetMeta(meta)
+}
+
+func (st StreamProxy) Groups() []StreamGroup {
+	return st.stream.Groups()
+}
+
+// SetGroups replaces consumer groups of the stream
+func (st StreamProxy) SetGroups(groups []StreamGroup) {
+	st.stream.SetGroups(groups)
+}
+
 func (st StreamProxy) Max(prefix string) (string, interface{}) {
 	return st.stream.Max(prefix)
 }
@@ -183,6 +273,10 @@ func (st StreamProxy) Min(prefix string) (string, interface{}) {
 	return st.stream.Min(prefix)
 }
 
+func (st StreamProxy) Entries() []StreamKV {
+	return st.stream.Entries()
+}
+
 func (st StreamProxy) Range(start, end string) []StreamKV {
 	return st.stream.Range(start, end)
 }
@@ -18,25 +18,40 @@ type StringsDataType struct {
 	mu      *sync.RWMutex
 }
 
-func (s *StringsDataType) cleanExpireKeys() {
-	cur := 0
+// expiredKeys samples up to PICK_NUMBER keys with expire time and returns the expired ones
+func (s *StringsDataType) expiredKeys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now, sampled := time.Now(), 0
+	keys := make([]string, 0, PICK_NUMBER)
 	for key, elem := range s.storage {
-		if elem.Expire.Before(time.Now()) && !elem.Expire.IsZero() {
-			delete(s.storage, key)
+		if elem.Expire.IsZero() {
+			continue
+		}
+
+		if elem.Expire.Before(now) {
+			keys = append(keys, key)
 		}
 
-		cur++
-		if cur <= PICK_NUMBER {
-			return
+		if sampled++; sampled == PICK_NUMBER {
+			break
 		}
 	}
+
+	return keys
 }
 
-func (s *StringsDataType) startExpiryWorker() {
-	for {
-		time.Sleep(time.Second * 6)
-		s.cleanExpireKeys()
+// deleteExpired deletes the key unless it was set again without being expired
+func (s *StringsDataType) deleteExpired(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.storage[key]
+	if !ok || elem.Expire.IsZero() || !elem.Expire.Before(time.Now()) {
+		return false
 	}
+
+	delete(s.storage, key)
+	return true
 }
 
 func (s *StringsDataType) Delete(key string) {
@@ -54,13 +69,10 @@ func NewStringsStorageFromExists(cache map[string]StringsElement) *StringsDataTy
 		cache = make(map[string]StringsElement)
 	}
 
-	stringStorage := &StringsDataType{
+	return &StringsDataType{
 		storage: cache,
 		mu:      &sync.RWMutex{},
 	}
-
-	//go stringStorage.startExpiryWorker()
-	return stringStorage
 }
 
 func (s *StringsDataType) Set(key string, value string, expire time.Time) {
@@ -73,26 +85,41 @@ func (s *StringsDataType) Set(key string, value string, expire time.Time) {
 }
 
 func (s *StringsDataType) Get(key string) (string, bool) {
+	elem, ok := s.GetElement(key)
+	return elem.Value, ok
+}
+
+// GetElement returns the value with its expire time
+func (s *StringsDataType) GetElement(key string) (StringsElement, bool) {
 	s.mu.RLock()
 	elem, ok := s.storage[key]
 	s.mu.RUnlock()
 	if !ok {
-		return "", false
+		return StringsElement{}, false
 	}
 
+	// expired keys are deleted by the server, so the deletion reaches replicas and the AOF
 	if elem.Expire.Before(time.Now()) && !elem.Expire.IsZero() {
-		s.Delete(key)
-		return "", false
+		return StringsElement{}, false
 	}
 
-	return elem.Value, true
+	return elem, true
+}
+
+// expired tells whether the key exists with expire time in the past
+func (s *StringsDataType) expired(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	elem, ok := s.storage[key]
+	return ok && !elem.Expire.IsZero() && elem.Expire.Before(time.Now())
 }
 
 func (s *StringsDataType) Keys(pattern *regexp.Regexp) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	keys := make([]string, 0, len(s.storage))
 	for key, elem := range s.storage {
 		if elem.Expire.Before(time.Now()) && !elem.Expire.IsZero() {
-			delete(s.storage, key)
 			continue
 		}
 		if pattern == nil || pattern.MatchString(key) {
@@ -114,3 +141,19 @@ func (s *StringsDataType) Cp(other *StringsDataType) {
 		s.storage[k] = v
 	}
 }
+
+// Snapshot returns copy of all not expired elements
+func (s *StringsDataType) Snapshot() map[string]StringsElement {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot := make(map[string]StringsElement, len(s.storage))
+	for key, elem := range s.storage {
+		if elem.Expire.Before(time.Now()) && !elem.Expire.IsZero() {
+			continue
+		}
+
+		snapshot[key] = elem
+	}
+
+	return snapshot
+}
@@ -7,9 +7,11 @@ import (
 
 type StringsStorage interface {
 	Get(string) (string, bool, error)
+	GetElement(string) (StringsElement, bool, error)
 	Set(string, string, time.Time) error
 	Delete(string) (bool, error)
 	Keys(pattern *regexp.Regexp) []string
+	Snapshot() map[string]StringsElement
 }
 
 type StringsProxy struct {
@@ -23,11 +25,16 @@ func (s *StringsProxy) Get(key string) (string, bool, error) {
 	}
 
 	val, ok := s.storage.Get(key)
-	if !ok {
-		s.keyTypes.Delete(key)
+	return val, ok, nil
+}
+
+func (s *StringsProxy) GetElement(key string) (StringsElement, bool, error) {
+	if ok, err := s.keyTypes.AssertKeyTypeOrNone(key, STRINGS); err != nil || !ok {
+		return StringsElement{}, false, err
 	}
 
-	return val, ok, nil
+	elem, ok := s.storage.GetElement(key)
+	return elem, ok, nil
 }
 
 func (s *StringsProxy) Set(key string, val string, expire time.Time) error {
@@ -50,10 +57,32 @@ func (s *StringsProxy) Delete(key string) (bool, error) {
 	return true, nil
 }
 
+// expireKeys deletes the expired keys of a sample and notifies them as expired
+func (s *StringsProxy) expireKeys() []string {
+	return s.expire(s.storage.expiredKeys())
+}
+
+// expire deletes the keys still expired and notifies them as expired, the sample is reused for the result
+func (s *StringsProxy) expire(sample []string) []string {
+	keys := sample[:0]
+	for _, key := range sample {
+		if s.storage.deleteExpired(key) {
+			s.keyTypes.Expire(key)
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
 func (s *StringsProxy) Keys(pattern *regexp.Regexp) []string {
 	return s.storage.Keys(pattern)
 }
 
+func (s *StringsProxy) Snapshot() map[string]StringsElement {
+	return s.storage.Snapshot()
+}
+
 func (s *StringsProxy) GetType() DataType {
 	return s.storage.GetType()
 }
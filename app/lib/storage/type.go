@@ -3,6 +3,7 @@ package storage
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 type DataType int
@@ -17,15 +18,37 @@ const (
 	STREAMS
 )
 
+// events of the keys made by the storage itself, the rest of the events is notified by the commands
+const (
+	EVENT_NEW     = "new"
+	EVENT_EXPIRED = "expired"
+)
+
+// KeyEventFunc is told about keys of the db created and expired by the storage
+type KeyEventFunc func(db int, event, key string)
+
 type keyTypeMap struct {
 	mu    *sync.RWMutex
+	db    int
 	kType map[string]DataType
+	// versions of the watched keys, every modification of the key bumps its version
+	versions map[string]*keyVersion
+	// holds KeyEventFunc
+	onKeyEvent *atomic.Value
+}
+
+type keyVersion struct {
+	version  uint64
+	watchers int
 }
 
-func newKeyType() *keyTypeMap {
+func newKeyType(db int) *keyTypeMap {
 	return &keyTypeMap{
-		mu:    &sync.RWMutex{},
-		kType: make(map[string]DataType),
+		mu:         &sync.RWMutex{},
+		db:         db,
+		kType:      make(map[string]DataType),
+		versions:   make(map[string]*keyVersion),
+		onKeyEvent: &atomic.Value{},
 	}
 }
 
@@ -55,12 +78,90 @@ func (kt keyTypeMap) GetType(key string) DataType {
 
 func (kt keyTypeMap) SetType(key string, t DataType) {
 	kt.mu.Lock()
-	defer kt.mu.Unlock()
+	_, exists := kt.kType[key]
 	kt.kType[key] = t
+	kt.touch(key)
+	kt.mu.Unlock()
+	if !exists {
+		kt.notify(EVENT_NEW, key)
+	}
 }
 
 func (kt keyTypeMap) Delete(key string) {
 	kt.mu.Lock()
 	defer kt.mu.Unlock()
 	delete(kt.kType, key)
+	kt.touch(key)
+}
+
+// Expire deletes the expired key and notifies it
+func (kt keyTypeMap) Expire(key string) {
+	kt.mu.Lock()
+	_, exists := kt.kType[key]
+	delete(kt.kType, key)
+	kt.touch(key)
+	kt.mu.Unlock()
+	if exists {
+		kt.notify(EVENT_EXPIRED, key)
+	}
+}
+
+func (kt keyTypeMap) notify(event, key string) {
+	if fn, ok := kt.onKeyEvent.Load().(KeyEventFunc); ok {
+		fn(kt.db, event, key)
+	}
+}
+
+// touch bumps version of the watched key, must be called with mu held
+func (kt keyTypeMap) touch(key string) {
+	if v, ok := kt.versions[key]; ok {
+		v.version++
+	}
+}
+
+// Watch starts tracking modifications of the key and returns its current version
+func (kt keyTypeMap) Watch(key string) uint64 {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	v, ok := kt.versions[key]
+	if !ok {
+		v = &keyVersion{}
+		kt.versions[key] = v
+	}
+
+	v.watchers++
+	return v.version
+}
+
+// Unwatch stops tracking the key once none of the watchers is interested in it
+func (kt keyTypeMap) Unwatch(key string) {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	if v, ok := kt.versions[key]; ok {
+		if v.watchers--; v.watchers == 0 {
+			delete(kt.versions, key)
+		}
+	}
+}
+
+// Version returns version of the watched key
+func (kt keyTypeMap) Version(key string) uint64 {
+	kt.mu.RLock()
+	defer kt.mu.RUnlock()
+	if v, ok := kt.versions[key]; ok {
+		return v.version
+	}
+
+	return 0
+}
+
+func (kt keyTypeMap) Keys() []string {
+	kt.mu.RLock()
+	defer kt.mu.RUnlock()
+	keys := make([]string, 0, len(kt.kType))
+	for key := range kt.kType {
+		keys = append(keys, key)
+	}
+
+	return keys
 }
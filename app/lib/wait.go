@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	resp "github.com/codecrafters-io/redis-starter-go/app/lib/encoding"
@@ -9,87 +10,174 @@ import (
 	"time"
 )
 
-func HandleWait(ctx context.Context, req *RESPRequest) (interface{}, error) {
-	var (
+// waiter is a blocked WAIT, done is closed once n replicas acknowledged offset
+type waiter struct {
+	offset uint64
+	n      int
+	// only ACKs of the slave are counted when it is set
+	slave *replication.Slave
+	done  chan struct{}
+}
 
-		// Wait for n slaves
-		n int64
+// resolved must be called with s.mu held
+func (w *waiter) resolved(s *RedisServer) bool {
+	if w.slave != nil {
+		return w.slave.GetOffset() >= w.offset
+	}
+
+	return s.ackedReplicas(w.offset) >= w.n
+}
 
-		// In-sync
-		N int64
+var getAck = func() []byte {
+	buff := bytes.NewBuffer(make([]byte, 0, 37))
+	(resp.Array{A: []resp.Marshaller{
+		resp.BulkString{S: []byte("REPLCONF")},
+		resp.BulkString{S: []byte("GETACK")},
+		resp.BulkString{S: []byte("*")},
+	}}).MarshalRESP(buff)
+	return buff.Bytes()
+}()
 
-		// Timeout
-		timeout time.Duration
-	)
-	if len(req.Args.A) < 2 {
+// HandleWait blocks until numreplicas acknowledged every write propagated before the call or the timeout
+// fires, 0 timeout blocks forever. Replies with the number of replicas that acknowledged the writes
+func HandleWait(ctx context.Context, req *RESPRequest) (interface{}, error) {
+	if len(req.Args.A) != 2 {
 		return nil, fmt.Errorf("ERR wrong number of arguments")
 	}
 
-	if v, ok := req.Args.A[0].(resp.BulkString); ok {
-		if v.S == nil {
-			return nil, fmt.Errorf("ERR invalid number of slaves")
-		}
+	n, err := intArg(req.Args.A[0])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("ERR invalid number of replicas")
+	}
 
-		i, err := strconv.ParseInt(string(v.S), 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("ERR invalid number of slaves")
-		}
-		n = i
+	ms, err := intArg(req.Args.A[1])
+	if err != nil || ms < 0 {
+		return nil, fmt.Errorf("ERR timeout is negative or not an integer")
 	}
 
-	if v, ok := req.Args.A[1].(resp.BulkString); ok {
-		if v.S == nil {
-			return nil, fmt.Errorf("ERR invalid timeout")
-		}
+	if req.s.config.ReplicationConfig.Master.Load() != nil {
+		return nil, fmt.Errorf("ERR WAIT cannot be used with replica instances")
+	}
 
-		i, err := strconv.ParseInt(string(v.S), 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("ERR invalid timeout")
-		}
-		timeout = time.Duration(i) * time.Millisecond
+	s := req.s
+	w := &waiter{
+		offset: s.config.ReplicationConfig.MasterReplOffset.Load(),
+		n:      int(n),
+		done:   make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	// WAIT of a transaction does not block
+	if acked := s.ackedReplicas(w.offset); acked >= w.n || req.InTransaction() {
+		s.mu.Unlock()
+		return acked, nil
+	}
+
+	s.waiters = append(s.waiters, w)
+	s.getAck = true
+	s.mu.Unlock()
+	s.notifyWaiters()
+	var timeout <-chan time.Time
+	if ms > 0 {
+		timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	acks := make(chan uint64)
-	req.Logger.Printf("Target offset: %d", req.s.config.ReplicationConfig.MasterReplOffset.Load())
-	for _, r := range req.s.slaves {
-		if r.GetOffset() >= req.s.config.ReplicationConfig.MasterReplOffset.Load() {
-			N++
-			// First of all why you read it?, second the tester on codecrafters is responding with offset that is a sum of
-			// prev_master_offset + len(set_message) + len(ack_message), why? idk, but as i cached responses to reduce round trips overhead
-			// i had to repeat GetAck for each replication, otherwise the tester will fail(((
-			go func(r *replication.Slave) {
-				r.GetAck(timeout)
-			}(r)
-			continue
+	req.Block(func() {
+		select {
+		case <-w.done:
+		case <-timeout:
+		case <-ctx.Done():
 		}
+	})
 
-		go func(r *replication.Slave) {
-			offset, err := r.GetAck(timeout)
-			if err != nil {
-				req.Logger.Printf("Error getting ack: %s", err)
-			}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeWaiter(w)
+	return s.ackedReplicas(w.offset), nil
+}
+
+func intArg(arg resp.Marshaller) (int64, error) {
+	switch v := arg.(type) {
+	case resp.SimpleInt:
+		return v.I, nil
+	case resp.BulkString:
+		return strconv.ParseInt(string(v.S), 10, 64)
+	}
+
+	return 0, fmt.Errorf("expected integer, got %T", arg)
+}
 
-			acks <- offset
-		}(r)
+// notifyWaiters wakes up waitersLoop, notifications are coalesced while it is busy
+func (s *RedisServer) notifyWaiters() {
+	select {
+	case s.acks <- struct{}{}:
+	default:
 	}
+}
 
-	req.Logger.Printf("Waiting for %d slaves, total %d of %d, timeout %s", n, N, len(req.s.slaves), timeout)
-	for i := N; i < n; i++ {
+// waitersLoop resolves blocked WAITs whenever replica sends ACK, GETACK requested by every WAIT since
+// the previous iteration is sent once
+func (s *RedisServer) waitersLoop() {
+	var retry <-chan time.Time
+	for {
 		select {
-		case offset := <-acks:
-			if offset >= req.s.config.ReplicationConfig.MasterReplOffset.Load() {
-				N++
-			}
+		case <-s.close:
+			return
+		case <-s.acks:
+		case <-retry:
+		}
 
-			if N >= n {
-				break
+		retry = nil
+		s.mu.Lock()
+		pending := s.waiters[:0]
+		for _, w := range s.waiters {
+			if w.resolved(s) {
+				close(w.done)
+				continue
 			}
-		case <-time.After(timeout):
-			req.Logger.Printf("timeout excited")
-			break
+
+			pending = append(pending, w)
+		}
+
+		s.waiters = pending
+		// GETACK is a part of the stream, replicas count it in their offset, so it is sent between the commands
+		// and not while writes are paused, it is retried rather than delayed until the next ACK
+		if len(pending) == 0 {
+			s.getAck = false
+		} else if s.getAck && s.writes.TryRLock() {
+			s.propagate(getAck)
+			s.getAck = false
+			s.writes.RUnlock()
+		}
+
+		if s.getAck {
+			retry = time.After(GETACK_RETRY)
+		}
+
+		s.mu.Unlock()
+	}
+}
+
+// ackedReplicas must be called with s.mu held
+func (s *RedisServer) ackedReplicas(offset uint64) int {
+	n := 0
+	for _, slave := range s.slaves {
+		if slave.GetOffset() >= offset {
+			n++
 		}
 	}
 
-	req.Logger.Printf("Returning %d", N)
-	return N, nil
+	return n
+}
+
+// removeWaiter must be called with s.mu held
+func (s *RedisServer) removeWaiter(w *waiter) {
+	for i, r := range s.waiters {
+		if r == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
 }
@@ -4,9 +4,15 @@ import (
 	"fmt"
 	"github.com/codecrafters-io/redis-starter-go/app/lib"
 	"github.com/codecrafters-io/redis-starter-go/app/lib/handlers"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/persistence"
+	"github.com/codecrafters-io/redis-starter-go/app/lib/sentinel"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 const HELP = `
@@ -16,32 +22,125 @@ Usage: <build> [options]
 --replicaof <host> <port>	Make the server a replication of another instance
 --dir <directory>		Set rdb directory
 --dbfilename <name>		Set rdb file name, combined with "dir" option sets path to rdb file
+--save <"">			Empty value disables saving rdb on shutdown
+--appendonly <yes|no>		Log every write command to the append only file
+--appenddirname <name>		Set directory inside "dir" holding append only files
+--appendfilename <name>		Set base name of append only files
+--appendfsync <always|everysec|no>	Set append only file fsync policy
+--aof-load-truncated <yes|no>	Load append only file with incomplete last command
+--aof-use-rdb-preamble <yes|no>	Write rdb snapshot as the base of rewritten append only file
+--auto-aof-rewrite-percentage <n>	Rewrite append only file when it grows by n percent, 0 disables
+--auto-aof-rewrite-min-size <bytes>	Minimal size of append only file to be rewritten automatically
+--repl-diskless-sync <yes|no>	Stream rdb directly to replicas socket during full resync
+--replica-read-only <yes|no>	Reject write commands of clients on replica
+--repl-ping-replica-period <seconds>	Interval of PINGs sent by master to replicas
+--repl-timeout <seconds>	Drop replication link without any traffic for the given time
+--min-replicas-to-write <n>	Refuse writes when less than n replicas are connected with acceptable lag, 0 disables
+--min-replicas-max-lag <seconds>	Maximal ACK lag of replica counted by min-replicas-to-write
+--replica-priority <n>		Priority of the replica to be promoted by sentinel, lower is preferred, 0 disables
+--cluster-enabled <yes|no>	Serve only hash slots assigned to the node, keys of other slots are redirected
+--cluster-announce-ip <ip>	Address of the node given to clients and other cluster nodes
+--cluster-node-timeout <ms>	Time without reply after which cluster node is considered failing
+--cluster-config-file <name>	File persisting the cluster state, relative to "dir" option
+--notify-keyspace-events <classes>	Publish keyspace notifications of the classes, e.g. "Ex" for expired keys
+--sentinel			Run as sentinel monitoring masters and promoting their replicas on failure
+--sentinel-monitor <name> <host> <port> <quorum>	Monitor master, quorum of sentinels has to agree it is down
+--sentinel-down-after-milliseconds <name> <ms>	Time without reply after which master is considered down
+--sentinel-failover-timeout <name> <ms>	Time given to failover of the master
+--sentinel-known-sentinel <name> <host> <port>	Another sentinel monitoring the master
 
 `
 
 func RegisterHandlers(router *lib.Router) {
-	router.RegisterHandler("set", lib.ReplWrapper{Next: lib.HandleFunc(handlers.HandleSet)})
-	router.RegisterHandler("get", lib.HandleFunc(handlers.HandleGet))
-	router.RegisterHandler("keys", lib.HandleFunc(handlers.HandleKeys))
+	router.RegisterCommand("set", lib.HandleFunc(handlers.HandleSet), lib.CMD_WRITE)
+	router.RegisterCommand("get", lib.HandleFunc(handlers.HandleGet), lib.CMD_READONLY)
+	router.RegisterCommand("keys", lib.HandleFunc(handlers.HandleKeys), lib.CMD_READONLY)
 	router.RegisterHandlerFunc("ping", handlers.HandlePing)
 	router.RegisterHandlerFunc("echo", handlers.HandleEcho)
 	router.RegisterHandlerFunc("info", handlers.HandleInfo)
 	router.RegisterHandlerFunc("replconf", lib.HandleReplicationConf)
 	router.RegisterHandlerFunc("psync", lib.HandlePsync)
+	router.RegisterHandlerFunc("replicaof", lib.HandleReplicaOf)
+	router.RegisterHandlerFunc("slaveof", lib.HandleReplicaOf)
+	router.RegisterHandlerFunc("failover", lib.HandleFailover)
+	router.RegisterHandlerFunc("role", lib.HandleRole)
 	router.RegisterHandlerFunc("wait", lib.HandleWait)
 	router.RegisterHandlerFunc("config", lib.HandleConfig)
+	router.RegisterHandlerFunc("bgrewriteaof", lib.HandleBgRewriteAof)
+	router.RegisterHandlerFunc("save", lib.HandleSave)
+	router.RegisterHandlerFunc("bgsave", lib.HandleBgSave)
 	router.RegisterHandlerFunc("select", lib.HandleSelect)
-	router.RegisterHandlerFunc("type", handlers.HandleType)
-	router.RegisterHandlerFunc("xadd", handlers.HandleXAdd)
-	router.RegisterHandlerFunc("xrange", handlers.HandleXRange)
-	router.RegisterHandlerFunc("xread", handlers.HandleXRead)
-
+	router.RegisterCommand("type", lib.HandleFunc(handlers.HandleType), lib.CMD_READONLY)
+	router.RegisterCommand("xadd", lib.HandleFunc(handlers.HandleXAdd), lib.CMD_WRITE)
+	router.RegisterCommand("xrange", lib.HandleFunc(handlers.HandleXRange), lib.CMD_READONLY)
+	router.RegisterCommand("xread", lib.HandleFunc(handlers.HandleXRead), lib.CMD_READONLY)
+	router.RegisterCommand("xdel", lib.HandleFunc(handlers.HandleXDel), lib.CMD_WRITE)
+	router.RegisterCommand("xsetid", lib.HandleFunc(handlers.HandleXSetId), lib.CMD_WRITE)
+	router.RegisterCommand("dump", lib.HandleFunc(handlers.HandleDump), lib.CMD_READONLY)
+	router.RegisterCommand("restore", lib.HandleFunc(handlers.HandleRestore), lib.CMD_WRITE)
+	router.RegisterCommand("restore-asking", lib.HandleFunc(handlers.HandleRestore), lib.CMD_WRITE|lib.CMD_ASKING)
+	router.RegisterCommand("del", lib.HandleFunc(handlers.HandleDel), lib.CMD_WRITE)
+	router.RegisterCommand("migrate", lib.HandleFunc(handlers.HandleMigrate), lib.CMD_WRITE)
+	router.RegisterCommand("import", lib.HandleFunc(lib.HandleImport), lib.CMD_WRITE|lib.CMD_NOMULTI|lib.CMD_BULK)
+	router.RegisterCommand("export", lib.HandleFunc(lib.HandleExport), lib.CMD_READONLY)
+	router.RegisterHandlerFunc("cluster", lib.HandleCluster)
+	router.RegisterHandlerFunc("asking", lib.HandleAsking)
+	router.RegisterHandlerFunc("multi", lib.HandleMulti)
+	router.RegisterHandlerFunc("exec", lib.HandleExec)
+	router.RegisterHandlerFunc("discard", lib.HandleDiscard)
+	router.RegisterHandlerFunc("watch", lib.HandleWatch)
+	router.RegisterHandlerFunc("unwatch", lib.HandleUnwatch)
+	router.RegisterHandlerFunc("subscribe", lib.HandleSubscribe)
+	router.RegisterHandlerFunc("psubscribe", lib.HandlePSubscribe)
+	router.RegisterHandlerFunc("ssubscribe", lib.HandleSSubscribe)
+	router.RegisterHandlerFunc("unsubscribe", lib.HandleUnsubscribe)
+	router.RegisterHandlerFunc("punsubscribe", lib.HandlePUnsubscribe)
+	router.RegisterHandlerFunc("sunsubscribe", lib.HandleSUnsubscribe)
+	router.RegisterHandlerFunc("publish", lib.HandlePublish)
+	router.RegisterHandlerFunc("spublish", lib.HandleSPublish)
+	router.RegisterHandlerFunc("pubsub", lib.HandlePubsub)
+	router.RegisterHandlerFunc("hello", lib.HandleHello)
+	for _, command := range []string{"set", "get", "type", "xadd", "xrange", "xdel", "xsetid", "dump", "restore", "restore-asking"} {
+		router.RegisterKeys(command, lib.FirstKey)
+	}
+	router.RegisterKeys("xread", handlers.XReadKeys)
+	router.RegisterKeys("del", lib.AllKeys)
+	router.RegisterKeys("watch", lib.AllKeys)
+	// shard channels are served by the owner of their slot like keys
+	router.RegisterKeys("ssubscribe", lib.AllKeys)
+	router.RegisterKeys("sunsubscribe", lib.AllKeys)
+	router.RegisterKeys("spublish", lib.FirstKey)
+	// arity is validated before the command is queued by MULTI
+	for command, arity := range map[string]int{
+		"set": -3, "get": 2, "keys": 2, "ping": -1, "echo": 2, "info": -1, "replconf": -1, "psync": 3,
+		"replicaof": 3, "slaveof": 3, "failover": -1, "role": 1, "wait": 3, "config": -2, "bgrewriteaof": 1,
+		"save": 1, "bgsave": -1, "select": 2, "type": 2, "xadd": -5, "xrange": -4, "xread": -4, "xdel": -3, "xsetid": -3, "dump": 2,
+		"restore": -4, "restore-asking": -4, "del": -2, "migrate": -6, "cluster": -2, "asking": 1,
+		"multi": 1, "exec": 1, "discard": 1, "watch": -2, "unwatch": 1, "subscribe": -2, "psubscribe": -2,
+		"ssubscribe": -2, "unsubscribe": -1, "punsubscribe": -1, "sunsubscribe": -1, "publish": 3, "spublish": 3,
+		"pubsub": -2, "hello": -1, "import": 2, "export": -2,
+	} {
+		router.RegisterArity(command, arity)
+	}
 }
 func main() {
 	log.SetPrefix("redis-server:")
 	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
 
 	config := lib.GetDefaultConfig()
+	sentinelConfig := sentinel.GetDefaultConfig()
+	sentinelMode, portSet := false, false
+	monitored := func(name string) *sentinel.MasterConfig {
+		for _, m := range sentinelConfig.Masters {
+			if m.Name == name {
+				return m
+			}
+		}
+
+		log.Fatalf("Unknown sentinel master %s", name)
+		return nil
+	}
+
 	args := os.Args[1:]
 	for i, v := range args {
 		switch v {
@@ -58,6 +157,7 @@ func main() {
 				log.Fatal("Invalid port")
 			}
 			config.Port = int(port)
+			portSet = true
 		case "--replicaof":
 			if i+2 >= len(args) {
 				log.Fatal("Invalid replicaof")
@@ -66,7 +166,7 @@ func main() {
 			if err != nil {
 				log.Fatal("Invalid port")
 			}
-			config.ReplicaOf = args[i+1] + ":" + strconv.Itoa(int(port))
+			config.SetReplicaOf(args[i+1] + ":" + strconv.Itoa(int(port)))
 		case "--dir":
 			if i+1 >= len(args) {
 				log.Fatal("Invalid replicaof")
@@ -77,16 +177,205 @@ func main() {
 				log.Fatal("Invalid replicaof")
 			}
 			config.PersistenceConfig.File = args[i+1]
+		case "--save":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid save")
+			}
+			config.PersistenceConfig.Save = args[i+1] != ""
+		case "--appendonly":
+			if i+1 >= len(args) || (args[i+1] != "yes" && args[i+1] != "no") {
+				log.Fatal("Invalid appendonly")
+			}
+			config.PersistenceConfig.AppendOnly = args[i+1] == "yes"
+		case "--appenddirname":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid appenddirname")
+			}
+			config.PersistenceConfig.AppendDirname = args[i+1]
+		case "--appendfilename":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid appendfilename")
+			}
+			config.PersistenceConfig.AppendFilename = args[i+1]
+		case "--appendfsync":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid appendfsync")
+			}
+			switch args[i+1] {
+			case persistence.FSYNC_ALWAYS, persistence.FSYNC_EVERYSEC, persistence.FSYNC_NO:
+				config.PersistenceConfig.AppendFsync = args[i+1]
+			default:
+				log.Fatal("Invalid appendfsync")
+			}
+		case "--aof-load-truncated":
+			if i+1 >= len(args) || (args[i+1] != "yes" && args[i+1] != "no") {
+				log.Fatal("Invalid aof-load-truncated")
+			}
+			config.PersistenceConfig.AofLoadTruncated = args[i+1] == "yes"
+		case "--aof-use-rdb-preamble":
+			if i+1 >= len(args) || (args[i+1] != "yes" && args[i+1] != "no") {
+				log.Fatal("Invalid aof-use-rdb-preamble")
+			}
+			config.PersistenceConfig.AofUseRdbPreamble = args[i+1] == "yes"
+		case "--auto-aof-rewrite-percentage":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid auto-aof-rewrite-percentage")
+			}
+			percentage, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || percentage < 0 {
+				log.Fatal("Invalid auto-aof-rewrite-percentage")
+			}
+			config.PersistenceConfig.AutoAofRewritePercentage = int(percentage)
+		case "--auto-aof-rewrite-min-size":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid auto-aof-rewrite-min-size")
+			}
+			size, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || size < 0 {
+				log.Fatal("Invalid auto-aof-rewrite-min-size")
+			}
+			config.PersistenceConfig.AutoAofRewriteMinSize = size
+		case "--repl-diskless-sync":
+			if i+1 >= len(args) || (args[i+1] != "yes" && args[i+1] != "no") {
+				log.Fatal("Invalid repl-diskless-sync")
+			}
+			config.ReplicationConfig.ReplDisklessSync = args[i+1] == "yes"
+		case "--replica-read-only":
+			if i+1 >= len(args) || (args[i+1] != "yes" && args[i+1] != "no") {
+				log.Fatal("Invalid replica-read-only")
+			}
+			config.ReplicationConfig.ReplicaReadOnly = args[i+1] == "yes"
+		case "--repl-ping-replica-period":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid repl-ping-replica-period")
+			}
+			period, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || period <= 0 {
+				log.Fatal("Invalid repl-ping-replica-period")
+			}
+			config.ReplicationConfig.ReplPingReplicaPeriod = time.Duration(period) * time.Second
+		case "--repl-timeout":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid repl-timeout")
+			}
+			timeout, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || timeout <= 0 {
+				log.Fatal("Invalid repl-timeout")
+			}
+			config.ReplicationConfig.ReplTimeout = time.Duration(timeout) * time.Second
+		case "--min-replicas-to-write":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid min-replicas-to-write")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n < 0 {
+				log.Fatal("Invalid min-replicas-to-write")
+			}
+			config.ReplicationConfig.MinReplicasToWrite = int(n)
+		case "--min-replicas-max-lag":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid min-replicas-max-lag")
+			}
+			lag, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || lag < 0 {
+				log.Fatal("Invalid min-replicas-max-lag")
+			}
+			config.ReplicationConfig.MinReplicasMaxLag = time.Duration(lag) * time.Second
+		case "--replica-priority":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid replica-priority")
+			}
+			priority, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || priority < 0 {
+				log.Fatal("Invalid replica-priority")
+			}
+			config.ReplicationConfig.ReplicaPriority = int(priority)
+		case "--cluster-enabled":
+			if i+1 >= len(args) || (args[i+1] != "yes" && args[i+1] != "no") {
+				log.Fatal("Invalid cluster-enabled")
+			}
+			config.ClusterConfig.Enabled = args[i+1] == "yes"
+		case "--cluster-announce-ip":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid cluster-announce-ip")
+			}
+			config.ClusterConfig.AnnounceIP = args[i+1]
+		case "--cluster-node-timeout":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid cluster-node-timeout")
+			}
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || ms <= 0 {
+				log.Fatal("Invalid cluster-node-timeout")
+			}
+			config.ClusterConfig.NodeTimeout = time.Duration(ms) * time.Millisecond
+		case "--cluster-config-file":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid cluster-config-file")
+			}
+			config.ClusterConfig.ConfigFile = args[i+1]
+		case "--notify-keyspace-events":
+			if i+1 >= len(args) {
+				log.Fatal("Invalid notify-keyspace-events")
+			}
+			flags, err := lib.ParseNotifyFlags(args[i+1])
+			if err != nil {
+				log.Fatalf("Invalid notify-keyspace-events: %s", err)
+			}
+			config.NotifyKeyspaceEvents.Store(int32(flags))
+		case "--sentinel":
+			sentinelMode = true
+		case "--sentinel-monitor":
+			if i+4 >= len(args) {
+				log.Fatal("Invalid sentinel-monitor")
+			}
+			quorum, err := strconv.ParseInt(args[i+4], 10, 64)
+			if err != nil || quorum <= 0 {
+				log.Fatal("Invalid sentinel-monitor quorum")
+			}
+			sentinelConfig.Masters = append(sentinelConfig.Masters, sentinel.NewMasterConfig(args[i+1], args[i+2], args[i+3], int(quorum)))
+		case "--sentinel-down-after-milliseconds":
+			if i+2 >= len(args) {
+				log.Fatal("Invalid sentinel-down-after-milliseconds")
+			}
+			ms, err := strconv.ParseInt(args[i+2], 10, 64)
+			if err != nil || ms <= 0 {
+				log.Fatal("Invalid sentinel-down-after-milliseconds")
+			}
+			monitored(args[i+1]).DownAfter = time.Duration(ms) * time.Millisecond
+		case "--sentinel-failover-timeout":
+			if i+2 >= len(args) {
+				log.Fatal("Invalid sentinel-failover-timeout")
+			}
+			ms, err := strconv.ParseInt(args[i+2], 10, 64)
+			if err != nil || ms <= 0 {
+				log.Fatal("Invalid sentinel-failover-timeout")
+			}
+			monitored(args[i+1]).FailoverTimeout = time.Duration(ms) * time.Millisecond
+		case "--sentinel-known-sentinel":
+			if i+3 >= len(args) {
+				log.Fatal("Invalid sentinel-known-sentinel")
+			}
+			m := monitored(args[i+1])
+			m.KnownSentinels = append(m.KnownSentinels, args[i+2]+":"+args[i+3])
 		}
 	}
 
+	if config.ClusterConfig.ConfigFile != "" && !filepath.IsAbs(config.ClusterConfig.ConfigFile) {
+		config.ClusterConfig.ConfigFile = filepath.Join(config.PersistenceConfig.Dir, config.ClusterConfig.ConfigFile)
+	}
+
+	if sentinelMode {
+		runSentinel(config, sentinelConfig, portSet)
+		return
+	}
+
 	router := lib.NewRouter()
 	RegisterHandlers(router)
 	server, err := lib.New(config, router)
 	if err != nil {
 		panic(err)
 	}
-	defer server.Close()
 	done := make(chan struct{})
 	go func() {
 		server.ConnectMaster()
@@ -95,6 +384,55 @@ func main() {
 		}
 		done <- struct{}{}
 	}()
+
+	// closing on signals lets the server save the rdb and flush the append only file
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		done <- struct{}{}
+	}()
+
 	<-done
+	server.Close()
+
+}
+
+// runSentinel serves only the sentinel commands, the dataset and persistence are not used
+func runSentinel(config *lib.ServerConfig, sentinelConfig *sentinel.Config, portSet bool) {
+	if !portSet {
+		config.Port = sentinelConfig.Port
+	}
+	sentinelConfig.Port = config.Port
+	config.PersistenceConfig.Save = false
+	config.PersistenceConfig.AppendOnly = false
+
+	router := lib.NewRouter()
+	router.RegisterHandlerFunc("ping", handlers.HandlePing)
+	sen := sentinel.New(sentinelConfig)
+	sen.RegisterHandlers(router)
+	server, err := lib.New(config, router)
+	if err != nil {
+		panic(err)
+	}
 
+	done := make(chan struct{}, 2)
+	go func() {
+		if err = server.ListenAndServe(); err != nil {
+			fmt.Printf("Error while listening for port %d: %s", config.Port, err)
+		}
+		done <- struct{}{}
+	}()
+	go sen.Run()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		done <- struct{}{}
+	}()
+
+	<-done
+	sen.Close()
+	server.Close()
 }
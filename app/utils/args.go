@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"fmt"
+)
+
+var ErrUnbalancedQuotes = fmt.Errorf("unbalanced quotes")
+
+// SplitArgs splits the line into arguments like redis-cli and inline commands do. Arguments are separated by
+// spaces, double quoted ones support \n, \r, \t, \b, \a, \xHH and escaped characters, single quoted ones
+// support escaped single quote only. Closing quote must be followed by space or the end of the line
+func SplitArgs(line []byte) ([][]byte, error) {
+	args := make([][]byte, 0, 4)
+	p := 0
+	for {
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+
+		if p == len(line) {
+			return args, nil
+		}
+
+		var (
+			arg                []byte
+			inDouble, inSingle bool
+		)
+
+	arg:
+		for {
+			switch {
+			case inDouble:
+				if p == len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+
+				switch c := line[p]; {
+				case c == '\\' && p+3 < len(line) && line[p+1] == 'x' && isHex(line[p+2]) && isHex(line[p+3]):
+					arg = append(arg, hexValue(line[p+2])<<4|hexValue(line[p+3]))
+					p += 3
+				case c == '\\' && p+1 < len(line):
+					p++
+					switch line[p] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[p]
+					}
+
+					arg = append(arg, c)
+				case c == '"':
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+
+					p++
+					break arg
+				default:
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if p == len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+
+				switch c := line[p]; {
+				case c == '\\' && p+1 < len(line) && line[p+1] == '\'':
+					arg = append(arg, '\'')
+					p++
+				case c == '\'':
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+
+					p++
+					break arg
+				default:
+					arg = append(arg, c)
+				}
+			default:
+				if p == len(line) {
+					break arg
+				}
+
+				switch c := line[p]; c {
+				case ' ', '\n', '\r', '\t', 0:
+					break arg
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+
+			p++
+		}
+
+		if arg == nil {
+			arg = []byte{}
+		}
+
+		args = append(args, arg)
+	}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+
+	return false
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+
+	return c - '0'
+}
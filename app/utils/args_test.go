@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"   \t ", []string{}},
+		{"PING", []string{"PING"}},
+		{"  set  foo   bar \r", []string{"set", "foo", "bar"}},
+		{`set "hello world" 'it''s'`, nil},
+		{`set "hello world" 'it\'s'`, []string{"set", "hello world", "it's"}},
+		{`set k "a\nb\t\"c\"\\\x41\x4a\xzz"`, []string{"set", "k", "a\nb\t\"c\"\\AJxzz"}},
+		{`set k 'a\nb'`, []string{"set", "k", `a\nb`}},
+		{`set k ""`, []string{"set", "k", ""}},
+		{`set k ''`, []string{"set", "k", ""}},
+		{`set k"v" x`, []string{"set", "kv", "x"}},
+		{`set "k"v`, nil},
+		{`set "k`, nil},
+		{`set 'k`, nil},
+		{`set "k\`, nil},
+	} {
+		args, err := SplitArgs([]byte(tc.line))
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("expected %q to fail, got %q", tc.line, args)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error splitting %q: %s", tc.line, err)
+			continue
+		}
+
+		s := make([]string, 0, len(args))
+		for _, arg := range args {
+			s = append(s, string(arg))
+		}
+
+		if !reflect.DeepEqual(s, tc.expected) {
+			t.Errorf("expected %q to be split to %q, got %q", tc.line, tc.expected, s)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package utils
+
+// GlobMatch reports whether s matches the glob-style pattern used by Redis: * matches any sequence, ? any
+// character, [...] any of the characters or ranges unless negated with ^, and \ escapes the next character
+func GlobMatch(pattern, s string) bool {
+	p, i := 0, 0
+	// position of the last star and of the string it was tried at, so the star is extended on mismatch
+	star, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starI = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if next, ok := matchClass(pattern, p, s[i]); ok {
+					p = next
+					i++
+					continue
+				}
+			default:
+				c, next := pattern[p], p+1
+				if c == '\\' && next < len(pattern) {
+					c, next = pattern[next], next+1
+				}
+
+				if c == s[i] {
+					p = next
+					i++
+					continue
+				}
+			}
+		}
+
+		if star < 0 {
+			return false
+		}
+
+		starI++
+		p, i = star+1, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// matchClass matches c against the class starting at p, it returns position following the class, unterminated
+// class ends with the pattern
+func matchClass(pattern string, p int, c byte) (int, bool) {
+	p++
+	not := p < len(pattern) && pattern[p] == '^'
+	if not {
+		p++
+	}
+
+	match := false
+	for ; p < len(pattern) && pattern[p] != ']'; p++ {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			match = match || pattern[p] == c
+		case p+2 < len(pattern) && pattern[p+1] == '-':
+			start, end := pattern[p], pattern[p+2]
+			if start > end {
+				start, end = end, start
+			}
+
+			match = match || (c >= start && c <= end)
+			p += 2
+		default:
+			match = match || pattern[p] == c
+		}
+	}
+
+	if p < len(pattern) {
+		p++
+	}
+
+	return p, match != not
+}
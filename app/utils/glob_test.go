@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		s        string
+		expected bool
+	}{
+		{"*", "", true},
+		{"*", "news/sports", true},
+		{"news.*", "news.tech", true},
+		{"news.*", "news", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo*", "hello world", true},
+		{"*a*b", "xaxbxb", true},
+		{"*a*b", "xaxbx", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h[ab", "ha", true},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"a\\", "a\\", true},
+	} {
+		if GlobMatch(tc.pattern, tc.s) != tc.expected {
+			t.Errorf("expected match of %q and %q to be %v", tc.pattern, tc.s, tc.expected)
+		}
+	}
+}